@@ -0,0 +1,627 @@
+package acl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/junostorage/utils/glob"
+)
+
+// DefaultUser is the user new connections are authenticated as
+const DefaultUser = "default"
+
+// Categories are the command categories that can be used in +@category
+// and -@category rules
+var Categories = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string",
+	"bitmap", "hyperloglog", "geo", "stream", "pubsub", "admin", "fast",
+	"slow", "blocking", "dangerous", "connection", "transaction", "scripting",
+}
+
+var (
+	ErrNoSuchUser    = errors.New("User doesn't exist")
+	ErrAuthFailed    = errors.New("invalid username-password pair or user is disabled.")
+	ErrNoPermChannel = errors.New("No permissions to access a channel")
+)
+
+// Command describes a command for the permission checks. Name is either a
+// command or a command and its subcommand separated by '|', e.g. config|get.
+type Command struct {
+	Name       string
+	Categories []string
+	// Positions of the keys in the arguments, the command name is at 0.
+	// A negative LastKey counts from the end of the arguments.
+	FirstKey, LastKey, Step int
+	// Write is set when the command modifies the keys
+	Write bool
+}
+
+// Keys returns the keys in the arguments of the command
+func (cmd *Command) Keys(args []string) []string {
+	if cmd.FirstKey <= 0 || cmd.FirstKey >= len(args) {
+		return nil
+	}
+	last := cmd.LastKey
+	if last < 0 {
+		last = len(args) + last
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	step := cmd.Step
+	if step <= 0 {
+		step = 1
+	}
+	var keys []string
+	for i := cmd.FirstKey; i <= last; i += step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// keyPattern is a key pattern with the kind of access it grants
+type keyPattern struct {
+	pattern string
+	read    bool
+	write   bool
+}
+
+func (k keyPattern) String() string {
+	switch {
+	case k.read && k.write:
+		return "~" + k.pattern
+	case k.read:
+		return "%R~" + k.pattern
+	default:
+		return "%W~" + k.pattern
+	}
+}
+
+// User is an ACL user
+type User struct {
+	Name      string
+	Enabled   bool
+	NoPass    bool
+	passwords []string // sha256 hex digests
+	keys      []keyPattern
+	channels  []string
+	// command rules in the order they were applied, e.g. +@all -flushall
+	commands []string
+}
+
+// Passwords returns the sha256 hex digests of the user passwords
+func (u *User) Passwords() []string {
+	return append([]string(nil), u.passwords...)
+}
+
+// KeyPatterns returns the key patterns as rules, e.g. ~cache:* %R~*
+func (u *User) KeyPatterns() []string {
+	rules := make([]string, 0, len(u.keys))
+	for _, k := range u.keys {
+		rules = append(rules, k.String())
+	}
+	return rules
+}
+
+// ChannelPatterns returns the pub/sub channel patterns as rules, e.g. &news.*
+func (u *User) ChannelPatterns() []string {
+	rules := make([]string, 0, len(u.channels))
+	for _, c := range u.channels {
+		rules = append(rules, "&"+c)
+	}
+	return rules
+}
+
+// CommandRules returns the command rules, e.g. +@all -flushall
+func (u *User) CommandRules() string {
+	rules := u.commands
+	if len(rules) == 0 || (rules[0] != "+@all" && rules[0] != "-@all") {
+		rules = append([]string{"-@all"}, rules...)
+	}
+	return strings.Join(rules, " ")
+}
+
+// Flags returns the user flags, e.g. on nopass
+func (u *User) Flags() []string {
+	flags := []string{"off"}
+	if u.Enabled {
+		flags[0] = "on"
+	}
+	if u.NoPass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+// String describes the user as rules that recreate it, in the ACL LIST
+// and ACL file format.
+func (u *User) String() string {
+	parts := []string{"user", u.Name}
+	parts = append(parts, u.Flags()...)
+	for _, p := range u.passwords {
+		parts = append(parts, "#"+p)
+	}
+	parts = append(parts, u.KeyPatterns()...)
+	if len(u.channels) == 0 {
+		parts = append(parts, "resetchannels")
+	} else {
+		parts = append(parts, u.ChannelPatterns()...)
+	}
+	parts = append(parts, u.CommandRules())
+	return strings.Join(parts, " ")
+}
+
+func (u *User) clone() *User {
+	u2 := *u
+	u2.passwords = append([]string(nil), u.passwords...)
+	u2.keys = append([]keyPattern(nil), u.keys...)
+	u2.channels = append([]string(nil), u.channels...)
+	u2.commands = append([]string(nil), u.commands...)
+	return &u2
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// apply applies a rule to the user
+func (u *User) apply(rule string) error {
+	lower := strings.ToLower(rule)
+	switch {
+	case lower == "on":
+		u.Enabled = true
+	case lower == "off":
+		u.Enabled = false
+	case lower == "nopass":
+		u.NoPass = true
+		u.passwords = nil
+	case lower == "resetpass":
+		u.NoPass = false
+		u.passwords = nil
+	case lower == "allkeys":
+		u.keys = []keyPattern{{pattern: "*", read: true, write: true}}
+	case lower == "resetkeys":
+		u.keys = nil
+	case lower == "allchannels":
+		u.channels = []string{"*"}
+	case lower == "resetchannels":
+		u.channels = nil
+	case lower == "allcommands":
+		u.commands = []string{"+@all"}
+	case lower == "nocommands":
+		u.commands = []string{"-@all"}
+	case lower == "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "resetchannels", "off", "nocommands"} {
+			u.apply(r)
+		}
+
+	case strings.HasPrefix(rule, ">"):
+		u.addPassword(hashPassword(rule[1:]))
+	case strings.HasPrefix(rule, "<"):
+		u.removePassword(hashPassword(rule[1:]))
+	case strings.HasPrefix(rule, "#"):
+		if _, err := hex.DecodeString(rule[1:]); err != nil || len(rule) != 65 {
+			return fmt.Errorf("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		u.addPassword(strings.ToLower(rule[1:]))
+	case strings.HasPrefix(rule, "!"):
+		u.removePassword(strings.ToLower(rule[1:]))
+
+	case strings.HasPrefix(rule, "~"):
+		u.addKeyPattern(keyPattern{pattern: rule[1:], read: true, write: true})
+	case strings.HasPrefix(rule, "%"):
+		i := strings.IndexByte(rule, '~')
+		if i < 2 {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': Syntax error", rule)
+		}
+		k := keyPattern{pattern: rule[i+1:]}
+		for _, c := range strings.ToUpper(rule[1:i]) {
+			switch c {
+			case 'R':
+				k.read = true
+			case 'W':
+				k.write = true
+			default:
+				return fmt.Errorf("Error in ACL SETUSER modifier '%s': Syntax error", rule)
+			}
+		}
+		u.addKeyPattern(k)
+	case strings.HasPrefix(rule, "&"):
+		u.channels = append(u.channels, rule[1:])
+
+	case strings.HasPrefix(rule, "+"), strings.HasPrefix(rule, "-"):
+		name := lower[1:]
+		if strings.HasPrefix(name, "@") && name != "@all" && !isCategory(name[1:]) {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': Unknown command or category name in ACL", rule)
+		}
+		if name == "@all" {
+			// the rule overrides all the previous command rules
+			u.commands = nil
+		}
+		u.commands = append(u.commands, lower)
+
+	default:
+		return fmt.Errorf("Error in ACL SETUSER modifier '%s': Syntax error", rule)
+	}
+	return nil
+}
+
+func (u *User) addPassword(hash string) {
+	u.NoPass = false
+	for _, p := range u.passwords {
+		if p == hash {
+			return
+		}
+	}
+	u.passwords = append(u.passwords, hash)
+}
+
+func (u *User) removePassword(hash string) {
+	for i, p := range u.passwords {
+		if p == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return
+		}
+	}
+}
+
+func (u *User) addKeyPattern(k keyPattern) {
+	for i, p := range u.keys {
+		if p.pattern == k.pattern {
+			u.keys[i].read = p.read || k.read
+			u.keys[i].write = p.write || k.write
+			return
+		}
+	}
+	u.keys = append(u.keys, k)
+}
+
+func isCategory(name string) bool {
+	for _, c := range Categories {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPassword reports whether the password is one of the user passwords
+func (u *User) checkPassword(password string) bool {
+	if u.NoPass {
+		return true
+	}
+	hash := hashPassword(password)
+	for _, p := range u.passwords {
+		if p == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// canRun reports whether the rules allow the command. The last rule that
+// applies to the command, directly or by one of its categories, wins.
+func (u *User) canRun(cmd *Command) bool {
+	name := cmd.Name
+	parent := name
+	if i := strings.IndexByte(name, '|'); i > 0 {
+		parent = name[:i]
+	}
+
+	allowed := false
+	for _, rule := range u.commands {
+		target := rule[1:]
+		applies := false
+		switch {
+		case target == "@all":
+			applies = true
+		case strings.HasPrefix(target, "@"):
+			for _, c := range cmd.Categories {
+				if c == target[1:] {
+					applies = true
+				}
+			}
+		default:
+			applies = target == name || target == parent
+		}
+		if applies {
+			allowed = rule[0] == '+'
+		}
+	}
+	return allowed
+}
+
+// canAccessKey reports whether a key pattern grants the access to the key
+func (u *User) canAccessKey(key string, write bool) bool {
+	for _, k := range u.keys {
+		if (write && !k.write) || (!write && !k.read) {
+			continue
+		}
+		if matched, _ := glob.Match(k.pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL holds the users and the commands they may run
+type ACL struct {
+	mu       sync.RWMutex
+	users    map[string]*User
+	commands map[string]*Command
+	log      *Log
+}
+
+// New returns an ACL with the default user, which can run any command
+// without a password.
+func New() *ACL {
+	a := &ACL{
+		users:    make(map[string]*User),
+		commands: make(map[string]*Command),
+		log:      newLog(),
+	}
+	a.users[DefaultUser] = defaultUser()
+	return a
+}
+
+func defaultUser() *User {
+	u := &User{Name: DefaultUser}
+	for _, r := range []string{"on", "nopass", "allkeys", "allchannels", "allcommands"} {
+		u.apply(r)
+	}
+	return u
+}
+
+// SetCommands sets the commands the permissions are checked against
+func (a *ACL) SetCommands(commands []Command) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.commands = make(map[string]*Command, len(commands))
+	for i := range commands {
+		a.commands[commands[i].Name] = &commands[i]
+	}
+}
+
+// CommandsInCategory returns the commands of the category, sorted
+func (a *ACL) CommandsInCategory(category string) ([]string, error) {
+	if !isCategory(category) {
+		return nil, fmt.Errorf("Unknown category '%s'", category)
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	var names []string
+	for name, cmd := range a.commands {
+		for _, c := range cmd.Categories {
+			if c == category {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Log returns the log of the denied commands and failed authentications
+func (a *ACL) Log() *Log {
+	return a.log
+}
+
+// SetUser creates or modifies a user applying the rules in order. The user
+// is left untouched when one of the rules is invalid.
+func (a *ACL) SetUser(name string, rules ...string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	u, ok := a.users[name]
+	if ok {
+		u = u.clone()
+	} else {
+		u = &User{Name: name}
+	}
+	for _, r := range rules {
+		if err := u.apply(r); err != nil {
+			return err
+		}
+	}
+	a.users[name] = u
+	return nil
+}
+
+// GetUser returns a copy of the user
+func (a *ACL) GetUser(name string) (*User, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	u, ok := a.users[name]
+	if !ok {
+		return nil, false
+	}
+	return u.clone(), true
+}
+
+// DelUser deletes the users and returns the number of users deleted, the
+// default user can't be deleted.
+func (a *ACL) DelUser(names ...string) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, name := range names {
+		if name == DefaultUser {
+			return 0, errors.New("The 'default' user cannot be removed")
+		}
+	}
+	n := 0
+	for _, name := range names {
+		if _, ok := a.users[name]; ok {
+			delete(a.users, name)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Users returns the user names, sorted
+func (a *ACL) Users() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// List returns the description of the users, sorted by name
+func (a *ACL) List() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	list := make([]string, 0, len(a.users))
+	for _, u := range a.users {
+		list = append(list, u.String())
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Authenticate checks the password of an enabled user
+func (a *ACL) Authenticate(name, password string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	u, ok := a.users[name]
+	if !ok || !u.Enabled || !u.checkPassword(password) {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+// NoPassDefault reports whether the connections can use the default user
+// without authenticating.
+func (a *ACL) NoPassDefault() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	u := a.users[DefaultUser]
+	return u.Enabled && u.NoPass
+}
+
+// Lookup returns the command described by the arguments, the subcommand
+// is looked up first, e.g. config|get before config.
+func (a *ACL) Lookup(args []string) (*Command, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.lookup(args)
+}
+
+func (a *ACL) lookup(args []string) (*Command, bool) {
+	if len(args) == 0 {
+		return nil, false
+	}
+	name := strings.ToLower(args[0])
+	if len(args) > 1 {
+		if cmd, ok := a.commands[name+"|"+strings.ToLower(args[1])]; ok {
+			return cmd, true
+		}
+	}
+	cmd, ok := a.commands[name]
+	return cmd, ok
+}
+
+// Check returns an error when the user isn't allowed to run the command
+// given by the arguments on its keys. Commands unknown to the ACL are
+// checked by their name only.
+func (a *ACL) Check(name string, args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	cmd, ok := a.lookup(args)
+	if !ok {
+		cmd = &Command{Name: strings.ToLower(args[0])}
+	}
+	// a disabled user can't authenticate but the connections already
+	// authenticated keep their permissions
+	u, ok := a.users[name]
+	if !ok {
+		return ErrNoSuchUser
+	}
+	if !u.canRun(cmd) {
+		return &CommandError{User: name, Command: cmd.Name}
+	}
+	for _, key := range cmd.Keys(args) {
+		if !u.canAccessKey(key, cmd.Write) {
+			return &KeyError{Key: key}
+		}
+	}
+	return nil
+}
+
+// CheckChannel returns an error when the user can't access the channel
+func (a *ACL) CheckChannel(name, channel string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	u, ok := a.users[name]
+	if !ok {
+		return ErrNoSuchUser
+	}
+	for _, pattern := range u.channels {
+		if matched, _ := glob.Match(pattern, channel); matched {
+			return nil
+		}
+	}
+	return ErrNoPermChannel
+}
+
+// CheckPattern returns an error when the user can't subscribe to the
+// channel pattern, the pattern must be one of the user patterns literally.
+func (a *ACL) CheckPattern(name, pattern string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	u, ok := a.users[name]
+	if !ok {
+		return ErrNoSuchUser
+	}
+	for _, p := range u.channels {
+		if p == "*" || p == pattern {
+			return nil
+		}
+	}
+	return ErrNoPermChannel
+}
+
+// CommandError is returned by Check when the user can't run the command
+type CommandError struct {
+	User    string
+	Command string
+}
+
+func (err *CommandError) Error() string {
+	return fmt.Sprintf("User %s has no permissions to run the '%s' command", err.User, err.Command)
+}
+
+// KeyError is returned by Check when a key can't be accessed
+type KeyError struct {
+	Key string
+}
+
+func (err *KeyError) Error() string {
+	return "No permissions to access a key"
+}
@@ -0,0 +1,160 @@
+package acl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testCommands = []Command{
+	{Name: "get", Categories: []string{"read", "string", "fast"}, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "set", Categories: []string{"write", "string", "slow"}, FirstKey: 1, LastKey: 1, Step: 1, Write: true},
+	{Name: "del", Categories: []string{"keyspace", "write", "slow"}, FirstKey: 1, LastKey: -1, Step: 1, Write: true},
+	{Name: "config", Categories: []string{"admin", "slow", "dangerous"}},
+	{Name: "config|get", Categories: []string{"admin", "slow", "dangerous"}},
+}
+
+func TestCheck(t *testing.T) {
+
+	a := New()
+	a.SetCommands(testCommands)
+	if err := a.SetUser("alice", "on", ">secret", "~cache:*", "%R~shared:*", "+@all", "-@dangerous", "+config|get", "-del"); err != nil {
+		t.Fatalf("SetUser error:%v", err)
+	}
+
+	testCases := []struct {
+		args []string
+		err  bool
+	}{
+		{[]string{"GET", "cache:1"}, false},
+		{[]string{"SET", "cache:1", "v"}, false},
+		{[]string{"GET", "shared:1"}, false},
+		{[]string{"SET", "shared:1", "v"}, true},
+		{[]string{"GET", "other"}, true},
+		{[]string{"DEL", "cache:1"}, true},
+		{[]string{"CONFIG", "GET", "maxmemory"}, false},
+		{[]string{"CONFIG", "SET", "maxmemory", "1"}, true},
+		{[]string{"UNKNOWN"}, false},
+	}
+
+	for _, testCase := range testCases {
+		err := a.Check("alice", testCase.args)
+		if (err != nil) != testCase.err {
+			t.Errorf("Unexpected result of %q: %v", testCase.args, err)
+		}
+	}
+
+	if err := a.Check("default", []string{"DEL", "a", "b"}); err != nil {
+		t.Errorf("Expected the default user to run any command, got %v", err)
+	}
+	if err := a.Check("nobody", []string{"GET", "a"}); err != ErrNoSuchUser {
+		t.Errorf("Expected ErrNoSuchUser, got %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+
+	a := New()
+	a.SetUser("alice", ">secret", ">other")
+
+	if err := a.Authenticate("alice", "secret"); err != ErrAuthFailed {
+		t.Errorf("Expected a disabled user to fail, got %v", err)
+	}
+	a.SetUser("alice", "on", "<other")
+	if err := a.Authenticate("alice", "secret"); err != nil {
+		t.Errorf("Authenticate error:%v", err)
+	}
+	if err := a.Authenticate("alice", "other"); err != ErrAuthFailed {
+		t.Errorf("Expected the removed password to fail, got %v", err)
+	}
+	if !a.NoPassDefault() {
+		t.Errorf("Expected the default user to be nopass")
+	}
+	a.SetUser(DefaultUser, "resetpass", ">pw")
+	if a.NoPassDefault() {
+		t.Errorf("Expected the default user to require a password")
+	}
+}
+
+func TestCheckChannel(t *testing.T) {
+
+	a := New()
+	a.SetUser("alice", "on", "nopass", "&news.*")
+
+	if err := a.CheckChannel("alice", "news.sport"); err != nil {
+		t.Errorf("CheckChannel error:%v", err)
+	}
+	if err := a.CheckChannel("alice", "private"); err != ErrNoPermChannel {
+		t.Errorf("Expected ErrNoPermChannel, got %v", err)
+	}
+	if err := a.CheckPattern("alice", "news.*"); err != nil {
+		t.Errorf("CheckPattern error:%v", err)
+	}
+	if err := a.CheckPattern("alice", "news.s*"); err != ErrNoPermChannel {
+		t.Errorf("Expected ErrNoPermChannel, got %v", err)
+	}
+	a.SetUser("alice", "resetchannels")
+	if err := a.CheckChannel("alice", "news.sport"); err != ErrNoPermChannel {
+		t.Errorf("Expected ErrNoPermChannel, got %v", err)
+	}
+}
+
+func TestLog(t *testing.T) {
+
+	l := newLog()
+	l.SetMaxLen(2)
+	l.Add(ReasonCommand, "toplevel", "get", "alice", "")
+	l.Add(ReasonCommand, "toplevel", "get", "alice", "")
+	l.Add(ReasonKey, "toplevel", "k1", "alice", "")
+	l.Add(ReasonAuth, "toplevel", "AUTH", "bob", "")
+
+	entries := l.Entries(-1)
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+	if entries[0].Reason != ReasonAuth || entries[1].Object != "k1" {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+
+	l.SetMaxLen(10)
+	l.Add(ReasonKey, "toplevel", "k1", "alice", "")
+	if entries := l.Entries(1); entries[0].Count != 2 {
+		t.Errorf("Expected the entries to be grouped, got %+v", entries)
+	}
+}
+
+func TestFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "junoacl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.acl")
+
+	a := New()
+	a.SetUser("alice", "on", ">secret", "~cache:*", "&news.*", "+@read")
+	if err := a.SaveFile(path); err != nil {
+		t.Fatalf("SaveFile error:%v", err)
+	}
+
+	b := New()
+	if err := b.LoadFile(path); err != nil {
+		t.Fatalf("LoadFile error:%v", err)
+	}
+	if got, want := b.List(), a.List(); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if err := b.Authenticate("alice", "secret"); err != nil {
+		t.Errorf("Authenticate error:%v", err)
+	}
+
+	ioutil.WriteFile(path, []byte("user alice on\nuser bob badrule\n"), 0644)
+	if err := b.LoadFile(path); err == nil {
+		t.Errorf("Expected an error loading an invalid file")
+	}
+	if _, ok := b.GetUser("alice"); !ok {
+		t.Errorf("Expected the users to be kept when the file is invalid")
+	}
+}
@@ -0,0 +1,81 @@
+package acl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadFile replaces the users with the ones in the ACL file. Each line of
+// the file describes a user as "user <name> <rules...>". Nothing is
+// changed when the file has errors.
+func (a *ACL) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]*User)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if fields[0] != "user" || len(fields) < 2 {
+			return fmt.Errorf("%s:%d: should start with user keyword", path, n)
+		}
+		name := fields[1]
+		if _, ok := users[name]; ok {
+			return fmt.Errorf("%s:%d: duplicate user '%s' found", path, n, name)
+		}
+		u := &User{Name: name}
+		for _, r := range fields[2:] {
+			if err := u.apply(r); err != nil {
+				return fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+		}
+		users[name] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if _, ok := users[DefaultUser]; !ok {
+		users[DefaultUser] = defaultUser()
+	}
+
+	a.mu.Lock()
+	a.users = users
+	a.mu.Unlock()
+	return nil
+}
+
+// SaveFile writes the users to the ACL file, the file is replaced
+// atomically.
+func (a *ACL) SaveFile(path string) error {
+	var buf bytes.Buffer
+	for _, u := range a.List() {
+		buf.WriteString(u)
+		buf.WriteByte('\n')
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".acl-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
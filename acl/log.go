@@ -0,0 +1,115 @@
+package acl
+
+import (
+	"sync"
+	"time"
+)
+
+// Reasons of the log entries
+const (
+	ReasonCommand = "command"
+	ReasonKey     = "key"
+	ReasonChannel = "channel"
+	ReasonAuth    = "auth"
+)
+
+// groupWindow is the time within which equal entries are grouped
+const groupWindow = 60 * time.Second
+
+// Entry is a denied command or a failed authentication
+type Entry struct {
+	Count      int64
+	Reason     string
+	Context    string
+	Object     string
+	Username   string
+	ClientInfo string
+	Created    time.Time
+	Updated    time.Time
+	EntryID    int64
+}
+
+// Log keeps the most recent entries, newest first
+type Log struct {
+	mu      sync.Mutex
+	entries []*Entry
+	maxLen  int
+	nextID  int64
+}
+
+func newLog() *Log {
+	return &Log{maxLen: 128}
+}
+
+// SetMaxLen sets the maximum number of entries kept
+func (l *Log) SetMaxLen(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.maxLen = n
+	l.trim()
+}
+
+func (l *Log) trim() {
+	if l.maxLen >= 0 && len(l.entries) > l.maxLen {
+		l.entries = l.entries[:l.maxLen]
+	}
+}
+
+// Add adds an entry, an entry equal to a recent one only increments its
+// count and becomes the newest.
+func (l *Log) Add(reason, context, object, username, clientInfo string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for i, e := range l.entries {
+		if e.Reason == reason && e.Context == context && e.Object == object &&
+			e.Username == username && now.Sub(e.Updated) < groupWindow {
+			e.Count++
+			e.Updated = now
+			e.ClientInfo = clientInfo
+			// the updated entry becomes the newest one
+			copy(l.entries[1:i+1], l.entries[:i])
+			l.entries[0] = e
+			return
+		}
+	}
+	e := &Entry{
+		Count:      1,
+		Reason:     reason,
+		Context:    context,
+		Object:     object,
+		Username:   username,
+		ClientInfo: clientInfo,
+		Created:    now,
+		Updated:    now,
+		EntryID:    l.nextID,
+	}
+	l.nextID++
+	l.entries = append([]*Entry{e}, l.entries...)
+	l.trim()
+}
+
+// Entries returns up to count entries, all of them if count is negative
+func (l *Log) Entries(count int) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if count < 0 || count > len(l.entries) {
+		count = len(l.entries)
+	}
+	entries := make([]Entry, count)
+	for i := range entries {
+		entries[i] = *l.entries[i]
+	}
+	return entries
+}
+
+// Reset removes all the entries
+func (l *Log) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = nil
+}
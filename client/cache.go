@@ -0,0 +1,239 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/junostorage/resp"
+)
+
+// invalidateChannel is the channel the server sends the invalidation
+// messages on
+const invalidateChannel = "__redis__:invalidate"
+
+// ErrCacheEnabled is returned when the cache of the connection is already
+// enabled
+var ErrCacheEnabled = errors.New("the cache is already enabled")
+
+// cacheableCommands are the read commands whose replies are cached, their
+// first argument is the key.
+var cacheableCommands = map[string]bool{
+	"get":     true,
+	"hget":    true,
+	"hgetall": true,
+	"lindex":  true,
+	"llen":    true,
+}
+
+// cache holds the replies of the cacheable commands by key. The server
+// tracks the keys read by the connection and sends their invalidations to
+// a second connection subscribed to the invalidation channel.
+type cache struct {
+	mu sync.Mutex
+	// entries holds the replies of a key by command and arguments
+	entries map[string]map[string]resp.Value
+	size    int
+	max     int
+	// inflight counts the commands of the keys waiting for a reply, a key
+	// invalidated meanwhile is not cached as the reply may be stale
+	inflight    map[string]int
+	invalidated map[string]bool
+	// broken is set when the invalidation connection is lost, the
+	// commands are sent to the server from then on
+	broken bool
+	hits   int64
+	misses int64
+
+	inv *Conn
+}
+
+// EnableCache turns on the client side caching of the replies of GET, HGET,
+// HGETALL, LINDEX and LLEN, up to max replies. The server sends the
+// invalidations of the keys read by the connection to a second connection,
+// opened with the same address and options. The connection must be
+// authenticated already when the server requires it.
+func (conn *Conn) EnableCache(max int) error {
+	if conn.cache != nil {
+		return ErrCacheEnabled
+	}
+
+	netconn, err := conn.dial()
+	if err != nil {
+		return err
+	}
+	inv := newConn(netconn, conn.dial)
+
+	c := &cache{
+		entries:     make(map[string]map[string]resp.Value),
+		max:         max,
+		inflight:    make(map[string]int),
+		invalidated: make(map[string]bool),
+		inv:         inv,
+	}
+	if err := c.subscribe(conn); err != nil {
+		inv.conn.Close()
+		return err
+	}
+	conn.cache = c
+	go c.run()
+	return nil
+}
+
+// CacheStats returns the number of commands answered from the cache and
+// sent to the server.
+func (conn *Conn) CacheStats() (hits, misses int64) {
+	if conn.cache == nil {
+		return 0, 0
+	}
+	conn.cache.mu.Lock()
+	defer conn.cache.mu.Unlock()
+	return conn.cache.hits, conn.cache.misses
+}
+
+// subscribe subscribes the invalidation connection and turns the tracking
+// of the connection on.
+func (c *cache) subscribe(conn *Conn) error {
+	id, err := c.inv.do("client", "id")
+	if err != nil {
+		return err
+	}
+	if err := id.Error(); err != nil {
+		return err
+	}
+	v, err := c.inv.do("subscribe", invalidateChannel)
+	if err != nil {
+		return err
+	}
+	if err := v.Error(); err != nil {
+		return err
+	}
+
+	v, err = conn.do("client", "tracking", "on", "redirect", id.Integer())
+	if err != nil {
+		return err
+	}
+	return v.Error()
+}
+
+// run applies the invalidation messages until the invalidation connection
+// is closed.
+func (c *cache) run() {
+	for {
+		v, _, err := c.inv.rd.ReadValue()
+		if err != nil {
+			break
+		}
+		msg := v.Array()
+		if len(msg) != 3 || msg[0].String() != "message" || msg[1].String() != invalidateChannel {
+			continue
+		}
+		if msg[2].IsNull() {
+			c.flush()
+			continue
+		}
+		for _, key := range msg[2].Array() {
+			c.invalidate(key.String())
+		}
+	}
+
+	c.mu.Lock()
+	c.broken = true
+	c.mu.Unlock()
+	c.flush()
+}
+
+func (c *cache) close() {
+	c.inv.Close()
+}
+
+// do answers the cacheable commands from the cache, the other commands drop
+// the replies of the key in the first argument as they may modify it.
+func (c *cache) do(conn *Conn, commandName string, args ...interface{}) (resp.Value, error) {
+	if len(args) == 0 {
+		return conn.do(commandName, args...)
+	}
+	key := fmt.Sprint(args[0])
+	if !cacheableCommands[strings.ToLower(commandName)] {
+		c.invalidate(key)
+		return conn.do(commandName, args...)
+	}
+
+	sig := strings.ToLower(fmt.Sprint(commandName, args))
+	c.mu.Lock()
+	if c.broken {
+		c.mu.Unlock()
+		return conn.do(commandName, args...)
+	}
+	if v, ok := c.entries[key][sig]; ok {
+		c.hits++
+		c.mu.Unlock()
+		return v, nil
+	}
+	c.misses++
+	c.inflight[key]++
+	c.mu.Unlock()
+
+	v, err := conn.do(commandName, args...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil && v.Error() == nil && !c.invalidated[key] && !c.broken {
+		c.store(key, sig, v)
+	}
+	c.inflight[key]--
+	if c.inflight[key] == 0 {
+		delete(c.inflight, key)
+		delete(c.invalidated, key)
+	}
+	return v, err
+}
+
+// store caches the reply, arbitrary replies are dropped once the cache is
+// full. The caller holds the lock.
+func (c *cache) store(key, sig string, v resp.Value) {
+	for k, replies := range c.entries {
+		if c.max <= 0 || c.size < c.max {
+			break
+		}
+		c.size -= len(replies)
+		delete(c.entries, k)
+	}
+	if c.max <= 0 {
+		return
+	}
+	replies, ok := c.entries[key]
+	if !ok {
+		replies = make(map[string]resp.Value)
+		c.entries[key] = replies
+	}
+	if _, ok := replies[sig]; !ok {
+		c.size++
+	}
+	replies[sig] = v
+}
+
+// invalidate drops the replies of the key
+func (c *cache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size -= len(c.entries[key])
+	delete(c.entries, key)
+	if c.inflight[key] > 0 {
+		c.invalidated[key] = true
+	}
+}
+
+// flush drops all the replies
+func (c *cache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]map[string]resp.Value)
+	c.size = 0
+	for key := range c.inflight {
+		c.invalidated[key] = true
+	}
+}
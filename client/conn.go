@@ -1,45 +1,82 @@
 package client
 
 import (
+	"crypto/tls"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/junostorage/resp"
 )
 
+const (
+	tlsScheme  = "tls://"
+	unixScheme = "unix://"
+)
+
 // Conn represents a simple resp connection.
 type Conn struct {
 	conn net.Conn
 	rd   *resp.Reader
 	wr   *resp.Writer
+	// dial opens another connection to the server, e.g. for the
+	// invalidation messages of the cache
+	dial  func() (net.Conn, error)
+	cache *cache
 }
 
-// DialTimeout dials a resp server.
+// Dial dials a resp server. An address prefixed with tls:// is dialed
+// with TLS verifying the server with the system roots, unix:///path dials
+// the Unix socket at path.
 func Dial(address string) (*Conn, error) {
-	tcpconn, err := net.Dial("tcp", address)
+	return DialTimeout(address, 0)
+}
+
+// DialTimeout dials a resp server.
+func DialTimeout(address string, timeout time.Duration) (*Conn, error) {
+	if strings.HasPrefix(address, tlsScheme) {
+		address = strings.TrimPrefix(address, tlsScheme)
+		return dialTLS(address, timeout, &tls.Config{})
+	}
+	network := "tcp"
+	if strings.HasPrefix(address, unixScheme) {
+		network, address = "unix", strings.TrimPrefix(address, unixScheme)
+	}
+	dial := func() (net.Conn, error) {
+		return net.DialTimeout(network, address, timeout)
+	}
+	netconn, err := dial()
 	if err != nil {
 		return nil, err
 	}
-	conn := &Conn{
-		conn: tcpconn,
-		rd:   resp.NewReader(tcpconn),
-		wr:   resp.NewWriter(tcpconn),
-	}
-	return conn, nil
+	return newConn(netconn, dial), nil
 }
 
-// DialTimeout dials a resp server.
-func DialTimeout(address string, timeout time.Duration) (*Conn, error) {
-	tcpconn, err := net.DialTimeout("tcp", address, timeout)
+// DialTLS dials a resp server with TLS. The config holds the client
+// certificate and the roots the server is verified with.
+func DialTLS(address string, config *tls.Config) (*Conn, error) {
+	return dialTLS(strings.TrimPrefix(address, tlsScheme), 0, config)
+}
+
+func dialTLS(address string, timeout time.Duration, config *tls.Config) (*Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	dial := func() (net.Conn, error) {
+		return tls.DialWithDialer(dialer, "tcp", address, config)
+	}
+	tlsconn, err := dial()
 	if err != nil {
 		return nil, err
 	}
-	conn := &Conn{
-		conn: tcpconn,
-		rd:   resp.NewReader(tcpconn),
-		wr:   resp.NewWriter(tcpconn),
+	return newConn(tlsconn, dial), nil
+}
+
+func newConn(netconn net.Conn, dial func() (net.Conn, error)) *Conn {
+	return &Conn{
+		conn: netconn,
+		rd:   resp.NewReader(netconn),
+		wr:   resp.NewWriter(netconn),
+		dial: dial,
 	}
-	return conn, nil
 }
 
 // SetDeadline sets the connection deadline for reads and writes.
@@ -59,12 +96,23 @@ func (conn *Conn) SetWriteDeadline(t time.Time) error {
 
 // Close closes the connection.
 func (conn *Conn) Close() error {
+	if conn.cache != nil {
+		conn.cache.close()
+	}
 	conn.wr.WriteMultiBulk("quit")
 	return conn.conn.Close()
 }
 
-// Do performs a command and returns a resp value.
+// Do performs a command and returns a resp value. With the cache enabled
+// the replies of the cacheable commands may come from the cache.
 func (conn *Conn) Do(commandName string, args ...interface{}) (val resp.Value, err error) {
+	if conn.cache != nil {
+		return conn.cache.do(conn, commandName, args...)
+	}
+	return conn.do(commandName, args...)
+}
+
+func (conn *Conn) do(commandName string, args ...interface{}) (val resp.Value, err error) {
 	if err := conn.wr.WriteMultiBulk(commandName, args...); err != nil {
 		return val, err
 	}
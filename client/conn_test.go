@@ -99,3 +99,52 @@ func TestDialClinet(t *testing.T) {
 	}
 
 }
+
+func TestCache(t *testing.T) {
+
+	con, err := Dial("localhost:6380")
+	if err != nil {
+		t.Fatalf("Dial error:%v", err)
+	}
+	defer con.Close()
+	other, err := Dial("localhost:6380")
+	if err != nil {
+		t.Fatalf("Dial error:%v", err)
+	}
+	defer other.Close()
+
+	if err := con.EnableCache(100); err != nil {
+		t.Fatalf("EnableCache error:%v", err)
+	}
+	other.Do("set", "cachekey", "v1")
+
+	for i := 0; i < 2; i++ {
+		if val, err := con.Do("get", "cachekey"); err != nil || val.String() != "v1" {
+			t.Errorf("Expected v1, got %v err:%v", val, err)
+		}
+	}
+	if hits, misses := con.CacheStats(); hits != 1 || misses != 1 {
+		t.Errorf("Expected 1 hit and 1 miss, got %d %d", hits, misses)
+	}
+
+	// the write of another client invalidates the cached reply
+	other.Do("set", "cachekey", "v2")
+	deadline := time.Now().Add(time.Second)
+	for {
+		val, _ := con.Do("get", "cachekey")
+		if val.String() == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the invalidation of the cached reply, got %v", val)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the own writes drop the cached reply at once
+	con.Do("set", "cachekey", "v3")
+	if val, _ := con.Do("get", "cachekey"); val.String() != "v3" {
+		t.Errorf("Expected v3, got %v", val)
+	}
+	other.Do("del", "cachekey")
+}
@@ -0,0 +1,454 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/junostorage/utils/glob"
+)
+
+type kind int
+
+const (
+	kindString kind = iota
+	kindInt
+	kindMemory
+	kindEnum
+	kindOutputBufferLimit
+)
+
+// param describes a configuration parameter
+type param struct {
+	name     string
+	kind     kind
+	def      string
+	mutable  bool
+	min, max int64
+	enum     []string
+}
+
+// The registry of the supported configuration parameters
+var params = []*param{
+	// network
+	{name: "bind", kind: kindString, def: ""},
+	{name: "port", kind: kindInt, def: "6380", min: 0, max: 65535},
+	{name: "http-port", kind: kindInt, def: "6382", min: 0, max: 65535},
+	{name: "timeout", kind: kindInt, def: "0", mutable: true, min: 0, max: 1<<31 - 1},
+	{name: "tcp-keepalive", kind: kindInt, def: "300", mutable: true, min: 0, max: 1<<31 - 1},
+	{name: "unixsocket", kind: kindString, def: ""},
+	{name: "unixsocketperm", kind: kindString, def: "0"},
+	{name: "tls-port", kind: kindInt, def: "0", min: 0, max: 65535},
+	{name: "tls-http-port", kind: kindInt, def: "0", min: 0, max: 65535},
+	{name: "maxclients", kind: kindInt, def: "10000", mutable: true, min: 1, max: 1<<31 - 1},
+	{name: "client-output-buffer-limit", kind: kindOutputBufferLimit, def: "normal 0 0 0 replica 256mb 64mb 60 pubsub 32mb 8mb 60", mutable: true},
+	{name: "tracking-table-max-keys", kind: kindInt, def: "1000000", mutable: true, min: 0, max: 1<<31 - 1},
+	{name: "databases", kind: kindInt, def: "16", min: 1, max: 1 << 16},
+	{name: "network-model", kind: kindEnum, def: "goroutine", enum: []string{"goroutine", "epoll"}},
+	{name: "io-threads", kind: kindInt, def: "0", min: 0, max: 1024},
+	{name: "shutdown-timeout", kind: kindInt, def: "10", mutable: true, min: 0, max: 1<<31 - 1},
+
+	// memory
+	{name: "maxmemory", kind: kindMemory, def: "1gb", mutable: true, min: 0, max: 1<<63 - 1},
+	{name: "maxmemory-policy", kind: kindEnum, def: "noeviction", mutable: true, enum: []string{"noeviction", "allkeys-random", "volatile-random", "volatile-ttl"}},
+
+	// monitoring
+	{name: "slowlog-log-slower-than", kind: kindInt, def: "10000", mutable: true, min: -1, max: 1<<63 - 1},
+	{name: "slowlog-max-len", kind: kindInt, def: "128", mutable: true, min: 0, max: 1<<31 - 1},
+	{name: "latency-monitor-threshold", kind: kindInt, def: "0", mutable: true, min: 0, max: 1<<63 - 1},
+
+	// persistence, the path of the snapshot is only set on startup so the
+	// clients can't have files written elsewhere
+	{name: "dir", kind: kindString, def: "./"},
+	{name: "dbfilename", kind: kindString, def: "dump.juno"},
+	{name: "save", kind: kindString, def: "", mutable: true},
+
+	// logging
+	{name: "loglevel", kind: kindEnum, def: "notice", enum: []string{"debug", "verbose", "notice", "warning"}},
+	{name: "logfile", kind: kindString, def: ""},
+
+	// security
+	{name: "requirepass", kind: kindString, def: "", mutable: true},
+	{name: "aclfile", kind: kindString, def: ""},
+	{name: "tls-cert-file", kind: kindString, def: ""},
+	{name: "tls-key-file", kind: kindString, def: ""},
+	{name: "tls-ca-cert-file", kind: kindString, def: ""},
+	{name: "tls-auth-clients", kind: kindEnum, def: "yes", enum: []string{"yes", "no", "optional"}},
+	{name: "tls-auth-clients-user", kind: kindEnum, def: "off", enum: []string{"off", "cn"}},
+	{name: "tls-protocols", kind: kindString, def: "TLSv1.2 TLSv1.3"},
+	{name: "tls-ciphers", kind: kindString, def: ""},
+	{name: "acllog-max-len", kind: kindInt, def: "128", mutable: true, min: 0, max: 1<<31 - 1},
+}
+
+var (
+	ErrNoConfigFile = errors.New("The server is running without a config file")
+)
+
+func lookup(name string) *param {
+	for _, p := range params {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Config is a registry of the server configuration parameters
+type Config struct {
+	mu     sync.RWMutex
+	path   string
+	values map[string]string
+}
+
+// New returns a Config with the default values
+func New() *Config {
+	c := &Config{values: make(map[string]string)}
+	for _, p := range params {
+		c.values[p.name], _ = p.parse(p.def)
+	}
+	return c
+}
+
+// Load reads a redis.conf style configuration file. Each line holds a
+// parameter name followed by its value, blank lines and lines starting
+// with '#' are ignored.
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := New()
+	c.path = path
+
+	n := 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		n++
+		name, value, ok := parseLine(s.Text())
+		if !ok {
+			continue
+		}
+		if err := c.set(name, value, true); err != nil {
+			return nil, fmt.Errorf("config file %s, line %d: %v", path, n, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseLine splits a configuration line into the parameter name and value
+func parseLine(line string) (name, value string, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", "", false
+	}
+	fields := strings.Fields(line)
+	name = strings.ToLower(fields[0])
+	value = strings.Join(fields[1:], " ")
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	return name, value, true
+}
+
+// Clone returns a copy of the config
+func (c *Config) Clone() *Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	c2 := &Config{path: c.path, values: make(map[string]string, len(c.values))}
+	for k, v := range c.values {
+		c2.values[k] = v
+	}
+	return c2
+}
+
+// Path returns the configuration file the config was loaded from
+func (c *Config) Path() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.path
+}
+
+// Get returns the name and value pairs of the parameters matching the pattern
+func (c *Config) Get(pattern string) (pairs []string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	names := make([]string, 0, len(params))
+	for _, p := range params {
+		if matched, _ := glob.Match(strings.ToLower(pattern), p.name); matched {
+			names = append(names, p.name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pairs = append(pairs, name, c.values[name])
+	}
+	return
+}
+
+// Set changes the value of a mutable parameter
+func (c *Config) Set(name, value string) error {
+	return c.set(strings.ToLower(name), value, false)
+}
+
+// SetStartup changes the value of any parameter, it's meant to be used
+// before the server starts, e.g. for the command line flags.
+func (c *Config) SetStartup(name, value string) error {
+	return c.set(strings.ToLower(name), value, true)
+}
+
+func (c *Config) set(name, value string, startup bool) error {
+	p := lookup(name)
+	if p == nil {
+		return fmt.Errorf("unknown option or number of arguments for CONFIG SET - '%s'", name)
+	}
+	if !p.mutable && !startup {
+		return fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name)
+	}
+	v, err := p.parse(value)
+	if err != nil {
+		return fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - %v", name, err)
+	}
+
+	c.mu.Lock()
+	// the classes missing from an output buffer limit keep their limits
+	if p.kind == kindOutputBufferLimit && c.values[name] != "" {
+		v = mergeOutputBufferLimits(c.values[name], v)
+	}
+	c.values[name] = v
+	c.mu.Unlock()
+	return nil
+}
+
+// parse validates the value and returns its normalized form
+func (p *param) parse(value string) (string, error) {
+	switch p.kind {
+	case kindInt, kindMemory:
+		var n int64
+		var err error
+		if p.kind == kindMemory {
+			n, err = ParseMemory(value)
+		} else {
+			n, err = strconv.ParseInt(value, 10, 64)
+		}
+		if err != nil {
+			return "", fmt.Errorf("argument couldn't be parsed into an integer")
+		}
+		if n < p.min || n > p.max {
+			return "", fmt.Errorf("argument must be between %d and %d inclusive", p.min, p.max)
+		}
+		return strconv.FormatInt(n, 10), nil
+
+	case kindEnum:
+		for _, e := range p.enum {
+			if strings.ToLower(value) == e {
+				return e, nil
+			}
+		}
+		return "", fmt.Errorf("argument(s) must be one of the following: %s", strings.Join(p.enum, ", "))
+
+	case kindOutputBufferLimit:
+		limits, err := parseOutputBufferLimits(value)
+		if err != nil {
+			return "", err
+		}
+		return formatOutputBufferLimits(limits), nil
+	}
+	return value, nil
+}
+
+// OutputBufferClasses are the client classes of client-output-buffer-limit
+var OutputBufferClasses = []string{"normal", "replica", "pubsub"}
+
+// OutputBufferLimit is the client-output-buffer-limit of a client class. A
+// client is disconnected once its output buffer is over Hard bytes, or
+// over Soft bytes for SoftSeconds. A zero limit is disabled.
+type OutputBufferLimit struct {
+	Hard        int64
+	Soft        int64
+	SoftSeconds int64
+}
+
+// parseOutputBufferLimits parses the <class> <hard> <soft> <soft seconds>
+// groups of client-output-buffer-limit, slave is an alias of replica
+func parseOutputBufferLimits(value string) (map[string]OutputBufferLimit, error) {
+	fields := strings.Fields(value)
+	if len(fields)%4 != 0 {
+		return nil, fmt.Errorf("wrong number of arguments in buffer limit configuration")
+	}
+	limits := make(map[string]OutputBufferLimit)
+	for i := 0; i < len(fields); i += 4 {
+		class := strings.ToLower(fields[i])
+		if class == "slave" {
+			class = "replica"
+		}
+		known := false
+		for _, c := range OutputBufferClasses {
+			known = known || c == class
+		}
+		if !known {
+			return nil, fmt.Errorf("invalid client class specified in buffer limit configuration")
+		}
+		hard, err1 := ParseMemory(fields[i+1])
+		soft, err2 := ParseMemory(fields[i+2])
+		seconds, err3 := strconv.ParseInt(fields[i+3], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil || hard < 0 || soft < 0 || seconds < 0 {
+			return nil, fmt.Errorf("error in hard, soft or soft_seconds setting in buffer limit configuration")
+		}
+		limits[class] = OutputBufferLimit{Hard: hard, Soft: soft, SoftSeconds: seconds}
+	}
+	return limits, nil
+}
+
+// formatOutputBufferLimits returns the limits in the order of
+// OutputBufferClasses, the sizes in bytes
+func formatOutputBufferLimits(limits map[string]OutputBufferLimit) string {
+	var groups []string
+	for _, class := range OutputBufferClasses {
+		if l, ok := limits[class]; ok {
+			groups = append(groups, fmt.Sprintf("%s %d %d %d", class, l.Hard, l.Soft, l.SoftSeconds))
+		}
+	}
+	return strings.Join(groups, " ")
+}
+
+// mergeOutputBufferLimits overrides the limits of old with the classes set
+// by value
+func mergeOutputBufferLimits(old, value string) string {
+	limits, _ := parseOutputBufferLimits(old)
+	set, _ := parseOutputBufferLimits(value)
+	for class, l := range set {
+		limits[class] = l
+	}
+	return formatOutputBufferLimits(limits)
+}
+
+// ParseMemory parses memory sizes like 1gb, 100mb, 512k or plain bytes
+func ParseMemory(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+		{"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000},
+		{"b", 1},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			n, err := strconv.ParseInt(strings.TrimSuffix(s, u.suffix), 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			if n > math.MaxInt64/u.mul || n < math.MinInt64/u.mul {
+				return 0, fmt.Errorf("memory size %s is out of range", s)
+			}
+			return n * u.mul, nil
+		}
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// String returns the value of a parameter
+func (c *Config) String(name string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.values[name]
+}
+
+// Int returns the value of an integer or memory parameter
+func (c *Config) Int(name string) int64 {
+	n, _ := strconv.ParseInt(c.String(name), 10, 64)
+	return n
+}
+
+// OutputBufferLimits returns the client-output-buffer-limit of the client
+// classes
+func (c *Config) OutputBufferLimits() map[string]OutputBufferLimit {
+	limits, _ := parseOutputBufferLimits(c.String("client-output-buffer-limit"))
+	return limits
+}
+
+// Rewrite writes the current configuration back to the file it was loaded
+// from. Comments and unknown lines are kept, known parameters are updated
+// in place and the changed parameters missing from the file are appended.
+func (c *Config) Rewrite() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.path == "" {
+		return ErrNoConfigFile
+	}
+
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var lines []string
+	written := make(map[string]bool)
+	if len(data) > 0 {
+		for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+			name, _, ok := parseLine(line)
+			if ok && lookup(name) != nil {
+				if written[name] {
+					continue
+				}
+				written[name] = true
+				line = formatLine(name, c.values[name])
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	header := false
+	for _, p := range params {
+		if written[p.name] {
+			continue
+		}
+		if def, _ := p.parse(p.def); def == c.values[p.name] {
+			continue
+		}
+		if !header {
+			lines = append(lines, "# Generated by CONFIG REWRITE")
+			header = true
+		}
+		lines = append(lines, formatLine(p.name, c.values[p.name]))
+	}
+
+	// the file holds the passwords, it keeps its mode or is only readable
+	// by the owner
+	mode := os.FileMode(0600)
+	if fi, err := os.Stat(c.path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), mode); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+func formatLine(name, value string) string {
+	if value == "" || strings.ContainsAny(value, " \t#") {
+		value = `"` + value + `"`
+	}
+	return name + " " + value
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadRewrite(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "junoconf")
+	if err != nil {
+		t.Fatalf("tempdir error:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "juno.conf")
+	data := "# junostorage config\nport 7000\n\n# memory\nmaxmemory 100mb\nmaxmemory 200mb\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("write error:%v", err)
+	}
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load error:%v", err)
+	}
+	if got := c.Int("port"); got != 7000 {
+		t.Errorf("Want: %d, got: %d", 7000, got)
+	}
+	if got := c.Int("maxmemory"); got != 200<<20 {
+		t.Errorf("Want: %d, got: %d", 200<<20, got)
+	}
+
+	for _, name := range []string{"port", "dir", "dbfilename"} {
+		if err := c.Set(name, "7001"); err == nil {
+			t.Errorf("Expected error on setting immutable %s", name)
+		}
+	}
+	if err := c.Set("loglevel", "bogus"); err == nil {
+		t.Errorf("Expected error on invalid loglevel")
+	}
+	if err := c.Set("maxmemory", "1mb"); err != nil {
+		t.Fatalf("Set error:%v", err)
+	}
+	if err := c.Set("timeout", "30"); err != nil {
+		t.Fatalf("Set error:%v", err)
+	}
+
+	pairs := c.Get("max*")
+	if len(pairs) != 6 || pairs[0] != "maxclients" {
+		t.Errorf("Unexpected CONFIG GET result: %v", pairs)
+	}
+
+	if err := c.Rewrite(); err != nil {
+		t.Fatalf("Rewrite error:%v", err)
+	}
+	out, _ := ioutil.ReadFile(path)
+	want := "# junostorage config\nport 7000\n\n# memory\nmaxmemory 1048576\n# Generated by CONFIG REWRITE\ntimeout 30\n"
+	if string(out) != want {
+		t.Errorf("Want:\n%s\ngot:\n%s", want, out)
+	}
+	// the file isn't made readable by the others
+	if fi, err := os.Stat(path); err != nil {
+		t.Errorf("Stat error:%v", err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("Want mode 0600, got: %v", fi.Mode().Perm())
+	}
+
+	c2, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load error:%v", err)
+	}
+	if got := c2.String("timeout"); got != "30" {
+		t.Errorf("Want: %s, got: %s", "30", got)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("unknown-option 1\n"), 0644); err != nil {
+		t.Fatalf("write error:%v", err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Errorf("Expected error on unknown option")
+	}
+
+	// the parameters without an implementation aren't accepted
+	for _, name := range []string{"protected-mode", "appendonly"} {
+		if err := c2.Set(name, "yes"); err == nil {
+			t.Errorf("Expected error on %s", name)
+		}
+	}
+
+}
+
+func TestParseMemory(t *testing.T) {
+
+	testCases := []struct {
+		value string
+		res   int64
+	}{
+		{"100", 100},
+		{"1k", 1000},
+		{"1kb", 1024},
+		{"2mb", 2 << 20},
+		{"1GB", 1 << 30},
+	}
+
+	for _, testCase := range testCases {
+		n, err := ParseMemory(testCase.value)
+		if err != nil {
+			t.Errorf("ParseMemory error:%v", err)
+		}
+		if n != testCase.res {
+			t.Errorf("Want: %d, got: %d, value:%v", testCase.res, n, testCase.value)
+		}
+	}
+
+	if _, err := ParseMemory("lots"); err == nil || !strings.Contains(err.Error(), "invalid") {
+		t.Errorf("Expected parse error, got:%v", err)
+	}
+	// the sizes overflowing int64 aren't wrapped
+	for _, value := range []string{"99999999999gb", "9223372036854775807kb", "-99999999999gb"} {
+		if n, err := ParseMemory(value); err == nil {
+			t.Errorf("Expected range error, got:%d, value:%v", n, value)
+		}
+	}
+
+}
+
+func TestOutputBufferLimits(t *testing.T) {
+
+	c := New()
+	if got, want := c.String("client-output-buffer-limit"), "normal 0 0 0 replica 268435456 67108864 60 pubsub 33554432 8388608 60"; got != want {
+		t.Errorf("Want: %s, got: %s", want, got)
+	}
+
+	// the classes not set keep their limits
+	if err := c.Set("client-output-buffer-limit", "pubsub 1mb 512kb 10"); err != nil {
+		t.Fatalf("Set error:%v", err)
+	}
+	limits := c.OutputBufferLimits()
+	if want := (OutputBufferLimit{Hard: 1 << 20, Soft: 512 << 10, SoftSeconds: 10}); limits["pubsub"] != want {
+		t.Errorf("Want: %v, got: %v", want, limits["pubsub"])
+	}
+	if limits["replica"].Hard != 256<<20 {
+		t.Errorf("Want the replica limits kept, got: %v", limits["replica"])
+	}
+
+	for _, value := range []string{"pubsub 1mb 1mb", "client 1 1 1", "normal 1 -1 0", "normal 1 1 x"} {
+		if err := c.Set("client-output-buffer-limit", value); err == nil {
+			t.Errorf("Expected error on %q", value)
+		}
+	}
+}
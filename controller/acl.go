@@ -0,0 +1,412 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/junostorage/acl"
+	"github.com/junostorage/controller/server"
+
+	"github.com/junostorage/resp"
+)
+
+var (
+	errNoAuth         = errReply{"NOAUTH", "Authentication required."}
+	errWrongPass      = errReply{"WRONGPASS", acl.ErrAuthFailed.Error()}
+	errAuthHTTP       = errors.New("AUTH is not supported over HTTP, use the Basic authentication")
+	errAuthNoPassword = errors.New("AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	errNoACLFile      = errors.New("This instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a config file) in order to store users in the config.")
+)
+
+// requiresAuth reports whether the command can only be run by
+// authenticated clients
+func requiresAuth(cmd string) bool {
+	if cmd, ok := commands[cmd]; ok {
+		return cmd.flags&flagNoAuth == 0
+	}
+	return true
+}
+
+// applyRequirePass sets the requirepass password on the default user, the
+// default user is left untouched while requirepass doesn't change.
+func (c *Controller) applyRequirePass() error {
+	pass := c.config.String("requirepass")
+	if pass == c.requirepass {
+		return nil
+	}
+
+	rules := []string{"resetpass", ">" + pass}
+	if pass == "" {
+		rules = []string{"nopass"}
+	}
+	if err := c.acl.SetUser(acl.DefaultUser, rules...); err != nil {
+		return err
+	}
+	c.requirepass = pass
+	return nil
+}
+
+// connUser returns the user the command runs as, the http clients run as
+// the user of the Basic authentication or as the default user.
+func connUser(conn *server.Conn, msg *server.Message) string {
+	if conn != nil {
+		return conn.User()
+	}
+	if msg.Username != "" {
+		return msg.Username
+	}
+	return acl.DefaultUser
+}
+
+// authorize checks that the client is authenticated and its user can run
+// the command on the keys.
+func (c *Controller) authorize(conn *server.Conn, msg *server.Message) error {
+	if !requiresAuth(msg.Command) {
+		return nil
+	}
+
+	switch {
+	case conn != nil:
+		// the default user may have become nopass after the connection
+		// was opened
+		if conn.User() == "" {
+			if !c.acl.NoPassDefault() {
+				return errNoAuth
+			}
+			conn.SetUser(acl.DefaultUser)
+		}
+	case msg.Username != "" || msg.Password != "":
+		if err := c.acl.Authenticate(connUser(conn, msg), msg.Password); err != nil {
+			c.acl.Log().Add(acl.ReasonAuth, "toplevel", "AUTH", connUser(conn, msg), c.aclClientInfo(conn, msg))
+			return errWrongPass
+		}
+	case c.certUser(msg.ClientCN) != "":
+		msg.Username = c.certUser(msg.ClientCN)
+	case !c.acl.NoPassDefault():
+		return errNoAuth
+	}
+
+	user := connUser(conn, msg)
+	args := make([]string, 0, len(msg.Values))
+	for _, v := range msg.Values {
+		args = append(args, v.String())
+	}
+
+	switch err := c.acl.Check(user, args).(type) {
+	case nil:
+		return nil
+	case *acl.CommandError:
+		c.acl.Log().Add(acl.ReasonCommand, "toplevel", err.Command, user, c.aclClientInfo(conn, msg))
+		return errReply{"NOPERM", err.Error()}
+	case *acl.KeyError:
+		c.acl.Log().Add(acl.ReasonKey, "toplevel", err.Key, user, c.aclClientInfo(conn, msg))
+		return errReply{"NOPERM", err.Error()}
+	default:
+		return errReply{"NOPERM", err.Error()}
+	}
+}
+
+// aclClientInfo describes the client in the ACL LOG entries
+func (c *Controller) aclClientInfo(conn *server.Conn, msg *server.Message) string {
+	if conn == nil {
+		return fmt.Sprintf("addr=%s cmd=%s user=%s", msg.RemoteAddr, msg.Command, connUser(conn, msg))
+	}
+	return c.clientInfo(conn)
+}
+
+// AUTH [username] password
+func (c *Controller) cmdAuth(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	var user, pass string
+	switch len(msg.Values) {
+	default:
+		err = errInvalidNumberOfArguments
+		return
+	case 2:
+		if c.acl.NoPassDefault() {
+			return "", errAuthNoPassword
+		}
+		user, pass = acl.DefaultUser, msg.Values[1].String()
+	case 3:
+		user, pass = msg.Values[1].String(), msg.Values[2].String()
+	}
+
+	if conn == nil {
+		return "", errAuthHTTP
+	}
+
+	if err := c.acl.Authenticate(user, pass); err != nil {
+		c.acl.Log().Add(acl.ReasonAuth, "toplevel", "AUTH", user, c.clientInfo(conn))
+		return "", errWrongPass
+	}
+	conn.SetUser(user)
+
+	return okOutput(msg)
+}
+
+func (c *Controller) cmdACL(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) < 2 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	switch strings.ToLower(msg.Values[1].String()) {
+	default:
+		err = fmt.Errorf("unknown subcommand '%s'. Try ACL HELP.", msg.Values[1].String())
+	case "setuser":
+		res, err = c.cmdACLSetUser(msg)
+	case "getuser":
+		res, err = c.cmdACLGetUser(msg)
+	case "deluser":
+		res, err = c.cmdACLDelUser(conn, msg)
+	case "list":
+		if len(msg.Values) != 2 {
+			return "", errInvalidNumberOfArguments
+		}
+		res, err = stringsOutput(msg, c.acl.List())
+	case "users":
+		if len(msg.Values) != 2 {
+			return "", errInvalidNumberOfArguments
+		}
+		res, err = stringsOutput(msg, c.acl.Users())
+	case "whoami":
+		if len(msg.Values) != 2 {
+			return "", errInvalidNumberOfArguments
+		}
+		res, err = stringOutput(msg, connUser(conn, msg))
+	case "cat":
+		res, err = c.cmdACLCat(msg)
+	case "dryrun":
+		res, err = c.cmdACLDryRun(msg)
+	case "log":
+		res, err = c.cmdACLLog(msg)
+	case "load":
+		res, err = c.cmdACLLoad(conn, msg)
+	case "save":
+		if len(msg.Values) != 2 {
+			return "", errInvalidNumberOfArguments
+		}
+		path := c.config.String("aclfile")
+		if path == "" {
+			return "", errNoACLFile
+		}
+		if err = c.acl.SaveFile(path); err != nil {
+			return
+		}
+		res, err = okOutput(msg)
+	}
+	return
+}
+
+// ACL SETUSER username [rule [rule ...]]
+func (c *Controller) cmdACLSetUser(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) < 3 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	rules := make([]string, 0, len(msg.Values)-3)
+	for _, v := range msg.Values[3:] {
+		rules = append(rules, v.String())
+	}
+	if err = c.acl.SetUser(msg.Values[2].String(), rules...); err != nil {
+		return
+	}
+
+	return okOutput(msg)
+}
+
+// ACL GETUSER username
+func (c *Controller) cmdACLGetUser(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 3 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	u, ok := c.acl.GetUser(msg.Values[2].String())
+	if !ok {
+		return nullOutput(msg)
+	}
+
+	keys := strings.Join(u.KeyPatterns(), " ")
+	channels := strings.Join(u.ChannelPatterns(), " ")
+
+	return valueOutput(msg, resp.MapValue([]resp.Value{
+		resp.StringValue("flags"), stringsValue(u.Flags()),
+		resp.StringValue("passwords"), stringsValue(u.Passwords()),
+		resp.StringValue("commands"), resp.StringValue(u.CommandRules()),
+		resp.StringValue("keys"), resp.StringValue(keys),
+		resp.StringValue("channels"), resp.StringValue(channels),
+		resp.StringValue("selectors"), resp.ArrayValue(nil),
+	}))
+}
+
+// ACL DELUSER username [username ...]
+// The connections authenticated as the deleted users are closed.
+func (c *Controller) cmdACLDelUser(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) < 3 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	names := make([]string, 0, len(msg.Values)-2)
+	for _, v := range msg.Values[2:] {
+		names = append(names, v.String())
+	}
+	n, err := c.acl.DelUser(names...)
+	if err != nil {
+		return
+	}
+	c.killUnknownUsers(conn)
+
+	return integerOutput(msg, n)
+}
+
+// killUnknownUsers closes the connections whose user doesn't exist anymore
+func (c *Controller) killUnknownUsers(current *server.Conn) {
+	for _, cn := range c.sortedConns() {
+		user := cn.User()
+		if user == "" {
+			continue
+		}
+		if _, ok := c.acl.GetUser(user); !ok {
+			c.killClient(current, cn)
+		}
+	}
+}
+
+// ACL CAT [category]
+func (c *Controller) cmdACLCat(msg *server.Message) (res string, err error) {
+
+	switch len(msg.Values) {
+	default:
+		return "", errInvalidNumberOfArguments
+	case 2:
+		return stringsOutput(msg, acl.Categories)
+	case 3:
+		names, err := c.acl.CommandsInCategory(strings.ToLower(msg.Values[2].String()))
+		if err != nil {
+			return "", err
+		}
+		return stringsOutput(msg, names)
+	}
+}
+
+// ACL DRYRUN username command [arg [arg ...]]
+func (c *Controller) cmdACLDryRun(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) < 4 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	user := msg.Values[2].String()
+	if _, ok := c.acl.GetUser(user); !ok {
+		return "", fmt.Errorf("User '%s' not found", user)
+	}
+
+	args := make([]string, 0, len(msg.Values)-3)
+	for _, v := range msg.Values[3:] {
+		args = append(args, v.String())
+	}
+	if err := c.acl.Check(user, args); err != nil {
+		return stringOutput(msg, err.Error())
+	}
+
+	return okOutput(msg)
+}
+
+// ACL LOG [count|RESET]
+func (c *Controller) cmdACLLog(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) > 3 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	n := 10
+	if len(msg.Values) == 3 {
+		if strings.ToLower(msg.Values[2].String()) == "reset" {
+			c.acl.Log().Reset()
+			return okOutput(msg)
+		}
+		if n, err = strconv.Atoi(msg.Values[2].String()); err != nil || n < 0 {
+			return "", errors.New("value is out of range, must be positive")
+		}
+	}
+
+	entries := c.acl.Log().Entries(n)
+	now := time.Now()
+
+	vals := make([]resp.Value, 0, len(entries))
+	for _, e := range entries {
+		vals = append(vals, resp.MapValue([]resp.Value{
+			resp.StringValue("count"), resp.IntegerValue(int(e.Count)),
+			resp.StringValue("reason"), resp.StringValue(e.Reason),
+			resp.StringValue("context"), resp.StringValue(e.Context),
+			resp.StringValue("object"), resp.StringValue(e.Object),
+			resp.StringValue("username"), resp.StringValue(e.Username),
+			resp.StringValue("age-seconds"), resp.DoubleValue(float64(now.Sub(e.Updated)/time.Millisecond) / 1000),
+			resp.StringValue("client-info"), resp.StringValue(e.ClientInfo),
+			resp.StringValue("entry-id"), resp.IntegerValue(int(e.EntryID)),
+			resp.StringValue("timestamp-created"), resp.IntegerValue(int(e.Created.UnixNano() / int64(time.Millisecond))),
+			resp.StringValue("timestamp-last-updated"), resp.IntegerValue(int(e.Updated.UnixNano() / int64(time.Millisecond))),
+		}))
+	}
+
+	return valueOutput(msg, resp.ArrayValue(vals))
+}
+
+// ACL LOAD
+// The connections whose user isn't in the file anymore are closed.
+func (c *Controller) cmdACLLoad(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 2 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	path := c.config.String("aclfile")
+	if path == "" {
+		return "", errNoACLFile
+	}
+	if err = c.acl.LoadFile(path); err != nil {
+		return
+	}
+	c.killUnknownUsers(conn)
+
+	return okOutput(msg)
+}
+
+// stringsOutput returns the reply of the commands which reply with a list
+// of strings
+func stringsOutput(msg *server.Message, list []string) (res string, err error) {
+	switch msg.OutputType {
+	case server.JSON:
+		return jsonOutput(jsonData(stringsValue(list)))
+	case server.RESP:
+		data, err := stringsValue(list).MarshalRESP()
+		if err != nil {
+			return "", err
+		}
+
+		res = string(data)
+	}
+
+	return
+}
+
+func stringsValue(list []string) resp.Value {
+	vals := make([]resp.Value, 0, len(list))
+	for _, s := range list {
+		vals = append(vals, resp.StringValue(s))
+	}
+	return resp.ArrayValue(vals)
+}
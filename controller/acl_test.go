@@ -0,0 +1,154 @@
+package controller
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/junostorage/config"
+	"github.com/junostorage/controller/server"
+
+	"github.com/junostorage/resp"
+)
+
+func TestACL(t *testing.T) {
+
+	c := newController(config.New())
+
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	admin := server.NewConn(p1)
+	conn := server.NewConn(p2)
+	c.connsMu.Lock()
+	c.conns[admin] = true
+	c.conns[conn] = true
+	c.connsMu.Unlock()
+
+	send := func(conn *server.Conn, data string) string {
+		var buf bytes.Buffer
+		message, err := readMessage(data)
+		if err != nil {
+			t.Fatalf("reader error:%v", err)
+		}
+		if err := c.handleInputCommand(conn, message, &buf); err != nil {
+			t.Fatalf("handleInputCommand error:%v", err)
+		}
+		return buf.String()
+	}
+
+	testCases := []struct {
+		conn *server.Conn
+		data string
+		res  string
+	}{
+		{admin, "ACL SETUSER alice on >secret ~cache:* %R~shared:* +@read +set\r\n", "+OK\r\n"},
+		{admin, "ACL SETUSER bob on +@all -@dangerous badrule\r\n", "-ERR Error in ACL SETUSER modifier 'badrule': Syntax error\r\n"},
+		{admin, "ACL WHOAMI\r\n", "$7\r\ndefault\r\n"},
+		{conn, "AUTH alice wrong\r\n", "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{conn, "AUTH alice secret\r\n", "+OK\r\n"},
+		{conn, "ACL WHOAMI\r\n", "-NOPERM User alice has no permissions to run the 'acl|whoami' command\r\n"},
+		{conn, "SET cache:1 v\r\n", "+OK\r\n"},
+		{conn, "GET cache:1\r\n", "$1\r\nv\r\n"},
+		{conn, "SET shared:1 v\r\n", "-NOPERM No permissions to access a key\r\n"},
+		{conn, "GET other\r\n", "-NOPERM No permissions to access a key\r\n"},
+		{conn, "HSET cache:2 f v\r\n", "-NOPERM User alice has no permissions to run the 'hset' command\r\n"},
+		{admin, "ACL DRYRUN alice DEL cache:1\r\n", "$54\r\nUser alice has no permissions to run the 'del' command\r\n"},
+		{admin, "ACL DRYRUN alice GET cache:1\r\n", "+OK\r\n"},
+		{admin, "ACL LIST\r\n", "*2\r\n$132\r\nuser alice on #2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b ~cache:* %R~shared:* resetchannels -@all +@read +set\r\n$34\r\nuser default on nopass ~* &* +@all\r\n"},
+		{admin, "ACL DELUSER default\r\n", "-ERR The 'default' user cannot be removed\r\n"},
+	}
+
+	for _, testCase := range testCases {
+		if res := send(testCase.conn, testCase.data); res != testCase.res {
+			t.Errorf("Expected the result of %q to be %q, but instead found it to be %q", testCase.data, testCase.res, res)
+		}
+	}
+
+	entries := c.acl.Log().Entries(-1)
+	if len(entries) != 5 {
+		t.Fatalf("Expected 5 ACL LOG entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.Reason != "command" || e.Object != "hset" || e.Username != "alice" {
+		t.Errorf("Unexpected ACL LOG entry %+v", e)
+	}
+	if e := entries[4]; e.Reason != "auth" || e.Object != "AUTH" || !strings.Contains(e.ClientInfo, " addr=pipe ") {
+		t.Errorf("Unexpected ACL LOG entry %+v", e)
+	}
+
+	if res := send(admin, "ACL DELUSER alice\r\n"); res != ":1\r\n" {
+		t.Errorf("Unexpected ACL DELUSER reply %q", res)
+	}
+	if _, err := p1.Write([]byte("x")); err == nil {
+		t.Errorf("Expected the connection of the deleted user to be closed")
+	}
+}
+
+func TestRequirePass(t *testing.T) {
+
+	c := newController(config.New())
+
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	conn := server.NewConn(p1)
+
+	send := func(data string) string {
+		var buf bytes.Buffer
+		message, err := readMessage(data)
+		if err != nil {
+			t.Fatalf("reader error:%v", err)
+		}
+		if err := c.handleInputCommand(conn, message, &buf); err != nil {
+			t.Fatalf("handleInputCommand error:%v", err)
+		}
+		return buf.String()
+	}
+
+	if res := send("AUTH foobared\r\n"); !strings.HasPrefix(res, "-ERR AUTH <password> called without any password") {
+		t.Errorf("Unexpected AUTH reply %q", res)
+	}
+	if res := send("CONFIG SET requirepass foobared\r\n"); res != "+OK\r\n" {
+		t.Fatalf("Unexpected CONFIG SET reply %q", res)
+	}
+
+	// the connections opened from now on must authenticate
+	conn = server.NewConn(p2)
+	if res := send("PING\r\n"); res != "-NOAUTH Authentication required.\r\n" {
+		t.Errorf("Unexpected PING reply %q", res)
+	}
+	if res := send("AUTH foobared\r\n"); res != "+OK\r\n" {
+		t.Errorf("Unexpected AUTH reply %q", res)
+	}
+	if res := send("PING\r\n"); res != "+PONG\r\n" {
+		t.Errorf("Unexpected PING reply %q", res)
+	}
+
+	// http clients use the Basic authentication
+	testCases := []struct {
+		username, password string
+		status             int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"default", "wrong", http.StatusUnauthorized},
+		{"default", "foobared", http.StatusOK},
+	}
+	for _, testCase := range testCases {
+		message := &server.Message{
+			Command:  "ping",
+			Values:   []resp.Value{resp.StringValue("ping")},
+			ConnType: server.HTTP, OutputType: server.JSON,
+			Username: testCase.username, Password: testCase.password,
+		}
+		w := httptest.NewRecorder()
+		if err := c.handleInputCommand(nil, message, w); err != nil {
+			t.Fatalf("handleInputCommand error:%v", err)
+		}
+		if w.Code != testCase.status {
+			t.Errorf("Expected status %d for %q, got %d", testCase.status, testCase.username, w.Code)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/junostorage/controller/server"
+	"github.com/junostorage/storage"
+)
+
+var errMethodNotAllowed = errors.New("method not allowed")
+
+// batchHandler runs the commands of a JSON array of commands posted to
+// /batch, e.g. [["SET","k","v"],["GET","k"]]. The replies are a JSON array
+// of the replies of the commands, or one per line with NDJSON when the
+// client accepts application/x-ndjson or asks for ?stream. With ?atomic the
+// commands run as a MULTI/EXEC block: no other command runs in between and
+// none of them runs when one can't be queued. A batch failing midway ends
+// with the error as its last reply.
+func (c *Controller) batchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, jsonErrorOutput(errMethodNotAllowed))
+		return
+	}
+	msgs, err := server.ReadHTTPBatch(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, jsonErrorOutput(err))
+		return
+	}
+	query := r.URL.Query()
+	_, atomic := query["atomic"]
+	_, stream := query["stream"]
+	stream = stream || server.Accepts(r, "application/x-ndjson")
+
+	if atomic {
+		if err := checkAtomic(msgs); err != nil {
+			w.WriteHeader(httpStatus(err))
+			io.WriteString(w, jsonErrorOutput(err))
+			return
+		}
+	}
+	c.stats.recordBatch(len(msgs))
+
+	out := &batchWriter{w: w, stream: stream}
+	if stream {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	out.begin()
+	if atomic {
+		err = c.runAtomic(msgs, out)
+	} else {
+		for _, msg := range msgs {
+			if err = out.run(msg, c.handleInputCommand); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		logs.Errorf("http batch error:%v", err)
+		out.fail(err)
+	}
+	out.end()
+}
+
+// runAtomic runs the commands under the controller write lock, once
+// CLIENT PAUSE lets them through. The handlers don't take the lock
+// themselves, the connections have their own, so the commands that kill
+// clients or change the users and the config run in the batch too. The
+// replies are written once the lock is released.
+func (c *Controller) runAtomic(msgs []*server.Message, out *batchWriter) error {
+	write := false
+	for _, msg := range msgs {
+		cmd, _ := lookupCommand(msg.Values)
+		if cmd.flags&flagWrite != 0 {
+			write = true
+		}
+	}
+	c.pause.wait(write)
+	c.mu.Lock()
+	var err error
+	replies := make([][]byte, 0, len(msgs))
+	for _, msg := range msgs {
+		var buf bytes.Buffer
+		if err = c.runCommand(nil, msg, &buf, true); err != nil {
+			break
+		}
+		replies = append(replies, buf.Bytes())
+	}
+	c.mu.Unlock()
+
+	for _, reply := range replies {
+		if err := out.write(reply); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// checkAtomic returns the EXECABORT error of the batch when one of the
+// commands can't be queued: an unknown command, a wrong number of
+// arguments or a command that doesn't run in a transaction
+func checkAtomic(msgs []*server.Message) error {
+	for i, msg := range msgs {
+		var err error
+		cmd, ok := lookupCommand(msg.Values)
+		switch {
+		case !ok:
+			err = errUnknownCommand{msg.Values[0].String()}
+		case !cmd.checkArity(len(msg.Values)):
+			err = fmt.Errorf("wrong number of arguments for '%s' command", msg.Command)
+		case cmd.name == storage.CmdShutdown || cmd.name == storage.CmdMonitor:
+			err = fmt.Errorf("%s is not allowed in an atomic batch", msg.Command)
+		}
+		if err != nil {
+			return errReply{"EXECABORT", fmt.Sprintf("Transaction discarded because of previous errors, command %d: %v", i+1, err)}
+		}
+	}
+	return nil
+}
+
+// batchWriter writes the replies of a batch, as the items of a JSON
+// array or a line each with NDJSON. The lines are flushed as they are
+// written.
+type batchWriter struct {
+	w      http.ResponseWriter
+	stream bool
+	n      int
+	buf    bytes.Buffer
+}
+
+func (out *batchWriter) begin() {
+	if !out.stream {
+		io.WriteString(out.w, "[")
+	}
+}
+
+// fail writes the error that stopped the batch as its last reply
+func (out *batchWriter) fail(err error) {
+	out.write([]byte(jsonErrorOutput(err)))
+}
+
+func (out *batchWriter) end() {
+	if !out.stream {
+		io.WriteString(out.w, "]")
+	}
+}
+
+// run runs the command with the handler and writes its reply
+func (out *batchWriter) run(msg *server.Message, handler func(*server.Conn, *server.Message, io.Writer) error) error {
+	out.buf.Reset()
+	if err := handler(nil, msg, &out.buf); err != nil {
+		return err
+	}
+	return out.write(out.buf.Bytes())
+}
+
+// write writes the reply of a command, a command replying nothing is
+// reported as a success
+func (out *batchWriter) write(reply []byte) error {
+	if len(reply) == 0 {
+		reply = []byte(`{"status":true}`)
+	}
+	if !out.stream && out.n > 0 {
+		io.WriteString(out.w, ",")
+	}
+	out.n++
+	if _, err := out.w.Write(reply); err != nil {
+		return err
+	}
+	if out.stream {
+		io.WriteString(out.w, "\n")
+	}
+	if f, ok := out.w.(http.Flusher); ok && out.stream {
+		f.Flush()
+	}
+	return nil
+}
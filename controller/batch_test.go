@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/junostorage/config"
+	"github.com/junostorage/controller/server"
+)
+
+func TestBatch(t *testing.T) {
+
+	dc := newController(config.New())
+	testCases := []struct {
+		method string
+		url    string
+		body   string
+		res    string
+		status int
+	}{
+		{"POST", "/batch", `[["SET","b:1","v"],["GET","b:1"],["PING"],["LPUSH","b:1","x"]]`,
+			`[{"status":true},{"status":true,"value":"v"},{"status":true,"value":"PONG"},` +
+				`{"status":false,"code":"WRONGTYPE","error":"Operation against a key holding the wrong kind of value"}]`, http.StatusOK},
+		{"POST", "/batch?stream", `[["DEL","b:1"],["GET","b:1"]]`,
+			"{\"status\":true,\"value\":1}\n{\"status\":false,\"code\":\"ERR\",\"error\":\"Key not found\"}\n", http.StatusOK},
+		// none of the commands runs when one can't be queued
+		{"POST", "/batch?atomic", `[["SET","b:2","v"],["GET"]]`,
+			`{"status":false,"code":"EXECABORT","error":"Transaction discarded because of previous errors, command 2: wrong number of arguments for 'get' command"}`,
+			http.StatusBadRequest},
+		{"POST", "/batch?atomic", `[["SET","b:2","v",10]]`,
+			`[{"status":false,"code":"ERR","error":"syntax error"}]`, http.StatusOK},
+		{"POST", "/batch?atomic", `[["SET","b:2","v"],["GET","b:2"],["SHUTDOWN"]]`,
+			`{"status":false,"code":"EXECABORT","error":"Transaction discarded because of previous errors, command 3: shutdown is not allowed in an atomic batch"}`,
+			http.StatusBadRequest},
+		{"POST", "/batch", `[["GET","b:2"]]`,
+			`[{"status":false,"code":"ERR","error":"Key not found"}]`, http.StatusOK},
+		{"POST", "/batch?atomic", `[["SET","b:2","v"],["GET","b:2"]]`,
+			`[{"status":true},{"status":true,"value":"v"}]`, http.StatusOK},
+		// the commands taking the connections or the users run too
+		{"POST", "/batch?atomic", `[["CONFIG","SET","slowlog-max-len","64"],["ACL","SETUSER","b:user","on"],["CLIENT","KILL","ID","999999"],["ACL","DELUSER","b:user"]]`,
+			`[{"status":true},{"status":true},{"status":true,"value":0},{"status":true,"value":1}]`, http.StatusOK},
+		{"POST", "/batch", `[["PING"],[]]`,
+			`{"status":false,"code":"ERR","error":"invalid JSON command: the command is empty"}`, http.StatusBadRequest},
+		{"GET", "/batch", ``, `{"status":false,"code":"ERR","error":"method not allowed"}`, http.StatusMethodNotAllowed},
+	}
+	for _, testCase := range testCases {
+		w := httptest.NewRecorder()
+		dc.batchHandler(w, httptest.NewRequest(testCase.method, testCase.url, strings.NewReader(testCase.body)))
+		if res := w.Body.String(); res != testCase.res {
+			t.Errorf("Want: %s, got: %s, body:%s", testCase.res, res, testCase.body)
+		}
+		if w.Code != testCase.status {
+			t.Errorf("Want status %d, got %d, body:%s", testCase.status, w.Code, testCase.body)
+		}
+	}
+}
+
+func TestBatchWriterFail(t *testing.T) {
+
+	failing := func(conn *server.Conn, msg *server.Message, w io.Writer) error {
+		return errors.New("write failed")
+	}
+	for _, stream := range []bool{false, true} {
+		w := httptest.NewRecorder()
+		out := &batchWriter{w: w, stream: stream}
+		out.begin()
+		msg, _ := readMessage("PING\r\n")
+		out.run(msg, func(conn *server.Conn, msg *server.Message, w io.Writer) error { return nil })
+		if err := out.run(msg, failing); err != nil {
+			out.fail(err)
+		}
+		out.end()
+
+		// the replies stay well formed
+		want := `[{"status":true},{"status":false,"code":"ERR","error":"write failed"}]`
+		if stream {
+			want = "{\"status\":true}\n{\"status\":false,\"code\":\"ERR\",\"error\":\"write failed\"}\n"
+		}
+		if res := w.Body.String(); res != want {
+			t.Errorf("Want: %s, got: %s", want, res)
+		}
+	}
+}
@@ -0,0 +1,695 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/junostorage/acl"
+	"github.com/junostorage/config"
+	"github.com/junostorage/controller/server"
+
+	"github.com/junostorage/resp"
+)
+
+var (
+	errClientHTTP    = errors.New("CLIENT subcommand is not supported over HTTP")
+	errNoSuchClient  = errors.New("No such client")
+	errInvalidName   = errors.New("Client names cannot contain spaces, newlines or special characters.")
+	errPauseTimeout  = errors.New("timeout is not an integer or out of range")
+	errClientIDRange = errors.New("client-id should be greater than 0")
+	errMaxClients    = errors.New("max number of clients reached")
+	errHelloHTTP     = errors.New("HELLO is not supported over HTTP")
+	errOutputHTTP    = errors.New("OUTPUT is not supported over HTTP, the format of the reply is given by ?format= or the Accept header")
+	errNoProto       = errReply{"NOPROTO", "unsupported protocol version"}
+	errHelloNoAuth   = errReply{"NOAUTH", "HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"}
+)
+
+// clientPause holds the state of CLIENT PAUSE
+type clientPause struct {
+	mu    sync.Mutex
+	until time.Time
+	all   bool
+	// closed when the pause ends earlier with CLIENT UNPAUSE
+	done chan struct{}
+}
+
+// pause pauses the clients until the deadline, only the write commands
+// unless all is set
+func (p *clientPause) pause(until time.Time, all bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done == nil || time.Now().After(p.until) {
+		p.done = make(chan struct{})
+		p.until = until
+		p.all = all
+		return
+	}
+	// a pause in progress is only extended
+	if until.After(p.until) {
+		p.until = until
+	}
+	p.all = p.all || all
+}
+
+func (p *clientPause) unpause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done != nil {
+		close(p.done)
+		p.done = nil
+	}
+}
+
+// wait blocks while the clients are paused for the kind of command
+func (p *clientPause) wait(write bool) {
+	for {
+		p.mu.Lock()
+		done, until := p.done, p.until
+		paused := done != nil && time.Now().Before(until) && (p.all || write)
+		p.mu.Unlock()
+		if !paused {
+			return
+		}
+
+		t := time.NewTimer(time.Until(until))
+		select {
+		case <-done:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+func (c *Controller) isMonitor(conn *server.Conn) bool {
+	c.monitorsMu.Lock()
+	defer c.monitorsMu.Unlock()
+	_, ok := c.monitors[conn]
+	return ok
+}
+
+// clientInfo returns the CLIENT LIST line of the connection
+func (c *Controller) clientInfo(conn *server.Conn) string {
+	cmd, last := conn.LastCommand()
+	now := time.Now()
+
+	flags := ""
+	if c.isMonitor(conn) {
+		flags += "O"
+	}
+	sub, psub := c.pubsub.counts(conn)
+	if sub+psub > 0 {
+		flags += "P"
+	}
+	if conn.NoEvict() {
+		flags += "e"
+	}
+	if conn.IsUnix() {
+		flags += "U"
+	}
+	c.tracking.mu.Lock()
+	if tc := c.tracking.clients[conn.ID]; tc != nil {
+		flags += "t"
+		if tc.bcast {
+			flags += "B"
+		}
+		if tc.redirectBroken {
+			flags += "R"
+		}
+	}
+	c.tracking.mu.Unlock()
+	if flags == "" {
+		flags = "N"
+	}
+
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=%d multi=-1 qbuf=%d obl=0 oll=0 omem=%d cmd=%s user=%s redir=%d resp=%d",
+		conn.ID, conn.Addr(), conn.LAddr(), conn.Name(),
+		int64(now.Sub(conn.Created).Seconds()), int64(now.Sub(last).Seconds()),
+		flags, conn.DB(), sub, psub, conn.InputBuffered(), conn.Output(), cmd, conn.User(), c.trackingRedirect(conn), conn.Proto())
+}
+
+// reservedFDs are the file descriptors kept for the listeners, the log and
+// the files of the persistence besides the clients
+const reservedFDs = 32
+
+// acceptClient registers the new connection unless there are already
+// maxclients of them or the server is shutting down
+func (c *Controller) acceptClient(conn *server.Conn) error {
+	c.connsMu.Lock()
+	defer c.connsMu.Unlock()
+
+	if c.shuttingDown {
+		return errShuttingDown
+	}
+	if int64(len(c.conns)) >= c.config.Int("maxclients") {
+		c.stats.connRejected()
+		return errMaxClients
+	}
+	c.conns[conn] = true
+	c.stats.connOpened()
+	return nil
+}
+
+// connOpened accepts a connection, it's authenticated as the user of its
+// client certificate or as the default user when it has no password
+func (c *Controller) connOpened(conn *server.Conn) error {
+	if err := c.acceptClient(conn); err != nil {
+		return err
+	}
+	switch {
+	case c.certUser(conn.PeerCommonName()) != "":
+		conn.SetUser(c.certUser(conn.PeerCommonName()))
+	case c.acl.NoPassDefault():
+		conn.SetUser(acl.DefaultUser)
+	}
+	conn.SetKeepAlive(time.Duration(c.config.Int("tcp-keepalive")) * time.Second)
+	conn.SetOutputLimit(func() server.OutputLimit { return c.outputLimit(conn) })
+	return nil
+}
+
+// connClosed forgets a connection, its subscriptions, monitor and client
+// side caching included
+func (c *Controller) connClosed(conn *server.Conn) {
+	if conn.OutputLimitReached() {
+		logs.Warnf("client %v closed for overcoming of output buffer limits", conn.Addr())
+		c.stats.outputLimitReached()
+	}
+	c.connsMu.Lock()
+	delete(c.conns, conn)
+	c.connsMu.Unlock()
+	c.removeMonitor(conn)
+	c.pubsub.remove(conn)
+	c.tracking.disable(conn.ID)
+}
+
+// outputLimit returns the client-output-buffer-limit of the class of the
+// connection, there are no replica clients
+func (c *Controller) outputLimit(conn *server.Conn) server.OutputLimit {
+	limits, _ := c.outputLimits.Load().(map[string]config.OutputBufferLimit)
+	class := "normal"
+	if conn.Pubsub() {
+		class = "pubsub"
+	}
+	l := limits[class]
+	return server.OutputLimit{Hard: l.Hard, Soft: l.Soft, SoftTime: time.Duration(l.SoftSeconds) * time.Second}
+}
+
+// closeIdleClients closes the connections idle for longer than timeout,
+// the subscribers and the monitors only wait for messages so they're kept
+func (c *Controller) closeIdleClients() {
+	timeout := time.Duration(c.config.Int("timeout")) * time.Second
+	if timeout == 0 {
+		return
+	}
+	for _, conn := range c.sortedConns() {
+		if conn.Pubsub() || c.isMonitor(conn) {
+			continue
+		}
+		if _, last := conn.LastCommand(); time.Since(last) > timeout {
+			logs.Debugf("closing idle client %v", conn.Addr())
+			conn.Close()
+		}
+	}
+}
+
+// checkOutputLimits closes the connections over their output limit. The
+// limits are checked as the replies are queued, this catches the clients
+// not reading them as they don't send commands anymore.
+func (c *Controller) checkOutputLimits() {
+	for _, conn := range c.sortedConns() {
+		conn.CheckOutputLimit()
+	}
+}
+
+// sortedConns returns the connections sorted by ID
+func (c *Controller) sortedConns() []*server.Conn {
+	c.connsMu.Lock()
+	conns := make([]*server.Conn, 0, len(c.conns))
+	for conn := range c.conns {
+		conns = append(conns, conn)
+	}
+	c.connsMu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
+
+// connCount returns the number of connections
+func (c *Controller) connCount() int {
+	c.connsMu.Lock()
+	defer c.connsMu.Unlock()
+	return len(c.conns)
+}
+
+func (c *Controller) cmdClient(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) < 2 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	sub := strings.ToLower(msg.Values[1].String())
+	switch sub {
+	case "id", "info", "setname", "getname", "reply", "no-evict", "tracking", "caching", "getredir", "trackinginfo":
+		if conn == nil {
+			return "", errClientHTTP
+		}
+	}
+
+	switch sub {
+	default:
+		err = fmt.Errorf("unknown subcommand '%s'. Try CLIENT HELP.", msg.Values[1].String())
+	case "list":
+		res, err = c.cmdClientList(msg)
+	case "info":
+		if len(msg.Values) != 2 {
+			return "", errInvalidNumberOfArguments
+		}
+		res, err = stringOutput(msg, c.clientInfo(conn)+"\n")
+	case "id":
+		if len(msg.Values) != 2 {
+			return "", errInvalidNumberOfArguments
+		}
+		res, err = integerOutput(msg, int(conn.ID))
+	case "setname":
+		res, err = c.cmdClientSetName(conn, msg)
+	case "getname":
+		if len(msg.Values) != 2 {
+			return "", errInvalidNumberOfArguments
+		}
+		name := conn.Name()
+		if name == "" {
+			return nullOutput(msg)
+		}
+		res, err = stringOutput(msg, name)
+	case "kill":
+		res, err = c.cmdClientKill(conn, msg)
+	case "pause":
+		res, err = c.cmdClientPause(msg)
+	case "unpause":
+		if len(msg.Values) != 2 {
+			return "", errInvalidNumberOfArguments
+		}
+		c.pause.unpause()
+		res, err = okOutput(msg)
+	case "no-evict":
+		if len(msg.Values) != 3 {
+			return "", errInvalidNumberOfArguments
+		}
+		switch strings.ToLower(msg.Values[2].String()) {
+		default:
+			return "", errSyntax
+		case "on":
+			conn.SetNoEvict(true)
+		case "off":
+			conn.SetNoEvict(false)
+		}
+		res, err = okOutput(msg)
+	case "reply":
+		res, err = c.cmdClientReply(conn, msg)
+	case "tracking":
+		res, err = c.cmdClientTracking(conn, msg)
+	case "caching":
+		res, err = c.cmdClientCaching(conn, msg)
+	case "getredir":
+		res, err = c.cmdClientGetRedir(conn, msg)
+	case "trackinginfo":
+		res, err = c.cmdClientTrackingInfo(conn, msg)
+	}
+	return
+}
+
+// CLIENT LIST [TYPE normal|master|replica|pubsub] [ID client-id ...]
+func (c *Controller) cmdClientList(msg *server.Message) (res string, err error) {
+
+	var typ string
+	var ids map[int64]bool
+	args := msg.Values[2:]
+	for len(args) > 0 {
+		switch strings.ToLower(args[0].String()) {
+		default:
+			return "", errSyntax
+		case "type":
+			if len(args) < 2 {
+				return "", errSyntax
+			}
+			typ = strings.ToLower(args[1].String())
+			switch typ {
+			default:
+				return "", fmt.Errorf("Unknown client type '%s'", args[1].String())
+			case "normal", "master", "replica", "slave", "pubsub":
+			}
+			args = args[2:]
+		case "id":
+			if len(args) < 2 {
+				return "", errSyntax
+			}
+			ids = make(map[int64]bool)
+			for _, v := range args[1:] {
+				id, err := strconv.ParseInt(v.String(), 10, 64)
+				if err != nil || id <= 0 {
+					return "", fmt.Errorf("Invalid client ID")
+				}
+				ids[id] = true
+			}
+			args = nil
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, conn := range c.sortedConns() {
+		if ids != nil && !ids[conn.ID] {
+			continue
+		}
+		// there are no replication clients
+		switch typ {
+		case "normal":
+			if c.pubsub.subscribed(conn) {
+				continue
+			}
+		case "pubsub":
+			if !c.pubsub.subscribed(conn) {
+				continue
+			}
+		case "master", "replica", "slave":
+			continue
+		}
+		buf.WriteString(c.clientInfo(conn))
+		buf.WriteByte('\n')
+	}
+
+	return stringOutput(msg, buf.String())
+}
+
+func (c *Controller) cmdClientSetName(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 3 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	name := msg.Values[2].String()
+	if !validClientName(name) {
+		return "", errInvalidName
+	}
+	conn.SetName(name)
+
+	return okOutput(msg)
+}
+
+// validClientName reports whether the name has no spaces, newlines or
+// special characters
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// CLIENT KILL addr
+// CLIENT KILL [ID client-id] [ADDR addr] [LADDR laddr] [USER username] [SKIPME yes|no]
+func (c *Controller) cmdClientKill(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) < 3 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	// the old form kills a single client by address
+	if len(msg.Values) == 3 {
+		addr := msg.Values[2].String()
+		for _, cn := range c.sortedConns() {
+			if cn.Addr() == addr {
+				c.killClient(conn, cn)
+				return okOutput(msg)
+			}
+		}
+		return "", errNoSuchClient
+	}
+
+	if len(msg.Values)%2 != 0 {
+		return "", errSyntax
+	}
+
+	var id int64
+	var addr, laddr, user string
+	skipme := true
+	for i := 2; i < len(msg.Values); i += 2 {
+		value := msg.Values[i+1].String()
+		switch strings.ToLower(msg.Values[i].String()) {
+		default:
+			return "", errSyntax
+		case "id":
+			if id, err = strconv.ParseInt(value, 10, 64); err != nil || id <= 0 {
+				return "", errClientIDRange
+			}
+		case "addr":
+			addr = value
+		case "laddr":
+			laddr = value
+		case "user":
+			user = value
+		case "skipme":
+			switch strings.ToLower(value) {
+			default:
+				return "", errSyntax
+			case "yes":
+				skipme = true
+			case "no":
+				skipme = false
+			}
+		}
+	}
+
+	n := 0
+	for _, cn := range c.sortedConns() {
+		if id != 0 && cn.ID != id {
+			continue
+		}
+		if addr != "" && cn.Addr() != addr {
+			continue
+		}
+		if laddr != "" && cn.LAddr() != laddr {
+			continue
+		}
+		if user != "" && cn.User() != user {
+			continue
+		}
+		if skipme && cn == conn {
+			continue
+		}
+		c.killClient(conn, cn)
+		n++
+	}
+
+	return integerOutput(msg, n)
+}
+
+// killClient closes the connection, the current connection is closed once
+// the reply is sent
+func (c *Controller) killClient(current, conn *server.Conn) {
+	if conn == current {
+		conn.CloseAfterReply()
+		return
+	}
+	conn.Close()
+}
+
+// CLIENT PAUSE timeout [WRITE|ALL]
+func (c *Controller) cmdClientPause(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 3 && len(msg.Values) != 4 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	ms, err := strconv.ParseInt(msg.Values[2].String(), 10, 64)
+	if err != nil || ms < 0 {
+		return "", errPauseTimeout
+	}
+
+	all := true
+	if len(msg.Values) == 4 {
+		switch strings.ToLower(msg.Values[3].String()) {
+		default:
+			return "", errSyntax
+		case "write":
+			all = false
+		case "all":
+		}
+	}
+
+	c.pause.pause(time.Now().Add(time.Duration(ms)*time.Millisecond), all)
+
+	return okOutput(msg)
+}
+
+// CLIENT REPLY ON|OFF|SKIP
+func (c *Controller) cmdClientReply(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 3 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	switch strings.ToLower(msg.Values[2].String()) {
+	default:
+		return "", errSyntax
+	case "on":
+		conn.Reply = server.ReplyOn
+		return okOutput(msg)
+	case "off":
+		conn.Reply = server.ReplyOff
+	case "skip":
+		conn.Reply = server.ReplySkip
+	}
+	return "", nil
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func (c *Controller) cmdHello(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	if conn == nil {
+		return "", errHelloHTTP
+	}
+
+	proto := conn.Proto()
+	var user, pass, name string
+	var setName bool
+	if len(msg.Values) > 1 {
+		n, err := strconv.Atoi(msg.Values[1].String())
+		if err != nil {
+			return "", errors.New("Protocol version is not an integer or out of range")
+		}
+		if n != 2 && n != 3 {
+			return "", errNoProto
+		}
+		proto = n
+
+		for i := 2; i < len(msg.Values); i++ {
+			more := len(msg.Values) - i - 1
+			switch opt := strings.ToLower(msg.Values[i].String()); {
+			case opt == "auth" && more >= 2:
+				user, pass = msg.Values[i+1].String(), msg.Values[i+2].String()
+				i += 2
+			case opt == "setname" && more >= 1:
+				name, setName = msg.Values[i+1].String(), true
+				if !validClientName(name) {
+					return "", errInvalidName
+				}
+				i++
+			default:
+				return "", fmt.Errorf("Syntax error in HELLO option '%s'", msg.Values[i].String())
+			}
+		}
+	}
+
+	switch {
+	case user != "":
+		if err := c.acl.Authenticate(user, pass); err != nil {
+			c.acl.Log().Add(acl.ReasonAuth, "toplevel", "AUTH", user, c.clientInfo(conn))
+			return "", errWrongPass
+		}
+		conn.SetUser(user)
+	case conn.User() == "":
+		if !c.acl.NoPassDefault() {
+			return "", errHelloNoAuth
+		}
+		conn.SetUser(acl.DefaultUser)
+	}
+
+	if setName {
+		conn.SetName(name)
+	}
+	conn.SetProto(proto)
+	msg.Proto = proto
+
+	return valueOutput(msg, resp.MapValue([]resp.Value{
+		resp.StringValue("server"), resp.StringValue("redis"),
+		resp.StringValue("version"), resp.StringValue(redisVersion),
+		resp.StringValue("proto"), resp.IntegerValue(proto),
+		resp.StringValue("id"), resp.IntegerValue(int(conn.ID)),
+		resp.StringValue("mode"), resp.StringValue("standalone"),
+		resp.StringValue("role"), resp.StringValue("master"),
+		resp.StringValue("modules"), resp.ArrayValue(nil),
+	}))
+}
+
+// OUTPUT [RESP|JSON]
+// The JSON replies of the TCP connections are a line each, OUTPUT replies
+// in the new format.
+func (c *Controller) cmdOutput(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	if conn == nil {
+		return "", errOutputHTTP
+	}
+
+	switch len(msg.Values) {
+	case 1:
+		return stringOutput(msg, strings.ToLower(conn.OutputType().String()))
+	case 2:
+	default:
+		return "", errInvalidNumberOfArguments
+	}
+
+	var output server.Type
+	switch strings.ToLower(msg.Values[1].String()) {
+	case "resp":
+		output = server.RESP
+	case "json":
+		output = server.JSON
+	default:
+		return "", errSyntax
+	}
+	conn.SetOutputType(output)
+	msg.OutputType = output
+
+	return okOutput(msg)
+}
+
+// stringOutput returns the reply of the commands which reply with a string
+func stringOutput(msg *server.Message, s string) (res string, err error) {
+	switch msg.OutputType {
+	case server.JSON:
+		return jsonOutput(s)
+	case server.RESP:
+		data, err := resp.StringValue(s).MarshalRESP()
+		if err != nil {
+			return "", err
+		}
+
+		res = string(data)
+	}
+
+	return
+}
+
+// nullOutput returns the reply of the commands which reply with null
+func nullOutput(msg *server.Message) (res string, err error) {
+	switch msg.OutputType {
+	case server.JSON:
+		return jsonOutput(nil)
+	case server.RESP:
+		data, _ := marshalValue(msg, resp.NilValue())
+		res = string(data)
+	}
+
+	return
+}
+
+// marshalValue returns the RESP reply of the value, the RESP3 types are
+// converted for the RESP2 clients.
+func marshalValue(msg *server.Message, v resp.Value) ([]byte, error) {
+	if msg.Proto < 3 {
+		v = v.RESP2()
+	}
+	return v.MarshalRESP()
+}
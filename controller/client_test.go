@@ -0,0 +1,351 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/junostorage/config"
+	"github.com/junostorage/controller/server"
+)
+
+func TestCmdClient(t *testing.T) {
+
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	conn := server.NewConn(p1)
+	other := server.NewConn(p2)
+
+	c.connsMu.Lock()
+	c.conns[conn] = true
+	c.conns[other] = true
+	c.connsMu.Unlock()
+	defer func() {
+		c.connsMu.Lock()
+		delete(c.conns, conn)
+		delete(c.conns, other)
+		c.connsMu.Unlock()
+	}()
+
+	testCases := []struct {
+		data string
+		res  string
+		err  bool
+	}{
+		{
+			data: "CLIENT ID\r\n",
+			res:  fmt.Sprintf(":%d\r\n", conn.ID),
+		},
+		{
+			data: "CLIENT GETNAME\r\n",
+			res:  "$-1\r\n",
+		},
+		{
+			data: "CLIENT SETNAME my name\r\n",
+			err:  true,
+		},
+		{
+			data: "CLIENT SETNAME worker-1\r\n",
+			res:  "+OK\r\n",
+		},
+		{
+			data: "CLIENT GETNAME\r\n",
+			res:  "$8\r\nworker-1\r\n",
+		},
+		{
+			data: "CLIENT NO-EVICT on\r\n",
+			res:  "+OK\r\n",
+		},
+		{
+			data: fmt.Sprintf("CLIENT KILL ID %d\r\n", conn.ID),
+			res:  ":0\r\n",
+		},
+		{
+			data: "CLIENT KILL 1.2.3.4:5\r\n",
+			err:  true,
+		},
+		{
+			data: "CLIENT PAUSE 10 everything\r\n",
+			err:  true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		message, err := readMessage(testCase.data)
+		if err != nil {
+			t.Fatalf("reader error:%v", err)
+		}
+
+		res, err := c.cmdClient(conn, message)
+		if testCase.err {
+			if err == nil {
+				t.Errorf("Expected error, data:%q", testCase.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("cmdClient error:%v, data:%q", err, testCase.data)
+		}
+		if res != testCase.res {
+			t.Errorf("Expected the result to be %q, but instead found it to be %q", testCase.res, res)
+		}
+	}
+
+	message, _ := readMessage(fmt.Sprintf("CLIENT LIST ID %d %d\r\n", conn.ID, other.ID))
+	res, err := c.cmdClient(conn, message)
+	if err != nil {
+		t.Fatalf("cmdClient error:%v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(res[strings.Index(res, "\r\n")+2:]), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 clients, got %q", res)
+	}
+	if want := fmt.Sprintf("id=%d addr=pipe laddr=pipe name=worker-1 ", conn.ID); !strings.HasPrefix(lines[0], want) {
+		t.Errorf("Expected %q prefix, got %q", want, lines[0])
+	}
+	if !strings.Contains(lines[0], " flags=e ") || !strings.Contains(lines[1], " flags=N ") {
+		t.Errorf("Unexpected flags %q", lines)
+	}
+
+	message, _ = readMessage(fmt.Sprintf("CLIENT KILL ID %d\r\n", other.ID))
+	if res, err = c.cmdClient(conn, message); err != nil || res != ":1\r\n" {
+		t.Errorf("Unexpected CLIENT KILL reply %q, err:%v", res, err)
+	}
+	if _, err := p1.Write([]byte("x")); err == nil {
+		t.Errorf("Expected the killed connection to be closed")
+	}
+
+}
+
+func TestClientReply(t *testing.T) {
+
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	conn := server.NewConn(p1)
+
+	send := func(data string) string {
+		var buf bytes.Buffer
+		message, err := readMessage(data)
+		if err != nil {
+			t.Fatalf("reader error:%v", err)
+		}
+		if err := c.handleInputCommand(conn, message, &buf); err != nil {
+			t.Fatalf("handleInputCommand error:%v", err)
+		}
+		return buf.String()
+	}
+
+	if res := send("CLIENT REPLY SKIP\r\n"); res != "" {
+		t.Errorf("Expected no reply, got %q", res)
+	}
+	if res := send("SET mkey 1\r\n"); res != "" {
+		t.Errorf("Expected skipped reply, got %q", res)
+	}
+	if res := send("SET mkey 1\r\n"); res != "+OK\r\n" {
+		t.Errorf("Expected reply, got %q", res)
+	}
+	if res := send("CLIENT REPLY OFF\r\n"); res != "" {
+		t.Errorf("Expected no reply, got %q", res)
+	}
+	if res := send("GET mkey\r\n"); res != "" {
+		t.Errorf("Expected muted reply, got %q", res)
+	}
+	if res := send("CLIENT REPLY ON\r\n"); res != "+OK\r\n" {
+		t.Errorf("Expected reply, got %q", res)
+	}
+
+}
+
+func TestClientPause(t *testing.T) {
+
+	var p clientPause
+	p.pause(time.Now().Add(time.Second), false)
+
+	start := time.Now()
+	p.wait(false)
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("Expected read commands not to be paused")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.unpause()
+	}()
+	p.wait(true)
+	if d := time.Since(start); d < 50*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("Expected write commands to wait for the unpause, waited %v", d)
+	}
+
+	p.pause(time.Now().Add(20*time.Millisecond), true)
+	start = time.Now()
+	p.wait(false)
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("Expected the pause to last until the timeout, waited %v", d)
+	}
+
+}
+
+func TestClientInfoUnix(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "junounix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "juno.sock")
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if nc, err := net.Dial("unix", path); err == nil {
+			defer nc.Close()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	nc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	conn := server.NewConn(nc)
+
+	info := c.clientInfo(conn)
+	if want := fmt.Sprintf(" addr=%s:0 laddr=%s:0 ", path, path); !strings.Contains(info, want) {
+		t.Errorf("Expected %q in %q", want, info)
+	}
+	if !strings.Contains(info, " flags=U ") {
+		t.Errorf("Expected the U flag in %q", info)
+	}
+}
+
+func TestClientLimits(t *testing.T) {
+
+	cfg := config.New()
+	cfg.Set("maxclients", "1")
+	cfg.Set("timeout", "1")
+	cfg.Set("client-output-buffer-limit", "pubsub 1kb 0 0")
+	dc := newController(cfg)
+	dc.applyConfig()
+
+	p1, p2 := net.Pipe()
+	defer p2.Close()
+	go io.Copy(ioutil.Discard, p2)
+	p3, p4 := net.Pipe()
+	defer p3.Close()
+	defer p4.Close()
+	conn := server.NewConn(p1)
+	if err := dc.acceptClient(conn); err != nil {
+		t.Fatalf("accept error:%v", err)
+	}
+	if err := dc.acceptClient(server.NewConn(p3)); err != errMaxClients {
+		t.Errorf("Want: %v, got: %v", errMaxClients, err)
+	}
+	if info := dc.info([]string{"stats"}); !strings.Contains(info, "rejected_connections:1\r\n") {
+		t.Errorf("Want the rejected connection in INFO:\n%s", info)
+	}
+
+	// the subscribed connections have the pubsub limits
+	if limit := dc.outputLimit(conn); limit.Hard != 0 {
+		t.Errorf("Want no limit for a normal client, got: %v", limit)
+	}
+	conn.SetPubsub(true)
+	if limit := dc.outputLimit(conn); limit.Hard != 1024 {
+		t.Errorf("Want the pubsub limit, got: %v", limit)
+	}
+
+	// the subscribers are never idle, the other clients are closed
+	conn.Touch("get", 0)
+	time.Sleep(1100 * time.Millisecond)
+	dc.closeIdleClients()
+	if _, err := p1.Write([]byte("x")); err == io.ErrClosedPipe {
+		t.Errorf("Want the subscriber kept")
+	}
+	conn.SetPubsub(false)
+	dc.closeIdleClients()
+	if _, err := p1.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("Want the idle client closed, got: %v", err)
+	}
+}
+
+func TestSlowClient(t *testing.T) {
+
+	cfg := config.New()
+	cfg.Set("client-output-buffer-limit", "normal 0 16 1")
+	dc := newController(cfg)
+	dc.applyConfig()
+
+	// the client never reads its replies
+	p1, p2 := net.Pipe()
+	defer p2.Close()
+	conn := server.NewConn(p1)
+	if err := dc.connOpened(conn); err != nil {
+		t.Fatalf("accept error:%v", err)
+	}
+	written := make(chan error)
+	go func() {
+		_, err := conn.Write(make([]byte, 32))
+		written <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	dc.checkOutputLimits()
+	if got := conn.Output(); got != 32 {
+		t.Errorf("Want the pending reply in the output, got: %d", got)
+	}
+	time.Sleep(time.Second)
+	dc.checkOutputLimits()
+	if err := <-written; err == nil || !conn.OutputLimitReached() {
+		t.Errorf("Want the client closed over the soft limit, got: %v", err)
+	}
+	dc.connClosed(conn)
+}
+
+func TestCmdOutput(t *testing.T) {
+
+	oc := newController(config.New())
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	conn := server.NewConn(p1)
+
+	testCases := []struct {
+		data string
+		res  string
+	}{
+		{"OUTPUT\r\n", "$4\r\nresp\r\n"},
+		{"OUTPUT xml\r\n", "-ERR syntax error\r\n"},
+		// OUTPUT replies in the new format, the JSON replies are a line each
+		{"OUTPUT json\r\n", "{\"status\":true}\r\n"},
+		{"SET k v\r\n", "{\"status\":true}\r\n"},
+		{"GET k\r\n", "{\"status\":true,\"value\":\"v\"}\r\n"},
+		{"PING\r\n", "{\"status\":true,\"value\":\"PONG\"}\r\n"},
+		{"OUTPUT resp json\r\n", "{\"status\":false,\"code\":\"ERR\",\"error\":\"wrong number of arguments for 'output' command\"}\r\n"},
+		{"OUTPUT resp\r\n", "+OK\r\n"},
+		{"GET k\r\n", "$1\r\nv\r\n"},
+	}
+	for _, testCase := range testCases {
+		message, err := readMessage(testCase.data)
+		if err != nil {
+			t.Fatalf("reader error:%v", err)
+		}
+		var buf bytes.Buffer
+		if err := oc.handleBatch(conn, []*server.Message{message}, &buf); err != nil {
+			t.Fatalf("handleBatch error:%v", err)
+		}
+		if res := buf.String(); res != testCase.res {
+			t.Errorf("Want: %q, got: %q, data:%q", testCase.res, res, testCase.data)
+		}
+	}
+}
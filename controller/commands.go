@@ -0,0 +1,562 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/junostorage/acl"
+	"github.com/junostorage/controller/server"
+	"github.com/junostorage/storage"
+
+	"github.com/junostorage/resp"
+)
+
+// commandFlags are the properties of a command reported by COMMAND
+type commandFlags uint
+
+const (
+	// flagWrite commands modify the dataset, they lock the shards of their keys
+	flagWrite commandFlags = 1 << iota
+	// flagReadonly commands only read the dataset
+	flagReadonly
+	// flagDenyOOM commands are rejected once maxmemory is reached
+	flagDenyOOM
+	// flagAdmin commands administer the server
+	flagAdmin
+	// flagPubsub commands are related to pub/sub
+	flagPubsub
+	// flagNoScript commands can't be called from scripts
+	flagNoScript
+	// flagFast commands run in constant time, their latency is reported
+	// as the fast-command event
+	flagFast
+	// flagNoAuth commands can be run before the client is authenticated
+	flagNoAuth
+)
+
+// commandFlagNames are the names of the flags in the COMMAND replies
+var commandFlagNames = []struct {
+	flag commandFlags
+	name string
+}{
+	{flagWrite, "write"},
+	{flagReadonly, "readonly"},
+	{flagDenyOOM, "denyoom"},
+	{flagAdmin, "admin"},
+	{flagPubsub, "pubsub"},
+	{flagNoScript, "noscript"},
+	{flagFast, "fast"},
+	{flagNoAuth, "no_auth"},
+}
+
+// commandHandler runs a command, conn is nil for the http clients
+type commandHandler func(c *Controller, conn *server.Conn, msg *server.Message) (res string, err error)
+
+// msgHandler adapts the handlers that don't use the connection
+func msgHandler(f func(c *Controller, msg *server.Message) (string, error)) commandHandler {
+	return func(c *Controller, conn *server.Conn, msg *server.Message) (string, error) {
+		return f(c, msg)
+	}
+}
+
+// command describes a command of the command table
+type command struct {
+	name string
+	// arity is the number of arguments including the command name, the
+	// minimum number when it's negative
+	arity int
+	flags commandFlags
+	// positions of the keys in the arguments, the command name is at 0.
+	// A negative lastKey counts from the end of the arguments.
+	firstKey, lastKey, step int
+	// categories are the ACL categories besides the ones given by the
+	// flags, e.g. string or connection
+	categories []string
+	group      string
+	summary    string
+	// exclusive commands run under the controller write lock as they
+	// modify the controller state, e.g. CONFIG
+	exclusive bool
+	// handler runs the command, the subcommands are dispatched by the
+	// handler of their parent
+	handler     commandHandler
+	subcommands []*command
+	// parent is set for the subcommands
+	parent *command
+}
+
+// fullName returns the name of the command, subcommands are prefixed with
+// their parent and '|', e.g. config|get
+func (cmd *command) fullName() string {
+	if cmd.parent != nil {
+		return cmd.parent.name + "|" + cmd.name
+	}
+	return cmd.name
+}
+
+// aclCategories returns all the ACL categories of the command
+func (cmd *command) aclCategories() []string {
+	var cats []string
+	if cmd.flags&flagWrite != 0 {
+		cats = append(cats, "write")
+	}
+	if cmd.flags&flagReadonly != 0 {
+		cats = append(cats, "read")
+	}
+	if cmd.flags&flagAdmin != 0 {
+		cats = append(cats, "admin", "dangerous")
+	}
+	if cmd.flags&flagPubsub != 0 {
+		cats = append(cats, "pubsub")
+	}
+	if cmd.flags&flagFast != 0 {
+		cats = append(cats, "fast")
+	} else {
+		cats = append(cats, "slow")
+	}
+	for _, cat := range cmd.categories {
+		if !containsString(cats, cat) {
+			cats = append(cats, cat)
+		}
+	}
+	return cats
+}
+
+// aclCommand returns the description of the command for the ACL checks
+func (cmd *command) aclCommand() acl.Command {
+	return acl.Command{
+		Name:       cmd.fullName(),
+		Categories: cmd.aclCategories(),
+		FirstKey:   cmd.firstKey,
+		LastKey:    cmd.lastKey,
+		Step:       cmd.step,
+		Write:      cmd.flags&flagWrite != 0,
+	}
+}
+
+// keys returns the keys in the arguments of the command
+func (cmd *command) keys(args []string) []string {
+	aclCmd := cmd.aclCommand()
+	return aclCmd.Keys(args)
+}
+
+// checkArity reports whether the number of arguments matches the arity
+func (cmd *command) checkArity(n int) bool {
+	if cmd.arity < 0 {
+		return n >= -cmd.arity
+	}
+	return n == cmd.arity
+}
+
+// commandTable holds the commands served by the controller
+var commandTable = []*command{
+	{name: "ping", arity: -1, flags: flagFast, categories: []string{"connection"}, group: "connection",
+		summary: "Returns the server's liveliness response.", handler: (*Controller).cmdPing},
+	{name: storage.CmdAuth, arity: -2, flags: flagFast | flagNoAuth | flagNoScript, categories: []string{"connection"}, group: "connection",
+		summary: "Authenticates the connection.", handler: (*Controller).cmdAuth},
+	{name: storage.CmdHello, arity: -1, flags: flagFast | flagNoAuth | flagNoScript, categories: []string{"connection"}, group: "connection",
+		summary: "Handshakes with the server.", handler: (*Controller).cmdHello},
+	{name: storage.CmdOutput, arity: -1, flags: flagFast | flagNoAuth | flagNoScript, categories: []string{"connection"}, group: "connection",
+		summary: "Returns or sets the format of the replies, RESP or JSON.", handler: (*Controller).cmdOutput},
+	{name: storage.CmdGet, arity: 2, flags: flagReadonly | flagFast, firstKey: 1, lastKey: 1, step: 1, categories: []string{"string"}, group: "string",
+		summary: "Returns the string value of a key.", handler: msgHandler((*Controller).cmdGet)},
+	{name: storage.CmdSet, arity: -3, flags: flagWrite | flagDenyOOM, firstKey: 1, lastKey: 1, step: 1, categories: []string{"string"}, group: "string",
+		summary: "Sets the string value of a key.", handler: msgHandler((*Controller).cmdSet)},
+	{name: storage.CmdKeys, arity: 2, flags: flagReadonly, categories: []string{"keyspace", "dangerous"}, group: "generic",
+		summary: "Returns all key names that match a pattern.", handler: msgHandler((*Controller).cmdKeys)},
+	{name: storage.CmdDel, arity: -2, flags: flagWrite, firstKey: 1, lastKey: -1, step: 1, categories: []string{"keyspace"}, group: "generic",
+		summary: "Deletes one or more keys.", handler: msgHandler((*Controller).cmdDel)},
+	{name: storage.CmdExpire, arity: 3, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, step: 1, categories: []string{"keyspace"}, group: "generic",
+		summary: "Sets the expiration time of a key in seconds.", handler: msgHandler((*Controller).cmdExpire)},
+	{name: storage.CmdMove, arity: 3, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, step: 1, categories: []string{"keyspace"}, group: "generic",
+		summary: "Moves a key to another database.", handler: msgHandler((*Controller).cmdMove)},
+	{name: storage.CmdSelect, arity: 2, flags: flagFast, categories: []string{"connection"}, group: "connection",
+		summary: "Changes the selected database.", handler: (*Controller).cmdSelect},
+	{name: storage.CmdSwapdb, arity: 3, flags: flagWrite | flagFast, categories: []string{"keyspace", "dangerous"}, group: "server",
+		summary: "Swaps two databases.", handler: msgHandler((*Controller).cmdSwapdb)},
+	{name: storage.CmdFlushdb, arity: -1, flags: flagWrite, categories: []string{"keyspace", "dangerous"}, group: "server",
+		summary: "Removes all keys from the current database.", handler: msgHandler((*Controller).cmdFlushdb)},
+	{name: storage.CmdFlushall, arity: -1, flags: flagWrite, categories: []string{"keyspace", "dangerous"}, group: "server",
+		summary: "Removes all keys from all databases.", handler: msgHandler((*Controller).cmdFlushall)},
+	{name: storage.CmdHset, arity: 4, flags: flagWrite | flagDenyOOM | flagFast, firstKey: 1, lastKey: 1, step: 1, categories: []string{"hash"}, group: "hash",
+		summary: "Sets the value of a field in a hash.", handler: msgHandler((*Controller).cmdHset)},
+	{name: storage.CmdHget, arity: 3, flags: flagReadonly | flagFast, firstKey: 1, lastKey: 1, step: 1, categories: []string{"hash"}, group: "hash",
+		summary: "Returns the value of a field in a hash.", handler: msgHandler((*Controller).cmdHget)},
+	{name: storage.CmdHgetAll, arity: 2, flags: flagReadonly, firstKey: 1, lastKey: 1, step: 1, categories: []string{"hash"}, group: "hash",
+		summary: "Returns all fields and values in a hash.", handler: msgHandler((*Controller).cmdHgetAll)},
+	{name: storage.CmdHdel, arity: -3, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, step: 1, categories: []string{"hash"}, group: "hash",
+		summary: "Deletes one or more fields and their values from a hash.", handler: msgHandler((*Controller).cmdHdel)},
+	{name: storage.CmdLpush, arity: -3, flags: flagWrite | flagDenyOOM | flagFast, firstKey: 1, lastKey: 1, step: 1, categories: []string{"list"}, group: "list",
+		summary: "Prepends one or more elements to a list.", handler: msgHandler((*Controller).cmdLpush)},
+	{name: storage.CmdLpop, arity: 2, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, step: 1, categories: []string{"list"}, group: "list",
+		summary: "Returns the first element of a list after removing it.", handler: msgHandler((*Controller).cmdLpop)},
+	{name: storage.CmdLindex, arity: 3, flags: flagReadonly, firstKey: 1, lastKey: 1, step: 1, categories: []string{"list"}, group: "list",
+		summary: "Returns an element from a list by its index.", handler: msgHandler((*Controller).cmdLIndex)},
+	{name: storage.CmdLlen, arity: 2, flags: flagReadonly | flagFast, firstKey: 1, lastKey: 1, step: 1, categories: []string{"list"}, group: "list",
+		summary: "Returns the length of a list.", handler: msgHandler((*Controller).cmdLen)},
+	{name: storage.CmdMemory, arity: -2, group: "server",
+		summary: "A container for memory diagnostics commands.", handler: msgHandler((*Controller).cmdMemory),
+		subcommands: []*command{
+			{name: "usage", arity: -3, flags: flagReadonly, firstKey: 2, lastKey: 2, step: 1, group: "server",
+				summary: "Estimates the memory usage of a key."},
+			{name: "stats", arity: 2, group: "server", summary: "Returns details about memory usage."},
+			{name: "doctor", arity: 2, group: "server", summary: "Outputs a memory problems report."},
+		}},
+	{name: storage.CmdInfo, arity: -1, categories: []string{"dangerous"}, group: "server",
+		summary: "Returns information and statistics about the server.", handler: msgHandler((*Controller).cmdInfo)},
+	{name: storage.CmdMonitor, arity: 1, flags: flagAdmin | flagNoScript, group: "server",
+		summary: "Listens for all requests received by the server in real-time.", handler: (*Controller).cmdMonitor},
+	{name: storage.CmdSave, arity: 1, flags: flagAdmin | flagNoScript, group: "server",
+		summary: "Synchronously saves the databases to disk.", handler: msgHandler((*Controller).cmdSave)},
+	{name: storage.CmdShutdown, arity: -1, flags: flagAdmin | flagNoScript, group: "server",
+		summary: "Synchronously saves the databases to disk and shuts down the server.", handler: (*Controller).cmdShutdown},
+	{name: storage.CmdConfig, arity: -2, flags: flagAdmin | flagNoScript, group: "server", exclusive: true,
+		summary: "A container for server configuration commands.", handler: msgHandler((*Controller).cmdConfig),
+		subcommands: []*command{
+			{name: "get", arity: -3, flags: flagAdmin | flagNoScript, group: "server",
+				summary: "Returns the effective values of configuration parameters."},
+			{name: "set", arity: -4, flags: flagAdmin | flagNoScript, group: "server",
+				summary: "Sets configuration parameters in-flight."},
+			{name: "rewrite", arity: 2, flags: flagAdmin | flagNoScript, group: "server",
+				summary: "Persists the effective configuration to file."},
+			{name: "resetstat", arity: 2, flags: flagAdmin | flagNoScript, group: "server",
+				summary: "Resets the server's statistics."},
+		}},
+	{name: storage.CmdSlowlog, arity: -2, flags: flagAdmin, group: "server",
+		summary: "A container for slow log commands.", handler: msgHandler((*Controller).cmdSlowlog),
+		subcommands: []*command{
+			{name: "get", arity: -2, flags: flagAdmin, group: "server", summary: "Returns the slow log's entries."},
+			{name: "len", arity: 2, flags: flagAdmin, group: "server", summary: "Returns the number of entries in the slow log."},
+			{name: "reset", arity: 2, flags: flagAdmin, group: "server", summary: "Clears all entries from the slow log."},
+		}},
+	{name: storage.CmdLatency, arity: -2, flags: flagAdmin, group: "server",
+		summary: "A container for latency diagnostics commands.", handler: msgHandler((*Controller).cmdLatency),
+		subcommands: []*command{
+			{name: "latest", arity: 2, flags: flagAdmin, group: "server", summary: "Returns the latest latency samples for all events."},
+			{name: "history", arity: 3, flags: flagAdmin, group: "server", summary: "Returns timestamp-latency samples for an event."},
+			{name: "reset", arity: -2, flags: flagAdmin, group: "server", summary: "Resets the latency data for one or more events."},
+			{name: "doctor", arity: 2, flags: flagAdmin, group: "server", summary: "Returns a human-readable latency analysis report."},
+		}},
+	{name: storage.CmdClient, arity: -2, categories: []string{"connection"}, group: "connection",
+		summary: "A container for client connection commands.", handler: (*Controller).cmdClient,
+		subcommands: []*command{
+			{name: "id", arity: 2, categories: []string{"connection"}, group: "connection", summary: "Returns the unique client ID of the connection."},
+			{name: "info", arity: 2, categories: []string{"connection"}, group: "connection", summary: "Returns information about the connection."},
+			{name: "setname", arity: 3, categories: []string{"connection"}, group: "connection", summary: "Sets the connection name."},
+			{name: "getname", arity: 2, categories: []string{"connection"}, group: "connection", summary: "Returns the name of the connection."},
+			{name: "reply", arity: 3, categories: []string{"connection"}, group: "connection", summary: "Instructs the server whether to reply to commands."},
+			{name: "tracking", arity: -3, categories: []string{"connection"}, group: "connection", summary: "Controls server-assisted client-side caching for the connection."},
+			{name: "caching", arity: 3, categories: []string{"connection"}, group: "connection", summary: "Instructs the server whether to track the keys in the next request."},
+			{name: "getredir", arity: 2, categories: []string{"connection"}, group: "connection", summary: "Returns the client ID to which the connection's tracking notifications are redirected."},
+			{name: "trackinginfo", arity: 2, categories: []string{"connection"}, group: "connection", summary: "Returns information about server-assisted client-side caching for the connection."},
+			{name: "list", arity: -2, flags: flagAdmin | flagNoScript, categories: []string{"connection"}, group: "connection", summary: "Lists open connections."},
+			{name: "kill", arity: -3, flags: flagAdmin | flagNoScript, categories: []string{"connection"}, group: "connection", summary: "Terminates open connections."},
+			{name: "pause", arity: -3, flags: flagAdmin | flagNoScript, categories: []string{"connection"}, group: "connection", summary: "Suspends commands processing."},
+			{name: "unpause", arity: 2, flags: flagAdmin | flagNoScript, categories: []string{"connection"}, group: "connection", summary: "Resumes processing commands from paused clients."},
+			{name: "no-evict", arity: 3, flags: flagAdmin | flagNoScript, categories: []string{"connection"}, group: "connection", summary: "Sets the client eviction mode of the connection."},
+		}},
+	{name: storage.CmdSubscribe, arity: -2, flags: flagPubsub | flagNoScript, group: "pubsub",
+		summary: "Listens for messages published to channels.", handler: (*Controller).cmdSubscribe},
+	{name: storage.CmdUnsubscribe, arity: -1, flags: flagPubsub | flagNoScript, group: "pubsub",
+		summary: "Stops listening to messages posted to channels.", handler: (*Controller).cmdUnsubscribe},
+	{name: storage.CmdPsubscribe, arity: -2, flags: flagPubsub | flagNoScript, group: "pubsub",
+		summary: "Listens for messages published to channels that match one or more patterns.", handler: (*Controller).cmdSubscribe},
+	{name: storage.CmdPunsubscribe, arity: -1, flags: flagPubsub | flagNoScript, group: "pubsub",
+		summary: "Stops listening to messages published to channels that match one or more patterns.", handler: (*Controller).cmdUnsubscribe},
+	{name: storage.CmdPublish, arity: 3, flags: flagPubsub | flagFast, group: "pubsub",
+		summary: "Posts a message to a channel.", handler: (*Controller).cmdPublish},
+	{name: storage.CmdPubsub, arity: -2, group: "pubsub",
+		summary: "A container for pub/sub commands.", handler: msgHandler((*Controller).cmdPubsub),
+		subcommands: []*command{
+			{name: "channels", arity: -2, flags: flagPubsub, group: "pubsub", summary: "Returns the active channels."},
+			{name: "numsub", arity: -2, flags: flagPubsub, group: "pubsub", summary: "Returns a count of subscribers to channels."},
+			{name: "numpat", arity: 2, flags: flagPubsub, group: "pubsub", summary: "Returns a count of unique pattern subscriptions."},
+		}},
+	{name: storage.CmdACL, arity: -2, flags: flagAdmin | flagNoScript, group: "server",
+		summary: "A container for Access List Control commands.", handler: (*Controller).cmdACL,
+		subcommands: []*command{
+			{name: "setuser", arity: -3, flags: flagAdmin | flagNoScript, group: "server", summary: "Creates and modifies an ACL user and its rules."},
+			{name: "getuser", arity: 3, flags: flagAdmin | flagNoScript, group: "server", summary: "Lists the ACL rules of a user."},
+			{name: "deluser", arity: -3, flags: flagAdmin | flagNoScript, group: "server", summary: "Deletes ACL users, and terminates their connections."},
+			{name: "list", arity: 2, flags: flagAdmin | flagNoScript, group: "server", summary: "Dumps the effective rules in ACL file format."},
+			{name: "users", arity: 2, flags: flagAdmin | flagNoScript, group: "server", summary: "Lists all ACL users."},
+			{name: "whoami", arity: 2, flags: flagNoScript, group: "server", summary: "Returns the authenticated username of the current connection."},
+			{name: "cat", arity: -2, flags: flagNoScript, group: "server", summary: "Lists the ACL categories, or the commands inside a category."},
+			{name: "dryrun", arity: -4, flags: flagAdmin | flagNoScript, group: "server", summary: "Simulates the execution of a command by a user, without executing the command."},
+			{name: "log", arity: -2, flags: flagAdmin | flagNoScript, group: "server", summary: "Lists recent security events generated due to ACL rules."},
+			{name: "load", arity: 2, flags: flagAdmin | flagNoScript, group: "server", summary: "Reloads the rules from the configured ACL file."},
+			{name: "save", arity: 2, flags: flagAdmin | flagNoScript, group: "server", summary: "Saves the effective ACL rules in the configured ACL file."},
+		}},
+	{name: storage.CmdCommand, arity: -1, categories: []string{"connection"}, group: "server",
+		summary: "Returns detailed information about all commands.", handler: msgHandler((*Controller).cmdCommand),
+		subcommands: []*command{
+			{name: "count", arity: 2, categories: []string{"connection"}, group: "server", summary: "Returns a count of commands."},
+			{name: "info", arity: -2, categories: []string{"connection"}, group: "server", summary: "Returns information about one, multiple or all commands."},
+			{name: "docs", arity: -2, categories: []string{"connection"}, group: "server", summary: "Returns documentary information about one, multiple or all commands."},
+			{name: "getkeys", arity: -3, categories: []string{"connection"}, group: "server", summary: "Extracts the key names from an arbitrary command."},
+			{name: "list", arity: -2, categories: []string{"connection"}, group: "server", summary: "Returns a list of command names."},
+		}},
+}
+
+// commands holds the command table by name, the subcommands are found
+// through their parent
+var commands = make(map[string]*command)
+
+func init() {
+	for _, cmd := range commandTable {
+		commands[cmd.name] = cmd
+		for _, sub := range cmd.subcommands {
+			sub.parent = cmd
+		}
+	}
+}
+
+// lookupCommand returns the command of the arguments, the subcommand when
+// the command has one matching the second argument.
+func lookupCommand(args []resp.Value) (*command, bool) {
+	if len(args) == 0 {
+		return nil, false
+	}
+	cmd, ok := commands[strings.ToLower(args[0].String())]
+	if !ok {
+		return nil, false
+	}
+	if len(args) > 1 {
+		if sub := cmd.subcommand(args[1].String()); sub != nil {
+			return sub, true
+		}
+	}
+	return cmd, true
+}
+
+// subcommand returns the subcommand with the name, nil if there's none
+func (cmd *command) subcommand(name string) *command {
+	name = strings.ToLower(name)
+	for _, sub := range cmd.subcommands {
+		if sub.name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// aclCommands describes the commands and subcommands for the ACL rules
+func aclCommands() []acl.Command {
+	var list []acl.Command
+	for _, cmd := range sortedCommands() {
+		list = append(list, cmd.aclCommand())
+		for _, sub := range cmd.subcommands {
+			list = append(list, sub.aclCommand())
+		}
+	}
+	return list
+}
+
+// sortedCommands returns the commands sorted by name
+func sortedCommands() []*command {
+	list := make([]*command, 0, len(commands))
+	for _, cmd := range commands {
+		list = append(list, cmd)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// commandInfo returns the COMMAND INFO reply of the command
+func commandInfo(cmd *command) resp.Value {
+	var flags []resp.Value
+	for _, f := range commandFlagNames {
+		if cmd.flags&f.flag != 0 {
+			flags = append(flags, resp.SimpleStringValue(f.name))
+		}
+	}
+	var cats []resp.Value
+	for _, cat := range cmd.aclCategories() {
+		cats = append(cats, resp.SimpleStringValue("@"+cat))
+	}
+	subs := make([]resp.Value, 0, len(cmd.subcommands))
+	for _, sub := range cmd.subcommands {
+		subs = append(subs, commandInfo(sub))
+	}
+
+	return resp.ArrayValue([]resp.Value{
+		resp.StringValue(cmd.fullName()),
+		resp.IntegerValue(cmd.arity),
+		resp.SetValue(flags),
+		resp.IntegerValue(cmd.firstKey),
+		resp.IntegerValue(cmd.lastKey),
+		resp.IntegerValue(cmd.step),
+		resp.SetValue(cats),
+		resp.SetValue(nil),
+		resp.ArrayValue(keySpecs(cmd)),
+		resp.ArrayValue(subs),
+	})
+}
+
+// keySpecs returns the key specifications of the command, the keys are
+// found from an index up to an offset from the first key or from the end.
+func keySpecs(cmd *command) []resp.Value {
+	if cmd.firstKey <= 0 {
+		return nil
+	}
+	access := []resp.Value{resp.SimpleStringValue("RO"), resp.SimpleStringValue("access")}
+	if cmd.flags&flagWrite != 0 {
+		access = []resp.Value{resp.SimpleStringValue("RW"), resp.SimpleStringValue("update")}
+	}
+	lastKey := cmd.lastKey
+	if lastKey >= 0 {
+		lastKey -= cmd.firstKey
+	}
+
+	return []resp.Value{resp.MapValue([]resp.Value{
+		resp.StringValue("flags"), resp.SetValue(access),
+		resp.StringValue("begin_search"), resp.MapValue([]resp.Value{
+			resp.StringValue("type"), resp.StringValue("index"),
+			resp.StringValue("spec"), resp.MapValue([]resp.Value{
+				resp.StringValue("index"), resp.IntegerValue(cmd.firstKey),
+			}),
+		}),
+		resp.StringValue("find_keys"), resp.MapValue([]resp.Value{
+			resp.StringValue("type"), resp.StringValue("range"),
+			resp.StringValue("spec"), resp.MapValue([]resp.Value{
+				resp.StringValue("lastkey"), resp.IntegerValue(lastKey),
+				resp.StringValue("keystep"), resp.IntegerValue(cmd.step),
+				resp.StringValue("limit"), resp.IntegerValue(0),
+			}),
+		}),
+	})}
+}
+
+// commandDocs returns the COMMAND DOCS reply of the command
+func commandDocs(cmd *command) resp.Value {
+	docs := []resp.Value{
+		resp.StringValue("summary"), resp.StringValue(cmd.summary),
+		resp.StringValue("group"), resp.StringValue(cmd.group),
+	}
+	if len(cmd.subcommands) > 0 {
+		subs := make([]resp.Value, 0, len(cmd.subcommands)*2)
+		for _, sub := range cmd.subcommands {
+			subs = append(subs, resp.StringValue(sub.fullName()), commandDocs(sub))
+		}
+		docs = append(docs, resp.StringValue("subcommands"), resp.MapValue(subs))
+	}
+	return resp.MapValue(docs)
+}
+
+// COMMAND [COUNT | INFO [command ...] | DOCS [command ...] | GETKEYS command [arg ...] | LIST]
+func (c *Controller) cmdCommand(msg *server.Message) (res string, err error) {
+
+	var v resp.Value
+	if len(msg.Values) == 1 {
+		vals := make([]resp.Value, 0, len(commands))
+		for _, cmd := range sortedCommands() {
+			vals = append(vals, commandInfo(cmd))
+		}
+		return valueOutput(msg, resp.ArrayValue(vals))
+	}
+
+	switch strings.ToLower(msg.Values[1].String()) {
+	default:
+		return "", fmt.Errorf("unknown subcommand '%s'. Try COMMAND HELP.", msg.Values[1].String())
+	case "count":
+		if len(msg.Values) != 2 {
+			return "", errInvalidNumberOfArguments
+		}
+		return integerOutput(msg, len(commands))
+	case "list":
+		names := make([]string, 0, len(commands))
+		for _, cmd := range sortedCommands() {
+			names = append(names, cmd.name)
+		}
+		return stringsOutput(msg, names)
+	case "info":
+		var vals []resp.Value
+		if len(msg.Values) == 2 {
+			for _, cmd := range sortedCommands() {
+				vals = append(vals, commandInfo(cmd))
+			}
+		}
+		for _, name := range msg.Values[2:] {
+			cmd, ok := lookupCommandName(name.String())
+			if !ok {
+				vals = append(vals, resp.NilValue())
+				continue
+			}
+			vals = append(vals, commandInfo(cmd))
+		}
+		v = resp.ArrayValue(vals)
+	case "docs":
+		var vals []resp.Value
+		names := msg.Values[2:]
+		if len(names) == 0 {
+			for _, cmd := range sortedCommands() {
+				names = append(names, resp.StringValue(cmd.name))
+			}
+		}
+		for _, name := range names {
+			if cmd, ok := lookupCommandName(name.String()); ok {
+				vals = append(vals, resp.StringValue(cmd.fullName()), commandDocs(cmd))
+			}
+		}
+		v = resp.MapValue(vals)
+	case "getkeys":
+		if len(msg.Values) < 3 {
+			return "", errInvalidNumberOfArguments
+		}
+		args := msg.Values[2:]
+		cmd, ok := lookupCommand(args)
+		if !ok {
+			return "", errors.New("Invalid command specified")
+		}
+		if !cmd.checkArity(len(args)) {
+			return "", errors.New("Invalid number of arguments specified for command")
+		}
+		keys := cmd.keys(stringArgs(args))
+		if len(keys) == 0 {
+			return "", errors.New("The command has no key arguments")
+		}
+		return stringsOutput(msg, keys)
+	}
+
+	return valueOutput(msg, v)
+}
+
+// lookupCommandName returns the command by name, "parent|sub" names the
+// subcommands
+func lookupCommandName(name string) (*command, bool) {
+	parts := strings.SplitN(strings.ToLower(name), "|", 2)
+	cmd, ok := commands[parts[0]]
+	if !ok || len(parts) == 1 {
+		return cmd, ok
+	}
+	sub := cmd.subcommand(parts[1])
+	return sub, sub != nil
+}
+
+// valueOutput returns the reply of the value
+func valueOutput(msg *server.Message, v resp.Value) (res string, err error) {
+	switch msg.OutputType {
+	case server.JSON:
+		return jsonOutput(jsonData(v))
+	case server.RESP:
+		data, err := marshalValue(msg, v)
+		if err != nil {
+			return "", err
+		}
+
+		res = string(data)
+	}
+
+	return
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
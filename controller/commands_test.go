@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCommandTable(t *testing.T) {
+
+	for _, cmd := range commandTable {
+		if cmd.handler == nil {
+			t.Errorf("Command %s has no handler", cmd.name)
+		}
+		if cmd.arity == 0 {
+			t.Errorf("Command %s has no arity", cmd.name)
+		}
+		if cmd.flags&flagWrite != 0 && cmd.flags&flagReadonly != 0 {
+			t.Errorf("Command %s is both write and readonly", cmd.name)
+		}
+		for _, sub := range cmd.subcommands {
+			if sub.parent != cmd {
+				t.Errorf("Subcommand %s has no parent", sub.fullName())
+			}
+		}
+	}
+
+	if !requiresAuth("get") || requiresAuth("auth") || requiresAuth("hello") {
+		t.Errorf("Unexpected requiresAuth")
+	}
+}
+
+func TestCommand(t *testing.T) {
+
+	testCases := []struct {
+		data string
+		res  string
+		// prefix only checks the start of the reply
+		prefix bool
+	}{
+		{"COMMAND COUNT\r\n", fmt.Sprintf(":%d\r\n", len(commandTable)), false},
+		{"COMMAND INFO get nosuch\r\n", "*2\r\n*10\r\n$3\r\nget\r\n:2\r\n*2\r\n+readonly\r\n+fast\r\n:1\r\n:1\r\n:1\r\n*3\r\n+@read\r\n+@fast\r\n+@string\r\n*0\r\n", true},
+		{"COMMAND GETKEYS set k v\r\n", "*1\r\n$1\r\nk\r\n", false},
+		{"COMMAND GETKEYS memory usage k\r\n", "*1\r\n$1\r\nk\r\n", false},
+		{"COMMAND GETKEYS nosuch k\r\n", "-ERR Invalid command specified\r\n", false},
+		{"COMMAND GETKEYS get k v\r\n", "-ERR Invalid number of arguments specified for command\r\n", false},
+		{"COMMAND GETKEYS ping\r\n", "-ERR The command has no key arguments\r\n", false},
+		{"COMMAND DOCS get\r\n", "*2\r\n$3\r\nget\r\n*4\r\n$7\r\nsummary\r\n$34\r\nReturns the string value of a key.\r\n$5\r\ngroup\r\n$6\r\nstring\r\n", false},
+		{"GET\r\n", "-ERR wrong number of arguments for 'get' command\r\n", false},
+		{"CONFIG GET\r\n", "-ERR wrong number of arguments for 'config' command\r\n", false},
+		{"NOSUCH\r\n", "-ERR unknown command 'NOSUCH'\r\n", false},
+	}
+
+	for _, testCase := range testCases {
+		var buf bytes.Buffer
+		message, err := readMessage(testCase.data)
+		if err != nil {
+			t.Fatalf("reader error:%v", err)
+		}
+		if err := c.handleInputCommand(nil, message, &buf); err != nil {
+			t.Fatalf("handleInputCommand error:%v", err)
+		}
+		res := buf.String()
+		if testCase.prefix {
+			if !strings.HasPrefix(res, testCase.res) {
+				t.Errorf("Expected %q for %q, got %q", testCase.res, testCase.data, res)
+			}
+			continue
+		}
+		if res != testCase.res {
+			t.Errorf("Expected %q for %q, got %q", testCase.res, testCase.data, res)
+		}
+	}
+}
+
+func TestCommandKeySpecs(t *testing.T) {
+
+	cmd, _ := lookupCommandName("del")
+	specs := keySpecs(cmd)
+	if len(specs) != 1 {
+		t.Fatalf("Expected 1 key spec, got %d", len(specs))
+	}
+	spec := specs[0].Map()
+	if flags := spec["flags"].Array(); len(flags) != 2 || flags[0].String() != "RW" {
+		t.Errorf("Unexpected flags %v", flags)
+	}
+	if lastKey := spec["find_keys"].Map()["spec"].Map()["lastkey"].Integer(); lastKey != -1 {
+		t.Errorf("Expected lastkey -1, got %d", lastKey)
+	}
+
+	cmd, ok := lookupCommandName("config|get")
+	if !ok || cmd.fullName() != "config|get" {
+		t.Fatalf("Expected config|get, got %v", cmd)
+	}
+	if keySpecs(cmd) != nil {
+		t.Errorf("Expected no key specs for config|get")
+	}
+}
@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/junostorage/controller/server"
+	"github.com/junostorage/storage"
+
+	"github.com/junostorage/resp"
+)
+
+// applyLogging sets the log level and output. It's only called at startup
+// as the logger is used without a lock.
+func (c *Controller) applyLogging() error {
+	switch c.config.String("loglevel") {
+	case "debug":
+		logs.Level = logrus.DebugLevel
+	case "verbose", "notice":
+		logs.Level = logrus.InfoLevel
+	case "warning":
+		logs.Level = logrus.WarnLevel
+	}
+
+	if path := c.config.String("logfile"); path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		c.logfile = f
+		logs.Out = f
+	}
+	return nil
+}
+
+// applyConfig applies the configuration parameters that take effect outside
+// of the command handlers. It's called at startup and after CONFIG SET.
+func (c *Controller) applyConfig() error {
+	c.acl.Log().SetMaxLen(int(c.config.Int("acllog-max-len")))
+	c.store.SetMaxMemory(c.maxmemory(), storage.EvictionPolicy(c.config.String("maxmemory-policy")))
+	c.store.SetPath(c.dbPath())
+	rules, err := parseSaveRules(c.config.String("save"))
+	if err != nil {
+		return err
+	}
+	c.saveRules = rules
+	c.outputLimits.Store(c.config.OutputBufferLimits())
+	return c.applyRequirePass()
+}
+
+// maxmemory returns the memory limit in bytes, zero means no limit.
+func (c *Controller) maxmemory() int64 {
+	return c.config.Int("maxmemory")
+}
+
+func (c *Controller) cmdConfig(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) < 2 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	switch strings.ToLower(msg.Values[1].String()) {
+	default:
+		err = fmt.Errorf("unknown subcommand '%s'. Try CONFIG HELP.", msg.Values[1].String())
+	case "get":
+		res, err = c.cmdConfigGet(msg)
+	case "set":
+		res, err = c.cmdConfigSet(msg)
+	case "rewrite":
+		res, err = c.cmdConfigRewrite(msg)
+	case "resetstat":
+		res, err = c.cmdConfigResetStat(msg)
+	}
+	return
+}
+
+// CONFIG GET parameter [parameter ...]
+func (c *Controller) cmdConfigGet(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) < 3 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	var pairs []string
+	seen := make(map[string]bool)
+	for _, v := range msg.Values[2:] {
+		p := c.config.Get(v.String())
+		for i := 0; i < len(p); i += 2 {
+			if !seen[p[i]] {
+				seen[p[i]] = true
+				pairs = append(pairs, p[i], p[i+1])
+			}
+		}
+	}
+
+	vals := make([]resp.Value, 0, len(pairs))
+	for _, p := range pairs {
+		vals = append(vals, resp.StringValue(p))
+	}
+
+	return valueOutput(msg, resp.MapValue(vals))
+}
+
+// CONFIG SET parameter value [parameter value ...]
+// All the parameters are validated before any of them is changed.
+func (c *Controller) cmdConfigSet(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) < 4 || len(msg.Values)%2 != 0 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	check := c.config.Clone()
+	for i := 2; i < len(msg.Values); i += 2 {
+		if err = check.Set(msg.Values[i].String(), msg.Values[i+1].String()); err != nil {
+			return
+		}
+	}
+	for i := 2; i < len(msg.Values); i += 2 {
+		c.config.Set(msg.Values[i].String(), msg.Values[i+1].String())
+	}
+	if err = c.applyConfig(); err != nil {
+		return
+	}
+
+	return okOutput(msg)
+}
+
+func (c *Controller) cmdConfigRewrite(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 2 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	if err = c.config.Rewrite(); err != nil {
+		return
+	}
+
+	return okOutput(msg)
+}
+
+func (c *Controller) cmdConfigResetStat(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 2 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	c.stats.reset()
+	c.store.ResetStats()
+
+	return okOutput(msg)
+}
+
+// okOutput returns the reply of the commands which only report success
+func okOutput(msg *server.Message) (res string, err error) {
+	switch msg.OutputType {
+	case server.JSON:
+		res = `{"status":true}`
+	case server.RESP:
+		data, err := resp.SimpleStringValue("OK").MarshalRESP()
+		if err != nil {
+			return "", err
+		}
+
+		res = string(data)
+	}
+
+	return
+}
@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"testing"
+)
+
+func TestCmdConfig(t *testing.T) {
+
+	testCases := []struct {
+		data string
+		res  string
+		err  bool
+	}{
+		{
+			data: "CONFIG GET maxmemory-policy\r\n",
+			res:  "*2\r\n$16\r\nmaxmemory-policy\r\n$10\r\nnoeviction\r\n",
+		},
+		{
+			data: "CONFIG SET slowlog-max-len 64 timeout 10\r\n",
+			res:  "+OK\r\n",
+		},
+		{
+			data: "CONFIG GET slowlog-max-len timeout\r\n",
+			res:  "*4\r\n$15\r\nslowlog-max-len\r\n$2\r\n64\r\n$7\r\ntimeout\r\n$2\r\n10\r\n",
+		},
+		{
+			data: "CONFIG SET loglevel warning\r\n",
+			err:  true,
+		},
+		{
+			data: "CONFIG SET timeout 20 port 7000\r\n",
+			err:  true,
+		},
+		{
+			data: "CONFIG GET timeout\r\n",
+			res:  "*2\r\n$7\r\ntimeout\r\n$2\r\n10\r\n",
+		},
+		{
+			data: "CONFIG SET slowlog-max-len 128 timeout 0\r\n",
+			res:  "+OK\r\n",
+		},
+		{
+			data: "CONFIG REWRITE\r\n",
+			err:  true,
+		},
+		{
+			data: "CONFIG RESETSTAT\r\n",
+			res:  "+OK\r\n",
+		},
+	}
+
+	for _, testCase := range testCases {
+		message, err := readMessage(testCase.data)
+		if err != nil {
+			t.Fatalf("reader error:%v", err)
+		}
+
+		res, err := c.cmdConfig(message)
+		if testCase.err {
+			if err == nil {
+				t.Errorf("Expected error, data:%q", testCase.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("cmdConfig error:%v, data:%q", err, testCase.data)
+		}
+		if res != testCase.res {
+			t.Errorf("Expected the result to be %q, but instead found it to be %q", testCase.res, res)
+		}
+	}
+
+}
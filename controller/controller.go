@@ -1,16 +1,23 @@
 package controller
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"runtime"
+	"os"
+	"os/signal"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/junostorage/acl"
+	"github.com/junostorage/config"
 	"github.com/junostorage/logger"
 
 	"github.com/junostorage/controller/server"
@@ -21,60 +28,166 @@ import (
 
 var (
 	errInvalidNumberOfArguments = errors.New("invalid number of arguments")
+	errMonitorHTTP              = errors.New("MONITOR is not supported over HTTP")
 	logs                        *logrus.Logger
 )
 
-const (
-	//@TODO feature read maxmem value from conf file
-	maxmem = 1024 * 1024 * 1024 // 1GB
-)
+// errUnknownCommand is returned for the commands the server doesn't implement
+type errUnknownCommand struct {
+	name string
+}
+
+func (err errUnknownCommand) Error() string {
+	return fmt.Sprintf("unknown command '%s'", err.name)
+}
+
+// errReply is an error replied with its own code instead of ERR, e.g.
+// NOAUTH or OOM
+type errReply struct {
+	code string
+	msg  string
+}
+
+func (err errReply) Error() string {
+	return err.code + " " + err.msg
+}
 
 // Controller struct
 type Controller struct {
-	mu                     sync.RWMutex
-	host                   string
-	port                   int
-	conns                  map[*server.Conn]bool
-	statsTotalConns        int
-	stopBackgroundExpiring bool
-	stopWatchingMemory     bool
-	outOfMemory            bool
-	cache                  *storage.MemoryCache
+	mu      sync.RWMutex
+	config  *config.Config
+	logfile *os.File
+	host    string
+	port    int
+	// connsMu guards the connections apart from c.mu so the accepted and
+	// closed connections never wait for the running commands
+	connsMu    sync.Mutex
+	conns      map[*server.Conn]bool
+	stats      *stats
+	slowlog    *slowlog
+	latency    *latencyMonitor
+	monitorsMu sync.Mutex
+	monitors   map[*server.Conn]*monitor
+	pubsub     *pubsub
+	tracking   *tracking
+	pause      clientPause
+	store      *storage.Store
+	saveRules  []saveRule
+	acl        *acl.ACL
+	// the requirepass password set on the default user
+	requirepass string
+	// the client-output-buffer-limit of the client classes, read by the
+	// writes of the connections
+	outputLimits atomic.Value
+	// shutdownc takes the SHUTDOWN requests, shuttingDown is set once the
+	// shutdown can't be aborted anymore and done is closed once it's over.
+	// shuttingDown is set under both c.mu and connsMu.
+	shutdownc    chan *shutdownRequest
+	abortc       chan struct{}
+	shutdownBusy int32
+	shuttingDown bool
+	done         chan struct{}
 }
 
 func init() {
 	logs = logger.GetLogger()
 }
 
-// ListenAndServe starts a new server
-func ListenAndServe(host string, port int, httpPort int) error {
-	return ListenAndServeEx(host, port, httpPort, nil)
+func newController(cfg *config.Config) *Controller {
+	c := &Controller{
+		config:   cfg,
+		conns:    make(map[*server.Conn]bool),
+		stats:    newStats(),
+		slowlog:  &slowlog{},
+		latency:  newLatencyMonitor(),
+		monitors: make(map[*server.Conn]*monitor),
+		pubsub:   newPubsub(),
+		tracking: newTracking(),
+		acl:      acl.New()}
+	c.shutdownc = make(chan *shutdownRequest)
+	c.abortc = make(chan struct{}, 1)
+	c.done = make(chan struct{})
+	c.acl.SetCommands(aclCommands())
+	c.store = storage.NewStore(storage.Options{
+		Databases: int(cfg.Int("databases")),
+		MaxMemory: c.maxmemory(),
+		Eviction:  storage.EvictionPolicy(cfg.String("maxmemory-policy")),
+		Path:      c.dbPath(),
+		OnExpire:  c.keyExpired,
+		OnEvict:   c.keyEvicted,
+	})
+	return c
 }
 
-// ListenAndServeEx function
-func ListenAndServeEx(host string, port int, httpPort int, ln *net.Listener) error {
+// ListenAndServe starts a new server, it's shut down on SIGTERM and SIGINT
+func ListenAndServe(cfg *config.Config) error {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigc)
+	return listenAndServe(cfg, nil, sigc)
+}
 
-	c := &Controller{
-		host:  host,
-		port:  port,
-		conns: make(map[*server.Conn]bool),
-		cache: storage.New()}
+// ListenAndServeEx starts a new server, ln is set to the listener of the
+// RESP port or of the TLS port. It returns once the server is shut down
+// with SHUTDOWN, or with the error of a listener, e.g. when ln is closed.
+func ListenAndServeEx(cfg *config.Config, ln *net.Listener) error {
+	return listenAndServe(cfg, ln, nil)
+}
 
-	// watch memory
-	go c.watchMemory()
-	// expire checker
-	go c.backgroundExpiring()
+func listenAndServe(cfg *config.Config, ln *net.Listener, sigc <-chan os.Signal) error {
+
+	host := cfg.String("bind")
+	port := int(cfg.Int("port"))
+	httpPort := int(cfg.Int("http-port"))
+	tlsPort := int(cfg.Int("tls-port"))
+	tlsHttpPort := int(cfg.Int("tls-http-port"))
+	unixSocket := cfg.String("unixsocket")
+	if port == 0 && tlsPort == 0 && unixSocket == "" {
+		return errors.New("nothing to listen on, port and tls-port are 0 and unixsocket is not set")
+	}
+	unixSocketPerm, err := strconv.ParseUint(cfg.String("unixsocketperm"), 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid unixsocketperm '%s'", cfg.String("unixsocketperm"))
+	}
+
+	c := newController(cfg)
+	c.host = host
+	c.port = port
+	if err := c.applyLogging(); err != nil {
+		return err
+	}
+
+	if path := cfg.String("aclfile"); path != "" {
+		if err := c.acl.LoadFile(path); err != nil {
+			return err
+		}
+	}
+	if c.dbPath() != "" {
+		if err := c.store.Load(); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := c.applyConfig(); err != nil {
+		return err
+	}
+	// every client holds a file descriptor, maxclients is lowered to the
+	// open files limit so that accepting them doesn't fail
+	if max, n := cfg.Int("maxclients"), fittingClients(cfg.Int("maxclients")); n < max {
+		logs.Warnf("maxclients lowered from %d to %d to fit the open files limit, %d file descriptors are reserved for the server",
+			max, n, reservedFDs)
+		cfg.Set("maxclients", strconv.FormatInt(n, 10))
+	}
 
-	defer func() {
-		c.mu.Lock()
-		c.stopBackgroundExpiring = true
-		c.stopWatchingMemory = true
-		c.mu.Unlock()
-	}()
+	var tlsConfig *tls.Config
+	if tlsPort != 0 || tlsHttpPort != 0 {
+		if tlsConfig, err = c.tlsConfig(); err != nil {
+			return err
+		}
+	}
 
-	handler := func(conn *server.Conn, msg *server.Message, rd *server.AnyReaderWriter, w io.Writer) error {
+	handler := func(conn *server.Conn, msgs []*server.Message, w io.Writer) error {
 
-		err := c.handleInputCommand(conn, msg, w)
+		err := c.handleBatch(conn, msgs, w)
 		if err != nil {
 			logs.Errorf("handler error:%v", err)
 			return err
@@ -92,59 +205,199 @@ func ListenAndServeEx(host string, port int, httpPort int, ln *net.Listener) err
 		return nil
 	}
 
-	opened := func(conn *server.Conn) {
-		c.mu.Lock()
-		c.conns[conn] = true
-		c.statsTotalConns++
-		c.mu.Unlock()
+	opened, closed := c.connOpened, c.connClosed
+
+	// the listeners are opened before serving so that they are closed by
+	// the shutdown, the port 0 disables a listener
+	var listeners []net.Listener
+	listen := func(l net.Listener, err error) error {
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
+		return nil
+	}
+	var plainLn, unixLn, tlsLn net.Listener
+	if port != 0 {
+		if err := listen(net.Listen("tcp", fmt.Sprintf("%s:%d", host, port))); err != nil {
+			return err
+		}
+		plainLn = listeners[len(listeners)-1]
+	}
+	if unixSocket != "" {
+		if err := listen(server.ListenUnix(unixSocket, os.FileMode(unixSocketPerm))); err != nil {
+			return err
+		}
+		unixLn = listeners[len(listeners)-1]
+	}
+	if tlsPort != 0 {
+		if err := listen(tls.Listen("tcp", fmt.Sprintf("%s:%d", host, tlsPort), tlsConfig)); err != nil {
+			return err
+		}
+		tlsLn = listeners[len(listeners)-1]
+	}
+	// ln is the plain listener when there is one
+	if ln != nil {
+		*ln = plainLn
+		if plainLn == nil {
+			*ln = tlsLn
+		}
+	}
+
+	// expire checker
+	go c.backgroundExpiring()
+
+	routes := []server.Route{
+		{Pattern: "/metrics", Handler: http.HandlerFunc(c.metricsHandler)},
+		{Pattern: "/batch", Handler: http.HandlerFunc(c.batchHandler)},
+		{Pattern: "/ws", Handler: c.connHandler(server.ServeWebSocket, handler)},
+		{Pattern: "/subscribe/", Handler: c.connHandler(server.ServeEvents, handler)},
+	}
+
+	var httpServers []*http.Server
+	if httpPort != 0 {
+		s := server.NewHttpServer(host, httpPort, httpHandler, routes...)
+		httpServers = append(httpServers, s)
+		go func() {
+			logs.Infof("The http server listening port %d", httpPort)
+			if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logs.Errorf("http server error:%v", err)
+			}
+		}()
+	}
+	if tlsHttpPort != 0 {
+		s := server.NewHttpServer(host, tlsHttpPort, httpHandler, routes...)
+		s.TLSConfig = tlsConfig
+		httpServers = append(httpServers, s)
+		go func() {
+			logs.Infof("The https server listening port %d", tlsHttpPort)
+			if err := s.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				logs.Errorf("https server error:%v", err)
+			}
+		}()
+	}
+
+	errc := make(chan error, 3)
+	if plainLn != nil {
+		go func() {
+			// the epoll event loop serves the idle connections without a
+			// goroutine each, Linux only
+			if cfg.String("network-model") == "epoll" {
+				logs.Infof("The server is now ready to accept connections on port %d with an event loop", port)
+				errc <- server.ServeEventLoop(plainLn, int(cfg.Int("io-threads")), handler, opened, closed)
+				return
+			}
+			logs.Infof("The server is now ready to accept connections on port %d", port)
+			errc <- server.Serve(plainLn, handler, opened, closed)
+		}()
 	}
-	closed := func(conn *server.Conn) {
-		c.mu.Lock()
-		delete(c.conns, conn)
-		c.mu.Unlock()
+	if unixLn != nil {
+		go func() {
+			logs.Infof("The server is now ready to accept connections at %s", unixSocket)
+			errc <- server.Serve(unixLn, handler, opened, closed)
+		}()
+	}
+	if tlsLn != nil {
+		go func() {
+			logs.Infof("The server is now ready to accept TLS connections on port %d", tlsPort)
+			errc <- server.Serve(tlsLn, handler, opened, closed)
+		}()
 	}
 
-	//run http server
-	go server.ListenHttpServer(host, httpPort, httpHandler)
+	for {
+		select {
+		case err := <-errc:
+			c.stop(listeners, httpServers)
+			return err
+
+		case req := <-c.shutdownc:
+			err := c.prepareShutdown(req)
+			req.done <- err
+			if err == nil {
+				c.stop(listeners, httpServers)
+				return nil
+			}
 
-	return server.ListenAndServe(host, port, handler, opened, closed, ln)
+		case sig := <-sigc:
+			logs.Warnf("Received %v scheduling shutdown...", sig)
+			if err := c.prepareShutdown(&shutdownRequest{}); err != nil {
+				logs.Errorf("%v received but errors trying to shut down the server, check the logs for more information", sig)
+				continue
+			}
+			c.stop(listeners, httpServers)
+			return nil
+		}
+	}
 }
 
 func (c *Controller) handleInputCommand(conn *server.Conn, msg *server.Message, w io.Writer) error {
+	return c.runCommand(conn, msg, w, false)
+}
+
+// runCommand runs a command and writes its reply. The admitted commands
+// were let through CLIENT PAUSE by handleBatch, which holds the controller
+// read lock.
+func (c *Controller) runCommand(conn *server.Conn, msg *server.Message, w io.Writer, admitted bool) error {
+
+	// CLIENT REPLY OFF|SKIP mutes the replies of the connection
+	muted := conn != nil && conn.Reply != server.ReplyOn
+	if conn != nil && conn.Reply == server.ReplySkip {
+		conn.Reply = server.ReplyOn
+	}
 
 	writeOutput := func(res string) error {
+		if muted {
+			return nil
+		}
 		switch msg.ConnType {
 		default:
 			err := fmt.Errorf("unsupported conn type: %v", msg.ConnType)
 			return err
 
 		case server.HTTP:
-			fmt.Fprintf(w, res)
+			_, err := io.WriteString(w, res)
+			return err
 
-		case server.Telnet:
+		case server.Telnet, server.WebSocket:
+			// the JSON replies of a stream are a line each
+			if msg.OutputType == server.JSON && conn != nil && !conn.Framed() {
+				res += "\r\n"
+			}
+			// the replies of a subscriber keep their order with the
+			// frames pushed to it
+			if conn != nil && w == io.Writer(conn) && c.pubsub.reply(conn, res) {
+				return nil
+			}
 			_, err := io.WriteString(w, res)
 			return err
 
 		}
-		return nil
-	}
-	// Ping. Just send back the response.
-	if msg.Command == "ping" {
-		switch msg.OutputType {
-		case server.RESP:
-			return writeOutput("+PONG\r\n")
-		}
-		return nil
 	}
 
 	writeErr := func(err error) error {
+		if rw, ok := w.(http.ResponseWriter); ok {
+			status := httpStatus(err)
+			if status == http.StatusUnauthorized {
+				rw.Header().Set("WWW-Authenticate", `Basic realm="juno"`)
+			}
+			rw.WriteHeader(status)
+		}
 		switch msg.OutputType {
 		case server.JSON:
-			return writeOutput(fmt.Sprintf(`{"status":false, "error":"%v"}`, err))
+			if err == errInvalidNumberOfArguments {
+				err = fmt.Errorf("wrong number of arguments for '%s' command", msg.Command)
+			}
+			return writeOutput(jsonErrorOutput(err))
 		case server.RESP:
 			if err == errInvalidNumberOfArguments {
 				return writeOutput("-ERR wrong number of arguments for '" + msg.Command + "' command\r\n")
 			}
+			if _, ok := err.(errReply); ok {
+				return writeOutput("-" + err.Error() + "\r\n")
+			}
 			v, _ := resp.ErrorValue(errors.New("ERR " + err.Error())).MarshalRESP()
 			return writeOutput(string(v))
 		}
@@ -152,146 +405,195 @@ func (c *Controller) handleInputCommand(conn *server.Conn, msg *server.Message,
 		return nil
 	}
 
-	// choose the locking strategy
-	switch msg.Command {
-	default:
-		c.mu.RLock()
-		defer c.mu.RUnlock()
-
-	case storage.CmdSet,
-		storage.CmdDel,
-		storage.CmdHset,
-		storage.CmdHdel,
-		storage.CmdLpush,
-		storage.CmdLpop,
-		storage.CmdExpire:
-		// write operations
-		c.mu.Lock()
-		defer c.mu.Unlock()
-
-	case storage.CmdGet,
-		storage.CmdKeys,
-		storage.CmdHget,
-		storage.CmdHgetAll,
-		storage.CmdLindex,
-		storage.CmdLlen:
-		// read operations
-		c.mu.RLock()
-		defer c.mu.RUnlock()
+	if err := c.authorize(conn, msg); err != nil {
+		c.stats.recordCommand(msg.Command, 0, err, true)
+		return writeErr(err)
+	}
 
+	// RESP2 subscribed connections only run the pub/sub commands
+	if err := c.checkSubscribed(conn, msg); err != nil {
+		c.stats.recordCommand(msg.Command, 0, err, true)
+		return writeErr(err)
 	}
 
-	res, err := c.command(msg, w)
-	if err != nil {
+	cmd, ok := lookupCommand(msg.Values)
+	if !ok {
+		err := errUnknownCommand{msg.Values[0].String()}
+		c.stats.recordCommand(msg.Command, 0, err, false)
 		logs.Errorf("command error:%v", err)
 		return writeErr(err)
 	}
+	if !cmd.checkArity(len(msg.Values)) {
+		c.stats.recordCommand(msg.Command, 0, errInvalidNumberOfArguments, true)
+		return writeErr(errInvalidNumberOfArguments)
+	}
+	root := cmd
+	if cmd.parent != nil {
+		root = cmd.parent
+	}
 
-	if res != "" {
-		if err := writeOutput(res); err != nil {
-			return err
+	// Ping. Just send back the response.
+	if root.name == "ping" {
+		c.stats.recordCommand(msg.Command, 0, nil, false)
+		c.feedMonitors(conn, msg)
+		res, _ := root.handler(c, conn, msg)
+		if res == "" {
+			return nil
 		}
+		return writeOutput(res)
 	}
 
-	return nil
-}
-
-func (c *Controller) command(msg *server.Message, w io.Writer) (res string, err error) {
-	switch msg.Command {
-	default:
-		err = fmt.Errorf("unknown command '%s'", msg.Values[0])
-	case storage.CmdGet:
-		res, err = c.cmdGet(msg)
-
-	case storage.CmdSet:
-		res, err = c.cmdSet(msg)
+	// Shutdown. The running commands are drained so it doesn't hold the
+	// lock.
+	if root.name == storage.CmdShutdown {
+		res, err := root.handler(c, conn, msg)
+		c.stats.recordCommand(msg.Command, 0, err, false)
+		if err != nil {
+			return writeErr(err)
+		}
+		if res == "" {
+			return nil
+		}
+		return writeOutput(res)
+	}
 
-	case storage.CmdKeys:
-		res, err = c.cmdKeys(msg)
+	// Monitor. The connection receives the processed commands from now on.
+	if root.name == storage.CmdMonitor {
+		res, err := root.handler(c, conn, msg)
+		if err != nil {
+			return writeErr(err)
+		}
+		if err := writeOutput(res); err != nil {
+			return err
+		}
+		c.addMonitor(conn)
+		return nil
+	}
 
-	case storage.CmdHset:
-		res, err = c.cmdHset(msg)
+	if !admitted {
+		// CLIENT PAUSE holds the commands, CLIENT itself is let through
+		// so the clients can be unpaused
+		if root.name != storage.CmdClient {
+			c.pause.wait(cmd.flags&flagWrite != 0)
+		}
 
-	case storage.CmdHget:
-		res, err = c.cmdHget(msg)
+		// choose the locking strategy, the keyspace is guarded by the
+		// shards of the store so c.mu only guards the controller state
+		switch {
+		default:
+			c.mu.RLock()
+			defer c.mu.RUnlock()
 
-	case storage.CmdHgetAll:
-		res, err = c.cmdHgetAll(msg)
+		case root.exclusive:
+			c.mu.Lock()
+			defer c.mu.Unlock()
 
-	case storage.CmdHdel:
-		res, err = c.cmdHdel(msg)
+		}
+	}
 
-	case storage.CmdDel:
-		res, err = c.cmdDel(msg)
+	// the commands waiting for the lock during the shutdown aren't run
+	if c.shuttingDown {
+		c.stats.recordCommand(msg.Command, 0, errShuttingDown, true)
+		return writeErr(errShuttingDown)
+	}
 
-	case storage.CmdLpush:
-		res, err = c.cmdLpush(msg)
+	// reject commands that may grow the dataset over the memory limit
+	if cmd.flags&flagDenyOOM != 0 && c.outOfMemory() {
+		c.stats.recordCommand(msg.Command, 0, errOutOfMemory, true)
+		return writeErr(errOutOfMemory)
+	}
 
-	case storage.CmdLindex:
-		res, err = c.cmdLIndex(msg)
+	start := time.Now()
+	res, err := root.handler(c, conn, msg)
+	elapsed := time.Since(start)
+	// the memory may be filled by a concurrent write after the check above
+	if err == storage.ErrOutOfMemory {
+		err = errOutOfMemory
+	}
+	c.stats.recordCommand(msg.Command, elapsed, err, err == errInvalidNumberOfArguments)
+	if err != errInvalidNumberOfArguments {
+		c.feedMonitors(conn, msg)
+	}
+	c.slowlog.record(msg, elapsed, clientAddr(conn, msg), clientName(conn),
+		c.config.Int("slowlog-log-slower-than"), c.config.Int("slowlog-max-len"))
+	event := latencyCommand
+	if cmd.flags&flagFast != 0 {
+		event = latencyFastCommand
+	}
+	c.latency.record(event, elapsed, c.config.Int("latency-monitor-threshold"))
+	// CLIENT REPLY ON is answered
+	if muted && conn.Reply == server.ReplyOn && root.name == storage.CmdClient {
+		muted = false
+	}
+	if err != nil {
+		logs.Errorf("command error:%v", err)
+		return writeErr(err)
+	}
+	c.trackCommand(conn, msg, cmd)
 
-	case storage.CmdLlen:
-		res, err = c.cmdLen(msg)
+	if res != "" {
+		if err := writeOutput(res); err != nil {
+			return err
+		}
+	}
 
-	case storage.CmdLpop:
-		res, err = c.cmdLpop(msg)
+	return nil
+}
 
-	case storage.CmdExpire:
-		res, err = c.cmdExpire(msg)
+// cmdPing replies PONG, subscribed RESP2 connections get a pong message
+func (c *Controller) cmdPing(conn *server.Conn, msg *server.Message) (res string, err error) {
+	switch msg.OutputType {
+	case server.JSON:
+		return jsonOutput("PONG")
+	case server.RESP:
+		if conn != nil && conn.Proto() < 3 && c.pubsub.subscribed(conn) {
+			return "*2\r\n$4\r\npong\r\n$0\r\n\r\n", nil
+		}
+		return "+PONG\r\n", nil
+	}
+	return "", nil
+}
 
+// cmdMonitor accepts the connection as a monitor, it's added once the
+// reply is written
+func (c *Controller) cmdMonitor(conn *server.Conn, msg *server.Message) (res string, err error) {
+	if conn == nil {
+		return "", errMonitorHTTP
 	}
-	return
+	return okOutput(msg)
 }
 
-// backgroundExpiring watches for when items must expire from the cache
+// backgroundExpiring watches for when items must expire from the cache,
+// until the server is shut down
 func (c *Controller) backgroundExpiring() {
 	t := time.NewTicker(time.Second * 2)
 	defer t.Stop()
 
-	for range t.C {
-		c.mu.Lock()
-		if c.stopBackgroundExpiring {
-			c.mu.Unlock()
+	for {
+		select {
+		case <-c.done:
 			return
+		case <-t.C:
 		}
 
-		keys := c.cache.ExpireList()
-		for _, k := range keys {
-			if c.cache.IsExpire(k) {
-				c.cache.Del(k)
-			}
-		}
-		c.mu.Unlock()
-
-	}
-}
-
-func (c *Controller) watchMemory() {
-	t := time.NewTicker(time.Second * 2)
-	defer t.Stop()
-	var mem runtime.MemStats
-
-	for range t.C {
-		func() {
-			c.mu.RLock()
-			if c.stopWatchingMemory {
-				c.mu.RUnlock()
-				return
-			}
-
-			oom := c.outOfMemory
+		// the shards are locked one at a time, c.mu is only read locked
+		// for the invalidations of the expired keys
+		c.mu.RLock()
+		if c.shuttingDown {
 			c.mu.RUnlock()
+			return
+		}
 
-			if oom {
-				// runs a garbage collection
-				runtime.GC()
-			}
-			runtime.ReadMemStats(&mem)
+		start := time.Now()
+		c.store.DeleteExpired()
+		rules := c.saveRules
+		c.mu.RUnlock()
+		c.saveIfNeeded(rules)
+		c.closeIdleClients()
+		c.checkOutputLimits()
+		c.latency.record(latencyExpireCycle, time.Since(start), c.config.Int("latency-monitor-threshold"))
 
-			c.mu.Lock()
-			c.outOfMemory = int(mem.HeapAlloc) > maxmem
-			c.mu.Unlock()
+		c.stats.sampleOps()
 
-		}()
 	}
 }
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package controller
+
+import (
+	"syscall"
+	"time"
+)
+
+// cpuUsage returns the system and user CPU time consumed by the process
+func cpuUsage() (sys, user time.Duration) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, 0
+	}
+	return time.Duration(ru.Stime.Nano()), time.Duration(ru.Utime.Nano())
+}
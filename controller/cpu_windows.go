@@ -0,0 +1,10 @@
+package controller
+
+import (
+	"time"
+)
+
+// cpuUsage is not supported on windows
+func cpuUsage() (sys, user time.Duration) {
+	return 0, 0
+}
@@ -1,7 +1,9 @@
 package controller
 
 import (
-	"fmt"
+	"errors"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/junostorage/controller/server"
@@ -10,6 +12,20 @@ import (
 	"github.com/junostorage/resp"
 )
 
+var (
+	errInvalidExpire = errors.New("invalid expire time in 'set' command")
+	errNotInteger    = errors.New("value is not an integer or out of range")
+)
+
+// integerArg parses an integer argument of a command
+func integerArg(v resp.Value) (int, error) {
+	n, err := strconv.Atoi(v.String())
+	if err != nil {
+		return 0, errNotInteger
+	}
+	return n, nil
+}
+
 func (c *Controller) cmdGet(msg *server.Message) (res string, err error) {
 
 	if len(msg.Values) != 2 {
@@ -18,11 +34,11 @@ func (c *Controller) cmdGet(msg *server.Message) (res string, err error) {
 	}
 
 	key := msg.Values[1].String()
-	value, err := c.cache.Get(key)
+	value, err := c.db(msg).Get(key)
 	if err != nil {
 
 		if err == storage.ErrNullValue {
-			data, _ := resp.NullValue().MarshalRESP()
+			data, _ := marshalValue(msg, resp.NilValue())
 
 			if msg.OutputType == server.RESP {
 				return string(data), nil
@@ -34,7 +50,7 @@ func (c *Controller) cmdGet(msg *server.Message) (res string, err error) {
 
 	switch msg.OutputType {
 	case server.JSON:
-		res = fmt.Sprintf(`{"status":true, "value":"%v"}`, value)
+		return jsonOutput(value)
 	case server.RESP:
 		data, err := resp.StringValue(value).MarshalRESP()
 		if err != nil {
@@ -47,9 +63,10 @@ func (c *Controller) cmdGet(msg *server.Message) (res string, err error) {
 	return
 }
 
+// SET key value [NX|XX] [EX seconds|PX milliseconds]
 func (c *Controller) cmdSet(msg *server.Message) (res string, err error) {
 
-	if len(msg.Values) != 3 {
+	if len(msg.Values) < 3 {
 		err = errInvalidNumberOfArguments
 		return
 	}
@@ -57,9 +74,64 @@ func (c *Controller) cmdSet(msg *server.Message) (res string, err error) {
 	key := msg.Values[1].String()
 	value := msg.Values[2].String()
 
-	if err = c.cache.Set(key, value); err != nil {
+	var nx, xx bool
+	var ttl time.Duration
+	for i := 3; i < len(msg.Values); i++ {
+		switch opt := strings.ToLower(msg.Values[i].String()); opt {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "ex", "px":
+			if ttl != 0 || i+1 == len(msg.Values) {
+				return "", errSyntax
+			}
+			i++
+			n, err := integerArg(msg.Values[i])
+			if err != nil {
+				return "", err
+			}
+			if n <= 0 {
+				return "", errInvalidExpire
+			}
+			ttl = time.Duration(n) * time.Millisecond
+			if opt == "ex" {
+				ttl = time.Duration(n) * time.Second
+			}
+		default:
+			return "", errSyntax
+		}
+	}
+	if nx && xx {
+		return "", errSyntax
+	}
+
+	// the condition and the expiration are applied with the key locked
+	done := false
+	err = c.store.UpdateKeys([]string{key}, func(tx *storage.Tx) error {
+		db := tx.DB(msg.DB)
+		if nx || xx {
+			_, err := db.Get(key)
+			exists := err != storage.ErrNullValue
+			if nx && exists || xx && !exists {
+				return nil
+			}
+		}
+		if err := db.Set(key, value); err != nil {
+			return err
+		}
+		if ttl > 0 {
+			db.SetTTL(key, ttl)
+		}
+		done = true
+		return nil
+	})
+	if err != nil {
 		return
 	}
+	if !done {
+		return nullOutput(msg)
+	}
 
 	switch msg.OutputType {
 	case server.JSON:
@@ -79,20 +151,30 @@ func (c *Controller) cmdSet(msg *server.Message) (res string, err error) {
 
 func (c *Controller) cmdDel(msg *server.Message) (res string, err error) {
 
-	if len(msg.Values) != 2 {
+	if len(msg.Values) < 2 {
 		err = errInvalidNumberOfArguments
 		return
 	}
 
-	val := 0
-	key := msg.Values[1].String()
-	if ok := c.cache.Del(key); ok {
-		val = 1
+	// the keys are deleted at once, their shards are locked in order
+	keys := make([]string, 0, len(msg.Values)-1)
+	for _, v := range msg.Values[1:] {
+		keys = append(keys, v.String())
 	}
+	val := 0
+	c.store.UpdateKeys(keys, func(tx *storage.Tx) error {
+		db := tx.DB(msg.DB)
+		for _, key := range keys {
+			if db.Del(key) {
+				val++
+			}
+		}
+		return nil
+	})
 
 	switch msg.OutputType {
 	case server.JSON:
-		res = fmt.Sprintf(`{"status":true, "value":"%v"}`, val)
+		return jsonOutput(val)
 	case server.RESP:
 		data, err := resp.IntegerValue(val).MarshalRESP()
 		if err != nil {
@@ -117,7 +199,7 @@ func (c *Controller) cmdHset(msg *server.Message) (res string, err error) {
 	field := msg.Values[2].String()
 	value := msg.Values[3].String()
 
-	if err = c.cache.HSet(key, field, value); err != nil {
+	if err = c.db(msg).HSet(key, field, value); err != nil {
 		return
 	}
 	switch msg.OutputType {
@@ -146,11 +228,11 @@ func (c *Controller) cmdHget(msg *server.Message) (res string, err error) {
 	key := msg.Values[1].String()
 	field := msg.Values[2].String()
 
-	value, err := c.cache.HGet(key, field)
+	value, err := c.db(msg).HGet(key, field)
 	if err != nil {
 
 		if err == storage.ErrNullValue {
-			data, _ := resp.NullValue().MarshalRESP()
+			data, _ := marshalValue(msg, resp.NilValue())
 
 			if msg.OutputType == server.RESP {
 				return string(data), nil
@@ -163,7 +245,7 @@ func (c *Controller) cmdHget(msg *server.Message) (res string, err error) {
 
 	switch msg.OutputType {
 	case server.JSON:
-		res = fmt.Sprintf(`{"status":true, "field":"%v", "value":"%v"}`, field, value)
+		return jsonOutput(value)
 	case server.RESP:
 		data, err := resp.StringValue(value).MarshalRESP()
 		if err != nil {
@@ -184,7 +266,7 @@ func (c *Controller) cmdHgetAll(msg *server.Message) (res string, err error) {
 
 	key := msg.Values[1].String()
 
-	values, err := c.cache.HGetAll(key)
+	values, err := c.db(msg).HGetAll(key)
 
 	if err != nil && err != storage.ErrNullValue {
 		return "", err
@@ -197,9 +279,9 @@ func (c *Controller) cmdHgetAll(msg *server.Message) (res string, err error) {
 
 	switch msg.OutputType {
 	case server.JSON:
-		res = fmt.Sprintf(`{"status":true, "value":"%v"}`, vals)
+		return jsonOutput(jsonObject(vals))
 	case server.RESP:
-		data, err := resp.ArrayValue(vals).MarshalRESP()
+		data, err := marshalValue(msg, resp.MapValue(vals))
 		if err != nil {
 			return "", err
 		}
@@ -223,7 +305,7 @@ func (c *Controller) cmdHdel(msg *server.Message) (res string, err error) {
 		fields = append(fields, v.String())
 	}
 
-	n, err := c.cache.HDel(key, fields...)
+	n, err := c.db(msg).HDel(key, fields...)
 	if err != nil {
 
 		if err == storage.ErrNullValue {
@@ -240,7 +322,7 @@ func (c *Controller) cmdHdel(msg *server.Message) (res string, err error) {
 
 	switch msg.OutputType {
 	case server.JSON:
-		res = fmt.Sprintf(`{"status":true, "value":%v}`, n)
+		return jsonOutput(n)
 	case server.RESP:
 		data, err := resp.IntegerValue(n).MarshalRESP()
 		if err != nil {
@@ -266,7 +348,16 @@ func (c *Controller) cmdLpush(msg *server.Message) (res string, err error) {
 		list = append(list, v.String())
 	}
 
-	err = c.cache.LPush(key, list...)
+	// the length is read with the key still locked
+	n := 0
+	err = c.store.UpdateKeys([]string{key}, func(tx *storage.Tx) error {
+		db := tx.DB(msg.DB)
+		if err := db.LPush(key, list...); err != nil {
+			return err
+		}
+		n, _ = db.Llen(key)
+		return nil
+	})
 	if err != nil {
 
 		if err == storage.ErrNullValue {
@@ -280,11 +371,9 @@ func (c *Controller) cmdLpush(msg *server.Message) (res string, err error) {
 		return "", err
 	}
 
-	n, _ := c.cache.Llen(key)
-
 	switch msg.OutputType {
 	case server.JSON:
-		res = fmt.Sprintf(`{"status":true, "value":%v}`, n)
+		return jsonOutput(n)
 	case server.RESP:
 		data, err := resp.IntegerValue(n).MarshalRESP()
 		if err != nil {
@@ -307,7 +396,7 @@ func (c *Controller) cmdLen(msg *server.Message) (res string, err error) {
 
 	key := msg.Values[1].String()
 
-	n, err := c.cache.Llen(key)
+	n, err := c.db(msg).Llen(key)
 	if err != nil {
 
 		if err == storage.ErrNullValue {
@@ -323,7 +412,7 @@ func (c *Controller) cmdLen(msg *server.Message) (res string, err error) {
 
 	switch msg.OutputType {
 	case server.JSON:
-		res = fmt.Sprintf(`{"status":true, "value":%v}`, n)
+		return jsonOutput(n)
 	case server.RESP:
 		data, err := resp.IntegerValue(n).MarshalRESP()
 		if err != nil {
@@ -345,13 +434,16 @@ func (c *Controller) cmdLIndex(msg *server.Message) (res string, err error) {
 	}
 
 	key := msg.Values[1].String()
-	index := msg.Values[2].Integer()
+	index, err := integerArg(msg.Values[2])
+	if err != nil {
+		return "", err
+	}
 
-	value, err := c.cache.Lindex(key, index)
+	value, err := c.db(msg).Lindex(key, index)
 	if err != nil {
 
 		if err == storage.ErrNullValue {
-			data, _ := resp.NullValue().MarshalRESP()
+			data, _ := marshalValue(msg, resp.NilValue())
 
 			if msg.OutputType == server.RESP {
 				return string(data), nil
@@ -363,7 +455,7 @@ func (c *Controller) cmdLIndex(msg *server.Message) (res string, err error) {
 
 	switch msg.OutputType {
 	case server.JSON:
-		res = fmt.Sprintf(`{"status":true, "value":"%v"}`, value)
+		return jsonOutput(value)
 	case server.RESP:
 		data, err := resp.StringValue(value).MarshalRESP()
 		if err != nil {
@@ -385,11 +477,11 @@ func (c *Controller) cmdLpop(msg *server.Message) (res string, err error) {
 
 	key := msg.Values[1].String()
 
-	value, err := c.cache.LPop(key)
+	value, err := c.db(msg).LPop(key)
 	if err != nil {
 
 		if err == storage.ErrNullValue {
-			data, _ := resp.NullValue().MarshalRESP()
+			data, _ := marshalValue(msg, resp.NilValue())
 
 			if msg.OutputType == server.RESP {
 				return string(data), nil
@@ -402,7 +494,7 @@ func (c *Controller) cmdLpop(msg *server.Message) (res string, err error) {
 
 	switch msg.OutputType {
 	case server.JSON:
-		res = fmt.Sprintf(`{"status":true, "value":"%v"}`, value)
+		return jsonOutput(value)
 	case server.RESP:
 		data, err := resp.StringValue(value).MarshalRESP()
 		if err != nil {
@@ -424,7 +516,7 @@ func (c *Controller) cmdKeys(msg *server.Message) (res string, err error) {
 
 	pattern := msg.Values[1].String()
 
-	values, err := c.cache.Keys(pattern)
+	values, err := c.db(msg).Keys(pattern)
 	if err != nil {
 		return "", err
 	}
@@ -436,7 +528,7 @@ func (c *Controller) cmdKeys(msg *server.Message) (res string, err error) {
 
 	switch msg.OutputType {
 	case server.JSON:
-		res = fmt.Sprintf(`{"status":true, "value":"%v"}`, vals)
+		return jsonOutput(jsonData(resp.ArrayValue(vals)))
 	case server.RESP:
 		data, err := resp.ArrayValue(vals).MarshalRESP()
 		if err != nil {
@@ -457,9 +549,19 @@ func (c *Controller) cmdExpire(msg *server.Message) (res string, err error) {
 	}
 
 	key := msg.Values[1].String()
-	value := msg.Values[2].Integer()
+	value, err := integerArg(msg.Values[2])
+	if err != nil {
+		return "", err
+	}
 
-	if err = c.cache.SetTTL(key, time.Duration(value)*time.Second); err != nil {
+	// a key expiring now or in the past is deleted
+	db := c.db(msg)
+	if value > 0 {
+		err = db.SetTTL(key, time.Duration(value)*time.Second)
+	} else if !db.Del(key) {
+		err = storage.ErrNullValue
+	}
+	if err != nil {
 		if err == storage.ErrNullValue {
 			data, _ := resp.IntegerValue(0).MarshalRESP()
 
@@ -473,7 +575,7 @@ func (c *Controller) cmdExpire(msg *server.Message) (res string, err error) {
 
 	switch msg.OutputType {
 	case server.JSON:
-		res = fmt.Sprintf(`{"status":true, "value":%v}`, 1)
+		return jsonOutput(1)
 	case server.RESP:
 		data, err := resp.IntegerValue(1).MarshalRESP()
 		if err != nil {
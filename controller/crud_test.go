@@ -2,14 +2,16 @@ package controller
 
 import (
 	"bytes"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/junostorage/storage"
-
+	"github.com/junostorage/config"
 	"github.com/junostorage/controller/server"
 )
 
-var c = &Controller{cache: storage.New()}
+var c = newController(config.New())
 
 func readMessage(data string) (message *server.Message, err error) {
 	buffer := bytes.NewBuffer([]byte(data))
@@ -145,3 +147,127 @@ func TestCmdLindex(t *testing.T) {
 	}
 
 }
+
+func TestCmdDelKeys(t *testing.T) {
+
+	// a controller of its own to keep the command stats of c
+	dc := newController(config.New())
+	send := func(data string) string {
+		var buf bytes.Buffer
+		message, err := readMessage(data)
+		if err != nil {
+			t.Fatalf("reader error:%v", err)
+		}
+		if err := dc.handleInputCommand(nil, message, &buf); err != nil {
+			t.Fatalf("handleInputCommand error:%v", err)
+		}
+		return buf.String()
+	}
+
+	send("SET del:1 v\r\n")
+	send("LPUSH del:2 v\r\n")
+	if res := send("DEL del:1 del:2 del:3\r\n"); res != ":2\r\n" {
+		t.Errorf("Unexpected reply %q", res)
+	}
+	if res := send("GET del:1\r\n"); res != "$-1\r\n" {
+		t.Errorf("Unexpected reply %q", res)
+	}
+}
+
+func TestCmdSetOptions(t *testing.T) {
+
+	dc := newController(config.New())
+	send := func(data string) string {
+		var buf bytes.Buffer
+		message, err := readMessage(data)
+		if err != nil {
+			t.Fatalf("reader error:%v", err)
+		}
+		if err := dc.handleInputCommand(nil, message, &buf); err != nil {
+			t.Fatalf("handleInputCommand error:%v", err)
+		}
+		return buf.String()
+	}
+
+	testCases := []struct {
+		data string
+		res  string
+	}{
+		{"SET opt:1 a XX\r\n", "$-1\r\n"},
+		{"SET opt:1 a NX\r\n", "+OK\r\n"},
+		{"SET opt:1 b NX\r\n", "$-1\r\n"},
+		{"SET opt:1 b XX PX 100\r\n", "+OK\r\n"},
+		{"GET opt:1\r\n", "$1\r\nb\r\n"},
+		{"SET opt:1 b NX XX\r\n", "-ERR syntax error\r\n"},
+		{"SET opt:1 b EX\r\n", "-ERR syntax error\r\n"},
+		{"SET opt:1 b EX 0\r\n", "-ERR invalid expire time in 'set' command\r\n"},
+		{"SET opt:1 b EX ten\r\n", "-ERR value is not an integer or out of range\r\n"},
+		{"EXPIRE opt:1 ten\r\n", "-ERR value is not an integer or out of range\r\n"},
+		{"LINDEX opt:1 first\r\n", "-ERR value is not an integer or out of range\r\n"},
+		{"GET opt:1\r\n", "$1\r\nb\r\n"},
+	}
+	for _, testCase := range testCases {
+		if res := send(testCase.data); res != testCase.res {
+			t.Errorf("Want: %q, got: %q, data:%q", testCase.res, res, testCase.data)
+		}
+	}
+
+	// the key expires after PX, the expirations aren't rounded to seconds
+	time.Sleep(150 * time.Millisecond)
+	if res := send("GET opt:1\r\n"); res != "$-1\r\n" {
+		t.Errorf("Want the key expired, got: %q", res)
+	}
+
+	// a key expiring now is deleted
+	send("SET opt:2 v\r\n")
+	if res := send("EXPIRE opt:2 0\r\n"); res != ":1\r\n" {
+		t.Errorf("Unexpected reply %q", res)
+	}
+	if res := send("GET opt:2\r\n"); res != "$-1\r\n" {
+		t.Errorf("Want the key deleted, got: %q", res)
+	}
+	if res := send("EXPIRE opt:2 0\r\n"); res != ":0\r\n" {
+		t.Errorf("Unexpected reply %q", res)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+
+	// the writes of distinct keys run in parallel, -race checks them
+	dc := newController(config.New())
+	var mu sync.Mutex
+	lengths := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				var buf bytes.Buffer
+				message, err := readMessage(fmt.Sprintf("LPUSH concurrent:%d v\r\n", j%4))
+				if err != nil {
+					t.Errorf("reader error:%v", err)
+					return
+				}
+				dc.handleInputCommand(nil, message, &buf)
+				mu.Lock()
+				lengths[fmt.Sprintf("%d %s", j%4, buf.String())] = true
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	n := 0
+	for j := 0; j < 4; j++ {
+		l, _ := dc.db(&server.Message{}).Llen(fmt.Sprintf("concurrent:%d", j))
+		n += l
+	}
+	if n != 400 {
+		t.Errorf("Expected 400 elements, got %d", n)
+	}
+	// every LPUSH replies the length it left the list with
+	if len(lengths) != 400 {
+		t.Errorf("Expected 400 distinct lengths, got %d", len(lengths))
+	}
+}
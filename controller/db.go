@@ -0,0 +1,250 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/junostorage/controller/server"
+	"github.com/junostorage/storage"
+)
+
+var (
+	errDBIndex    = errors.New("DB index is out of range")
+	errSameDB     = errors.New("source and destination objects are the same")
+	errSelectHTTP = errors.New("SELECT is not supported over HTTP")
+	errNoDBFile   = errors.New("persistence is disabled, set dbfilename to save the databases")
+)
+
+// db returns the database selected by the client of the message
+func (c *Controller) db(msg *server.Message) *storage.DB {
+	return c.store.DB(msg.DB)
+}
+
+// dbIndex parses the index of a database
+func (c *Controller) dbIndex(s string) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errNotInteger
+	}
+	if i < 0 || i >= c.store.Databases() {
+		return 0, errDBIndex
+	}
+	return i, nil
+}
+
+// dbPath returns the path of the snapshot, empty when dbfilename isn't set
+func (c *Controller) dbPath() string {
+	name := c.config.String("dbfilename")
+	if name == "" {
+		return ""
+	}
+	return filepath.Join(c.config.String("dir"), name)
+}
+
+// keyExpired is called by the store for the keys removed on expiration
+func (c *Controller) keyExpired(db int, key string) {
+	c.stats.keyExpired()
+	c.invalidateKey(nil, key)
+}
+
+// keyEvicted is called by the store for the keys evicted by the
+// maxmemory-policy
+func (c *Controller) keyEvicted(db int, key string) {
+	c.invalidateKey(nil, key)
+}
+
+// usedMemory returns the estimated number of bytes held by the databases
+func (c *Controller) usedMemory() int64 {
+	return c.store.UsedMemory()
+}
+
+// peakMemory returns the highest value usedMemory reached
+func (c *Controller) peakMemory() int64 {
+	return c.store.PeakMemory()
+}
+
+// dbsLen returns the number of keys and keys with an expiration of all
+// the databases
+func (c *Controller) dbsLen() (keys, expires int) {
+	return c.store.Len()
+}
+
+// keyspaceStats returns the key lookups of all the databases
+func (c *Controller) keyspaceStats() (hits, misses int64) {
+	return c.store.KeyspaceStats()
+}
+
+// SELECT index
+func (c *Controller) cmdSelect(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 2 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+	if conn == nil {
+		return "", errSelectHTTP
+	}
+
+	db, err := c.dbIndex(msg.Values[1].String())
+	if err != nil {
+		return "", err
+	}
+	conn.SetDB(db)
+
+	return okOutput(msg)
+}
+
+// MOVE key db
+func (c *Controller) cmdMove(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 3 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	db, err := c.dbIndex(msg.Values[2].String())
+	if err != nil {
+		return "", err
+	}
+	if db == msg.DB {
+		return "", errSameDB
+	}
+
+	n := 0
+	if c.db(msg).Move(msg.Values[1].String(), db) {
+		n = 1
+	}
+	return integerOutput(msg, n)
+}
+
+// SWAPDB index1 index2
+func (c *Controller) cmdSwapdb(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 3 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	db1, err := c.dbIndex(msg.Values[1].String())
+	if err != nil {
+		return "", errors.New("invalid first DB index")
+	}
+	db2, err := c.dbIndex(msg.Values[2].String())
+	if err != nil {
+		return "", errors.New("invalid second DB index")
+	}
+
+	if db1 != db2 {
+		c.store.Swap(db1, db2)
+		// the clients of both databases now read other values
+		c.invalidateAll()
+	}
+
+	return okOutput(msg)
+}
+
+// FLUSHDB [ASYNC | SYNC]
+func (c *Controller) cmdFlushdb(msg *server.Message) (res string, err error) {
+
+	if err := checkFlushOption(msg); err != nil {
+		return "", err
+	}
+
+	c.db(msg).Flush()
+	c.invalidateAll()
+
+	return okOutput(msg)
+}
+
+// FLUSHALL [ASYNC | SYNC]
+func (c *Controller) cmdFlushall(msg *server.Message) (res string, err error) {
+
+	if err := checkFlushOption(msg); err != nil {
+		return "", err
+	}
+
+	c.store.FlushAll()
+	c.invalidateAll()
+
+	return okOutput(msg)
+}
+
+// checkFlushOption checks the ASYNC or SYNC option of the flush commands,
+// the databases are always flushed synchronously
+func checkFlushOption(msg *server.Message) error {
+	switch len(msg.Values) {
+	case 1:
+		return nil
+	case 2:
+		switch strings.ToLower(msg.Values[1].String()) {
+		case "async", "sync":
+			return nil
+		}
+		return errSyntax
+	}
+	return errInvalidNumberOfArguments
+}
+
+// saveRule saves the databases once they changed the number of times
+// within the number of seconds
+type saveRule struct {
+	seconds int64
+	changes int64
+}
+
+// parseSaveRules parses the save parameter, e.g. "3600 1 300 100"
+func parseSaveRules(s string) ([]saveRule, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save parameters '%s'", s)
+	}
+	var rules []saveRule
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.ParseInt(fields[i], 10, 64)
+		changes, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, fmt.Errorf("invalid save parameters '%s'", s)
+		}
+		rules = append(rules, saveRule{seconds, changes})
+	}
+	return rules, nil
+}
+
+// saveIfNeeded saves the databases when one of the rules matches
+func (c *Controller) saveIfNeeded(rules []saveRule) {
+	changes := c.store.Changes()
+	if changes == 0 {
+		return
+	}
+	elapsed := int64(time.Since(c.store.LastSave()).Seconds())
+	for _, rule := range rules {
+		if elapsed >= rule.seconds && changes >= rule.changes {
+			if err := c.store.Save(); err != nil && err != storage.ErrNoPath {
+				logs.Errorf("save error:%v", err)
+			}
+			return
+		}
+	}
+}
+
+// SAVE
+func (c *Controller) cmdSave(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 1 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	if err := c.store.Save(); err != nil {
+		if err == storage.ErrNoPath {
+			return "", errNoDBFile
+		}
+		return "", err
+	}
+
+	return okOutput(msg)
+}
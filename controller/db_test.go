@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/junostorage/config"
+	"github.com/junostorage/controller/server"
+)
+
+func TestDatabases(t *testing.T) {
+
+	// a controller of its own as the databases are flushed
+	dc := newController(config.New())
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	conn := server.NewConn(p1)
+
+	send := func(data string) string {
+		var buf bytes.Buffer
+		message, err := readMessage(data)
+		if err != nil {
+			t.Fatalf("reader error:%v", err)
+		}
+		message.Proto = conn.Proto()
+		message.DB = conn.DB()
+		if err := dc.handleInputCommand(conn, message, &buf); err != nil {
+			t.Fatalf("handleInputCommand error:%v", err)
+		}
+		return buf.String()
+	}
+
+	testCases := []struct {
+		data string
+		res  string
+	}{
+		{"SET k db0\r\n", "+OK\r\n"},
+		{"SELECT 1\r\n", "+OK\r\n"},
+		{"GET k\r\n", "$-1\r\n"},
+		{"SET k db1\r\n", "+OK\r\n"},
+		{"SELECT 16\r\n", "-ERR DB index is out of range\r\n"},
+		{"SELECT one\r\n", "-ERR value is not an integer or out of range\r\n"},
+		{"MOVE k 1\r\n", "-ERR source and destination objects are the same\r\n"},
+		{"MOVE k 0\r\n", ":0\r\n"},
+		{"SET m moved\r\n", "+OK\r\n"},
+		{"MOVE m 0\r\n", ":1\r\n"},
+		{"GET m\r\n", "$-1\r\n"},
+		{"SWAPDB 0 1\r\n", "+OK\r\n"},
+		{"GET k\r\n", "$3\r\ndb0\r\n"},
+		{"GET m\r\n", "$5\r\nmoved\r\n"},
+		{"SWAPDB 0 16\r\n", "-ERR invalid second DB index\r\n"},
+		{"FLUSHDB\r\n", "+OK\r\n"},
+		{"GET k\r\n", "$-1\r\n"},
+		{"SELECT 0\r\n", "+OK\r\n"},
+		{"GET k\r\n", "$3\r\ndb1\r\n"},
+		{"FLUSHDB LAZY\r\n", "-ERR syntax error\r\n"},
+	}
+	for _, testCase := range testCases {
+		if res := send(testCase.data); res != testCase.res {
+			t.Errorf("Expected %q for %q, got %q", testCase.res, testCase.data, res)
+		}
+	}
+	if info := dc.clientInfo(conn); !strings.Contains(info, " db=0 ") {
+		t.Errorf("Unexpected client info %q", info)
+	}
+
+	send("SELECT 3\r\n")
+	send("SET k db3\r\n")
+	if info := send("INFO keyspace\r\n"); !strings.Contains(info, "db0:keys=1,") || !strings.Contains(info, "db3:keys=1,") {
+		t.Errorf("Unexpected keyspace %q", info)
+	}
+
+	if res := send("FLUSHALL ASYNC\r\n"); res != "+OK\r\n" {
+		t.Errorf("Unexpected reply %q", res)
+	}
+	if keys, _ := dc.dbsLen(); keys != 0 || dc.usedMemory() != 0 {
+		t.Errorf("Expected no keys, got %d using %d bytes", keys, dc.usedMemory())
+	}
+
+	// the other controllers keep their own keyspace
+	if keys, _ := c.dbsLen(); keys == 0 {
+		t.Errorf("Expected the package controller keys")
+	}
+}
+
+func TestDatabasesHTTP(t *testing.T) {
+
+	var buf bytes.Buffer
+	message, err := readMessage("SELECT 1\r\n")
+	if err != nil {
+		t.Fatalf("reader error:%v", err)
+	}
+	if err := c.handleInputCommand(nil, message, &buf); err != nil {
+		t.Fatalf("handleInputCommand error:%v", err)
+	}
+	if res := buf.String(); res != "-ERR SELECT is not supported over HTTP\r\n" {
+		t.Errorf("Unexpected reply %q", res)
+	}
+}
+
+func TestSave(t *testing.T) {
+
+	cfg := config.New()
+	if err := cfg.SetStartup("dir", t.TempDir()); err != nil {
+		t.Fatalf("config error:%v", err)
+	}
+	sc := newController(cfg)
+
+	send := func(sc *Controller, data string) string {
+		var buf bytes.Buffer
+		message, err := readMessage(data)
+		if err != nil {
+			t.Fatalf("reader error:%v", err)
+		}
+		if err := sc.handleInputCommand(nil, message, &buf); err != nil {
+			t.Fatalf("handleInputCommand error:%v", err)
+		}
+		return buf.String()
+	}
+
+	send(sc, "SET k saved\r\n")
+	send(sc, "LPUSH l a b\r\n")
+	if res := send(sc, "SAVE\r\n"); res != "+OK\r\n" {
+		t.Fatalf("Unexpected reply %q", res)
+	}
+	if info := send(sc, "INFO persistence\r\n"); !strings.Contains(info, "rdb_changes_since_last_save:0\r\n") {
+		t.Errorf("Unexpected persistence %q", info)
+	}
+
+	// another controller with the same dir loads the snapshot
+	lc := newController(cfg)
+	if err := lc.store.Load(); err != nil {
+		t.Fatalf("load error:%v", err)
+	}
+	if res := send(lc, "GET k\r\n"); res != "$5\r\nsaved\r\n" {
+		t.Errorf("Unexpected reply %q", res)
+	}
+	if res := send(lc, "LLEN l\r\n"); res != ":2\r\n" {
+		t.Errorf("Unexpected reply %q", res)
+	}
+
+	if _, err := parseSaveRules("3600 1 300"); err == nil {
+		t.Errorf("Expected an error for an odd number of save parameters")
+	}
+	if rules, err := parseSaveRules("3600 1 300 100"); err != nil || len(rules) != 2 || rules[1].changes != 100 {
+		t.Errorf("Unexpected rules %v, error %v", rules, err)
+	}
+
+	cfg = config.New()
+	if err := cfg.SetStartup("dbfilename", ""); err != nil {
+		t.Fatalf("config error:%v", err)
+	}
+	if res := send(newController(cfg), "SAVE\r\n"); res != "-ERR "+errNoDBFile.Error()+"\r\n" {
+		t.Errorf("Unexpected reply %q", res)
+	}
+}
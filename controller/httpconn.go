@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/junostorage/acl"
+	"github.com/junostorage/controller/server"
+)
+
+// serveConn serves a connection over an http request, e.g. WebSocket
+type serveConn func(w http.ResponseWriter, r *http.Request, handler server.BatchHandler,
+	opened func(conn *server.Conn) error, closed func(conn *server.Conn))
+
+// connHandler returns the handler of an endpoint serving connections over
+// http, /ws and /subscribe/. The connections are opened and closed like
+// the TCP ones. The Basic authentication credentials of the request
+// authenticate the connection, the wrong ones are replied with 401.
+func (c *Controller) connHandler(serve serveConn, handler server.BatchHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := c.basicUser(r)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", `Basic realm="juno"`)
+			w.WriteHeader(httpStatus(err))
+			io.WriteString(w, jsonErrorOutput(err))
+			return
+		}
+		opened := func(conn *server.Conn) error {
+			if err := c.connOpened(conn); err != nil {
+				return err
+			}
+			if user != "" {
+				conn.SetUser(user)
+			}
+			return nil
+		}
+		serve(w, r, handler, opened, c.connClosed)
+	})
+}
+
+// basicUser authenticates the Basic credentials of the request, the user
+// is empty when there are none
+func (c *Controller) basicUser(r *http.Request) (string, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", nil
+	}
+	if user == "" {
+		user = acl.DefaultUser
+	}
+	if err := c.acl.Authenticate(user, pass); err != nil {
+		msg := &server.Message{Command: "auth", RemoteAddr: r.RemoteAddr, Username: user}
+		c.acl.Log().Add(acl.ReasonAuth, "toplevel", "AUTH", user, c.aclClientInfo(nil, msg))
+		return "", errWrongPass
+	}
+	return user, nil
+}
@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/junostorage/config"
+	"github.com/junostorage/controller/server"
+	"github.com/junostorage/resp"
+)
+
+func TestEvents(t *testing.T) {
+
+	dc := newController(config.New())
+	dc.config.Set("requirepass", "secret")
+	if err := dc.applyRequirePass(); err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(dc.connHandler(server.ServeEvents, dc.handleBatch))
+	defer s.Close()
+
+	testCases := []struct {
+		user, pass string
+		res        string
+		status     int
+	}{
+		{"", "", `{"status":false,"code":"NOAUTH","error":"Authentication required."}`, http.StatusUnauthorized},
+		{"default", "wrong", `{"status":false,"code":"WRONGPASS","error":"invalid username-password pair or user is disabled."}`, http.StatusUnauthorized},
+	}
+	for _, testCase := range testCases {
+		req, _ := http.NewRequest("GET", s.URL+"/subscribe/news", nil)
+		if testCase.user != "" {
+			req.SetBasicAuth(testCase.user, testCase.pass)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != testCase.res || res.StatusCode != testCase.status {
+			t.Errorf("Want: %d %s, got: %d %s", testCase.status, testCase.res, res.StatusCode, body)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", s.URL+"/subscribe/news", nil)
+	req.SetBasicAuth("", "secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Want Content-Type: text/event-stream, got: %s", ct)
+	}
+	rd := bufio.NewReader(res.Body)
+	readEvent := func() string {
+		line, _ := rd.ReadString('\n')
+		rd.ReadString('\n')
+		return line
+	}
+	if event := readEvent(); event != "data: {\"push\":[\"subscribe\",\"news\",1]}\n" {
+		t.Errorf("Want the subscription, got: %q", event)
+	}
+	if n := dc.pubsub.publish("news", "hello"); n != 1 {
+		t.Errorf("Want 1 subscriber, got %d", n)
+	}
+	if event := readEvent(); event != "data: {\"push\":[\"message\",\"news\",\"hello\"]}\n" {
+		t.Errorf("Want the message, got: %q", event)
+	}
+
+	// the subscriber is removed once the client goes away
+	res.Body.Close()
+	for i := 0; i < 50 && dc.pubsub.publish("news", "bye") > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := dc.pubsub.publish("news", "bye"); n != 0 {
+		t.Errorf("Want the subscriber removed, got %d", n)
+	}
+	if conns := dc.connCount(); conns != 0 {
+		t.Errorf("Want the connection closed, got %d connections", conns)
+	}
+}
+
+func TestJSONPushes(t *testing.T) {
+
+	// the pushes of the TCP connections are a line each
+	conn := server.NewConn(nil)
+	conn.SetOutputType(server.JSON)
+	if res := string(pushFrame(conn, resp.StringValue("message"), resp.StringValue("news"), resp.StringValue("hello"))); res != "{\"push\":[\"message\",\"news\",\"hello\"]}\r\n" {
+		t.Errorf("Want a JSON push, got: %q", res)
+	}
+	line := monitorLine(time.Unix(1339518083, 107412000), "127.0.0.1:60866", &server.Message{Values: []resp.Value{resp.StringValue("keys"), resp.StringValue("*")}})
+	if res := monitorJSON(line); res != `{"monitor":"1339518083.107412 [0 127.0.0.1:60866] \"keys\" \"*\""}` {
+		t.Errorf("Want a JSON monitor line, got: %s", res)
+	}
+}
@@ -0,0 +1,484 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/junostorage/controller/server"
+
+	"github.com/junostorage/resp"
+)
+
+const (
+	// junostorage release
+	version = "0.1.0"
+	// the Redis version reported to Redis tooling parsing INFO
+	redisVersion = "7.0.0"
+)
+
+var (
+	// sections returned by INFO without arguments
+	defaultInfoSections = []string{"server", "clients", "memory", "persistence", "stats", "replication", "cpu", "errorstats", "keyspace"}
+	// all the supported sections
+	allInfoSections = []string{"server", "clients", "memory", "persistence", "stats", "replication", "cpu", "commandstats", "errorstats", "keyspace"}
+)
+
+// latencyBuckets are the upper bounds of the command latency histogram
+var latencyBuckets = []time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// pipelineDepths are the upper bounds of the pipeline depth histogram
+var pipelineDepths = []int{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+
+// commandStats holds the counters reported in the commandstats section
+type commandStats struct {
+	calls    int64
+	usec     int64
+	rejected int64
+	failed   int64
+	// number of calls per latency bucket, the last one counts the calls
+	// slower than all the buckets
+	buckets [12]int64
+}
+
+// stats are the server counters, they are updated by concurrent readers
+// so they have their own lock.
+type stats struct {
+	mu             sync.Mutex
+	started        time.Time
+	totalConns     int64
+	totalCommands  int64
+	expiredKeys    int64
+	commands       map[string]*commandStats
+	errors         map[string]int64
+	opsSampleTime  time.Time
+	opsSampleCount int64
+	opsPerSec      int64
+	// the number of commands read at once from the connections, see
+	// pipelineDepths
+	batches       int64
+	batchCommands int64
+	maxBatch      int64
+	batchBuckets  [12]int64
+	// the connections refused for reaching maxclients and the clients
+	// closed for overcoming their client-output-buffer-limit
+	rejectedConns    int64
+	outputLimitConns int64
+}
+
+func newStats() *stats {
+	s := &stats{started: time.Now()}
+	s.reset()
+	return s
+}
+
+// reset clears the counters, the start time is kept
+func (s *stats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.totalConns = 0
+	s.totalCommands = 0
+	s.expiredKeys = 0
+	s.commands = make(map[string]*commandStats)
+	s.errors = make(map[string]int64)
+	s.opsSampleTime = time.Now()
+	s.opsSampleCount = 0
+	s.opsPerSec = 0
+	s.batches = 0
+	s.batchCommands = 0
+	s.maxBatch = 0
+	s.batchBuckets = [12]int64{}
+	s.rejectedConns = 0
+	s.outputLimitConns = 0
+}
+
+func (s *stats) connOpened() {
+	s.mu.Lock()
+	s.totalConns++
+	s.mu.Unlock()
+}
+
+func (s *stats) connRejected() {
+	s.mu.Lock()
+	s.rejectedConns++
+	s.mu.Unlock()
+}
+
+func (s *stats) outputLimitReached() {
+	s.mu.Lock()
+	s.outputLimitConns++
+	s.mu.Unlock()
+}
+
+// recordBatch accumulates the depth of a pipeline, the number of commands
+// read at once from a connection
+func (s *stats) recordBatch(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.batches++
+	s.batchCommands += int64(n)
+	if int64(n) > s.maxBatch {
+		s.maxBatch = int64(n)
+	}
+	i := sort.SearchInts(pipelineDepths, n)
+	s.batchBuckets[i]++
+}
+
+func (s *stats) keyExpired() {
+	s.mu.Lock()
+	s.expiredKeys++
+	s.mu.Unlock()
+}
+
+// recordCommand accumulates the call count, latency and error of a command.
+// A rejected command is one that failed before it was executed.
+func (s *stats) recordCommand(name string, d time.Duration, err error, rejected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.errors[errorCode(err)]++
+	}
+	if _, ok := err.(errUnknownCommand); ok {
+		return
+	}
+
+	s.totalCommands++
+	cs, ok := s.commands[name]
+	if !ok {
+		cs = &commandStats{}
+		s.commands[name] = cs
+	}
+
+	if err != nil && rejected {
+		cs.rejected++
+		return
+	}
+	if err != nil {
+		cs.failed++
+	}
+	cs.calls++
+	cs.usec += int64(d / time.Microsecond)
+
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	cs.buckets[i]++
+}
+
+// sampleOps updates the instantaneous ops per second, it's called
+// periodically by the background cron.
+func (s *stats) sampleOps() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if elapsed := now.Sub(s.opsSampleTime); elapsed > 0 {
+		s.opsPerSec = int64(float64(s.totalCommands-s.opsSampleCount) / elapsed.Seconds())
+	}
+	s.opsSampleTime = now
+	s.opsSampleCount = s.totalCommands
+}
+
+// errorCode returns the error prefix used in error replies, e.g. OOM or ERR
+func errorCode(err error) string {
+	if e, ok := err.(errReply); ok {
+		return e.code
+	}
+	msg := err.Error()
+	if i := strings.IndexByte(msg, ' '); i > 0 {
+		code := msg[:i]
+		if strings.IndexFunc(code, func(r rune) bool { return !unicode.IsUpper(r) }) == -1 {
+			return code
+		}
+	}
+	return "ERR"
+}
+
+func (c *Controller) cmdInfo(msg *server.Message) (res string, err error) {
+
+	sections := defaultInfoSections
+	if len(msg.Values) > 1 {
+		sections = nil
+		for _, v := range msg.Values[1:] {
+			switch name := strings.ToLower(v.String()); name {
+			case "default":
+				sections = append(sections, defaultInfoSections...)
+			case "all", "everything":
+				sections = append(sections, allInfoSections...)
+			default:
+				sections = append(sections, name)
+			}
+		}
+	}
+
+	info := c.info(sections)
+
+	switch msg.OutputType {
+	case server.JSON:
+		return jsonOutput(info)
+	case server.RESP:
+		data, err := resp.StringValue(info).MarshalRESP()
+		if err != nil {
+			return "", err
+		}
+
+		res = string(data)
+	}
+
+	return
+}
+
+// info returns the INFO text of the sections, unknown sections are skipped
+func (c *Controller) info(sections []string) string {
+	var buf bytes.Buffer
+	seen := make(map[string]bool)
+	for _, name := range sections {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		var fields [][2]string
+		switch name {
+		default:
+			continue
+		case "server":
+			fields = c.infoServer()
+		case "clients":
+			fields = c.infoClients()
+		case "memory":
+			fields = c.infoMemory()
+		case "persistence":
+			fields = c.infoPersistence()
+		case "stats":
+			fields = c.infoStats()
+		case "replication":
+			fields = c.infoReplication()
+		case "cpu":
+			fields = c.infoCPU()
+		case "commandstats":
+			fields = c.infoCommandStats()
+		case "errorstats":
+			fields = c.infoErrorStats()
+		case "keyspace":
+			fields = c.infoKeyspace()
+		}
+
+		if buf.Len() > 0 {
+			buf.WriteString("\r\n")
+		}
+		title := strings.ToUpper(name[:1]) + name[1:]
+		if name == "cpu" {
+			title = "CPU"
+		}
+		buf.WriteString("# " + title + "\r\n")
+		for _, f := range fields {
+			buf.WriteString(f[0] + ":" + f[1] + "\r\n")
+		}
+	}
+	return buf.String()
+}
+
+func (c *Controller) infoServer() [][2]string {
+	uptime := time.Since(c.stats.started)
+	executable, _ := os.Executable()
+	bits := "64"
+	if strings.HasSuffix(runtime.GOARCH, "386") || strings.HasSuffix(runtime.GOARCH, "arm") {
+		bits = "32"
+	}
+	return [][2]string{
+		{"redis_version", redisVersion},
+		{"juno_version", version},
+		{"redis_mode", "standalone"},
+		{"os", runtime.GOOS + " " + runtime.GOARCH},
+		{"arch_bits", bits},
+		{"go_version", runtime.Version()},
+		{"process_id", fmt.Sprint(os.Getpid())},
+		{"tcp_port", fmt.Sprint(c.port)},
+		{"http_port", fmt.Sprint(c.config.Int("http-port"))},
+		{"uptime_in_seconds", fmt.Sprint(int64(uptime.Seconds()))},
+		{"uptime_in_days", fmt.Sprint(int64(uptime.Hours() / 24))},
+		{"executable", executable},
+		{"config_file", c.config.Path()},
+	}
+}
+
+func (c *Controller) infoClients() [][2]string {
+	return [][2]string{
+		{"connected_clients", fmt.Sprint(c.connCount())},
+		{"maxclients", c.config.String("maxclients")},
+		{"blocked_clients", "0"},
+		{"tracking_clients", fmt.Sprint(c.tracking.numClients())},
+	}
+}
+
+func (c *Controller) infoMemory() [][2]string {
+	used := c.usedMemory()
+	peak := c.peakMemory()
+	max := c.maxmemory()
+	return [][2]string{
+		{"used_memory", fmt.Sprint(used)},
+		{"used_memory_human", humanBytes(used)},
+		{"used_memory_peak", fmt.Sprint(peak)},
+		{"used_memory_peak_human", humanBytes(peak)},
+		{"used_memory_dataset", fmt.Sprint(used)},
+		{"maxmemory", fmt.Sprint(max)},
+		{"maxmemory_human", humanBytes(max)},
+		{"maxmemory_policy", c.config.String("maxmemory-policy")},
+	}
+}
+
+func (c *Controller) infoPersistence() [][2]string {
+	return [][2]string{
+		{"loading", "0"},
+		{"rdb_changes_since_last_save", fmt.Sprint(c.store.Changes())},
+		{"rdb_bgsave_in_progress", "0"},
+		{"rdb_last_save_time", fmt.Sprint(c.store.LastSave().Unix())},
+		{"rdb_last_bgsave_status", "ok"},
+		{"aof_enabled", "0"},
+		{"aof_rewrite_in_progress", "0"},
+	}
+}
+
+func (c *Controller) infoStats() [][2]string {
+	hits, misses := c.keyspaceStats()
+
+	c.pubsub.mu.Lock()
+	channels, patterns := len(c.pubsub.channels), len(c.pubsub.patterns)
+	c.pubsub.mu.Unlock()
+	trackingKeys, trackingItems, trackingPrefixes := c.tracking.stats()
+
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+
+	var errors int64
+	for _, n := range c.stats.errors {
+		errors += n
+	}
+	var avgBatch float64
+	if c.stats.batches > 0 {
+		avgBatch = float64(c.stats.batchCommands) / float64(c.stats.batches)
+	}
+	return [][2]string{
+		{"total_connections_received", fmt.Sprint(c.stats.totalConns)},
+		{"total_commands_processed", fmt.Sprint(c.stats.totalCommands)},
+		{"instantaneous_ops_per_sec", fmt.Sprint(c.stats.opsPerSec)},
+		{"rejected_connections", fmt.Sprint(c.stats.rejectedConns)},
+		{"client_output_buffer_limit_disconnections", fmt.Sprint(c.stats.outputLimitConns)},
+		{"expired_keys", fmt.Sprint(c.stats.expiredKeys)},
+		{"evicted_keys", fmt.Sprint(c.store.EvictedKeys())},
+		{"keyspace_hits", fmt.Sprint(hits)},
+		{"keyspace_misses", fmt.Sprint(misses)},
+		{"pubsub_channels", fmt.Sprint(channels)},
+		{"pubsub_patterns", fmt.Sprint(patterns)},
+		{"tracking_total_keys", fmt.Sprint(trackingKeys)},
+		{"tracking_total_items", fmt.Sprint(trackingItems)},
+		{"tracking_total_prefixes", fmt.Sprint(trackingPrefixes)},
+		{"total_error_replies", fmt.Sprint(errors)},
+		{"total_pipelines", fmt.Sprint(c.stats.batches)},
+		{"pipeline_depth_avg", fmt.Sprintf("%.2f", avgBatch)},
+		{"pipeline_depth_max", fmt.Sprint(c.stats.maxBatch)},
+	}
+}
+
+func (c *Controller) infoReplication() [][2]string {
+	return [][2]string{
+		{"role", "master"},
+		{"connected_slaves", "0"},
+	}
+}
+
+func (c *Controller) infoCPU() [][2]string {
+	sys, user := cpuUsage()
+	return [][2]string{
+		{"used_cpu_sys", fmt.Sprintf("%.6f", sys.Seconds())},
+		{"used_cpu_user", fmt.Sprintf("%.6f", user.Seconds())},
+	}
+}
+
+func (c *Controller) infoCommandStats() [][2]string {
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+
+	names := make([]string, 0, len(c.stats.commands))
+	for name := range c.stats.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make([][2]string, 0, len(names))
+	for _, name := range names {
+		cs := c.stats.commands[name]
+		perCall := 0.0
+		if cs.calls > 0 {
+			perCall = float64(cs.usec) / float64(cs.calls)
+		}
+		fields = append(fields, [2]string{"cmdstat_" + name,
+			fmt.Sprintf("calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d",
+				cs.calls, cs.usec, perCall, cs.rejected, cs.failed)})
+	}
+	return fields
+}
+
+func (c *Controller) infoErrorStats() [][2]string {
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+
+	codes := make([]string, 0, len(c.stats.errors))
+	for code := range c.stats.errors {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	fields := make([][2]string, 0, len(codes))
+	for _, code := range codes {
+		fields = append(fields, [2]string{"errorstat_" + code, fmt.Sprintf("count=%d", c.stats.errors[code])})
+	}
+	return fields
+}
+
+func (c *Controller) infoKeyspace() [][2]string {
+	var fields [][2]string
+	for i := 0; i < c.store.Databases(); i++ {
+		keys, expires := c.store.DB(i).Len()
+		if keys == 0 {
+			continue
+		}
+		fields = append(fields, [2]string{fmt.Sprintf("db%d", i), fmt.Sprintf("keys=%d,expires=%d,avg_ttl=0", keys, expires)})
+	}
+	return fields
+}
+
+// humanBytes formats a number of bytes like 1.50M
+func humanBytes(n int64) string {
+	d := float64(n)
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%dB", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.2fK", d/1024)
+	case n < 1024*1024*1024:
+		return fmt.Sprintf("%.2fM", d/(1024*1024))
+	default:
+		return fmt.Sprintf("%.2fG", d/(1024*1024*1024))
+	}
+}
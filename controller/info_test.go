@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCmdInfo(t *testing.T) {
+
+	c.stats.recordCommand("get", time.Millisecond, nil, false)
+	c.stats.recordCommand("get", time.Millisecond, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value"), false)
+	c.stats.recordCommand("set", 0, errInvalidNumberOfArguments, true)
+	c.stats.recordCommand("foo", 0, errUnknownCommand{"foo"}, false)
+
+	testCases := []struct {
+		data     string
+		contains []string
+		excludes []string
+	}{
+		{
+			data:     "INFO\r\n",
+			contains: []string{"# Server\r\n", "redis_version:", "# Keyspace\r\n", "errorstat_WRONGTYPE:count=1\r\n", "errorstat_ERR:count=2\r\n"},
+			excludes: []string{"# Commandstats"},
+		},
+		{
+			data:     "INFO commandstats\r\n",
+			contains: []string{"cmdstat_get:calls=2,usec=2000,usec_per_call=1000.00,rejected_calls=0,failed_calls=1\r\n", "cmdstat_set:calls=0,usec=0,usec_per_call=0.00,rejected_calls=1,failed_calls=0\r\n"},
+			excludes: []string{"cmdstat_foo", "# Server"},
+		},
+		{
+			data:     "INFO memory stats\r\n",
+			contains: []string{"used_memory:", "keyspace_hits:"},
+			excludes: []string{"# Server"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		message, err := readMessage(testCase.data)
+		if err != nil {
+			t.Fatalf("reader error:%v", err)
+		}
+
+		res, err := c.cmdInfo(message)
+		if err != nil {
+			t.Fatalf("cmdInfo error:%v", err)
+		}
+		for _, s := range testCase.contains {
+			if !strings.Contains(res, s) {
+				t.Errorf("Expected %q in INFO, data:%q", s, testCase.data)
+			}
+		}
+		for _, s := range testCase.excludes {
+			if strings.Contains(res, s) {
+				t.Errorf("Unexpected %q in INFO, data:%q", s, testCase.data)
+			}
+		}
+	}
+
+}
@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+
+	"github.com/junostorage/resp"
+	"github.com/junostorage/storage"
+)
+
+// jsonOutput returns the JSON reply of a successful command with the
+// value, nil is replied as null
+func jsonOutput(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return `{"status":true,"value":` + string(data) + `}`, nil
+}
+
+// jsonError is the JSON reply of a failed command, the code is the prefix
+// of the RESP error, e.g. ERR or WRONGTYPE
+type jsonError struct {
+	Status bool   `json:"status"`
+	Code   string `json:"code"`
+	Error  string `json:"error"`
+}
+
+// jsonErrorOutput returns the JSON reply of the error
+func jsonErrorOutput(err error) string {
+	e := jsonError{Code: errorCode(err), Error: err.Error()}
+	if r, ok := err.(errReply); ok {
+		e.Error = r.msg
+	}
+	if err == storage.ErrWrongType {
+		e.Code = "WRONGTYPE"
+	}
+	data, _ := json.Marshal(e)
+	return string(data)
+}
+
+// httpStatus returns the status code of the http reply of the error
+func httpStatus(err error) int {
+	switch err {
+	case storage.ErrNullValue:
+		return http.StatusNotFound
+	case storage.ErrWrongType:
+		return http.StatusConflict
+	case errNoAuth, errWrongPass:
+		return http.StatusUnauthorized
+	case errOutOfMemory, storage.ErrOutOfMemory:
+		return http.StatusInsufficientStorage
+	case errShuttingDown:
+		return http.StatusServiceUnavailable
+	}
+	if e, ok := err.(errReply); ok && e.code == "NOPERM" {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// jsonData returns the value as the Go value encoded to JSON, the maps
+// become objects and the other aggregates arrays
+func jsonData(v resp.Value) interface{} {
+	if v.IsNull() {
+		return nil
+	}
+	switch v.Type() {
+	case resp.Integer:
+		return v.Integer()
+	case resp.Boolean:
+		return v.Bool()
+	case resp.Double:
+		// JSON has no infinities
+		f := v.Float()
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return v.String()
+		}
+		return f
+	case resp.BigNumber:
+		return json.Number(v.String())
+	case resp.Map:
+		return jsonObject(v.Array())
+	case resp.Array, resp.Set, resp.Push:
+		vals := v.Array()
+		items := make([]interface{}, 0, len(vals))
+		for _, item := range vals {
+			items = append(items, jsonData(item))
+		}
+		return items
+	}
+	return v.String()
+}
+
+// jsonObject is the JSON object of the key value pairs of a map, the
+// fields keep the order of the map
+type jsonObject []resp.Value
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i := 0; i+1 < len(o); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(o[i].String())
+		if err != nil {
+			return nil, err
+		}
+		val, err := json.Marshal(jsonData(o[i+1]))
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/junostorage/config"
+	"github.com/junostorage/controller/server"
+	"github.com/junostorage/resp"
+)
+
+func TestJSONOutput(t *testing.T) {
+
+	dc := newController(config.New())
+	testCases := []struct {
+		args   []string
+		res    string
+		status int
+	}{
+		{[]string{"set", "quoted", "say \"hi\"\n"}, `{"status":true}`, http.StatusOK},
+		{[]string{"get", "quoted"}, `{"status":true,"value":"say \"hi\"\n"}`, http.StatusOK},
+		{[]string{"del", "quoted", "missing"}, `{"status":true,"value":1}`, http.StatusOK},
+		{[]string{"get", "quoted"}, `{"status":false,"code":"ERR","error":"Key not found"}`, http.StatusNotFound},
+		{[]string{"hset", "h", "f", "v"}, `{"status":true}`, http.StatusOK},
+		{[]string{"hgetall", "h"}, `{"status":true,"value":{"f":"v"}}`, http.StatusOK},
+		{[]string{"hgetall", "missing"}, `{"status":true,"value":{}}`, http.StatusOK},
+		{[]string{"keys", "nomatch*"}, `{"status":true,"value":[]}`, http.StatusOK},
+		{[]string{"acl", "getuser", "nobody"}, `{"status":true,"value":null}`, http.StatusOK},
+		{[]string{"lpush", "h", "1"}, `{"status":false,"code":"WRONGTYPE","error":"Operation against a key holding the wrong kind of value"}`, http.StatusConflict},
+		{[]string{"get"}, `{"status":false,"code":"ERR","error":"wrong number of arguments for 'get' command"}`, http.StatusBadRequest},
+		{[]string{"nosuchcmd"}, `{"status":false,"code":"ERR","error":"unknown command 'nosuchcmd'"}`, http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		vals := make([]resp.Value, 0, len(testCase.args))
+		for _, a := range testCase.args {
+			vals = append(vals, resp.StringValue(a))
+		}
+		message := &server.Message{
+			Command: testCase.args[0], Values: vals,
+			ConnType: server.HTTP, OutputType: server.JSON,
+		}
+		w := httptest.NewRecorder()
+		if err := dc.handleInputCommand(nil, message, w); err != nil {
+			t.Fatalf("handleInputCommand error:%v", err)
+		}
+		if res := w.Body.String(); res != testCase.res {
+			t.Errorf("Want: %s, got: %s, args:%q", testCase.res, res, testCase.args)
+		}
+		if w.Code != testCase.status {
+			t.Errorf("Want status %d, got %d, args:%q", testCase.status, w.Code, testCase.args)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/junostorage/controller/server"
+
+	"github.com/junostorage/resp"
+)
+
+// Latency events
+const (
+	latencyCommand     = "command"
+	latencyFastCommand = "fast-command"
+	latencyExpireCycle = "expire-cycle"
+)
+
+const latencyHistoryLen = 160
+
+// latencySample is a latency spike of an event
+type latencySample struct {
+	time    time.Time
+	latency time.Duration
+}
+
+// latencyEvent holds the recent spikes of an event
+type latencyEvent struct {
+	history []latencySample
+	max     time.Duration
+}
+
+// latencyMonitor records the events that took longer than
+// latency-monitor-threshold
+type latencyMonitor struct {
+	mu     sync.Mutex
+	events map[string]*latencyEvent
+}
+
+func newLatencyMonitor() *latencyMonitor {
+	return &latencyMonitor{events: make(map[string]*latencyEvent)}
+}
+
+// record adds a sample when d is over the threshold given in milliseconds,
+// a zero threshold disables the monitor.
+func (l *latencyMonitor) record(event string, d time.Duration, threshold int64) {
+	if threshold <= 0 || d < time.Duration(threshold)*time.Millisecond {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.events[event]
+	if !ok {
+		e = &latencyEvent{}
+		l.events[event] = e
+	}
+
+	now := time.Now()
+	// samples in the same second are merged keeping the highest latency
+	if n := len(e.history); n > 0 && e.history[n-1].time.Unix() == now.Unix() {
+		if d > e.history[n-1].latency {
+			e.history[n-1].latency = d
+		}
+	} else {
+		e.history = append(e.history, latencySample{time: now, latency: d})
+		if len(e.history) > latencyHistoryLen {
+			e.history = e.history[1:]
+		}
+	}
+	if d > e.max {
+		e.max = d
+	}
+}
+
+// names returns the names of the events with samples, sorted
+func (l *latencyMonitor) names() []string {
+	names := make([]string, 0, len(l.events))
+	for name := range l.events {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// reset removes the samples of the events, of all the events when none is
+// given, and returns the number of events reset
+func (l *latencyMonitor) reset(events ...string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(events) == 0 {
+		n := len(l.events)
+		l.events = make(map[string]*latencyEvent)
+		return n
+	}
+	n := 0
+	for _, name := range events {
+		if _, ok := l.events[name]; ok {
+			delete(l.events, name)
+			n++
+		}
+	}
+	return n
+}
+
+func ms(d time.Duration) int {
+	return int(d / time.Millisecond)
+}
+
+func (c *Controller) cmdLatency(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) < 2 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	switch strings.ToLower(msg.Values[1].String()) {
+	default:
+		err = fmt.Errorf("unknown subcommand '%s'. Try LATENCY HELP.", msg.Values[1].String())
+	case "latest":
+		res, err = c.cmdLatencyLatest(msg)
+	case "history":
+		res, err = c.cmdLatencyHistory(msg)
+	case "reset":
+		events := make([]string, 0, len(msg.Values)-2)
+		for _, v := range msg.Values[2:] {
+			events = append(events, strings.ToLower(v.String()))
+		}
+		res, err = integerOutput(msg, c.latency.reset(events...))
+	case "doctor":
+		if len(msg.Values) != 2 {
+			return "", errInvalidNumberOfArguments
+		}
+		report := c.latencyDoctor()
+		switch msg.OutputType {
+		case server.JSON:
+			return jsonOutput(report)
+		case server.RESP:
+			data, _ := resp.StringValue(report).MarshalRESP()
+			res = string(data)
+		}
+	}
+	return
+}
+
+// LATENCY LATEST
+// Replies with the event name, the time of the latest spike, the latest and
+// the all time max latency in milliseconds for each event.
+func (c *Controller) cmdLatencyLatest(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 2 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	c.latency.mu.Lock()
+	defer c.latency.mu.Unlock()
+
+	names := c.latency.names()
+
+	switch msg.OutputType {
+	case server.JSON:
+		items := make([]jsonObject, 0, len(names))
+		for _, name := range names {
+			e := c.latency.events[name]
+			last := e.history[len(e.history)-1]
+			items = append(items, jsonObject{
+				resp.StringValue("event"), resp.StringValue(name),
+				resp.StringValue("time"), resp.IntegerValue(int(last.time.Unix())),
+				resp.StringValue("latest"), resp.IntegerValue(ms(last.latency)),
+				resp.StringValue("max"), resp.IntegerValue(ms(e.max)),
+			})
+		}
+		return jsonOutput(items)
+	case server.RESP:
+		vals := make([]resp.Value, 0, len(names))
+		for _, name := range names {
+			e := c.latency.events[name]
+			last := e.history[len(e.history)-1]
+			vals = append(vals, resp.ArrayValue([]resp.Value{
+				resp.StringValue(name),
+				resp.IntegerValue(int(last.time.Unix())),
+				resp.IntegerValue(ms(last.latency)),
+				resp.IntegerValue(ms(e.max)),
+			}))
+		}
+		data, err := resp.ArrayValue(vals).MarshalRESP()
+		if err != nil {
+			return "", err
+		}
+
+		res = string(data)
+	}
+
+	return
+}
+
+// LATENCY HISTORY event
+func (c *Controller) cmdLatencyHistory(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 3 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	c.latency.mu.Lock()
+	defer c.latency.mu.Unlock()
+
+	var history []latencySample
+	if e, ok := c.latency.events[strings.ToLower(msg.Values[2].String())]; ok {
+		history = e.history
+	}
+
+	switch msg.OutputType {
+	case server.JSON:
+		items := make([][2]int, 0, len(history))
+		for _, s := range history {
+			items = append(items, [2]int{int(s.time.Unix()), ms(s.latency)})
+		}
+		return jsonOutput(items)
+	case server.RESP:
+		vals := make([]resp.Value, 0, len(history))
+		for _, s := range history {
+			vals = append(vals, resp.ArrayValue([]resp.Value{
+				resp.IntegerValue(int(s.time.Unix())),
+				resp.IntegerValue(ms(s.latency)),
+			}))
+		}
+		data, err := resp.ArrayValue(vals).MarshalRESP()
+		if err != nil {
+			return "", err
+		}
+
+		res = string(data)
+	}
+
+	return
+}
+
+// latencyDoctor returns a human readable analysis of the latency events
+func (c *Controller) latencyDoctor() string {
+	threshold := c.config.Int("latency-monitor-threshold")
+	if threshold <= 0 {
+		return "Latency monitoring is disabled, enable it with \"CONFIG SET latency-monitor-threshold <milliseconds>\"."
+	}
+
+	c.latency.mu.Lock()
+	defer c.latency.mu.Unlock()
+
+	names := c.latency.names()
+	if len(names) == 0 {
+		return "No latency spike was observed since the instance started."
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("Latency spikes were observed:\n\n")
+	for i, name := range names {
+		e := c.latency.events[name]
+		var sum time.Duration
+		for _, s := range e.history {
+			sum += s.latency
+		}
+		fmt.Fprintf(&buf, "%d. %s: %d latency spikes (average %dms, worst %dms).\n",
+			i+1, name, len(e.history), ms(sum)/len(e.history), ms(e.max))
+	}
+
+	buf.WriteString("\nAdvice:\n\n")
+	for _, name := range names {
+		switch name {
+		case latencyCommand:
+			buf.WriteString("- Check your slow log with SLOWLOG GET to find which commands are slow, commands operating on big lists, hashes or KEYS with a broad pattern take time proportional to the size of the data.\n")
+		case latencyFastCommand:
+			buf.WriteString("- The system is slow to execute O(1) commands, check if the host is overloaded or the process is being swapped.\n")
+		case latencyExpireCycle:
+			buf.WriteString("- Many keys are expiring at the same time, consider adding some randomness to the TTLs.\n")
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyMonitor(t *testing.T) {
+
+	l := newLatencyMonitor()
+
+	l.record(latencyCommand, 50*time.Millisecond, 0)
+	l.record(latencyCommand, 5*time.Millisecond, 10)
+	if len(l.events) != 0 {
+		t.Fatalf("Expected no samples under the threshold")
+	}
+
+	l.record(latencyCommand, 20*time.Millisecond, 10)
+	l.record(latencyCommand, 30*time.Millisecond, 10)
+	l.record(latencyExpireCycle, 15*time.Millisecond, 10)
+
+	e := l.events[latencyCommand]
+	if len(e.history) != 1 || e.history[0].latency != 30*time.Millisecond || e.max != 30*time.Millisecond {
+		t.Errorf("Expected samples of the same second to be merged, got %v", e.history)
+	}
+
+	if n := l.reset(latencyExpireCycle, "unknown"); n != 1 {
+		t.Errorf("Expected 1 event reset, got %d", n)
+	}
+	if n := l.reset(); n != 1 {
+		t.Errorf("Expected 1 event reset, got %d", n)
+	}
+
+}
+
+func TestCmdLatency(t *testing.T) {
+
+	c.latency.reset()
+	c.latency.record(latencyFastCommand, 12*time.Millisecond, 10)
+
+	message, _ := readMessage("LATENCY LATEST\r\n")
+	res, err := c.cmdLatency(message)
+	if err != nil {
+		t.Fatalf("cmdLatency error:%v", err)
+	}
+	if !strings.HasPrefix(res, "*1\r\n*4\r\n$12\r\nfast-command\r\n") || !strings.HasSuffix(res, ":12\r\n:12\r\n") {
+		t.Errorf("Unexpected LATENCY LATEST reply %q", res)
+	}
+
+	message, _ = readMessage("LATENCY HISTORY fast-command\r\n")
+	if res, err = c.cmdLatency(message); err != nil {
+		t.Fatalf("cmdLatency error:%v", err)
+	}
+	if !strings.HasPrefix(res, "*1\r\n*2\r\n") {
+		t.Errorf("Unexpected LATENCY HISTORY reply %q", res)
+	}
+
+	message, _ = readMessage("LATENCY DOCTOR\r\n")
+	if res, err = c.cmdLatency(message); err != nil {
+		t.Fatalf("cmdLatency error:%v", err)
+	}
+	if !strings.Contains(res, "disabled") {
+		t.Errorf("Unexpected LATENCY DOCTOR reply %q", res)
+	}
+
+	message, _ = readMessage("LATENCY RESET\r\n")
+	if res, err = c.cmdLatency(message); err != nil || res != ":1\r\n" {
+		t.Errorf("Unexpected LATENCY RESET reply %q, err:%v", res, err)
+	}
+
+}
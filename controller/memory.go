@@ -0,0 +1,185 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/junostorage/controller/server"
+	"github.com/junostorage/storage"
+
+	"github.com/junostorage/resp"
+)
+
+var (
+	errOutOfMemory = errReply{"OOM", "command not allowed when used memory > 'maxmemory'"}
+	errSyntax      = errors.New("syntax error")
+)
+
+// outOfMemory reports whether the dataset grew over the memory limit, the
+// keys are evicted first when the maxmemory-policy allows it. Sizes are
+// accounted on every mutation so the check is cheap enough to be done
+// before each write command.
+func (c *Controller) outOfMemory() bool {
+	return c.store.Reserve() == storage.ErrOutOfMemory
+}
+
+func (c *Controller) cmdMemory(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) < 2 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	switch strings.ToLower(msg.Values[1].String()) {
+	default:
+		err = fmt.Errorf("unknown subcommand '%s'. Try MEMORY HELP.", msg.Values[1].String())
+	case "usage":
+		res, err = c.cmdMemoryUsage(msg)
+	case "stats":
+		res, err = c.cmdMemoryStats(msg)
+	case "doctor":
+		res, err = c.cmdMemoryDoctor(msg)
+	}
+	return
+}
+
+// MEMORY USAGE key [SAMPLES count]
+// Sizes are tracked exactly, SAMPLES is validated and accepted for
+// compatibility only.
+func (c *Controller) cmdMemoryUsage(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 3 && len(msg.Values) != 5 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	if len(msg.Values) == 5 {
+		if strings.ToLower(msg.Values[3].String()) != "samples" {
+			err = errSyntax
+			return
+		}
+		if n, e := strconv.Atoi(msg.Values[4].String()); e != nil || n < 0 {
+			err = errors.New("value is out of range, must be positive")
+			return
+		}
+	}
+
+	key := msg.Values[2].String()
+	n, err := c.db(msg).MemoryUsage(key)
+	if err != nil {
+
+		if err == storage.ErrNullValue {
+			data, _ := marshalValue(msg, resp.NilValue())
+
+			if msg.OutputType == server.RESP {
+				return string(data), nil
+			}
+		}
+
+		return "", err
+	}
+
+	switch msg.OutputType {
+	case server.JSON:
+		return jsonOutput(n)
+	case server.RESP:
+		data, err := resp.IntegerValue(int(n)).MarshalRESP()
+		if err != nil {
+			return "", err
+		}
+
+		res = string(data)
+	}
+
+	return
+}
+
+func (c *Controller) cmdMemoryStats(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 2 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	used := c.usedMemory()
+	peak := c.peakMemory()
+	keys, _ := c.dbsLen()
+
+	perKey := int64(0)
+	if keys > 0 {
+		perKey = used / int64(keys)
+	}
+	peakPerc := 100.0
+	if peak > 0 {
+		peakPerc = float64(used) * 100 / float64(peak)
+	}
+
+	stats := []struct {
+		name  string
+		value interface{}
+	}{
+		{"peak.allocated", peak},
+		{"total.allocated", used},
+		{"maxmemory", c.maxmemory()},
+		{"keys.count", keys},
+		{"keys.bytes-per-key", perKey},
+		{"dataset.bytes", used},
+		{"peak.percentage", peakPerc},
+	}
+
+	vals := make([]resp.Value, 0, len(stats)*2)
+	for _, s := range stats {
+		vals = append(vals, resp.StringValue(s.name), resp.AnyValue(s.value))
+	}
+
+	return valueOutput(msg, resp.MapValue(vals))
+}
+
+func (c *Controller) cmdMemoryDoctor(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 2 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	report := c.memoryDoctor()
+
+	switch msg.OutputType {
+	case server.JSON:
+		return jsonOutput(report)
+	case server.RESP:
+		data, err := resp.StringValue(report).MarshalRESP()
+		if err != nil {
+			return "", err
+		}
+
+		res = string(data)
+	}
+
+	return
+}
+
+// memoryDoctor returns a human readable report about the memory usage.
+func (c *Controller) memoryDoctor() string {
+	used := c.usedMemory()
+	peak := c.peakMemory()
+
+	if keys, _ := c.dbsLen(); keys == 0 {
+		return "The instance is empty, there is no memory usage to report."
+	}
+
+	var issues []string
+	if max := c.maxmemory(); max > 0 && used > max*9/10 {
+		issues = append(issues, fmt.Sprintf("- High memory usage: the dataset uses %d of the %d bytes allowed by maxmemory, the write commands are rejected once the limit is reached.", used, max))
+	}
+	if peak > used*3/2 {
+		issues = append(issues, fmt.Sprintf("- Peak memory: the peak of %d bytes is more than 150%% of the memory used now, the memory freed since may not be returned to the system yet.", peak))
+	}
+
+	if len(issues) == 0 {
+		return "No memory issue found."
+	}
+	return "Memory issues found:\n\n" + strings.Join(issues, "\n")
+}
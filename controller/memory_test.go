@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/junostorage/controller/server"
+	"github.com/junostorage/storage"
+)
+
+func TestCmdMemory(t *testing.T) {
+
+	testCases := []struct {
+		data string
+		res  string
+	}{
+		{
+			data: "MEMORY USAGE nokey\r\n",
+			res:  "$-1\r\n",
+		},
+		{
+			data: "MEMORY USAGE nokey SAMPLES 5\r\n",
+			res:  "$-1\r\n",
+		},
+		{
+			data: "MEMORY DOCTOR\r\n",
+		},
+		{
+			data: "MEMORY STATS\r\n",
+		},
+	}
+
+	for _, testCase := range testCases {
+		message, err := readMessage(testCase.data)
+		if err != nil {
+			t.Fatalf("reader error:%v", err)
+		}
+
+		res, err := c.cmdMemory(message)
+		if err != nil {
+			t.Errorf("cmdMemory error:%v, data:%q", err, testCase.data)
+		}
+		if testCase.res != "" && res != testCase.res {
+			t.Errorf("Expected the result to be %q, but instead found it to be %q", testCase.res, res)
+		}
+	}
+
+	message, _ := readMessage("SET memkey hallo\r\n")
+	if _, err := c.cmdSet(message); err != nil {
+		t.Fatalf("cmdSet error:%v", err)
+	}
+	message, _ = readMessage("MEMORY USAGE memkey\r\n")
+	res, err := c.cmdMemory(message)
+	if err != nil {
+		t.Fatalf("cmdMemory error:%v", err)
+	}
+	if res == "$-1\r\n" {
+		t.Errorf("Expected memory usage of memkey, got null")
+	}
+
+	message, _ = readMessage("MEMORY USAGE memkey SAMPLES -1\r\n")
+	if _, err := c.cmdMemory(message); err == nil {
+		t.Errorf("Expected error on negative samples")
+	}
+
+}
+
+func TestOutOfMemoryReply(t *testing.T) {
+
+	// the writes failing in the store after the memory check reply OOM too
+	commands["oomtest"] = &command{name: "oomtest", arity: 1, handler: func(c *Controller, conn *server.Conn, msg *server.Message) (string, error) {
+		return "", storage.ErrOutOfMemory
+	}}
+	defer delete(commands, "oomtest")
+
+	for _, outputType := range []server.Type{server.RESP, server.JSON} {
+		var buf bytes.Buffer
+		message, _ := readMessage("OOMTEST\r\n")
+		message.OutputType = outputType
+		if err := c.handleInputCommand(nil, message, &buf); err != nil {
+			t.Fatalf("handleInputCommand error:%v", err)
+		}
+		if res := buf.String(); !strings.HasPrefix(res, "-OOM ") && !strings.Contains(res, `"code":"OOM"`) {
+			t.Errorf("Expected the OOM error, got %q", res)
+		}
+	}
+	if status := httpStatus(storage.ErrOutOfMemory); status != http.StatusInsufficientStorage {
+		t.Errorf("Want status %d, got %d", http.StatusInsufficientStorage, status)
+	}
+}
@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// metricsHandler serves the server metrics in the Prometheus text
+// exposition format.
+func (c *Controller) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := c.writeMetrics(w); err != nil {
+		logs.Errorf("metrics error:%v", err)
+	}
+}
+
+// writeMetrics writes the metrics in the Prometheus text exposition format
+func (c *Controller) writeMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	metric := func(name, typ, help string, value interface{}) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, value)
+	}
+
+	c.mu.RLock()
+	clients := c.connCount()
+	dbKeys := make([][2]int, c.store.Databases())
+	for i := range dbKeys {
+		dbKeys[i][0], dbKeys[i][1] = c.store.DB(i).Len()
+	}
+	used := c.usedMemory()
+	peak := c.peakMemory()
+	hits, misses := c.keyspaceStats()
+	c.mu.RUnlock()
+
+	metric("juno_uptime_seconds", "gauge", "Number of seconds since the server started.", int64(time.Since(c.stats.started).Seconds()))
+	metric("juno_connected_clients", "gauge", "Number of client connections.", clients)
+	metric("juno_blocked_clients", "gauge", "Number of clients pending on a blocking call.", 0)
+	metric("juno_memory_used_bytes", "gauge", "Estimated number of bytes held by the dataset.", used)
+	metric("juno_memory_peak_bytes", "gauge", "Peak of the estimated number of bytes held by the dataset.", peak)
+	metric("juno_memory_max_bytes", "gauge", "The maxmemory configuration value.", c.maxmemory())
+	metric("juno_keyspace_hits_total", "counter", "Number of successful lookups of keys.", hits)
+	metric("juno_keyspace_misses_total", "counter", "Number of failed lookups of keys.", misses)
+	metric("juno_rdb_bgsave_in_progress", "gauge", "Whether a snapshot is being written.", 0)
+	metric("juno_rdb_last_bgsave_status", "gauge", "Whether the last snapshot succeeded.", 1)
+	metric("juno_aof_enabled", "gauge", "Whether the append only file is enabled.", 0)
+
+	// db0 is always reported, the other databases once they hold keys
+	fmt.Fprintf(bw, "# HELP juno_db_keys Number of keys in the database.\n# TYPE juno_db_keys gauge\n")
+	for i, n := range dbKeys {
+		if i == 0 || n[0] > 0 {
+			fmt.Fprintf(bw, "juno_db_keys{db=\"db%d\"} %d\n", i, n[0])
+		}
+	}
+	fmt.Fprintf(bw, "# HELP juno_db_keys_expiring Number of keys with an expiration in the database.\n# TYPE juno_db_keys_expiring gauge\n")
+	for i, n := range dbKeys {
+		if i == 0 || n[0] > 0 {
+			fmt.Fprintf(bw, "juno_db_keys_expiring{db=\"db%d\"} %d\n", i, n[1])
+		}
+	}
+
+	c.stats.mu.Lock()
+	metric("juno_connections_received_total", "counter", "Number of connections accepted by the server.", c.stats.totalConns)
+	metric("juno_commands_processed_total", "counter", "Number of commands processed by the server.", c.stats.totalCommands)
+	metric("juno_expired_keys_total", "counter", "Number of keys removed on expiration.", c.stats.expiredKeys)
+	metric("juno_evicted_keys_total", "counter", "Number of keys evicted due to the maxmemory limit.", c.store.EvictedKeys())
+
+	names := make([]string, 0, len(c.stats.commands))
+	for name := range c.stats.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(bw, "# HELP juno_commands_total Number of calls per command.\n# TYPE juno_commands_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(bw, "juno_commands_total{cmd=%q} %d\n", name, c.stats.commands[name].calls)
+	}
+	fmt.Fprintf(bw, "# HELP juno_commands_failed_total Number of failed calls per command.\n# TYPE juno_commands_failed_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(bw, "juno_commands_failed_total{cmd=%q} %d\n", name, c.stats.commands[name].failed)
+	}
+	fmt.Fprintf(bw, "# HELP juno_commands_rejected_total Number of calls per command rejected before execution.\n# TYPE juno_commands_rejected_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(bw, "juno_commands_rejected_total{cmd=%q} %d\n", name, c.stats.commands[name].rejected)
+	}
+
+	fmt.Fprintf(bw, "# HELP juno_command_duration_seconds Latency of the commands.\n# TYPE juno_command_duration_seconds histogram\n")
+	for _, name := range names {
+		cs := c.stats.commands[name]
+		var count int64
+		for i, le := range latencyBuckets {
+			count += cs.buckets[i]
+			fmt.Fprintf(bw, "juno_command_duration_seconds_bucket{cmd=%q,le=\"%g\"} %d\n", name, le.Seconds(), count)
+		}
+		fmt.Fprintf(bw, "juno_command_duration_seconds_bucket{cmd=%q,le=\"+Inf\"} %d\n", name, cs.calls)
+		fmt.Fprintf(bw, "juno_command_duration_seconds_sum{cmd=%q} %g\n", name, float64(cs.usec)/1e6)
+		fmt.Fprintf(bw, "juno_command_duration_seconds_count{cmd=%q} %d\n", name, cs.calls)
+	}
+
+	fmt.Fprintf(bw, "# HELP juno_pipeline_depth Number of commands read at once from a connection.\n# TYPE juno_pipeline_depth histogram\n")
+	var count int64
+	for i, le := range pipelineDepths {
+		count += c.stats.batchBuckets[i]
+		fmt.Fprintf(bw, "juno_pipeline_depth_bucket{le=\"%d\"} %d\n", le, count)
+	}
+	fmt.Fprintf(bw, "juno_pipeline_depth_bucket{le=\"+Inf\"} %d\n", c.stats.batches)
+	fmt.Fprintf(bw, "juno_pipeline_depth_sum %d\n", c.stats.batchCommands)
+	fmt.Fprintf(bw, "juno_pipeline_depth_count %d\n", c.stats.batches)
+	c.stats.mu.Unlock()
+
+	return bw.Flush()
+}
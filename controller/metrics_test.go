@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+
+	c.connsMu.Lock()
+	for conn := range c.conns {
+		delete(c.conns, conn)
+	}
+	c.connsMu.Unlock()
+	c.stats.recordCommand("lpush", 20*time.Microsecond, nil, false)
+	c.stats.recordCommand("lpush", 2*time.Second, nil, false)
+
+	rec := httptest.NewRecorder()
+	c.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Unexpected content type:%v", ct)
+	}
+
+	body := rec.Body.String()
+	for _, s := range []string{
+		"# TYPE juno_connected_clients gauge\njuno_connected_clients 0\n",
+		"# TYPE juno_command_duration_seconds histogram\n",
+		`juno_command_duration_seconds_bucket{cmd="lpush",le="1e-05"} 0` + "\n",
+		`juno_command_duration_seconds_bucket{cmd="lpush",le="5e-05"} 1` + "\n",
+		`juno_command_duration_seconds_bucket{cmd="lpush",le="1"} 1` + "\n",
+		`juno_command_duration_seconds_bucket{cmd="lpush",le="+Inf"} 2` + "\n",
+		`juno_command_duration_seconds_count{cmd="lpush"} 2` + "\n",
+		`juno_db_keys{db="db0"} `,
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("Expected %q in metrics", s)
+		}
+	}
+
+}
@@ -0,0 +1,194 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/junostorage/controller/server"
+)
+
+// monitorBacklog is the number of lines queued for a monitor, a monitor
+// that falls behind further is disconnected.
+const monitorBacklog = 4096
+
+// monitor is a connection that receives every processed command
+type monitor struct {
+	conn *server.Conn
+	ch   chan string
+}
+
+// run writes the queued lines to the connection until the monitor is
+// removed, then closes the connection. The lines were reserved on the
+// output of the connection when they were queued, the ones left once a
+// write fails are released.
+func (m *monitor) run() {
+	for line := range m.ch {
+		if _, err := m.conn.WriteReserved([]byte(line)); err != nil {
+			break
+		}
+	}
+	m.conn.Close()
+	for line := range m.ch {
+		m.conn.Release(len(line))
+	}
+}
+
+// addMonitor turns the connection into a feed of the processed commands
+func (c *Controller) addMonitor(conn *server.Conn) {
+	c.monitorsMu.Lock()
+	defer c.monitorsMu.Unlock()
+
+	if _, ok := c.monitors[conn]; ok {
+		return
+	}
+	m := &monitor{conn: conn, ch: make(chan string, monitorBacklog)}
+	c.monitors[conn] = m
+	go m.run()
+}
+
+// removeMonitor stops the feed of the connection, if any
+func (c *Controller) removeMonitor(conn *server.Conn) {
+	c.monitorsMu.Lock()
+	defer c.monitorsMu.Unlock()
+
+	if m, ok := c.monitors[conn]; ok {
+		delete(c.monitors, conn)
+		close(m.ch)
+	}
+}
+
+// feedMonitors sends the command to the monitors. It never blocks, the
+// monitors that can't keep up or are over their output limit are
+// disconnected.
+func (c *Controller) feedMonitors(conn *server.Conn, msg *server.Message) {
+	c.monitorsMu.Lock()
+	defer c.monitorsMu.Unlock()
+
+	if len(c.monitors) == 0 {
+		return
+	}
+
+	addr := clientAddr(conn, msg)
+	if conn != nil && conn.IsUnix() {
+		addr = "unix:" + conn.LocalAddr().String()
+	}
+	line := monitorLine(time.Now(), addr, msg)
+	var jsonLine string
+	for mc, m := range c.monitors {
+		line := line
+		if mc.OutputType() == server.JSON {
+			if jsonLine == "" {
+				jsonLine = monitorJSON(line)
+			}
+			line = jsonLine
+			if !mc.Framed() {
+				line += "\r\n"
+			}
+		}
+		if err := mc.Reserve(len(line)); err != nil {
+			logs.Warnf("disconnecting monitor %v: %v", mc.RemoteAddr(), err)
+			delete(c.monitors, mc)
+			close(m.ch)
+			continue
+		}
+		select {
+		case m.ch <- line:
+		default:
+			logs.Warnf("disconnecting monitor %v: output backlog exceeded", mc.RemoteAddr())
+			mc.Release(len(line))
+			delete(c.monitors, mc)
+			close(m.ch)
+		}
+	}
+}
+
+// monitorLine formats a command like Redis MONITOR does, e.g.
+// +1339518083.107412 [0 127.0.0.1:60866] "keys" "*"
+func monitorLine(t time.Time, addr string, msg *server.Message) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "+%d.%06d [%d %s]", t.Unix(), t.Nanosecond()/1000, msg.DB, addr)
+
+	redactFrom := redactedArgs(msg)
+	for i, v := range msg.Values {
+		buf.WriteByte(' ')
+		if i >= redactFrom {
+			buf.WriteString(`"(redacted)"`)
+			continue
+		}
+		buf.WriteString(quoteArg(v.String()))
+	}
+	buf.WriteString("\r\n")
+	return buf.String()
+}
+
+// monitorJSON returns the line of the JSON monitors, e.g.
+// {"monitor":"1339518083.107412 [0 127.0.0.1:60866] \"keys\" \"*\""}
+func monitorJSON(line string) string {
+	data, _ := json.Marshal(struct {
+		Monitor string `json:"monitor"`
+	}{strings.TrimSuffix(strings.TrimPrefix(line, "+"), "\r\n")})
+	return string(data)
+}
+
+// redactedArgs returns the index of the first argument of the message
+// that must not be shown to the monitors, e.g. passwords.
+func redactedArgs(msg *server.Message) int {
+	switch msg.Command {
+	case "auth":
+		return 1
+	case "hello":
+		for i, v := range msg.Values {
+			if strings.ToLower(v.String()) == "auth" {
+				return i + 1
+			}
+		}
+	case "acl":
+		if len(msg.Values) > 1 && strings.ToLower(msg.Values[1].String()) == "setuser" {
+			return 3
+		}
+	case "config":
+		if len(msg.Values) > 1 && strings.ToLower(msg.Values[1].String()) == "set" {
+			for i := 2; i < len(msg.Values); i += 2 {
+				if strings.ToLower(msg.Values[i].String()) == "requirepass" {
+					return i + 1
+				}
+			}
+		}
+	}
+	return len(msg.Values)
+}
+
+// quoteArg quotes the argument escaping the special and non-printable
+// characters.
+func quoteArg(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch b := s[i]; b {
+		case '\\', '"':
+			buf.WriteByte('\\')
+			buf.WriteByte(b)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\a':
+			buf.WriteString(`\a`)
+		case '\b':
+			buf.WriteString(`\b`)
+		default:
+			if b < 0x20 || b > 0x7e {
+				fmt.Fprintf(&buf, `\x%02x`, b)
+			} else {
+				buf.WriteByte(b)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
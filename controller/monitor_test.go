@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/junostorage/controller/server"
+)
+
+func TestMonitorLine(t *testing.T) {
+
+	testCases := []struct {
+		data string
+		line string
+	}{
+		{
+			data: "SET mkey \"hal\\\"lo\"\r\n",
+			line: `+1339518083.107412 [0 127.0.0.1:60866] "SET" "mkey" "\"hal\\\"lo\""` + "\r\n",
+		},
+		{
+			data: "AUTH user secret\r\n",
+			line: `+1339518083.107412 [0 127.0.0.1:60866] "AUTH" "(redacted)" "(redacted)"` + "\r\n",
+		},
+		{
+			data: "HELLO 3 AUTH user secret\r\n",
+			line: `+1339518083.107412 [0 127.0.0.1:60866] "HELLO" "3" "AUTH" "(redacted)" "(redacted)"` + "\r\n",
+		},
+	}
+
+	ts := time.Unix(1339518083, 107412000)
+	for _, testCase := range testCases {
+		message, err := readMessage(testCase.data)
+		if err != nil {
+			t.Fatalf("reader error:%v", err)
+		}
+		if line := monitorLine(ts, "127.0.0.1:60866", message); line != testCase.line {
+			t.Errorf("Expected %q, got %q", testCase.line, line)
+		}
+	}
+
+}
+
+func TestMonitorFeed(t *testing.T) {
+
+	client, srv := net.Pipe()
+	defer client.Close()
+	conn := &server.Conn{Conn: srv}
+
+	c.addMonitor(conn)
+	defer c.removeMonitor(conn)
+
+	message, _ := readMessage("GET mkey\r\n")
+	message.RemoteAddr = "127.0.0.1:5000"
+	c.feedMonitors(nil, message)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read error:%v", err)
+	}
+	if want := ` [0 127.0.0.1:5000] "GET" "mkey"` + "\r\n"; len(line) < len(want) || line[len(line)-len(want):] != want {
+		t.Errorf("Expected %q suffix, got %q", want, line)
+	}
+
+	// the lines of a monitor not reading are released once it's dropped
+	stuck, stuckSrv := net.Pipe()
+	stuckConn := &server.Conn{Conn: stuckSrv}
+	c.addMonitor(stuckConn)
+	for i := 0; i < monitorBacklog+2; i++ {
+		c.feedMonitors(nil, message)
+	}
+	c.monitorsMu.Lock()
+	_, ok := c.monitors[stuckConn]
+	c.monitorsMu.Unlock()
+	if ok {
+		t.Errorf("Expected the monitor to be dropped")
+	}
+	stuck.Close()
+	for i := 0; stuckConn.Output() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("Expected no output left, got %d", stuckConn.Output())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+}
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"io"
+
+	"github.com/junostorage/controller/server"
+	"github.com/junostorage/storage"
+)
+
+// handleBatch runs the commands pipelined by a client. The runs of
+// commands only needing the controller read lock are admitted at once,
+// they wait for CLIENT PAUSE and take the lock a single time.
+func (c *Controller) handleBatch(conn *server.Conn, msgs []*server.Message, w io.Writer) error {
+	c.stats.recordBatch(len(msgs))
+
+	for len(msgs) > 0 {
+		n, write := batchable(msgs)
+		if n < 2 {
+			n = 1
+			if err := c.runPipelined(conn, msgs[0], w, false); err != nil {
+				return err
+			}
+		} else if err := c.runAdmitted(conn, msgs[:n], w, write); err != nil {
+			return err
+		}
+		if conn.Closing() {
+			return nil
+		}
+		msgs = msgs[n:]
+	}
+	return nil
+}
+
+// runAdmitted runs the commands under a single controller read lock, once
+// CLIENT PAUSE lets them through. The replies are kept in the output
+// buffer of the connection until the batch is done, so a client that
+// doesn't read them never holds the lock.
+func (c *Controller) runAdmitted(conn *server.Conn, msgs []*server.Message, w io.Writer, write bool) error {
+	c.pause.wait(write)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, msg := range msgs {
+		if err := c.runPipelined(conn, msg, w, true); err != nil {
+			return err
+		}
+		if conn.Closing() {
+			return nil
+		}
+	}
+	return nil
+}
+
+// runPipelined runs a command of a pipeline with the state of the
+// connection when it's its turn, e.g. the database selected or the output
+// set by the previous commands
+func (c *Controller) runPipelined(conn *server.Conn, msg *server.Message, w io.Writer, admitted bool) error {
+	conn.Touch(msg.Command, msg.InputBuffered)
+	msg.Proto = conn.Proto()
+	msg.DB = conn.DB()
+	msg.OutputType = conn.OutputType()
+	return c.runCommand(conn, msg, w, admitted)
+}
+
+// batchable returns the number of leading commands that can be admitted
+// at once and whether one of them writes. The exclusive commands need the
+// controller write lock, PING, MONITOR and SHUTDOWN take their own path
+// and CLIENT must not wait for CLIENT PAUSE.
+func batchable(msgs []*server.Message) (n int, write bool) {
+	for _, msg := range msgs {
+		cmd, ok := lookupCommand(msg.Values)
+		if !ok {
+			break
+		}
+		root := cmd
+		if cmd.parent != nil {
+			root = cmd.parent
+		}
+		if root.exclusive || root.name == "ping" || root.name == storage.CmdMonitor ||
+			root.name == storage.CmdShutdown || root.name == storage.CmdClient {
+			break
+		}
+		if cmd.flags&flagWrite != 0 {
+			write = true
+		}
+		n++
+	}
+	return
+}
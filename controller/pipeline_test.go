@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/junostorage/config"
+	"github.com/junostorage/controller/server"
+)
+
+func TestPipeline(t *testing.T) {
+
+	pc := newController(config.New())
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	conn := server.NewConn(p1)
+
+	var msgs []*server.Message
+	for _, data := range []string{"SELECT 1\r\n", "SET k pipelined\r\n", "GET k\r\n", "CONFIG GET databases\r\n", "SELECT 0\r\n", "GET k\r\n"} {
+		message, err := readMessage(data)
+		if err != nil {
+			t.Fatalf("reader error:%v", err)
+		}
+		msgs = append(msgs, message)
+	}
+
+	// the commands see the database selected by the previous ones
+	var buf bytes.Buffer
+	if err := pc.handleBatch(conn, msgs, &buf); err != nil {
+		t.Fatalf("handleBatch error:%v", err)
+	}
+	expected := "+OK\r\n+OK\r\n$9\r\npipelined\r\n*2\r\n$9\r\ndatabases\r\n$2\r\n16\r\n+OK\r\n$-1\r\n"
+	if res := buf.String(); res != expected {
+		t.Errorf("Expected %q, got %q", expected, res)
+	}
+
+	if n, write := batchable(msgs); n != 3 || !write {
+		t.Errorf("Expected 3 admitted write commands, got %d %v", n, write)
+	}
+
+	buf.Reset()
+	message, _ := readMessage("INFO stats\r\n")
+	pc.handleInputCommand(nil, message, &buf)
+	for _, field := range []string{"total_pipelines:1\r\n", "pipeline_depth_avg:6.00\r\n", "pipeline_depth_max:6\r\n"} {
+		if !strings.Contains(buf.String(), field) {
+			t.Errorf("Expected %q in INFO stats", field)
+		}
+	}
+}
+
+func TestAcceptRunning(t *testing.T) {
+
+	pc := newController(config.New())
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	conn := server.NewConn(p1)
+
+	// the connections are accepted and closed while commands hold the
+	// controller lock, e.g. writing to a slow client
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+	done := make(chan error)
+	go func() {
+		err := pc.connOpened(conn)
+		pc.connClosed(conn)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("connOpened error:%v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Want the connection accepted without the controller lock")
+	}
+}
@@ -0,0 +1,443 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/junostorage/acl"
+	"github.com/junostorage/controller/server"
+	"github.com/junostorage/storage"
+	"github.com/junostorage/utils/glob"
+
+	"github.com/junostorage/resp"
+)
+
+// pubsubBacklog is the number of frames queued for a subscriber, a
+// subscriber that falls behind further is disconnected.
+const pubsubBacklog = 4096
+
+var errPubsubHTTP = errors.New("pub/sub subscriptions are not supported over HTTP")
+
+// subscriber is a connection subscribed to channels or patterns. The frames
+// are written by its own goroutine so a slow subscriber never blocks the
+// publishers.
+type subscriber struct {
+	conn     *server.Conn
+	ch       chan []byte
+	channels map[string]bool
+	patterns map[string]bool
+}
+
+// run writes the queued frames to the connection until the subscriber is
+// removed, then closes the connection. The frames were reserved on the
+// output of the connection when they were queued, the ones left once a
+// write fails are released.
+func (s *subscriber) run(ch <-chan []byte) {
+	for frame := range ch {
+		if _, err := s.conn.WriteReserved(frame); err != nil {
+			break
+		}
+	}
+	s.conn.Close()
+	for frame := range ch {
+		s.conn.Release(len(frame))
+	}
+}
+
+// count returns the number of subscriptions of the subscriber
+func (s *subscriber) count() int {
+	return len(s.channels) + len(s.patterns)
+}
+
+// pubsub holds the subscriptions to the channels and the patterns
+type pubsub struct {
+	mu          sync.Mutex
+	subscribers map[*server.Conn]*subscriber
+	channels    map[string]map[*subscriber]bool
+	patterns    map[string]map[*subscriber]bool
+	// queued holds the connections with a subscriber, their replies are
+	// queued too. It's read without the lock by every reply.
+	queued sync.Map
+}
+
+func newPubsub() *pubsub {
+	return &pubsub{
+		subscribers: make(map[*server.Conn]*subscriber),
+		channels:    make(map[string]map[*subscriber]bool),
+		patterns:    make(map[string]map[*subscriber]bool),
+	}
+}
+
+// pushFrame returns the frame of a pub/sub event, a push for the RESP3
+// connections and an array otherwise. The JSON connections get an object,
+// e.g. {"push":["message","news","hello"]}.
+func pushFrame(conn *server.Conn, vals ...resp.Value) []byte {
+	v := resp.PushValue(vals)
+	if conn.OutputType() == server.JSON {
+		data, _ := json.Marshal(struct {
+			Push interface{} `json:"push"`
+		}{jsonData(v)})
+		if !conn.Framed() {
+			data = append(data, '\r', '\n')
+		}
+		return data
+	}
+	if conn.Proto() < 3 {
+		v = v.RESP2()
+	}
+	data, _ := v.MarshalRESP()
+	return data
+}
+
+// send queues the frame, the subscribers that can't keep up are
+// disconnected, either when their backlog is full or when their output is
+// over the client-output-buffer-limit. The caller holds the lock.
+func (ps *pubsub) send(s *subscriber, frame []byte) {
+	if s.ch == nil {
+		return
+	}
+	if err := s.conn.Reserve(len(frame)); err != nil {
+		logs.Warnf("disconnecting subscriber %v: %v", s.conn.RemoteAddr(), err)
+		close(s.ch)
+		s.ch = nil
+		return
+	}
+	select {
+	case s.ch <- frame:
+	default:
+		logs.Warnf("disconnecting subscriber %v: output backlog exceeded", s.conn.RemoteAddr())
+		s.conn.Release(len(frame))
+		close(s.ch)
+		s.ch = nil
+	}
+}
+
+// subscriber returns the subscriber of the connection, it is created on the
+// first subscription. The caller holds the lock.
+func (ps *pubsub) subscriber(conn *server.Conn) *subscriber {
+	s, ok := ps.subscribers[conn]
+	if !ok {
+		s = &subscriber{
+			conn:     conn,
+			ch:       make(chan []byte, pubsubBacklog),
+			channels: make(map[string]bool),
+			patterns: make(map[string]bool),
+		}
+		ps.subscribers[conn] = s
+		ps.queued.Store(conn, true)
+		go s.run(s.ch)
+	}
+	return s
+}
+
+// reply queues the reply of a command of a connection with a subscriber,
+// so it's written after the acknowledgments and the messages queued
+// before it. It returns false when the connection has no subscriber, the
+// reply is written as usual then.
+func (ps *pubsub) reply(conn *server.Conn, res string) bool {
+	if _, ok := ps.queued.Load(conn); !ok {
+		return false
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	s, ok := ps.subscribers[conn]
+	if !ok {
+		return false
+	}
+	ps.send(s, []byte(res))
+	return true
+}
+
+// push queues a frame for the connection whether it's subscribed or not,
+// e.g. the invalidation messages of client side caching.
+func (ps *pubsub) push(conn *server.Conn, vals ...resp.Value) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.send(ps.subscriber(conn), pushFrame(conn, vals...))
+}
+
+// subscribe adds the subscriptions of the connection, one acknowledgment
+// is queued per channel. The acknowledgments go through the queue of the
+// subscriber so they are received before the messages, and before the
+// replies of the next commands which are queued too.
+func (ps *pubsub) subscribe(conn *server.Conn, names []string, pattern bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	s := ps.subscriber(conn)
+	kind, subs, index := "subscribe", s.channels, ps.channels
+	if pattern {
+		kind, subs, index = "psubscribe", s.patterns, ps.patterns
+	}
+	for _, name := range names {
+		if !subs[name] {
+			subs[name] = true
+			if index[name] == nil {
+				index[name] = make(map[*subscriber]bool)
+			}
+			index[name][s] = true
+		}
+		ps.send(s, pushFrame(conn, resp.StringValue(kind), resp.StringValue(name), resp.IntegerValue(s.count())))
+	}
+	conn.SetPubsub(true)
+}
+
+// unsubscribe removes the subscriptions of the connection, all of them
+// when no names are given.
+func (ps *pubsub) unsubscribe(conn *server.Conn, names []string, pattern bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	s := ps.subscriber(conn)
+	kind, subs, index := "unsubscribe", s.channels, ps.channels
+	if pattern {
+		kind, subs, index = "punsubscribe", s.patterns, ps.patterns
+	}
+	if len(names) == 0 {
+		for name := range subs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			ps.send(s, pushFrame(conn, resp.StringValue(kind), resp.NilValue(), resp.IntegerValue(s.count())))
+			return
+		}
+	}
+	for _, name := range names {
+		if subs[name] {
+			delete(subs, name)
+			delete(index[name], s)
+			if len(index[name]) == 0 {
+				delete(index, name)
+			}
+		}
+		ps.send(s, pushFrame(conn, resp.StringValue(kind), resp.StringValue(name), resp.IntegerValue(s.count())))
+	}
+	conn.SetPubsub(s.count() > 0)
+}
+
+// remove drops the subscriptions of the closed connection
+func (ps *pubsub) remove(conn *server.Conn) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	s, ok := ps.subscribers[conn]
+	if !ok {
+		return
+	}
+	delete(ps.subscribers, conn)
+	ps.queued.Delete(conn)
+	for name := range s.channels {
+		delete(ps.channels[name], s)
+		if len(ps.channels[name]) == 0 {
+			delete(ps.channels, name)
+		}
+	}
+	for name := range s.patterns {
+		delete(ps.patterns[name], s)
+		if len(ps.patterns[name]) == 0 {
+			delete(ps.patterns, name)
+		}
+	}
+	if s.ch != nil {
+		close(s.ch)
+		s.ch = nil
+	}
+}
+
+// publish sends the message to the subscribers of the channel and of the
+// matching patterns, it returns the number of receivers.
+func (ps *pubsub) publish(channel, message string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	n := 0
+	for s := range ps.channels[channel] {
+		ps.send(s, pushFrame(s.conn, resp.StringValue("message"), resp.StringValue(channel), resp.StringValue(message)))
+		n++
+	}
+	for pattern, subs := range ps.patterns {
+		if matched, _ := glob.Match(pattern, channel); !matched {
+			continue
+		}
+		for s := range subs {
+			ps.send(s, pushFrame(s.conn, resp.StringValue("pmessage"), resp.StringValue(pattern), resp.StringValue(channel), resp.StringValue(message)))
+			n++
+		}
+	}
+	return n
+}
+
+// counts returns the number of channel and pattern subscriptions of the
+// connection.
+func (ps *pubsub) counts(conn *server.Conn) (channels, patterns int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if s, ok := ps.subscribers[conn]; ok {
+		return len(s.channels), len(s.patterns)
+	}
+	return 0, 0
+}
+
+// subscribed reports whether the connection is in the subscribed state
+func (ps *pubsub) subscribed(conn *server.Conn) bool {
+	channels, patterns := ps.counts(conn)
+	return channels+patterns > 0
+}
+
+// subscribedCommands are the commands a RESP2 connection can run while
+// subscribed
+var subscribedCommands = map[string]bool{
+	storage.CmdSubscribe:    true,
+	storage.CmdUnsubscribe:  true,
+	storage.CmdPsubscribe:   true,
+	storage.CmdPunsubscribe: true,
+	"ping":                  true,
+	"quit":                  true,
+}
+
+// checkSubscribed returns an error when a RESP2 subscribed connection runs
+// a command that is not a pub/sub one, the RESP3 and the JSON connections
+// can run any command as the messages are told apart from the replies.
+func (c *Controller) checkSubscribed(conn *server.Conn, msg *server.Message) error {
+	if conn == nil || conn.Proto() >= 3 || conn.OutputType() == server.JSON || subscribedCommands[msg.Command] {
+		return nil
+	}
+	if !c.pubsub.subscribed(conn) {
+		return nil
+	}
+	return fmt.Errorf("Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", msg.Command)
+}
+
+// checkChannels returns an error when the user of the connection can't
+// access one of the channels or patterns.
+func (c *Controller) checkChannels(conn *server.Conn, msg *server.Message, names []string, pattern bool) error {
+	user := connUser(conn, msg)
+	for _, name := range names {
+		check := c.acl.CheckChannel
+		if pattern {
+			check = c.acl.CheckPattern
+		}
+		if err := check(user, name); err != nil {
+			c.acl.Log().Add(acl.ReasonChannel, "toplevel", name, user, c.aclClientInfo(conn, msg))
+			return errReply{"NOPERM", err.Error()}
+		}
+	}
+	return nil
+}
+
+// SUBSCRIBE channel [channel ...]
+// PSUBSCRIBE pattern [pattern ...]
+func (c *Controller) cmdSubscribe(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) < 2 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+	if conn == nil {
+		return "", errPubsubHTTP
+	}
+
+	pattern := msg.Command == storage.CmdPsubscribe
+	names := stringArgs(msg.Values[1:])
+	if err := c.checkChannels(conn, msg, names, pattern); err != nil {
+		return "", err
+	}
+	c.pubsub.subscribe(conn, names, pattern)
+
+	return "", nil
+}
+
+// UNSUBSCRIBE [channel ...]
+// PUNSUBSCRIBE [pattern ...]
+func (c *Controller) cmdUnsubscribe(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	if conn == nil {
+		return "", errPubsubHTTP
+	}
+
+	c.pubsub.unsubscribe(conn, stringArgs(msg.Values[1:]), msg.Command == storage.CmdPunsubscribe)
+
+	return "", nil
+}
+
+// PUBLISH channel message
+func (c *Controller) cmdPublish(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 3 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	channel := msg.Values[1].String()
+	if err := c.checkChannels(conn, msg, []string{channel}, false); err != nil {
+		return "", err
+	}
+
+	return integerOutput(msg, c.pubsub.publish(channel, msg.Values[2].String()))
+}
+
+// PUBSUB CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT
+func (c *Controller) cmdPubsub(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) < 2 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	ps := c.pubsub
+	switch strings.ToLower(msg.Values[1].String()) {
+	default:
+		return "", fmt.Errorf("unknown subcommand '%s'. Try PUBSUB HELP.", msg.Values[1].String())
+	case "channels":
+		if len(msg.Values) > 3 {
+			return "", errInvalidNumberOfArguments
+		}
+		pattern := "*"
+		if len(msg.Values) == 3 {
+			pattern = msg.Values[2].String()
+		}
+		ps.mu.Lock()
+		var channels []string
+		for name := range ps.channels {
+			if matched, _ := glob.Match(pattern, name); matched {
+				channels = append(channels, name)
+			}
+		}
+		ps.mu.Unlock()
+		sort.Strings(channels)
+		return stringsOutput(msg, channels)
+	case "numsub":
+		ps.mu.Lock()
+		vals := make([]resp.Value, 0, (len(msg.Values)-2)*2)
+		for _, v := range msg.Values[2:] {
+			vals = append(vals, resp.StringValue(v.String()), resp.IntegerValue(len(ps.channels[v.String()])))
+		}
+		ps.mu.Unlock()
+		return valueOutput(msg, resp.MapValue(vals))
+	case "numpat":
+		if len(msg.Values) != 2 {
+			return "", errInvalidNumberOfArguments
+		}
+		ps.mu.Lock()
+		n := len(ps.patterns)
+		ps.mu.Unlock()
+		return integerOutput(msg, n)
+	}
+}
+
+// stringArgs returns the arguments as strings
+func stringArgs(vals []resp.Value) []string {
+	args := make([]string, 0, len(vals))
+	for _, v := range vals {
+		args = append(args, v.String())
+	}
+	return args
+}
@@ -0,0 +1,225 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/junostorage/controller/server"
+)
+
+// sendCommand runs the command on the connection like the server does and
+// returns the reply.
+func sendCommand(t *testing.T, conn *server.Conn, data string) string {
+	var buf bytes.Buffer
+	message, err := readMessage(data)
+	if err != nil {
+		t.Fatalf("reader error:%v", err)
+	}
+	message.Proto = conn.Proto()
+	message.DB = conn.DB()
+	if err := c.handleInputCommand(conn, message, &buf); err != nil {
+		t.Fatalf("handleInputCommand error:%v", err)
+	}
+	return buf.String()
+}
+
+func TestHello(t *testing.T) {
+
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	conn := server.NewConn(p1)
+
+	if res := sendCommand(t, conn, "HELLO 4\r\n"); !strings.HasPrefix(res, "-NOPROTO ") {
+		t.Errorf("Expected NOPROTO, got %q", res)
+	}
+	if res := sendCommand(t, conn, "HELLO 3 SETNAME worker-1\r\n"); !strings.HasPrefix(res, "%7\r\n$6\r\nserver\r\n") || !strings.Contains(res, "$5\r\nproto\r\n:3\r\n") {
+		t.Errorf("Expected a RESP3 map, got %q", res)
+	}
+	if conn.Proto() != 3 || conn.Name() != "worker-1" {
+		t.Errorf("Expected proto 3 and name worker-1, got %d %q", conn.Proto(), conn.Name())
+	}
+
+	sendCommand(t, conn, "HSET hello:h f1 v1\r\n")
+	if res := sendCommand(t, conn, "HGETALL hello:h\r\n"); res != "%1\r\n$2\r\nf1\r\n$2\r\nv1\r\n" {
+		t.Errorf("Expected a map, got %q", res)
+	}
+	if res := sendCommand(t, conn, "GET hello:missing\r\n"); res != "_\r\n" {
+		t.Errorf("Expected a RESP3 null, got %q", res)
+	}
+
+	if res := sendCommand(t, conn, "HELLO 2\r\n"); !strings.HasPrefix(res, "*14\r\n") {
+		t.Errorf("Expected a RESP2 array, got %q", res)
+	}
+	if res := sendCommand(t, conn, "GET hello:missing\r\n"); res != "$-1\r\n" {
+		t.Errorf("Expected a RESP2 null, got %q", res)
+	}
+
+	// authentication with HELLO
+	c.acl.SetUser("hello-user", "on", ">secret", "+@all", "~*")
+	defer c.acl.DelUser("hello-user")
+	if res := sendCommand(t, conn, "HELLO 3 AUTH hello-user wrong\r\n"); !strings.HasPrefix(res, "-WRONGPASS ") {
+		t.Errorf("Expected WRONGPASS, got %q", res)
+	}
+	if res := sendCommand(t, conn, "HELLO 3 AUTH hello-user secret\r\n"); !strings.HasPrefix(res, "%7\r\n") || conn.User() != "hello-user" {
+		t.Errorf("Expected hello-user to be authenticated, got %q %q", res, conn.User())
+	}
+
+}
+
+func TestPubsub(t *testing.T) {
+
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	subConn := server.NewConn(p1)
+	defer c.pubsub.remove(subConn)
+	rd := bufio.NewReader(p2)
+
+	// read returns the next frame of the subscriber
+	read := func(n int) string {
+		p2.SetReadDeadline(time.Now().Add(time.Second))
+		var buf bytes.Buffer
+		for i := 0; i < n; i++ {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				t.Fatalf("read error:%v", err)
+			}
+			buf.WriteString(line)
+		}
+		return buf.String()
+	}
+
+	var buf bytes.Buffer
+	publish := func(data string) string {
+		buf.Reset()
+		message, _ := readMessage(data)
+		if err := c.handleInputCommand(nil, message, &buf); err != nil {
+			t.Fatalf("handleInputCommand error:%v", err)
+		}
+		return buf.String()
+	}
+
+	sendCommand(t, subConn, "SUBSCRIBE news\r\n")
+	if frame := read(6); frame != "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n" {
+		t.Errorf("Unexpected subscribe frame %q", frame)
+	}
+	sendCommand(t, subConn, "PSUBSCRIBE n*\r\n")
+	read(6)
+
+	if res := sendCommand(t, subConn, "GET mkey\r\n"); !strings.HasPrefix(res, "-ERR Can't execute 'get'") {
+		t.Errorf("Expected the command to be refused, got %q", res)
+	}
+	// there is no RESET command to leave the subscribed state
+	if res := sendCommand(t, subConn, "RESET\r\n"); !strings.HasPrefix(res, "-ERR Can't execute 'reset'") {
+		t.Errorf("Expected the subscribed error, got %q", res)
+	}
+	if res := publish("PUBLISH news hi\r\n"); res != ":2\r\n" {
+		t.Errorf("Expected 2 receivers, got %q", res)
+	}
+	if frame := read(7); frame != "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$2\r\nhi\r\n" {
+		t.Errorf("Unexpected message frame %q", frame)
+	}
+	if frame := read(9); frame != "*4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnews\r\n$2\r\nhi\r\n" {
+		t.Errorf("Unexpected pmessage frame %q", frame)
+	}
+
+	if res := publish("PUBSUB NUMSUB news other\r\n"); res != "*4\r\n$4\r\nnews\r\n:1\r\n$5\r\nother\r\n:0\r\n" {
+		t.Errorf("Unexpected NUMSUB reply %q", res)
+	}
+	if info := c.clientInfo(subConn); !strings.Contains(info, " flags=P ") || !strings.Contains(info, " sub=1 psub=1 ") {
+		t.Errorf("Unexpected client info %q", info)
+	}
+
+	// RESP3 connections receive push frames and can run any command
+	subConn.SetProto(3)
+	if res := sendCommand(t, subConn, "GET mkey\r\n"); strings.HasPrefix(res, "-") {
+		t.Errorf("Expected the command to run, got %q", res)
+	}
+	publish("PUBLISH news hi\r\n")
+	if frame := read(7); frame != ">3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$2\r\nhi\r\n" {
+		t.Errorf("Unexpected push frame %q", frame)
+	}
+	read(9)
+
+	sendCommand(t, subConn, "UNSUBSCRIBE\r\n")
+	if frame := read(6); frame != ">3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:1\r\n" {
+		t.Errorf("Unexpected unsubscribe frame %q", frame)
+	}
+
+	// the channel permissions are checked
+	c.acl.SetUser("pubsub-user", "on", "nopass", "+@all", "&allowed")
+	defer c.acl.DelUser("pubsub-user")
+	p3, p4 := net.Pipe()
+	defer p3.Close()
+	defer p4.Close()
+	other := server.NewConn(p3)
+	other.SetUser("pubsub-user")
+	if res := sendCommand(t, other, "SUBSCRIBE denied\r\n"); !strings.HasPrefix(res, "-NOPERM ") {
+		t.Errorf("Expected NOPERM, got %q", res)
+	}
+}
+
+func TestPubsubOrder(t *testing.T) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go server.Serve(ln, c.handleBatch, c.connOpened, c.connClosed)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	read := func(n int) string {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var buf bytes.Buffer
+		for i := 0; i < n; i++ {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				t.Fatalf("read error:%v", err)
+			}
+			buf.WriteString(line)
+		}
+		return buf.String()
+	}
+
+	// the replies of the pipelined commands follow the acknowledgments
+	for i := 0; i < 10; i++ {
+		conn.Write([]byte("SUBSCRIBE order\r\nPING\r\nUNSUBSCRIBE order\r\nPING\r\n"))
+		want := "*3\r\n$9\r\nsubscribe\r\n$5\r\norder\r\n:1\r\n*2\r\n$4\r\npong\r\n$0\r\n\r\n" +
+			"*3\r\n$11\r\nunsubscribe\r\n$5\r\norder\r\n:0\r\n+PONG\r\n"
+		if res := read(18); res != want {
+			t.Fatalf("Want: %q, got: %q", want, res)
+		}
+	}
+}
+
+func TestPubsubBacklog(t *testing.T) {
+
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	conn := server.NewConn(p1)
+	defer c.pubsub.remove(conn)
+
+	// the frames of a subscriber not reading are released once it's dropped
+	c.pubsub.subscribe(conn, []string{"backlog"}, false)
+	for i := 0; i < pubsubBacklog+2; i++ {
+		c.pubsub.publish("backlog", "hi")
+	}
+	p2.Close()
+	for i := 0; conn.Output() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("Expected no output left, got %d", conn.Output())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
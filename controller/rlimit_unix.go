@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package controller
+
+import (
+	"syscall"
+)
+
+// fittingClients returns the number of clients up to n fitting in the
+// open files limit of the process, the runtime already raised it to the
+// hard limit
+func fittingClients(n int64) int64 {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return n
+	}
+	limit := uint64(rl.Cur)
+	switch {
+	case limit >= uint64(n)+reservedFDs:
+		return n
+	case limit <= reservedFDs:
+		return 1
+	}
+	return int64(limit) - reservedFDs
+}
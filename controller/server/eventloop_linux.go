@@ -0,0 +1,503 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// readBufferSize is the size of the read buffer of a worker, it's
+	// shared by the connections the worker serves
+	readBufferSize = 64 << 10
+	// workerIdleTimeout is the time the workers started beyond the pool
+	// size wait for a connection before they exit
+	workerIdleTimeout = 5 * time.Second
+	// the events a connection waits for, it's served by one worker at a
+	// time
+	connEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+)
+
+var errConnClosed = errors.New("use of closed network connection")
+
+// ListenAndServeEventLoop starts a server at the specified address whose
+// connections are multiplexed by an epoll event loop instead of having a
+// goroutine and a read buffer each. The commands are run by a pool of
+// workers, at least workers of them, GOMAXPROCS when it's 0.
+func ListenAndServeEventLoop(
+	host string, port int,
+	workers int,
+	handler BatchHandler,
+	opened func(conn *Conn) error,
+	closed func(conn *Conn),
+	lnp *net.Listener,
+) error {
+	ln, err := net.Listen("tcp", fmt.Sprintf("%s:%d", host, port))
+	if err != nil {
+		return err
+	}
+	if lnp != nil {
+		*lnp = ln
+	}
+	log.Printf("The server is now ready to accept connections on port %d with an event loop\n", port)
+	return ServeEventLoop(ln, workers, handler, opened, closed)
+}
+
+// ServeEventLoop serves the connections accepted by the listener with an
+// event loop until the listener is closed, the connections are shut down
+// then.
+func ServeEventLoop(
+	ln net.Listener,
+	workers int,
+	handler BatchHandler,
+	opened func(conn *Conn) error,
+	closed func(conn *Conn),
+) error {
+	el, err := newEventLoop(workers, handler, opened, closed)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	defer el.close()
+
+	for {
+		conn, err := accept(ln)
+		if err != nil {
+			return err
+		}
+		if err := el.add(conn); err != nil {
+			conn.Close()
+		}
+	}
+}
+
+// eventLoop waits for the connections to be readable and hands them to
+// the workers
+type eventLoop struct {
+	epfd int
+	// wake is the pipe waking the event loop up when it's closed
+	wake    [2]int
+	handler BatchHandler
+	opened  func(conn *Conn) error
+	closed  func(conn *Conn)
+	// tasks hands the readable connections to the idle workers
+	tasks chan *loopConn
+	done  chan struct{}
+
+	mu    sync.Mutex
+	conns map[int]*loopConn
+}
+
+// loopConn is a connection of the event loop
+type loopConn struct {
+	conn *Conn
+	fc   *fdConn
+	// pending is the partial message left by the last read
+	pending []byte
+}
+
+func newEventLoop(workers int, handler BatchHandler, opened func(conn *Conn) error, closed func(conn *Conn)) (*eventLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	var wake [2]int
+	if err := syscall.Pipe2(wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(wake[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, wake[0], &ev); err != nil {
+		syscall.Close(epfd)
+		syscall.Close(wake[0])
+		syscall.Close(wake[1])
+		return nil, err
+	}
+	el := &eventLoop{
+		epfd:    epfd,
+		wake:    wake,
+		handler: handler,
+		opened:  opened,
+		closed:  closed,
+		tasks:   make(chan *loopConn),
+		done:    make(chan struct{}),
+		conns:   make(map[int]*loopConn),
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	for i := 0; i < workers; i++ {
+		go el.worker(nil, false)
+	}
+	go el.wait()
+	return el, nil
+}
+
+// add takes the connection over from the Go runtime, the socket is
+// duplicated and the net.Conn closed.
+func (el *eventLoop) add(c net.Conn) error {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return errors.New("the connection has no file descriptor")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	fd, dupErr := -1, error(nil)
+	if err := raw.Control(func(s uintptr) { fd, dupErr = syscall.Dup(int(s)) }); err != nil {
+		return err
+	}
+	if dupErr != nil {
+		return dupErr
+	}
+	laddr, raddr := c.LocalAddr(), c.RemoteAddr()
+	c.Close()
+	syscall.CloseOnExec(fd)
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	fc := &fdConn{fd: fd, laddr: laddr, raddr: raddr}
+	lc := &loopConn{conn: NewConn(fc), fc: fc}
+	if err := el.opened(lc.conn); err != nil {
+		io.WriteString(fc, "-ERR "+err.Error()+"\r\n")
+		fc.release()
+		return nil
+	}
+	el.mu.Lock()
+	el.conns[fd] = lc
+	el.mu.Unlock()
+
+	ev := syscall.EpollEvent{Events: connEvents, Fd: int32(fd)}
+	if err := syscall.EpollCtl(el.epfd, syscall.EPOLL_CTL_ADD, fd, &ev); err != nil {
+		el.release(lc)
+		return err
+	}
+	return nil
+}
+
+// wait dispatches the readable connections until the event loop is woken
+// up by close, the descriptors of the event loop are closed then
+func (el *eventLoop) wait() {
+	defer func() {
+		syscall.Close(el.epfd)
+		syscall.Close(el.wake[0])
+		syscall.Close(el.wake[1])
+	}()
+
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(el.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for i := 0; i < n; i++ {
+			if int(events[i].Fd) == el.wake[0] {
+				return
+			}
+			el.mu.Lock()
+			lc := el.conns[int(events[i].Fd)]
+			el.mu.Unlock()
+			if lc != nil {
+				el.dispatch(lc)
+			}
+		}
+	}
+}
+
+// dispatch hands the connection to an idle worker, a worker is started
+// when they're all busy, e.g. waiting for CLIENT PAUSE, so that a command
+// never waits for another connection.
+func (el *eventLoop) dispatch(lc *loopConn) {
+	select {
+	case el.tasks <- lc:
+	default:
+		go el.worker(lc, true)
+	}
+}
+
+// worker serves the readable connections with its read buffer, the extra
+// workers exit once they're idle.
+func (el *eventLoop) worker(lc *loopConn, extra bool) {
+	buf := make([]byte, readBufferSize)
+	rd := bufio.NewReaderSize(nil, 4096)
+	if lc != nil {
+		el.serve(lc, buf, rd)
+	}
+
+	var idle *time.Timer
+	if extra {
+		idle = time.NewTimer(workerIdleTimeout)
+		defer idle.Stop()
+	}
+	for {
+		var timeout <-chan time.Time
+		if extra {
+			idle.Reset(workerIdleTimeout)
+			timeout = idle.C
+		}
+		select {
+		case lc := <-el.tasks:
+			el.serve(lc, buf, rd)
+		case <-timeout:
+			return
+		case <-el.done:
+			return
+		}
+	}
+}
+
+// serve reads the connection until its input is drained and runs the
+// commands read, the connection waits for the next event afterwards.
+func (el *eventLoop) serve(lc *loopConn, buf []byte, rd *bufio.Reader) {
+	for {
+		n, err := lc.fc.read(buf)
+		if err == syscall.EAGAIN {
+			break
+		}
+		if n <= 0 || err != nil {
+			el.release(lc)
+			return
+		}
+
+		data := buf[:n]
+		if len(lc.pending) > 0 {
+			data = append(lc.pending, data...)
+		}
+		for len(data) > 0 {
+			msgs, n, err := ParsePipeline(rd, data, maxPipeline)
+			data = data[n:]
+			if err != nil || (len(msgs) > 0 && !serveBatch(lc.conn, msgs, el.handler)) {
+				el.release(lc)
+				return
+			}
+			if len(msgs) == 0 {
+				break
+			}
+		}
+		// the partial message is copied out of the shared read buffer
+		lc.pending = nil
+		if len(data) > 0 {
+			lc.pending = append([]byte(nil), data...)
+		}
+	}
+
+	ev := syscall.EpollEvent{Events: connEvents, Fd: int32(lc.fc.fd)}
+	if err := syscall.EpollCtl(el.epfd, syscall.EPOLL_CTL_MOD, lc.fc.fd, &ev); err != nil {
+		el.release(lc)
+	}
+}
+
+// release closes the connection, it's called by the worker serving the
+// connection or by close
+func (el *eventLoop) release(lc *loopConn) {
+	el.mu.Lock()
+	if el.conns[lc.fc.fd] != lc {
+		el.mu.Unlock()
+		return
+	}
+	delete(el.conns, lc.fc.fd)
+	el.mu.Unlock()
+	syscall.EpollCtl(el.epfd, syscall.EPOLL_CTL_DEL, lc.fc.fd, nil)
+	lc.fc.release()
+	el.closed(lc.conn)
+}
+
+// close stops the event loop and the workers, and releases the
+// connections
+func (el *eventLoop) close() {
+	close(el.done)
+	syscall.Write(el.wake[1], []byte{0})
+
+	el.mu.Lock()
+	conns := make([]*loopConn, 0, len(el.conns))
+	for _, lc := range el.conns {
+		conns = append(conns, lc)
+	}
+	el.mu.Unlock()
+	for _, lc := range conns {
+		el.release(lc)
+	}
+}
+
+// fdConn is a non-blocking socket of the event loop. Close shuts the
+// socket down, the event loop releases the descriptor once it reads the
+// end of the connection so that it's never reused while it's in use.
+type fdConn struct {
+	mu     sync.RWMutex
+	fd     int
+	closed bool
+	laddr  net.Addr
+	raddr  net.Addr
+}
+
+// read reads what's available, it returns EAGAIN when there's nothing
+func (c *fdConn) read(p []byte) (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return 0, errConnClosed
+	}
+	for {
+		n, err := syscall.Read(c.fd, p)
+		if err == syscall.EINTR {
+			continue
+		}
+		return n, err
+	}
+}
+
+// Read waits for the connection to be readable, the event loop reads with
+// read instead.
+func (c *fdConn) Read(p []byte) (int, error) {
+	for {
+		n, err := c.read(p)
+		if err != syscall.EAGAIN {
+			if n == 0 && err == nil {
+				return 0, errConnClosed
+			}
+			return n, err
+		}
+		if err := c.poll(pollIn); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes all of p, waiting for the connection to be writable when
+// the socket buffer is full.
+func (c *fdConn) Write(p []byte) (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return 0, errConnClosed
+	}
+	written := 0
+	for written < len(p) {
+		n, err := syscall.SendmsgN(c.fd, p[written:], nil, nil, syscall.MSG_NOSIGNAL)
+		switch err {
+		case nil:
+			written += n
+		case syscall.EINTR:
+		case syscall.EAGAIN:
+			if err := c.pollLocked(pollOut); err != nil {
+				return written, err
+			}
+		default:
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+const (
+	pollIn  = 0x1
+	pollOut = 0x4
+)
+
+// pollFd is the struct pollfd of poll(2)
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+func (c *fdConn) poll(events int16) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return errConnClosed
+	}
+	return c.pollLocked(events)
+}
+
+// pollLocked waits for the events with ppoll(2), the connection is read
+// locked. A shut down connection is reported as readable and writable.
+func (c *fdConn) pollLocked(events int16) error {
+	pfd := pollFd{fd: int32(c.fd), events: events}
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfd)), 1, 0, 0, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
+
+// Close shuts the connection down, the event loop is woken up and releases
+// it.
+func (c *fdConn) Close() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return errConnClosed
+	}
+	return syscall.Shutdown(c.fd, syscall.SHUT_RDWR)
+}
+
+// release closes the descriptor once the writers are done with it, the
+// connection is shut down first so that they don't wait for it
+func (c *fdConn) release() {
+	c.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		syscall.Close(c.fd)
+	}
+}
+
+// SetKeepAlive enables or disables the keepalive probes of the socket
+func (c *fdConn) SetKeepAlive(keepalive bool) error {
+	on := 0
+	if keepalive {
+		on = 1
+	}
+	return c.setsockopt(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, on)
+}
+
+// SetKeepAlivePeriod sets the idle time before the first probe and the
+// interval of the probes
+func (c *fdConn) SetKeepAlivePeriod(d time.Duration) error {
+	secs := int((d + time.Second - 1) / time.Second)
+	if err := c.setsockopt(syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, secs); err != nil {
+		return err
+	}
+	return c.setsockopt(syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs)
+}
+
+func (c *fdConn) setsockopt(level, opt, value int) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return errConnClosed
+	}
+	return syscall.SetsockoptInt(c.fd, level, opt, value)
+}
+
+func (c *fdConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *fdConn) RemoteAddr() net.Addr { return c.raddr }
+
+// The deadlines aren't supported by the event loop connections.
+func (c *fdConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fdConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fdConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoHandler replies with the first argument of the commands
+func echoHandler(conn *Conn, msgs []*Message, w io.Writer) error {
+	for _, msg := range msgs {
+		arg := ""
+		if len(msg.Values) > 1 {
+			arg = msg.Values[1].String()
+		}
+		if _, err := io.WriteString(w, "+"+arg+"\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestEventLoop(t *testing.T) {
+
+	var mu sync.Mutex
+	var conns []*Conn
+	closed := make(chan *Conn, 4)
+	opened := func(conn *Conn) error {
+		mu.Lock()
+		conns = append(conns, conn)
+		mu.Unlock()
+		return nil
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error:%v", err)
+	}
+	defer ln.Close()
+	go ServeEventLoop(ln, 1, echoHandler, opened, func(conn *Conn) { closed <- conn })
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial error:%v", err)
+	}
+	defer c.Close()
+	rd := bufio.NewReader(c)
+	readLine := func() string {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read error:%v", err)
+		}
+		return strings.TrimSpace(line)
+	}
+
+	// a pipeline and a message split over two reads
+	io.WriteString(c, "ECHO a\r\nECHO b\r\n*2\r\n$4\r\nECHO\r\n$5\r\nsp")
+	if a, b := readLine(), readLine(); a != "+a" || b != "+b" {
+		t.Errorf("Unexpected replies %q %q", a, b)
+	}
+	time.Sleep(50 * time.Millisecond)
+	io.WriteString(c, "lit\r\n")
+	if res := readLine(); res != "+split" {
+		t.Errorf("Unexpected reply %q", res)
+	}
+
+	// the connections closed by the server are released
+	mu.Lock()
+	conn := conns[0]
+	mu.Unlock()
+	if conn.RemoteAddr().String() != c.LocalAddr().String() {
+		t.Errorf("Unexpected remote address %s", conn.RemoteAddr())
+	}
+	conn.Close()
+	select {
+	case cc := <-closed:
+		if cc != conn {
+			t.Errorf("Unexpected closed connection")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the connection to be released")
+	}
+	if _, err := conn.Write([]byte("+late\r\n")); err == nil {
+		t.Errorf("Expected an error writing to a released connection")
+	}
+
+	// QUIT closes the connection after the reply
+	c2, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial error:%v", err)
+	}
+	defer c2.Close()
+	io.WriteString(c2, "ECHO x\r\nQUIT\r\n")
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	if b, _ := io.ReadAll(c2); string(b) != "+x\r\n+OK\r\n" {
+		t.Errorf("Unexpected replies %q", b)
+	}
+	<-closed
+
+	// closing the listener releases the connections left
+	c3, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial error:%v", err)
+	}
+	defer c3.Close()
+	io.WriteString(c3, "ECHO y\r\n")
+	rd = bufio.NewReader(c3)
+	c = c3
+	if res := readLine(); res != "+y" {
+		t.Errorf("Unexpected reply %q", res)
+	}
+	ln.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the connection to be released")
+	}
+	c3.SetReadDeadline(time.Now().Add(time.Second))
+	if b, err := io.ReadAll(c3); err != nil || len(b) != 0 {
+		t.Errorf("Expected the connection closed, got %q %v", b, err)
+	}
+}
+
+// BenchmarkConnMemory reports the memory held by the server per idle
+// connection, with a goroutine each or with the event loop
+func BenchmarkConnMemory(b *testing.B) {
+	const conns = 1000
+
+	servers := map[string]func(ln net.Listener) error{
+		"goroutine": func(ln net.Listener) error {
+			return Serve(ln, echoHandler, func(*Conn) error { return nil }, func(*Conn) {})
+		},
+		"epoll": func(ln net.Listener) error {
+			return ServeEventLoop(ln, 1, echoHandler, func(*Conn) error { return nil }, func(*Conn) {})
+		},
+	}
+	for _, mode := range []string{"goroutine", "epoll"} {
+		b.Run(mode, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					b.Fatal(err)
+				}
+				go servers[mode](ln)
+
+				before := heapAndStacks()
+				clients := make([]net.Conn, 0, conns)
+				rd := bufio.NewReader(nil)
+				for j := 0; j < conns; j++ {
+					c, err := net.Dial("tcp", ln.Addr().String())
+					if err != nil {
+						b.Fatal(err)
+					}
+					// a command is served so the connection is set up
+					io.WriteString(c, "ECHO x\r\n")
+					rd.Reset(c)
+					if _, err := rd.ReadString('\n'); err != nil {
+						b.Fatal(err)
+					}
+					clients = append(clients, c)
+				}
+				after := heapAndStacks()
+				b.ReportMetric(float64(after-before)/conns, "bytes/conn")
+
+				for _, c := range clients {
+					c.Close()
+				}
+				ln.Close()
+			}
+		})
+	}
+}
+
+// heapAndStacks returns the memory in use by the heap and the goroutine
+// stacks once the garbage is collected
+func heapAndStacks() int64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return int64(ms.HeapInuse + ms.StackInuse)
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// ListenAndServeEventLoop is only supported on Linux, the other systems
+// serve the connections with a goroutine each.
+func ListenAndServeEventLoop(
+	host string, port int,
+	workers int,
+	handler BatchHandler,
+	opened func(conn *Conn) error,
+	closed func(conn *Conn),
+	lnp *net.Listener,
+) error {
+	return errors.New("the epoll network model is only supported on Linux")
+}
+
+// ServeEventLoop is only supported on Linux.
+func ServeEventLoop(
+	ln net.Listener,
+	workers int,
+	handler BatchHandler,
+	opened func(conn *Conn) error,
+	closed func(conn *Conn),
+) error {
+	return errors.New("the epoll network model is only supported on Linux")
+}
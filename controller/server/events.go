@@ -0,0 +1,172 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/junostorage/resp"
+)
+
+var errNoChannel = errors.New("no channel in the path")
+
+// ServeEvents streams the messages published to the channel of
+// /subscribe/{channel} as server-sent events, each event is the JSON push
+// of a message, e.g. {"push":["message","news","hello"]}. The stream is
+// opened and closed like a TCP connection subscribed to the channel, the
+// errors of the subscription are replied before the stream starts.
+func ServeEvents(
+	w http.ResponseWriter, r *http.Request,
+	handler BatchHandler,
+	opened func(conn *Conn) error,
+	closed func(conn *Conn),
+) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, errMethod)
+		return
+	}
+	channel, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/subscribe/"))
+	if err != nil || channel == "" {
+		writeHTTPError(w, http.StatusNotFound, errNoChannel)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeHTTPError(w, http.StatusInternalServerError, errors.New("the reply can't be streamed"))
+		return
+	}
+	// the write timeout of the http server doesn't apply to the stream
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	ec := &eventConn{
+		w: w, flusher: flusher, remote: httpAddr(r.RemoteAddr), state: r.TLS,
+		started: make(chan struct{}), done: make(chan struct{}),
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		ec.local = addr
+	}
+	conn := NewConn(ec)
+	conn.framed = true
+	conn.SetOutputType(JSON)
+	if err := opened(conn); err != nil {
+		writeHTTPError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	defer closed(conn)
+	defer conn.Close()
+
+	// the events wait for the stream to start, the reply of SUBSCRIBE is
+	// only written when it fails
+	values := []resp.Value{resp.StringValue("subscribe"), resp.StringValue(channel)}
+	msg := &Message{Command: "subscribe", Values: values, ConnType: WebSocket, OutputType: JSON, RemoteAddr: r.RemoteAddr}
+	rec := &replyRecorder{ResponseWriter: w}
+	handler(conn, []*Message{msg}, rec)
+	if !conn.Pubsub() {
+		if rec.status == 0 {
+			rec.status = http.StatusBadRequest
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.buf.Bytes())
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	close(ec.started)
+
+	select {
+	case <-r.Context().Done():
+	case <-ec.done:
+	}
+}
+
+// eventConn is the connection of an event stream, each write is sent as
+// an event once the stream is started. Its reads wait for the stream to
+// end.
+type eventConn struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	local   net.Addr
+	remote  net.Addr
+	state   *tls.ConnectionState
+
+	// mu guards the writes, the reply isn't written anymore once the
+	// stream is closed
+	mu        sync.Mutex
+	closed    bool
+	started   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *eventConn) tlsState() *tls.ConnectionState {
+	return c.state
+}
+
+func (c *eventConn) Read(p []byte) (int, error) {
+	<-c.done
+	return 0, net.ErrClosed
+}
+
+// Write sends p as the data of an event, the JSON replies are a single line
+func (c *eventConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.started:
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	buf := make([]byte, 0, len(p)+8)
+	buf = append(buf, "data: "...)
+	buf = append(buf, p...)
+	buf = append(buf, "\n\n"...)
+	if _, err := c.w.Write(buf); err != nil {
+		return 0, err
+	}
+	c.flusher.Flush()
+	return len(p), nil
+}
+
+// Close ends the stream, it waits for the write in progress
+func (c *eventConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+		err = nil
+	})
+	return err
+}
+
+func (c *eventConn) LocalAddr() net.Addr {
+	if c.local == nil {
+		return httpAddr("")
+	}
+	return c.local
+}
+
+func (c *eventConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *eventConn) SetDeadline(t time.Time) error      { return nil }
+func (c *eventConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *eventConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// httpAddr is the address of an http client
+type httpAddr string
+
+func (a httpAddr) Network() string { return "tcp" }
+func (a httpAddr) String() string  { return string(a) }
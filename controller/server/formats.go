@@ -0,0 +1,287 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/junostorage/resp"
+)
+
+// the formats of the http replies
+const (
+	formatJSON    = "json"
+	formatRESP    = "resp"
+	formatMsgpack = "msgpack"
+	formatText    = "text"
+	formatRaw     = "raw"
+)
+
+// formatTypes are the content types of the formats
+var formatTypes = map[string]string{
+	formatJSON:    "application/json",
+	formatRESP:    "application/x-resp",
+	formatMsgpack: "application/msgpack",
+	formatText:    "text/plain; charset=utf-8",
+	formatRaw:     "application/octet-stream",
+}
+
+// mediaFormats are the formats of the media types of the Accept header
+var mediaFormats = map[string]string{
+	"application/json":         formatJSON,
+	"application/x-resp":       formatRESP,
+	"application/msgpack":      formatMsgpack,
+	"application/x-msgpack":    formatMsgpack,
+	"application/vnd.msgpack":  formatMsgpack,
+	"text/plain":               formatText,
+	"application/octet-stream": formatRaw,
+	"application/*":            formatJSON,
+	"*/*":                      formatJSON,
+}
+
+var errNotAcceptable = &httpError{http.StatusNotAcceptable,
+	"none of the accepted media types is supported: application/json, application/x-resp, application/msgpack, text/plain, application/octet-stream"}
+
+// replyFormat returns the format of the reply, given by ?format= or else
+// by the Accept header. The media types are tried by decreasing quality,
+// JSON is the default.
+func replyFormat(r *http.Request) (string, error) {
+	if f := strings.ToLower(r.URL.Query().Get("format")); f != "" {
+		if _, ok := formatTypes[f]; !ok {
+			return "", &httpError{http.StatusBadRequest, fmt.Sprintf("unknown reply format '%s'", f)}
+		}
+		return f, nil
+	}
+
+	type accepted struct {
+		media string
+		q     float64
+	}
+	var media []accepted
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		t, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			media = append(media, accepted{t, q})
+		}
+	}
+	if len(media) == 0 {
+		return formatJSON, nil
+	}
+	sort.SliceStable(media, func(i, j int) bool { return media[i].q > media[j].q })
+	for _, m := range media {
+		if f, ok := mediaFormats[m.media]; ok {
+			return f, nil
+		}
+	}
+	return "", errNotAcceptable
+}
+
+// writeFormatted writes the recorded RESP reply in the format, the
+// errors keep their status and null is replied with 404
+func writeFormatted(w http.ResponseWriter, rec *replyRecorder, format string) {
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Type", formatTypes[format])
+	if format == formatRESP {
+		w.WriteHeader(status)
+		w.Write(rec.buf.Bytes())
+		return
+	}
+
+	v, _, err := resp.NewReader(&rec.buf).ReadValue()
+	if err != nil {
+		w.Header().Set("Content-Type", formatTypes[formatJSON])
+		writeHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if v.IsNull() {
+		status = http.StatusNotFound
+	}
+	w.WriteHeader(status)
+	switch format {
+	case formatMsgpack:
+		w.Write(msgpackReply(v))
+	case formatText:
+		io.WriteString(w, strings.Join(textLines(v), "\n")+"\n")
+	}
+}
+
+// msgpackReply returns the MessagePack map of the reply, the same as the
+// JSON object: status and value, or status, code and error
+func msgpackReply(v resp.Value) []byte {
+	if err := v.Error(); err != nil {
+		code, msg := "ERR", err.Error()
+		if i := strings.IndexByte(msg, ' '); i > 0 && strings.ToUpper(msg[:i]) == msg[:i] {
+			code, msg = msg[:i], msg[i+1:]
+		}
+		buf := []byte{0x83}
+		buf = appendMsgpackString(buf, "status")
+		buf = append(buf, 0xc2)
+		buf = appendMsgpackString(buf, "code")
+		buf = appendMsgpackString(buf, code)
+		buf = appendMsgpackString(buf, "error")
+		return appendMsgpackString(buf, msg)
+	}
+	buf := []byte{0x82}
+	buf = appendMsgpackString(buf, "status")
+	buf = append(buf, 0xc3)
+	buf = appendMsgpackString(buf, "value")
+	return appendMsgpack(buf, v)
+}
+
+// appendMsgpack appends the MessagePack encoding of the value, the maps
+// keep their order and the strings that aren't UTF-8 are binary
+func appendMsgpack(buf []byte, v resp.Value) []byte {
+	if v.IsNull() {
+		return append(buf, 0xc0)
+	}
+	switch v.Type() {
+	case resp.Integer:
+		n := int64(v.Integer())
+		switch {
+		case n >= 0 && n < 128:
+			return append(buf, byte(n))
+		case n < 0 && n >= -32:
+			return append(buf, byte(n))
+		}
+		return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(n))
+	case resp.Boolean:
+		if v.Bool() {
+			return append(buf, 0xc3)
+		}
+		return append(buf, 0xc2)
+	case resp.Double:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcb), math.Float64bits(v.Float()))
+	case resp.Map:
+		vals := v.Array()
+		buf = appendMsgpackHeader(buf, len(vals)/2, 0x80, 0xde, 0xdf)
+		for _, item := range vals {
+			buf = appendMsgpack(buf, item)
+		}
+		return buf
+	case resp.Array, resp.Set, resp.Push:
+		vals := v.Array()
+		buf = appendMsgpackHeader(buf, len(vals), 0x90, 0xdc, 0xdd)
+		for _, item := range vals {
+			buf = appendMsgpack(buf, item)
+		}
+		return buf
+	}
+	data := v.Bytes()
+	if !utf8.Valid(data) {
+		n := len(data)
+		switch {
+		case n <= math.MaxUint8:
+			buf = append(buf, 0xc4, byte(n))
+		case n <= math.MaxUint16:
+			buf = binary.BigEndian.AppendUint16(append(buf, 0xc5), uint16(n))
+		default:
+			buf = binary.BigEndian.AppendUint32(append(buf, 0xc6), uint32(n))
+		}
+		return append(buf, data...)
+	}
+	return appendMsgpackString(buf, string(data))
+}
+
+// appendMsgpackString appends a MessagePack str
+func appendMsgpackString(buf []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xda), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xdb), uint32(n))
+	}
+	return append(buf, s...)
+}
+
+// appendMsgpackHeader appends the header of an array or a map of n items,
+// fix is the fixed format of less than 16 items
+func appendMsgpackHeader(buf []byte, n int, fix, b16, b32 byte) []byte {
+	switch {
+	case n < 16:
+		return append(buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, b16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(buf, b32), uint32(n))
+}
+
+// textLines returns the lines of the value formatted like redis-cli does,
+// the items of the aggregates are numbered and the nested ones indented
+func textLines(v resp.Value) []string {
+	if v.IsNull() {
+		return []string{"(nil)"}
+	}
+	switch v.Type() {
+	case resp.Error, resp.BlobError:
+		return []string{"(error) " + v.String()}
+	case resp.SimpleString:
+		return []string{v.String()}
+	case resp.Integer:
+		return []string{"(integer) " + v.String()}
+	case resp.Double:
+		return []string{"(double) " + v.String()}
+	case resp.BigNumber:
+		return []string{"(big number) " + v.String()}
+	case resp.Boolean:
+		return []string{"(" + strconv.FormatBool(v.Bool()) + ")"}
+	case resp.Map, resp.Array, resp.Set, resp.Push:
+		return textItems(v)
+	}
+	return []string{strconv.Quote(v.String())}
+}
+
+// textItems returns the lines of the items of an aggregate
+func textItems(v resp.Value) []string {
+	vals := v.Array()
+	if len(vals) == 0 {
+		return []string{"(empty array)"}
+	}
+	isMap := v.Type() == resp.Map
+	n := len(vals)
+	if isMap {
+		n /= 2
+	}
+	width := len(strconv.Itoa(n))
+	var lines []string
+	for i := 0; i < n; i++ {
+		label := fmt.Sprintf("%*d) ", width, i+1)
+		item := textLines(vals[i])
+		if isMap {
+			label = fmt.Sprintf("%*d# ", width, i+1)
+			key := textLines(vals[2*i])[0]
+			item = textLines(vals[2*i+1])
+			item[0] = key + " => " + item[0]
+		}
+		for j, line := range item {
+			if j == 0 {
+				lines = append(lines, label+line)
+				continue
+			}
+			lines = append(lines, strings.Repeat(" ", len(label))+line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/junostorage/resp"
+)
+
+func TestFormats(t *testing.T) {
+
+	testCases := []struct {
+		v       resp.Value
+		msgpack string
+		text    string
+	}{
+		{resp.StringValue("hallo"), "\xa5hallo", `"hallo"`},
+		{resp.BytesValue([]byte{0xff}), "\xc4\x01\xff", `"\xff"`},
+		{resp.SimpleStringValue("OK"), "\xa2OK", "OK"},
+		{resp.IntegerValue(-1), "\xff", "(integer) -1"},
+		{resp.IntegerValue(1000), "\xd3\x00\x00\x00\x00\x00\x00\x03\xe8", "(integer) 1000"},
+		{resp.NilValue(), "\xc0", "(nil)"},
+		{resp.ArrayValue(nil), "\x90", "(empty array)"},
+		{resp.ArrayValue([]resp.Value{resp.StringValue("a"), resp.ArrayValue([]resp.Value{resp.IntegerValue(1), resp.IntegerValue(2)})}),
+			"\x92\xa1a\x92\x01\x02", "1) \"a\"\n2) 1) (integer) 1\n   2) (integer) 2"},
+		{resp.MapValue([]resp.Value{resp.StringValue("k"), resp.StringValue("v")}), "\x81\xa1k\xa1v", `1# "k" => "v"`},
+	}
+	for _, testCase := range testCases {
+		if res := string(appendMsgpack(nil, testCase.v)); res != testCase.msgpack {
+			t.Errorf("Want msgpack: %q, got: %q, value:%v", testCase.msgpack, res, testCase.v)
+		}
+		if res := strings.Join(textLines(testCase.v), "\n"); res != testCase.text {
+			t.Errorf("Want text: %q, got: %q, value:%v", testCase.text, res, testCase.v)
+		}
+	}
+
+	// the errors are the map of the JSON errors
+	v := resp.ErrorValue(errors.New("WRONGTYPE Operation against a key holding the wrong kind of value"))
+	want := "\x83\xa6status\xc2\xa4code\xa9WRONGTYPE\xa5error\xd9\x37Operation against a key holding the wrong kind of value"
+	if res := string(msgpackReply(v)); res != want {
+		t.Errorf("Want: %q, got: %q", want, res)
+	}
+}
@@ -2,14 +2,60 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
+
+	"github.com/junostorage/resp"
+)
+
+var (
+	errNoCommand    = errors.New("no command in the path")
+	errEmptyCommand = errors.New("invalid JSON command: the command is empty")
+	errNotRaw       = errors.New("the reply isn't a string, it can't be replied as application/octet-stream")
+	errMethod       = &httpError{http.StatusMethodNotAllowed, "method not allowed"}
 )
 
+// Route is an extra endpoint served next to the command router, e.g. /metrics
+type Route struct {
+	Pattern string
+	Handler http.Handler
+}
+
 func ListenHttpServer(host string, port int,
-	httpHandler func(msg *Message, w http.ResponseWriter) error) error {
+	httpHandler func(msg *Message, w http.ResponseWriter) error, routes ...Route) error {
+
+	s := NewHttpServer(host, port, httpHandler, routes...)
+	log.Printf("The http server listening port %d\n", port)
+	return s.ListenAndServe()
+}
+
+// ListenHttpServerTLS starts the http server with TLS, the certificates are
+// given by the config.
+func ListenHttpServerTLS(host string, port int, config *tls.Config,
+	httpHandler func(msg *Message, w http.ResponseWriter) error, routes ...Route) error {
+
+	s := NewHttpServer(host, port, httpHandler, routes...)
+	s.TLSConfig = config
+	log.Printf("The https server listening port %d\n", port)
+	return s.ListenAndServeTLS("", "")
+}
+
+// NewHttpServer returns the http server running the commands, the caller
+// starts it and shuts it down.
+func NewHttpServer(host string, port int,
+	httpHandler func(msg *Message, w http.ResponseWriter) error, routes ...Route) *http.Server {
 
 	bind := fmt.Sprintf("%v:%v", host, port)
 	s := &http.Server{
@@ -19,24 +65,339 @@ func ListenHttpServer(host string, port int,
 		MaxHeaderBytes: 1 << 20,
 	}
 
-	http.HandleFunc("/", Handler(httpHandler))
-	log.Printf("The http server listening port %d\n", port)
-	return s.ListenAndServe()
+	// the routes are exact paths so they take precedence over the
+	// catch-all command router
+	mux := http.NewServeMux()
+	for _, r := range routes {
+		mux.Handle(r.Pattern, r.Handler)
+	}
+	mux.HandleFunc("/", Handler(httpHandler))
+	s.Handler = mux
+
+	// the contexts of the requests are canceled by the shutdown so the
+	// event streams end
+	ctx, cancel := context.WithCancel(context.Background())
+	s.BaseContext = func(net.Listener) context.Context { return ctx }
+	s.RegisterOnShutdown(cancel)
+	return s
 }
 
 func Handler(httpHandler func(msg *Message, w http.ResponseWriter) error) http.HandlerFunc {
 	return func(wr http.ResponseWriter, r *http.Request) {
 		wr.Header().Set("Content-Type", "application/json")
 
-		buffer := bytes.NewBuffer([]byte(r.URL.Path))
-		reader := NewAnyReaderWriter(buffer)
-		msg, err := reader.ReadHTTPMessage()
+		msg, err := ReadHTTPRequest(r)
+		if err != nil {
+			status := http.StatusBadRequest
+			if e, ok := err.(*httpError); ok {
+				status = e.status
+			}
+			writeHTTPError(wr, status, err)
+			return
+		}
+		setClient(msg, r)
+
+		format, err := replyFormat(r)
 		if err != nil {
-			fmt.Fprintf(wr, `{"status":false, "error":"%v"}`, err)
+			writeHTTPError(wr, err.(*httpError).status, err)
 			return
 		}
 
-		httpHandler(msg, wr)
+		// the reply is recorded and written once the command is done, the
+		// other formats than JSON are read back from the RESP reply and
+		// the binary values are replied as is
+		switch format {
+		case formatJSON:
+			rec := &replyRecorder{ResponseWriter: wr}
+			httpHandler(msg, rec)
+			if rec.status != 0 {
+				wr.WriteHeader(rec.status)
+			}
+			wr.Write(rec.buf.Bytes())
+		case formatRaw:
+			msg.OutputType, msg.Proto = RESP, 3
+			rec := &replyRecorder{ResponseWriter: wr}
+			httpHandler(msg, rec)
+			writeRaw(wr, rec)
+		default:
+			msg.OutputType, msg.Proto = RESP, 3
+			if format == formatRESP {
+				msg.Proto = 2
+			}
+			rec := &replyRecorder{ResponseWriter: wr}
+			httpHandler(msg, rec)
+			writeFormatted(wr, rec, format)
+		}
+
+	}
+}
+
+// httpError is an error of the request replied with the status
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (err *httpError) Error() string {
+	return err.msg
+}
+
+// ReadHTTPRequest reads the command of the request. The path names the
+// command and its arguments, e.g. /set/key/value, or a key with the REST
+// routes of /keys. The body of POST and PUT is the last argument, or the
+// whole command when it's a JSON array. The query parameters are the
+// options appended to the command, ?ex=10 gives EX 10.
+func ReadHTTPRequest(r *http.Request) (*Message, error) {
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	if err != nil {
+		return nil, &httpError{http.StatusRequestEntityTooLarge, err.Error()}
+	}
+	hasBody := len(body) > 0 && (r.Method == http.MethodPost || r.Method == http.MethodPut)
+
+	reader := NewAnyReaderWriter(bytes.NewBufferString(r.URL.EscapedPath()))
+	msg, err := reader.ReadHTTPMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := queryOptions(r.URL.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(msg.Values) == 0 && hasBody && mediaType(r) == "application/json":
+		if msg.Values, err = jsonCommand(body); err != nil {
+			return nil, err
+		}
+		hasBody = false
+
+	case len(msg.Values) == 0:
+		return nil, &httpError{http.StatusNotFound, errNoCommand.Error()}
+
+	case strings.EqualFold(msg.Values[0].String(), "keys") && len(msg.Values) <= 2:
+		if msg.Values, query, err = restCommand(r.Method, msg.Values, query, hasBody); err != nil {
+			return nil, err
+		}
+	}
+
+	if hasBody {
+		msg.Values = append(msg.Values, resp.BytesValue(body))
+	}
+	msg.Values = append(msg.Values, query...)
+	msg.Command = commandValues(msg.Values)
+	return msg, nil
+}
+
+// ReadHTTPBatch reads the commands of a batch, the body is a JSON array of
+// commands, e.g. [["SET","k","v"],["GET","k"]]
+func ReadHTTPBatch(r *http.Request) ([]*Message, error) {
+
+	var cmds [][]interface{}
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	dec.UseNumber()
+	if err := dec.Decode(&cmds); err != nil {
+		return nil, fmt.Errorf("invalid JSON batch: %v", err)
+	}
+	msgs := make([]*Message, 0, len(cmds))
+	for _, cmd := range cmds {
+		values, err := jsonArgs(cmd)
+		if err != nil {
+			return nil, err
+		}
+		msg := &Message{Command: commandValues(values), Values: values, ConnType: HTTP, OutputType: JSON}
+		setClient(msg, r)
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// setClient sets the address and the credentials of the client of the
+// request
+func setClient(msg *Message, r *http.Request) {
+	msg.RemoteAddr = r.RemoteAddr
+	msg.Username, msg.Password, _ = r.BasicAuth()
+	if r.TLS != nil {
+		msg.ClientCN = commonName(*r.TLS)
+	}
+}
+
+// maxBodySize is the max size of the request bodies, the max bulk length
+// of RESP
+const maxBodySize = 512 << 20
+
+// restCommand returns the command of the REST routes: GET /keys lists the
+// keys matching ?pattern=, GET, PUT and DELETE /keys/{key} get, set and
+// delete the key
+func restCommand(method string, args, query []resp.Value, hasBody bool) ([]resp.Value, []resp.Value, error) {
+	if len(args) == 1 {
+		if method != http.MethodGet {
+			return nil, nil, errMethod
+		}
+		pattern := resp.StringValue("*")
+		for i := 0; i+1 < len(query); i++ {
+			if strings.EqualFold(query[i].String(), "pattern") {
+				pattern = query[i+1]
+				query = append(query[:i:i], query[i+2:]...)
+				break
+			}
+		}
+		return []resp.Value{resp.StringValue("keys"), pattern}, query, nil
+	}
+
+	key := args[1]
+	switch method {
+	case http.MethodGet:
+		return []resp.Value{resp.StringValue("get"), key}, query, nil
+	case http.MethodPut, http.MethodPost:
+		if !hasBody {
+			return nil, nil, &httpError{http.StatusBadRequest, "the value is the body of the request"}
+		}
+		return []resp.Value{resp.StringValue("set"), key}, query, nil
+	case http.MethodDelete:
+		return []resp.Value{resp.StringValue("del"), key}, query, nil
+	}
+	return nil, nil, errMethod
+}
+
+// queryOptions returns the options of the query parameters in their order,
+// the names are upper cased and the empty values left out, ?nx&ex=10 gives
+// NX EX 10
+func queryOptions(rawQuery string) ([]resp.Value, error) {
+	var opts []resp.Value
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		name, value := param, ""
+		if i := strings.IndexByte(param, '='); i >= 0 {
+			name, value = param[:i], param[i+1:]
+		}
+		name, err := url.QueryUnescape(name)
+		if err != nil {
+			return nil, err
+		}
+		// ?format= is the format of the reply
+		if strings.EqualFold(name, "format") {
+			continue
+		}
+		opts = append(opts, resp.StringValue(strings.ToUpper(name)))
+		if value == "" {
+			continue
+		}
+		if value, err = url.QueryUnescape(value); err != nil {
+			return nil, err
+		}
+		opts = append(opts, resp.StringValue(value))
+	}
+	return opts, nil
+}
+
+// jsonCommand returns the arguments of a command given as a JSON array,
+// e.g. ["SET","key","value"]
+func jsonCommand(body []byte) ([]resp.Value, error) {
+	var args []interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&args); err != nil {
+		return nil, fmt.Errorf("invalid JSON command: %v", err)
+	}
+	return jsonArgs(args)
+}
+
+// jsonArgs returns the arguments of a command decoded from JSON
+func jsonArgs(args []interface{}) ([]resp.Value, error) {
+	if len(args) == 0 {
+		return nil, errEmptyCommand
+	}
+	values := make([]resp.Value, 0, len(args))
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case string:
+			values = append(values, resp.StringValue(arg))
+		case json.Number:
+			values = append(values, resp.StringValue(arg.String()))
+		default:
+			return nil, fmt.Errorf("invalid JSON command: the arguments are strings or numbers")
+		}
+	}
+	return values, nil
+}
+
+// mediaType returns the media type of the request body
+func mediaType(r *http.Request) string {
+	t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return t
+}
 
+// Accepts tells if the client asks for the media type with the Accept header
+func Accepts(r *http.Request, media string) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if t, _, _ := mime.ParseMediaType(strings.TrimSpace(accept)); t == media {
+			return true
+		}
 	}
+	return false
+}
+
+// replyRecorder keeps the reply of the command, the status is written by
+// the caller
+type replyRecorder struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (rec *replyRecorder) WriteHeader(status int) {
+	rec.status = status
+}
+
+func (rec *replyRecorder) Write(p []byte) (int, error) {
+	return rec.buf.Write(p)
+}
+
+// writeRaw writes the recorded RESP reply as is, the strings are the body
+// of the reply and null is replied with 404
+func writeRaw(w http.ResponseWriter, rec *replyRecorder) {
+	v, _, err := resp.NewReader(&rec.buf).ReadValue()
+	if err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	switch {
+	case v.Error() != nil:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		io.WriteString(w, v.String())
+	case v.IsNull():
+		w.WriteHeader(http.StatusNotFound)
+	case v.Type() == resp.Array || v.Type() == resp.Map || v.Type() == resp.Set || v.Type() == resp.Push:
+		writeHTTPError(w, http.StatusNotAcceptable, errNotRaw)
+	default:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(status)
+		w.Write(v.Bytes())
+	}
+}
+
+// writeHTTPError writes the JSON error object replied by the http server,
+// the same the commands reply with
+func writeHTTPError(w http.ResponseWriter, status int, err error) {
+	w.WriteHeader(status)
+	w.Write(jsonError(err))
+}
+
+// jsonError returns the JSON error object of an error of the request
+func jsonError(err error) []byte {
+	data, _ := json.Marshal(struct {
+		Status bool   `json:"status"`
+		Code   string `json:"code"`
+		Error  string `json:"error"`
+	}{Code: "ERR", Error: err.Error()})
+	return data
 }
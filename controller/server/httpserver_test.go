@@ -3,14 +3,19 @@ package server
 import (
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"testing"
 )
 
 func TestHTTPServer(t *testing.T) {
 
 	testCases := []struct {
-		url string
-		res string
+		method string
+		url    string
+		body   string
+		header string
+		res    string
+		status int
 	}{
 
 		{
@@ -20,7 +25,7 @@ func TestHTTPServer(t *testing.T) {
 
 		{
 			url: "http://localhost:6382/get/mkey",
-			res: `{"status":true, "value":"hallo"}`,
+			res: `{"status":true,"value":"hallo"}`,
 		},
 
 		{
@@ -35,54 +40,229 @@ func TestHTTPServer(t *testing.T) {
 
 		{
 			url: "http://localhost:6382/hdel/person/age",
-			res: `{"status":true, "value":1}`,
+			res: `{"status":true,"value":1}`,
+		},
+
+		{
+			url: "http://localhost:6382/hgetall/person",
+			res: `{"status":true,"value":{"name":"nemo"}}`,
 		},
 
 		{
 			url: "http://localhost:6382/expire/mkey/10",
-			res: `{"status":true, "value":1}`,
+			res: `{"status":true,"value":1}`,
 		},
 
 		{
 			url: "http://localhost:6382/lpush/list/1/2/3",
-			res: `{"status":true, "value":3}`,
+			res: `{"status":true,"value":3}`,
 		},
 
 		{
 			url: "http://localhost:6382/llen/list",
-			res: `{"status":true, "value":3}`,
+			res: `{"status":true,"value":3}`,
 		},
 
 		{
 			url: "http://localhost:6382/lindex/list/1",
-			res: `{"status":true, "value":"2"}`,
+			res: `{"status":true,"value":"2"}`,
 		},
 
 		{
 			url: "http://localhost:6382/lpop/list",
-			res: `{"status":true, "value":"3"}`,
+			res: `{"status":true,"value":"3"}`,
+		},
+
+		{
+			url: "http://localhost:6382/keys?pattern=pers*",
+			res: `{"status":true,"value":["person"]}`,
 		},
 
 		{
 			url: "http://localhost:6382/del/mkey",
-			res: `{"status":true, "value":"1"}`,
+			res: `{"status":true,"value":1}`,
+		},
+
+		{
+			url:    "http://localhost:6382/get/mkey",
+			res:    `{"status":false,"code":"ERR","error":"Key not found"}`,
+			status: http.StatusNotFound,
+		},
+
+		{
+			url:    "http://localhost:6382/get",
+			res:    `{"status":false,"code":"ERR","error":"wrong number of arguments for 'get' command"}`,
+			status: http.StatusBadRequest,
+		},
+
+		{
+			url:    "http://localhost:6382/lpush/person/1",
+			res:    `{"status":false,"code":"WRONGTYPE","error":"Operation against a key holding the wrong kind of value"}`,
+			status: http.StatusConflict,
+		},
+
+		{
+			url:    "http://localhost:6382/",
+			res:    `{"status":false,"code":"ERR","error":"no command in the path"}`,
+			status: http.StatusNotFound,
+		},
+
+		// the arguments are URL-decoded and keep their case
+		{
+			url: "http://localhost:6382/set/My%2FKey/Hallo%20World",
+			res: `{"status":true}`,
+		},
+
+		{
+			url: "http://localhost:6382/GET/My%2FKey",
+			res: `{"status":true,"value":"Hallo World"}`,
+		},
+
+		// the body is the value, the query parameters the options
+		{
+			method: "POST",
+			url:    "http://localhost:6382/set/body?ex=10",
+			body:   "line 1\nline \"2\"",
+			header: "Content-Type: text/plain",
+			res:    `{"status":true}`,
+		},
+
+		{
+			url: "http://localhost:6382/get/body",
+			res: `{"status":true,"value":"line 1\nline \"2\""}`,
+		},
+
+		{
+			method: "POST",
+			url:    "http://localhost:6382/set/body?nx",
+			body:   "other",
+			res:    `{"status":true,"value":null}`,
+		},
+
+		// the REST routes of the keys
+		{
+			method: "PUT",
+			url:    "http://localhost:6382/keys/rest",
+			body:   "\x00\xff",
+			header: "Content-Type: application/octet-stream",
+			res:    `{"status":true}`,
+		},
+
+		{
+			url:    "http://localhost:6382/keys/rest",
+			header: "Accept: application/octet-stream",
+			res:    "\x00\xff",
+		},
+
+		{
+			method: "DELETE",
+			url:    "http://localhost:6382/keys/rest",
+			res:    `{"status":true,"value":1}`,
+		},
+
+		{
+			url:    "http://localhost:6382/keys/rest",
+			header: "Accept: application/octet-stream",
+			status: http.StatusNotFound,
+		},
+
+		{
+			method: "PATCH",
+			url:    "http://localhost:6382/keys/rest",
+			res:    `{"status":false,"code":"ERR","error":"method not allowed"}`,
+			status: http.StatusMethodNotAllowed,
+		},
+
+		// the whole command is a JSON array
+		{
+			method: "POST",
+			url:    "http://localhost:6382/",
+			body:   `["SET","json",10]`,
+			header: "Content-Type: application/json",
+			res:    `{"status":true}`,
+		},
+
+		{
+			method: "POST",
+			url:    "http://localhost:6382/",
+			body:   `["GET","json"]`,
+			header: "Content-Type: application/json",
+			res:    `{"status":true,"value":"10"}`,
+		},
+
+		// the format of the reply is negotiated
+		{
+			url: "http://localhost:6382/hgetall/person?format=resp",
+			res: "*2\r\n$4\r\nname\r\n$4\r\nnemo\r\n",
+		},
+
+		{
+			url:    "http://localhost:6382/hgetall/person",
+			header: "Accept: text/html, text/plain;q=0.9, */*;q=0.8",
+			res:    "1# \"name\" => \"nemo\"\n",
+		},
+
+		{
+			url:    "http://localhost:6382/lpush/person/1",
+			header: "Accept: text/plain",
+			res:    "(error) ERR Operation against a key holding the wrong kind of value\n",
+			status: http.StatusConflict,
+		},
+
+		{
+			url:    "http://localhost:6382/get/json",
+			header: "Accept: application/msgpack",
+			res:    "\x82\xa6status\xc3\xa5value\xa210",
+		},
+
+		{
+			url:    "http://localhost:6382/ping",
+			header: "Accept: image/png",
+			res:    `{"status":false,"code":"ERR","error":"none of the accepted media types is supported: application/json, application/x-resp, application/msgpack, text/plain, application/octet-stream"}`,
+			status: http.StatusNotAcceptable,
+		},
+
+		{
+			url:    "http://localhost:6382/ping?format=xml",
+			res:    `{"status":false,"code":"ERR","error":"unknown reply format 'xml'"}`,
+			status: http.StatusBadRequest,
 		},
 	}
 
 	// Iterating over the test cases
 	for _, testCase := range testCases {
 
-		resp, err := http.Get(testCase.url)
+		method := testCase.method
+		if method == "" {
+			method = "GET"
+		}
+		req, err := http.NewRequest(method, testCase.url, strings.NewReader(testCase.body))
 		if err != nil {
-			t.Errorf("http error:%v, url:%v", err, testCase.url)
+			t.Fatalf("request error:%v, url:%v", err, testCase.url)
+		}
+		if testCase.header != "" {
+			kv := strings.SplitN(testCase.header, ": ", 2)
+			req.Header.Set(kv[0], kv[1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("http error:%v, url:%v", err, testCase.url)
 		}
 
 		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
 		result := string(body)
 		if testCase.res != string(body) {
 			t.Errorf("Expected the result to be `%v`, but instead found it to be `%v`,url:%v",
 				testCase.res, result, testCase.url)
 		}
+		status := testCase.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if resp.StatusCode != status {
+			t.Errorf("Expected the status %d, got %d, url:%v", status, resp.StatusCode, testCase.url)
+		}
 	}
 
 }
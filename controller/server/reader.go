@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"io"
+	"net/url"
 	"strings"
 
 	"github.com/junostorage/resp"
@@ -18,6 +19,7 @@ const (
 	Telnet
 	HTTP
 	JSON
+	WebSocket
 )
 
 // String return a string for type.
@@ -35,6 +37,8 @@ func (t Type) String() string {
 		return "HTTP"
 	case JSON:
 		return "JSON"
+	case WebSocket:
+		return "WebSocket"
 	}
 }
 
@@ -44,6 +48,20 @@ type Message struct {
 	Values     []resp.Value
 	ConnType   Type
 	OutputType Type
+	// Proto is the RESP protocol version of the replies, 2 or 3
+	Proto int
+	// DB is the database the command runs on
+	DB int
+	// RemoteAddr is the address of the http client
+	RemoteAddr string
+	// Username and Password are the http Basic authentication credentials
+	Username string
+	Password string
+	// ClientCN is the common name of the verified https client certificate
+	ClientCN string
+	// InputBuffered is the number of bytes left in the input buffer once
+	// the message was read
+	InputBuffered int
 }
 
 // AnyReaderWriter is resp or native reader writer.
@@ -67,6 +85,12 @@ func NewAnyReaderWriter(rd io.Reader) *AnyReaderWriter {
 	return ar
 }
 
+// Buffered returns the number of bytes that can be read from the
+// input buffer without blocking.
+func (ar *AnyReaderWriter) Buffered() int {
+	return ar.rd.Buffered()
+}
+
 // ReadMessage reads the next resp message.
 func (ar *AnyReaderWriter) ReadMessage() (*Message, error) {
 	_, err := ar.rd.ReadByte()
@@ -83,6 +107,57 @@ func (ar *AnyReaderWriter) ReadMessage() (*Message, error) {
 	return ar.readMultiBulkMessage()
 }
 
+// ReadPipeline reads the next message and the messages already in the input
+// buffer, at most max of them. The messages read before an error are
+// returned with it, the reading stops after a QUIT. A partial message left
+// in the buffer is read once the rest arrives.
+func (ar *AnyReaderWriter) ReadPipeline(max int) (msgs []*Message, err error) {
+	for len(msgs) == 0 || (ar.Buffered() > 0 && len(msgs) < max) {
+		msg, err := ar.ReadMessage()
+		if err != nil {
+			return msgs, err
+		}
+		if msg == nil || msg.Command == "" {
+			continue
+		}
+		msg.InputBuffered = ar.Buffered()
+		msgs = append(msgs, msg)
+		if msg.Command == "quit" {
+			break
+		}
+	}
+	return msgs, nil
+}
+
+// ParsePipeline parses the complete messages at the start of data, at most
+// max of them, and returns the number of bytes they take. A partial message
+// at the end of data is left to parse once the rest is read. rd is reset to
+// read data, it's reused to avoid an allocation per read.
+func ParsePipeline(rd *bufio.Reader, data []byte, max int) (msgs []*Message, n int, err error) {
+	br := bytes.NewReader(data)
+	rd.Reset(br)
+	ar := &AnyReaderWriter{rd: rd}
+	for len(msgs) < max {
+		msg, err := ar.ReadMessage()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return msgs, n, err
+		}
+		n = len(data) - br.Len() - rd.Buffered()
+		if msg == nil || msg.Command == "" {
+			continue
+		}
+		msg.InputBuffered = len(data) - n
+		msgs = append(msgs, msg)
+		if msg.Command == "quit" {
+			break
+		}
+	}
+	return msgs, n, nil
+}
+
 func commandValues(values []resp.Value) string {
 	if len(values) == 0 {
 		return ""
@@ -102,10 +177,11 @@ func (ar *AnyReaderWriter) readMultiBulkMessage() (*Message, error) {
 		return nil, nil
 	}
 
-	return &Message{Command: commandValues(values), Values: values, ConnType: Telnet, OutputType: RESP}, nil
+	return &Message{Command: commandValues(values), Values: values, ConnType: Telnet, OutputType: RESP, Proto: 2}, nil
 }
 
-// ReadHTTPMessage reads the http path
+// ReadHTTPMessage reads the escaped http path, the segments are the
+// URL-decoded arguments of the command
 func (ar *AnyReaderWriter) ReadHTTPMessage() (*Message, error) {
 
 	line, _, err := ar.rd.ReadLine()
@@ -115,11 +191,14 @@ func (ar *AnyReaderWriter) ReadHTTPMessage() (*Message, error) {
 	values := make([]resp.Value, 0, 2)
 	list := bytes.Split(line, []byte("/"))
 	for _, v := range list {
-		s := string(v)
-		if s == "" {
+		if len(v) == 0 {
 			continue
 		}
-		values = append(values, resp.StringValue(strings.ToLower(s)))
+		s, err := url.PathUnescape(string(v))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, resp.StringValue(s))
 	}
 
 	return &Message{Command: commandValues(values), Values: values, ConnType: HTTP, OutputType: JSON}, nil
@@ -20,13 +20,17 @@ func TestReader(t *testing.T) {
 
 func TestHTTPReader(t *testing.T) {
 
-	data := "/Set/mykey/hallo/"
+	data := "/Set/my%2Fkey/Hallo%20World/"
 	buffer := bytes.NewBuffer([]byte(data))
 	reader := NewAnyReaderWriter(buffer)
 
-	_, err := reader.ReadHTTPMessage()
+	msg, err := reader.ReadHTTPMessage()
 	if err != nil {
-		t.Errorf("reader error:%v", err)
+		t.Fatalf("reader error:%v", err)
+	}
+	if msg.Command != "set" || len(msg.Values) != 3 ||
+		msg.Values[1].String() != "my/key" || msg.Values[2].String() != "Hallo World" {
+		t.Errorf("Unexpected message %q %v", msg.Command, msg.Values)
 	}
 
 }
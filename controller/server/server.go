@@ -1,51 +1,608 @@
 package server
 
 import (
-	"fmt"
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"io"
 	"log"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ReplyMode controls whether the replies are sent to the client
+type ReplyMode int
+
+const (
+	ReplyOn ReplyMode = iota
+	ReplyOff
+	ReplySkip
+)
+
+var nextConnID int64
+
+// ErrOutputLimit is returned by the writes of a connection closed for
+// overcoming its output limit
+var ErrOutputLimit = errors.New("output buffer limit reached")
+
+// handshakeTimeout is the time a client has to complete the TLS handshake
+const handshakeTimeout = 10 * time.Second
+
+// maxPipeline is the number of pipelined commands handled at once, their
+// replies are flushed at least that often
+const maxPipeline = 1024
+
+// maxPooledBuffer is the capacity over which an output buffer isn't reused
+const maxPooledBuffer = 64 << 10
+
+// BatchHandler runs the commands pipelined by a client. They're read at once
+// from the input buffer and their replies, written to w, are kept in memory
+// and written to the client once the handler returns, so the handler never
+// waits for a slow client.
+type BatchHandler func(conn *Conn, msgs []*Message, w io.Writer) error
+
+// OutputLimit limits the output waiting to be sent to a client, the
+// connection is closed once it's over Hard bytes or over Soft bytes for
+// SoftTime. A zero limit is disabled.
+type OutputLimit struct {
+	Hard     int64
+	Soft     int64
+	SoftTime time.Duration
+}
+
 // Conn represents a server connection.
 type Conn struct {
 	net.Conn
 	Authenticated bool
+	// ID is unique and never reused during the server lifetime
+	ID      int64
+	Created time.Time
+	// Reply is the reply mode set with CLIENT REPLY
+	Reply ReplyMode
+
+	mu              sync.Mutex
+	name            string
+	user            string
+	proto           int
+	db              int
+	noEvict         bool
+	lastCmd         string
+	lastInteraction time.Time
+	inputBuffered   int
+	closeAfterReply bool
+	pubsub          bool
+	outputType      Type
+	// framed connections write each reply as a message, e.g. WebSocket,
+	// so their buffered writes are kept apart
+	framed bool
+
+	// output is the number of bytes waiting to be written, outputLimit
+	// returns the limit of the connection
+	output       int64
+	outputLimit  func() OutputLimit
+	softSince    time.Time
+	limitReached bool
+
+	// wmu guards the output buffer, the pub/sub messages and the monitors
+	// write from other goroutines. The ends of the messages of a framed
+	// connection are kept in wframes.
+	wmu     sync.Mutex
+	wbuf    *bytes.Buffer
+	wframes []int
 }
 
-// ListenAndServe starts a server at the specified address.
-func ListenAndServe(
-	host string, port int,
-	handler func(conn *Conn, msg *Message, rd *AnyReaderWriter, w io.Writer) error,
-	opened func(conn *Conn),
-	closed func(conn *Conn),
-	lnp *net.Listener,
-) error {
-	ln, err := net.Listen("tcp", fmt.Sprintf("%s:%d", host, port))
-	if err != nil {
+// outputBuffers are the output buffers of the connections running
+// commands, the idle connections don't hold one
+var outputBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// NewConn wraps a network connection assigning it a new ID.
+func NewConn(conn net.Conn) *Conn {
+	now := time.Now()
+	return &Conn{
+		Conn:            conn,
+		ID:              atomic.AddInt64(&nextConnID, 1),
+		Created:         now,
+		lastInteraction: now,
+		proto:           2,
+		outputType:      RESP,
+	}
+}
+
+// Name returns the name set with CLIENT SETNAME.
+func (c *Conn) Name() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name
+}
+
+// SetName sets the connection name.
+func (c *Conn) SetName(name string) {
+	c.mu.Lock()
+	c.name = name
+	c.mu.Unlock()
+}
+
+// User returns the ACL user the connection is authenticated as.
+func (c *Conn) User() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.user
+}
+
+// SetUser authenticates the connection as the user, an empty name makes
+// the connection unauthenticated.
+func (c *Conn) SetUser(user string) {
+	c.mu.Lock()
+	c.user = user
+	c.Authenticated = user != ""
+	c.mu.Unlock()
+}
+
+// Proto returns the RESP protocol version of the replies, 2 or 3.
+func (c *Conn) Proto() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.proto
+}
+
+// SetProto sets the protocol version negotiated with HELLO.
+func (c *Conn) SetProto(proto int) {
+	c.mu.Lock()
+	c.proto = proto
+	c.mu.Unlock()
+}
+
+// DB returns the database selected with SELECT.
+func (c *Conn) DB() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.db
+}
+
+// SetDB selects the database of the connection.
+func (c *Conn) SetDB(db int) {
+	c.mu.Lock()
+	c.db = db
+	c.mu.Unlock()
+}
+
+// NoEvict reports whether the client is excluded from client eviction.
+func (c *Conn) NoEvict() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.noEvict
+}
+
+// SetNoEvict sets the CLIENT NO-EVICT mode.
+func (c *Conn) SetNoEvict(on bool) {
+	c.mu.Lock()
+	c.noEvict = on
+	c.mu.Unlock()
+}
+
+// Pubsub reports whether the connection is subscribed to channels or
+// patterns.
+func (c *Conn) Pubsub() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pubsub
+}
+
+// SetPubsub sets whether the connection is subscribed.
+func (c *Conn) SetPubsub(on bool) {
+	c.mu.Lock()
+	c.pubsub = on
+	c.mu.Unlock()
+}
+
+// OutputType returns the encoding of the replies and of the pushed
+// messages, RESP or JSON.
+func (c *Conn) OutputType() Type {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.outputType
+}
+
+// SetOutputType sets the encoding of the replies.
+func (c *Conn) SetOutputType(t Type) {
+	c.mu.Lock()
+	c.outputType = t
+	c.mu.Unlock()
+}
+
+// Framed reports whether each reply is written as a message of its own,
+// e.g. WebSocket, rather than to a stream.
+func (c *Conn) Framed() bool {
+	return c.framed
+}
+
+// SetOutputLimit sets the function returning the output limit of the
+// connection, it's called by the writes so it must not wait for them.
+func (c *Conn) SetOutputLimit(limit func() OutputLimit) {
+	c.mu.Lock()
+	c.outputLimit = limit
+	c.mu.Unlock()
+}
+
+// Output returns the number of bytes waiting to be written, the replies
+// buffered or being written to a client that doesn't read them included.
+func (c *Conn) Output() int64 {
+	return atomic.LoadInt64(&c.output)
+}
+
+// OutputLimitReached reports whether the connection was closed for
+// overcoming its output limit.
+func (c *Conn) OutputLimitReached() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limitReached
+}
+
+// Reserve accounts n bytes queued for the connection until they're written
+// with WriteReserved. The connection is closed and ErrOutputLimit returned
+// once the output is over the limit.
+func (c *Conn) Reserve(n int) error {
+	output := atomic.AddInt64(&c.output, int64(n))
+
+	c.mu.Lock()
+	outputLimit, reached := c.outputLimit, c.limitReached
+	c.mu.Unlock()
+	if reached {
+		atomic.AddInt64(&c.output, -int64(n))
+		return ErrOutputLimit
+	}
+	var limit OutputLimit
+	if outputLimit != nil {
+		limit = outputLimit()
+	}
+
+	c.mu.Lock()
+	over := limit.Hard > 0 && output > limit.Hard
+	if limit.Soft > 0 && output > limit.Soft {
+		if c.softSince.IsZero() {
+			c.softSince = time.Now()
+		}
+		over = over || time.Since(c.softSince) >= limit.SoftTime
+	} else {
+		c.softSince = time.Time{}
+	}
+	c.limitReached = c.limitReached || over
+	c.mu.Unlock()
+
+	if over {
+		atomic.AddInt64(&c.output, -int64(n))
+		c.Conn.Close()
+		return ErrOutputLimit
+	}
+	return nil
+}
+
+// Release gives back n bytes reserved with Reserve that won't be written,
+// e.g. a message dropped.
+func (c *Conn) Release(n int) {
+	atomic.AddInt64(&c.output, -int64(n))
+}
+
+// CheckOutputLimit closes the connection once the output waiting to be
+// written is over the limit, it's meant to be called periodically as the
+// client of a blocked write doesn't send commands anymore. It returns
+// ErrOutputLimit once the connection is closed.
+func (c *Conn) CheckOutputLimit() error {
+	return c.Reserve(0)
+}
+
+// SetKeepAlive enables the TCP keepalive probes with the period, zero
+// disables them. It's a no-op for the Unix socket connections.
+func (c *Conn) SetKeepAlive(period time.Duration) error {
+	nc := c.Conn
+	if tlsConn, ok := nc.(*tls.Conn); ok {
+		nc = tlsConn.NetConn()
+	}
+	ka, ok := nc.(keepAliver)
+	if !ok {
+		return nil
+	}
+	if period <= 0 {
+		return ka.SetKeepAlive(false)
+	}
+	if err := ka.SetKeepAlive(true); err != nil {
 		return err
 	}
-	if lnp != nil {
-		*lnp = ln
+	return ka.SetKeepAlivePeriod(period)
+}
+
+// keepAliver is implemented by the TCP connections
+type keepAliver interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// Touch records the command being processed and the number of bytes left
+// in the input buffer.
+func (c *Conn) Touch(cmd string, inputBuffered int) {
+	c.mu.Lock()
+	c.lastCmd = cmd
+	c.lastInteraction = time.Now()
+	c.inputBuffered = inputBuffered
+	c.mu.Unlock()
+}
+
+// LastCommand returns the last command and when it was received.
+func (c *Conn) LastCommand() (cmd string, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastCmd, c.lastInteraction
+}
+
+// InputBuffered returns the number of bytes that were waiting in the input
+// buffer when the last command was read.
+func (c *Conn) InputBuffered() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inputBuffered
+}
+
+// CloseAfterReply closes the connection once the reply to the current
+// command is written.
+func (c *Conn) CloseAfterReply() {
+	c.mu.Lock()
+	c.closeAfterReply = true
+	c.mu.Unlock()
+}
+
+// IsUnix reports whether the connection was accepted on a Unix socket.
+func (c *Conn) IsUnix() bool {
+	_, ok := c.Conn.(*net.UnixConn)
+	return ok
+}
+
+// Addr returns the client address, the Unix socket connections report the
+// socket path as in path:0.
+func (c *Conn) Addr() string {
+	if c.IsUnix() {
+		return c.LocalAddr().String() + ":0"
 	}
-	log.Printf("The server is now ready to accept connections on port %d\n", port)
+	return c.RemoteAddr().String()
+}
+
+// LAddr returns the address the connection was accepted on.
+func (c *Conn) LAddr() string {
+	if c.IsUnix() {
+		return c.LocalAddr().String() + ":0"
+	}
+	return c.LocalAddr().String()
+}
+
+// PeerCommonName returns the common name of the verified TLS client
+// certificate, an empty string when the client didn't present one.
+func (c *Conn) PeerCommonName() string {
+	switch nc := c.Conn.(type) {
+	case *tls.Conn:
+		return commonName(nc.ConnectionState())
+	case httpConn:
+		if state := nc.tlsState(); state != nil {
+			return commonName(*state)
+		}
+	}
+	return ""
+}
+
+// httpConn is a connection served over an http request, e.g. WebSocket,
+// it reports the TLS state of the request
+type httpConn interface {
+	tlsState() *tls.ConnectionState
+}
+
+func commonName(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+// Closing reports whether the connection is closed once the reply to the
+// current command is written.
+func (c *Conn) Closing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeAfterReply
+}
+
+// Write writes to the output buffer while the commands pipelined by the
+// client run, and directly to the connection otherwise. The writes of the
+// other goroutines go through the same buffer so they're never interleaved
+// with a reply.
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.Reserve(len(p)); err != nil {
+		return 0, err
+	}
+	return c.WriteReserved(p)
+}
+
+// WriteReserved writes p, reserved with Reserve by the goroutine queuing
+// it, e.g. a pub/sub message. The bytes are released from the output once
+// written to the connection, by Flush when the writes are buffered.
+func (c *Conn) WriteReserved(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.wbuf == nil {
+		defer atomic.AddInt64(&c.output, -int64(len(p)))
+		return c.Conn.Write(p)
+	}
+	c.wbuf.Write(p)
+	if c.framed {
+		c.wframes = append(c.wframes, c.wbuf.Len())
+	}
+	return len(p), nil
+}
+
+// buffer starts buffering the writes until Flush
+func (c *Conn) buffer() {
+	c.wmu.Lock()
+	if c.wbuf == nil {
+		c.wbuf = outputBuffers.Get().(*bytes.Buffer)
+	}
+	c.wmu.Unlock()
+}
+
+// Flush writes the buffered output and stops buffering the writes, the
+// buffer is released. The writes of a framed connection are written one
+// by one as they are a message each.
+func (c *Conn) Flush() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.wbuf == nil {
+		return nil
+	}
+	buf, frames := c.wbuf, c.wframes
+	c.wbuf, c.wframes = nil, c.wframes[:0]
+	defer func() {
+		atomic.AddInt64(&c.output, -int64(buf.Len()))
+		if buf.Cap() <= maxPooledBuffer {
+			buf.Reset()
+			outputBuffers.Put(buf)
+		}
+	}()
+
+	data := buf.Bytes()
+	if !c.framed {
+		if len(data) == 0 {
+			return nil
+		}
+		_, err := c.Conn.Write(data)
+		return err
+	}
+	start := 0
+	for _, end := range frames {
+		if _, err := c.Conn.Write(data[start:end]); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// serveBatch runs the commands read at once from the connection and
+// flushes their replies. It returns false once the connection must be
+// closed.
+func serveBatch(conn *Conn, msgs []*Message, handler BatchHandler) bool {
+
+	// QUIT ends the pipeline, the commands before it are handled
+	var quit *Message
+	if n := len(msgs); n > 0 && msgs[n-1].Command == "quit" {
+		quit, msgs = msgs[n-1], msgs[:n-1]
+	}
+
+	conn.buffer()
+	var err error
+	if len(msgs) > 0 {
+		err = handler(conn, msgs, conn)
+	}
+	if quit != nil && err == nil && !conn.Closing() && conn.OutputType() == RESP {
+		io.WriteString(conn, "+OK\r\n")
+	}
+	return conn.Flush() == nil && err == nil && quit == nil && !conn.Closing()
+}
+
+// ListenUnix listens on a Unix socket, a stale socket file left by a
+// previous run is replaced. A zero perm keeps the permissions given by the
+// umask.
+func ListenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// the permissions default to the umask
+	if perm != 0 {
+		if err := os.Chmod(path, perm); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// refuse replies the error the connection was refused with and closes it
+func refuse(conn *Conn, err error) {
+	io.WriteString(conn.Conn, "-ERR "+err.Error()+"\r\n")
+	conn.Close()
+}
+
+// Serve serves the connections accepted by the listener until it's closed,
+// the connections already accepted are left open.
+func Serve(
+	ln net.Listener,
+	handler BatchHandler,
+	opened func(conn *Conn) error,
+	closed func(conn *Conn),
+) error {
 	for {
-		conn, err := ln.Accept()
+		conn, err := accept(ln)
 		if err != nil {
 			return err
 		}
-		go handleConn(&Conn{Conn: conn}, handler, opened, closed)
+		go handleConn(NewConn(conn), handler, opened, closed)
+	}
+}
+
+// maxAcceptDelay is the longest wait before accepting again after a
+// temporary error
+const maxAcceptDelay = time.Second
+
+// accept waits for the next connection of the listener. The temporary
+// errors, e.g. running out of file descriptors, are logged and retried
+// after a delay growing up to maxAcceptDelay, like net/http does.
+func accept(ln net.Listener) (net.Conn, error) {
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+			return nil, err
+		}
+		if delay == 0 {
+			delay = 5 * time.Millisecond
+		} else if delay *= 2; delay > maxAcceptDelay {
+			delay = maxAcceptDelay
+		}
+		log.Printf("accept error: %v; retrying in %v\n", err, delay)
+		time.Sleep(delay)
 	}
 }
 
 func handleConn(
 	conn *Conn,
-	handler func(conn *Conn, msg *Message, rd *AnyReaderWriter, w io.Writer) error,
-	opened func(conn *Conn),
+	handler BatchHandler,
+	opened func(conn *Conn) error,
 	closed func(conn *Conn),
 ) {
 
-	opened(conn)
+	// the handshake is completed before the connection is reported so the
+	// client certificate is known
+	if tlsConn, ok := conn.Conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+	}
+
+	// a refused connection is closed without being served
+	if err := opened(conn); err != nil {
+		refuse(conn, err)
+		return
+	}
 
 	defer closed(conn)
 	defer conn.Close()
@@ -53,27 +610,9 @@ func handleConn(
 	rd := NewAnyReaderWriter(conn)
 
 	for {
-		msg, err := rd.ReadMessage()
-		if err != nil {
+		msgs, err := rd.ReadPipeline(maxPipeline)
+		if !serveBatch(conn, msgs, handler) || err != nil {
 			return
 		}
-
-		if msg != nil && msg.Command != "" {
-
-			if msg.Command == "quit" {
-				if msg.OutputType == RESP {
-					io.WriteString(conn, "+OK\r\n")
-				}
-				return
-			}
-			err := handler(conn, msg, rd, conn)
-			if err != nil {
-				return
-			}
-
-		} else {
-			continue
-		}
-
 	}
 }
@@ -0,0 +1,311 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/junostorage/client"
+)
+
+func TestUnixSocket(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "junounix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "juno.sock")
+
+	// a stale socket file is replaced
+	ioutil.WriteFile(path, nil, 0600)
+
+	// the server replies with the client address
+	handler := func(conn *Conn, msgs []*Message, w io.Writer) error {
+		for range msgs {
+			if _, err := io.WriteString(w, "+"+conn.Addr()+"\r\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	ln, err := ListenUnix(path, 0700)
+	if err != nil {
+		t.Fatalf("ListenUnix error:%v", err)
+	}
+	defer ln.Close()
+	go Serve(ln, handler, func(*Conn) error { return nil }, func(*Conn) {})
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat error:%v", err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0700 {
+		t.Errorf("Unexpected socket mode %v", fi.Mode())
+	}
+
+	conn, err := client.Dial("unix://" + path)
+	if err != nil {
+		t.Fatalf("Dial error:%v", err)
+	}
+	defer conn.Close()
+	if v, err := conn.Do("PING"); err != nil || v.String() != path+":0" {
+		t.Errorf("Expected the socket address, got %q, err:%v", v.String(), err)
+	}
+}
+
+// countingConn counts the writes to the network connection
+type countingConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.writes++
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func TestPipeline(t *testing.T) {
+
+	p1, p2 := net.Pipe()
+	defer p2.Close()
+	cc := &countingConn{Conn: p1}
+
+	var depths []int
+	handler := func(conn *Conn, msgs []*Message, w io.Writer) error {
+		depths = append(depths, len(msgs))
+		for _, msg := range msgs {
+			if _, err := io.WriteString(w, "+"+msg.Values[1].String()+"\r\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		handleConn(NewConn(cc), handler, func(*Conn) error { return nil }, func(*Conn) {})
+		close(done)
+	}()
+
+	// the pipelined commands are handled at once and replied in one write
+	go io.WriteString(p2, "ECHO a\r\nECHO b\r\nECHO c\r\nQUIT\r\n")
+	rd := bufio.NewReader(p2)
+	var replies []string
+	for i := 0; i < 4; i++ {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read error:%v", err)
+		}
+		replies = append(replies, strings.TrimSpace(line))
+	}
+	<-done
+
+	if strings.Join(replies, " ") != "+a +b +c +OK" {
+		t.Errorf("Unexpected replies %v", replies)
+	}
+	if len(depths) != 1 || depths[0] != 3 {
+		t.Errorf("Expected a batch of 3 commands, got %v", depths)
+	}
+	if cc.writes != 1 {
+		t.Errorf("Expected a single write, got %d", cc.writes)
+	}
+}
+
+func TestSlowReader(t *testing.T) {
+
+	p1, p2 := net.Pipe()
+	defer p2.Close()
+	conn := NewConn(p1)
+
+	// the replies are kept in memory while the handler runs, it doesn't
+	// wait for the client reading them
+	ran := make(chan struct{})
+	handler := func(conn *Conn, msgs []*Message, w io.Writer) error {
+		for i := 0; i < 64; i++ {
+			if _, err := w.Write(make([]byte, 16<<10)); err != nil {
+				return err
+			}
+		}
+		close(ran)
+		return nil
+	}
+	done := make(chan bool)
+	go func() { done <- serveBatch(conn, []*Message{{Command: "get"}}, handler) }()
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatalf("Want the handler done before the replies are read")
+	}
+
+	n, _ := io.CopyN(ioutil.Discard, p2, 64<<10*16)
+	if n != 64<<10*16 || !<-done {
+		t.Errorf("Want the replies flushed, got %d bytes", n)
+	}
+}
+
+func TestOutputLimit(t *testing.T) {
+
+	p1, p2 := net.Pipe()
+	defer p2.Close()
+	conn := NewConn(p1)
+	limit := OutputLimit{Hard: 100, Soft: 10, SoftTime: 50 * time.Millisecond}
+	conn.SetOutputLimit(func() OutputLimit { return limit })
+
+	// the reserved output is released once written
+	if err := conn.Reserve(50); err != nil {
+		t.Fatalf("Reserve error:%v", err)
+	}
+	if got := conn.Output(); got != 50 {
+		t.Errorf("Want: 50, got: %d", got)
+	}
+	go ioutil.ReadAll(p2)
+	if _, err := conn.WriteReserved(make([]byte, 50)); err != nil {
+		t.Fatalf("Write error:%v", err)
+	}
+	if got := conn.Output(); got != 0 {
+		t.Errorf("Want: 0, got: %d", got)
+	}
+
+	// over the soft limit for longer than the soft time
+	if err := conn.Reserve(20); err != nil {
+		t.Fatalf("Reserve error:%v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := conn.Reserve(1); err != ErrOutputLimit {
+		t.Errorf("Want: %v, got: %v", ErrOutputLimit, err)
+	}
+	if !conn.OutputLimitReached() {
+		t.Errorf("Want the output limit reached")
+	}
+	if _, err := conn.Write([]byte("+OK\r\n")); err != ErrOutputLimit {
+		t.Errorf("Want the connection closed, got: %v", err)
+	}
+
+	// over the hard limit at once
+	p3, p4 := net.Pipe()
+	defer p4.Close()
+	conn = NewConn(p3)
+	conn.SetOutputLimit(func() OutputLimit { return limit })
+	if err := conn.Reserve(101); err != ErrOutputLimit {
+		t.Errorf("Want: %v, got: %v", ErrOutputLimit, err)
+	}
+	if _, err := p3.Write([]byte("x")); err == nil {
+		t.Errorf("Want the connection closed")
+	}
+
+	// the replies stay in the output until the client reads them, a
+	// client that never reads is closed once over the soft limit for
+	// longer than the soft time
+	p5, p6 := net.Pipe()
+	defer p6.Close()
+	conn = NewConn(p5)
+	conn.SetOutputLimit(func() OutputLimit { return OutputLimit{Soft: 5, SoftTime: 50 * time.Millisecond} })
+	handler := func(conn *Conn, msgs []*Message, w io.Writer) error {
+		_, err := io.WriteString(w, "+PONG\r\n")
+		return err
+	}
+	done := make(chan bool)
+	go func() { done <- serveBatch(conn, []*Message{{Command: "ping"}, {Command: "ping"}}, handler) }()
+	time.Sleep(20 * time.Millisecond)
+	if got := conn.Output(); got != 7 {
+		t.Errorf("Want: 7, got: %d", got)
+	}
+	if err := conn.CheckOutputLimit(); err != nil {
+		t.Errorf("Want the connection kept within the soft time, got: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := conn.CheckOutputLimit(); err != ErrOutputLimit {
+		t.Errorf("Want: %v, got: %v", ErrOutputLimit, err)
+	}
+	if <-done {
+		t.Errorf("Want the connection closed")
+	}
+	if got := conn.Output(); got != 0 {
+		t.Errorf("Want: 0, got: %d", got)
+	}
+}
+
+// flakyListener fails the first accepts as when the process is out of file
+// descriptors
+type flakyListener struct {
+	net.Listener
+	fails int
+}
+
+func (ln *flakyListener) Accept() (net.Conn, error) {
+	if ln.fails > 0 {
+		ln.fails--
+		return nil, syscall.EMFILE
+	}
+	return ln.Listener.Accept()
+}
+
+func TestAcceptRetry(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := func(conn *Conn, msgs []*Message, w io.Writer) error {
+		_, err := io.WriteString(w, "+PONG\r\n")
+		return err
+	}
+	served := make(chan error)
+	go func() {
+		served <- Serve(&flakyListener{Listener: l, fails: 3}, handler, func(*Conn) error { return nil }, func(*Conn) {})
+	}()
+
+	// the temporary errors don't stop the server
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "PING\r\n")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "+PONG\r\n" {
+		t.Errorf("Want +PONG, got: %q %v", line, err)
+	}
+
+	// closing the listener does
+	l.Close()
+	if err := <-served; err == nil {
+		t.Errorf("Want the error of the closed listener")
+	}
+}
+
+func TestRefuse(t *testing.T) {
+
+	cc, p2 := net.Pipe()
+	refused := errors.New("max number of clients reached")
+	closed := false
+	done := make(chan struct{})
+	go func() {
+		handleConn(NewConn(cc), nil, func(*Conn) error { return refused }, func(*Conn) { closed = true })
+		close(done)
+	}()
+
+	line, err := bufio.NewReader(p2).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read error:%v", err)
+	}
+	<-done
+	if line != "-ERR max number of clients reached\r\n" {
+		t.Errorf("Unexpected reply %q", line)
+	}
+	if closed {
+		t.Errorf("Want closed only called for the accepted connections")
+	}
+}
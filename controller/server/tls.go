@@ -0,0 +1,188 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reloadInterval is how often the certificate files are checked for changes
+var reloadInterval = time.Second
+
+// TLSOptions describes the TLS configuration of the listeners
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// CAFile holds the certificates the client certificates are verified with
+	CAFile string
+	// ClientAuth is tls.RequireAndVerifyClientCert when the clients must
+	// present a certificate, tls.VerifyClientCertIfGiven when it's optional
+	ClientAuth   tls.ClientAuthType
+	MinVersion   uint16
+	CipherSuites []uint16
+}
+
+// certReloader loads the certificate and the CA again when their files
+// change, the new connections use the new files.
+type certReloader struct {
+	opts TLSOptions
+
+	mu      sync.Mutex
+	config  *tls.Config
+	modTime time.Time
+	checked time.Time
+}
+
+// NewTLSConfig returns the TLS configuration of the listeners, the
+// certificate files are reloaded when they change.
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, errors.New("TLS requires a certificate and a key file")
+	}
+	if opts.ClientAuth != tls.NoClientCert && opts.CAFile == "" {
+		return nil, errors.New("TLS client authentication requires a CA certificate file")
+	}
+
+	r := &certReloader{opts: opts}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: opts.MinVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.get(), nil
+		},
+	}, nil
+}
+
+// lastModified returns the latest modification time of the files
+func (r *certReloader) lastModified() (time.Time, error) {
+	var t time.Time
+	for _, path := range []string{r.opts.CertFile, r.opts.KeyFile, r.opts.CAFile} {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+func (r *certReloader) load() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.opts.CertFile, r.opts.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   r.opts.ClientAuth,
+		MinVersion:   r.opts.MinVersion,
+		CipherSuites: r.opts.CipherSuites,
+	}
+	if r.opts.CAFile != "" {
+		data, err := ioutil.ReadFile(r.opts.CAFile)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", r.opts.CAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.config = config
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+// get returns the configuration, loading the files again when they changed.
+// The previous configuration is kept when the new files are invalid, e.g.
+// while they are being replaced.
+func (r *certReloader) get() *tls.Config {
+	r.mu.Lock()
+	config, modTime := r.config, r.modTime
+	check := time.Since(r.checked) >= reloadInterval
+	if check {
+		r.checked = time.Now()
+	}
+	r.mu.Unlock()
+
+	if !check {
+		return config
+	}
+	if t, err := r.lastModified(); err != nil || !t.After(modTime) {
+		return config
+	}
+	if err := r.load(); err != nil {
+		return config
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.config
+}
+
+// ParseTLSProtocols returns the minimum version of the protocols, e.g.
+// "TLSv1.2 TLSv1.3"
+func ParseTLSProtocols(s string) (uint16, error) {
+	versions := map[string]uint16{
+		"tlsv1":   tls.VersionTLS10,
+		"tlsv1.1": tls.VersionTLS11,
+		"tlsv1.2": tls.VersionTLS12,
+		"tlsv1.3": tls.VersionTLS13,
+	}
+
+	var min uint16
+	for _, name := range strings.Fields(s) {
+		v, ok := versions[strings.ToLower(name)]
+		if !ok {
+			return 0, fmt.Errorf("unknown TLS protocol '%s'", name)
+		}
+		if min == 0 || v < min {
+			min = v
+		}
+	}
+	if min == 0 {
+		min = tls.VersionTLS12
+	}
+	return min, nil
+}
+
+// ParseCipherSuites returns the cipher suites of the names separated by
+// ':', ',' or spaces, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". The
+// TLS 1.3 suites are not configurable.
+func ParseCipherSuites(s string) ([]uint16, error) {
+	suites := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		suites[cs.Name] = cs.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool { return r == ':' || r == ',' || r == ' ' }) {
+		id, ok := suites[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite '%s'", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/junostorage/client"
+)
+
+// testCert is a certificate and its key, signed by the parent
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, serial int64, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and the key in PEM files
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	if keyFile != "" {
+		ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestTLS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "junotls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	caFile := filepath.Join(dir, "ca.crt")
+
+	ca := newTestCert(t, "ca", 1, nil)
+	ca.write(t, caFile, "")
+	newTestCert(t, "server", 2, ca).write(t, certFile, keyFile)
+	clientCert := newTestCert(t, "alice", 3, ca)
+
+	config, err := NewTLSConfig(TLSOptions{
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		CAFile:     caFile,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		MinVersion: tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatalf("NewTLSConfig error:%v", err)
+	}
+
+	// the server replies with the common name of the client certificate
+	handler := func(conn *Conn, msgs []*Message, w io.Writer) error {
+		for range msgs {
+			if _, err := io.WriteString(w, "+"+conn.PeerCommonName()+"\r\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("Listen error:%v", err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+	go Serve(ln, handler, func(*Conn) error { return nil }, func(*Conn) {})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	conn, err := client.DialTLS(addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert.tlsCertificate()}})
+	if err != nil {
+		t.Fatalf("DialTLS error:%v", err)
+	}
+	v, err := conn.Do("PING")
+	conn.Close()
+	if err != nil || v.String() != "alice" {
+		t.Errorf("Expected the client common name, got %q, err:%v", v.String(), err)
+	}
+
+	// the client certificate is required
+	if conn, err := client.DialTLS(addr, &tls.Config{RootCAs: roots}); err == nil {
+		if _, err := conn.Do("PING"); err == nil {
+			t.Errorf("Expected the connection without a client certificate to fail")
+		}
+	}
+
+	// the new certificate is used without a restart
+	reloadInterval = 0
+	defer func() { reloadInterval = time.Second }()
+	newTestCert(t, "reloaded", 4, ca).write(t, certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+
+	tlsConn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert.tlsCertificate()}})
+	if err != nil {
+		t.Fatalf("Dial error:%v", err)
+	}
+	defer tlsConn.Close()
+	if cn := tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "reloaded" {
+		t.Errorf("Expected the reloaded certificate, got %q", cn)
+	}
+}
+
+func TestHTTPServerTLS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "junotls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	caFile := filepath.Join(dir, "ca.crt")
+
+	ca := newTestCert(t, "ca", 1, nil)
+	ca.write(t, caFile, "")
+	newTestCert(t, "server", 2, ca).write(t, certFile, keyFile)
+	clientCert := newTestCert(t, "bob", 3, ca)
+
+	config, err := NewTLSConfig(TLSOptions{
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		CAFile:     caFile,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	})
+	if err != nil {
+		t.Fatalf("NewTLSConfig error:%v", err)
+	}
+
+	port := freePort(t)
+	go ListenHttpServerTLS("127.0.0.1", port, config, func(msg *Message, w http.ResponseWriter) error {
+		_, err := io.WriteString(w, msg.ClientCN)
+		return err
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	testCases := []struct {
+		certs []tls.Certificate
+		res   string
+	}{
+		{nil, ""},
+		{[]tls.Certificate{clientCert.tlsCertificate()}, "bob"},
+	}
+	for _, testCase := range testCases {
+		httpClient := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: testCase.certs},
+		}}
+		resp, err := httpClient.Get(fmt.Sprintf("https://127.0.0.1:%d/ping", port))
+		if err != nil {
+			t.Fatalf("Get error:%v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != testCase.res {
+			t.Errorf("Expected %q, got %q", testCase.res, body)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsGUID is the GUID of the WebSocket handshake, RFC 6455
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// the opcodes of the WebSocket frames
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// the status codes of the WebSocket close frames
+const (
+	wsCloseNormal   = 1000
+	wsCloseProtocol = 1002
+	wsCloseNoStatus = 1005
+	wsCloseTooBig   = 1009
+	wsCloseTryAgain = 1013
+)
+
+// wsCloseTimeout is the time given to the peer to take the close frame
+const wsCloseTimeout = time.Second
+
+var (
+	errWSProtocol = errors.New("websocket protocol error")
+	errWSTooBig   = errors.New("websocket message too big")
+)
+
+// ServeWebSocket upgrades the request to a WebSocket connection and runs
+// the commands it sends until it's closed. With ?format=json, the default,
+// the messages are commands as JSON arrays, e.g. ["SET","k","v"], and the
+// replies and the pushed messages are JSON text messages. With
+// ?format=resp the binary messages carry the RESP stream of a TCP
+// connection. The format may also be asked as the subprotocol, json or
+// resp. The connections are opened and closed like the TCP ones.
+func ServeWebSocket(
+	w http.ResponseWriter, r *http.Request,
+	handler BatchHandler,
+	opened func(conn *Conn) error,
+	closed func(conn *Conn),
+) {
+	ws, format, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	conn := NewConn(ws)
+	conn.framed = true
+	conn.SetOutputType(format)
+
+	// a refused connection is told why with the close frame
+	if err := opened(conn); err != nil {
+		ws.closeWith(wsCloseTryAgain, err.Error())
+		return
+	}
+
+	defer closed(conn)
+	defer conn.Close()
+
+	if format == RESP {
+		rd := NewAnyReaderWriter(conn)
+		for {
+			msgs, err := rd.ReadPipeline(maxPipeline)
+			if !serveBatch(conn, msgs, handler) || err != nil {
+				return
+			}
+		}
+	}
+
+	for {
+		payload, err := ws.readMessage()
+		if err != nil {
+			return
+		}
+		values, err := jsonCommand(payload)
+		if err != nil {
+			if _, err := conn.Write(jsonError(err)); err != nil {
+				return
+			}
+			continue
+		}
+		msg := &Message{Command: commandValues(values), Values: values, ConnType: WebSocket, OutputType: JSON}
+		if !serveBatch(conn, []*Message{msg}, handler) {
+			return
+		}
+	}
+}
+
+// upgradeWebSocket completes the WebSocket handshake of the request, the
+// http errors are replied before it returns
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, Type, error) {
+	fail := func(status int, err error) (*wsConn, Type, error) {
+		w.Header().Set("Content-Type", "application/json")
+		writeHTTPError(w, status, err)
+		return nil, Null, err
+	}
+
+	if r.Method != http.MethodGet {
+		return fail(http.StatusMethodNotAllowed, errMethod)
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		return fail(http.StatusBadRequest, errors.New("not a websocket handshake"))
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return fail(http.StatusUpgradeRequired, errors.New("unsupported websocket version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return fail(http.StatusBadRequest, errors.New("missing Sec-WebSocket-Key"))
+	}
+	// the browsers send the credentials of the server along with the
+	// requests of any page, only the pages of the server itself connect
+	if !sameOrigin(r) {
+		return fail(http.StatusForbidden, errors.New("cross origin websocket requests are not allowed"))
+	}
+
+	format, protocol := JSON, ""
+	if strings.EqualFold(r.URL.Query().Get("format"), "resp") {
+		format = RESP
+	}
+	for _, p := range headerTokens(r.Header, "Sec-WebSocket-Protocol") {
+		if p == "json" || p == "resp" {
+			protocol, format = p, JSON
+			if p == "resp" {
+				format = RESP
+			}
+			break
+		}
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return fail(http.StatusInternalServerError, errors.New("the connection can't be upgraded"))
+	}
+	nc, brw, err := hj.Hijack()
+	if err != nil {
+		return fail(http.StatusInternalServerError, err)
+	}
+	// the deadlines of the http server don't apply to the connection
+	nc.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	head := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n"
+	if protocol != "" {
+		head += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	if _, err := io.WriteString(nc, head+"\r\n"); err != nil {
+		nc.Close()
+		return nil, Null, err
+	}
+
+	ws := &wsConn{Conn: nc, rd: brw.Reader, state: r.TLS, opcode: wsText}
+	if format == RESP {
+		ws.opcode = wsBinary
+	}
+	return ws, format, nil
+}
+
+// sameOrigin reports whether the request comes from a page of the server,
+// the clients other than the browsers don't send an Origin
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// headerTokens returns the comma separated tokens of the header values
+func headerTokens(h http.Header, name string) []string {
+	var tokens []string
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	return tokens
+}
+
+// headerHasToken reports whether the header has the token, ignoring the
+// case
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, t := range headerTokens(h, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsConn is a WebSocket connection. The reads return the payloads of the
+// data messages as a stream and each write is sent as a message, the
+// control frames are answered while reading.
+type wsConn struct {
+	net.Conn
+	rd    *bufio.Reader
+	state *tls.ConnectionState
+	// opcode is the opcode of the written messages, text or binary
+	opcode byte
+	// buf is the rest of the message being read
+	buf []byte
+
+	// wmu guards the writes of the frames, the control frames are written
+	// by the reader
+	wmu       sync.Mutex
+	closeOnce sync.Once
+}
+
+func (c *wsConn) tlsState() *tls.ConnectionState {
+	return c.state
+}
+
+// Read reads the payloads of the data messages
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.buf = msg
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// Write sends p as a message
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(c.opcode, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends the close frame and closes the connection
+func (c *wsConn) Close() error {
+	return c.closeWith(wsCloseNormal, "")
+}
+
+// closeWith sends the close frame with the status code and the reason,
+// then closes the connection
+func (c *wsConn) closeWith(code int, reason string) error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		// the reason of a control frame is limited to 123 bytes
+		if len(reason) > 123 {
+			reason = reason[:123]
+		}
+		payload := make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		payload = append(payload, reason...)
+
+		c.Conn.SetWriteDeadline(time.Now().Add(wsCloseTimeout))
+		c.writeFrame(wsClose, payload)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// readMessage returns the payload of the next data message, the
+// fragments are joined
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame(maxBodySize - len(msg))
+		switch err {
+		case nil:
+		case errWSProtocol:
+			c.closeWith(wsCloseProtocol, err.Error())
+			return nil, err
+		case errWSTooBig:
+			c.closeWith(wsCloseTooBig, err.Error())
+			return nil, err
+		default:
+			return nil, err
+		}
+
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			// the close frame is echoed with the status code of the peer
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			if code == wsCloseNoStatus {
+				code = wsCloseNormal
+			}
+			c.closeWith(code, "")
+			return nil, io.EOF
+		case wsContinuation:
+			if !started {
+				c.closeWith(wsCloseProtocol, "unexpected continuation frame")
+				return nil, errWSProtocol
+			}
+		case wsText, wsBinary:
+			if started {
+				c.closeWith(wsCloseProtocol, "unfinished fragmented message")
+				return nil, errWSProtocol
+			}
+			started = true
+		default:
+			c.closeWith(wsCloseProtocol, "unknown opcode")
+			return nil, errWSProtocol
+		}
+
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// readFrame reads a frame of the client, its payload is unmasked. The
+// payload of the data frames is limited to max bytes.
+func (c *wsConn) readFrame(max int) (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.rd, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0f
+	control := opcode&0x8 != 0
+	// the extensions are not negotiated and the clients mask their frames
+	if head[0]&0x70 != 0 || head[1]&0x80 == 0 {
+		err = errWSProtocol
+		return
+	}
+
+	n := uint64(head[1] & 0x7f)
+	switch {
+	case control && (n > 125 || !fin):
+		err = errWSProtocol
+		return
+	case n == 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.rd, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case n == 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.rd, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if !control && n > uint64(max) {
+		err = errWSTooBig
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.rd, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.rd, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// writeFrame writes a single unmasked frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	head := make([]byte, 2, 10+len(payload))
+	head[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n <= 125:
+		head[1] = byte(n)
+	case n <= 0xffff:
+		head[1] = 126
+		head = binary.BigEndian.AppendUint16(head, uint16(n))
+	default:
+		head[1] = 127
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.Conn.Write(append(head, payload...))
+	return err
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// wsDial opens a WebSocket connection to the path of the server
+func wsDial(t *testing.T, s *httptest.Server, path string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(s.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: "+strings.TrimPrefix(s.URL, "http://")+"\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	rd := bufio.NewReader(conn)
+	res, err := http.ReadResponse(rd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, rd, res
+}
+
+// wsSend sends a masked frame
+func wsSend(conn net.Conn, opcode byte, fin bool, payload string) {
+	head := []byte{opcode, 0x80 | byte(len(payload))}
+	if fin {
+		head[0] |= 0x80
+	}
+	mask := []byte{1, 2, 3, 4}
+	data := append(head, mask...)
+	for i := 0; i < len(payload); i++ {
+		data = append(data, payload[i]^mask[i%4])
+	}
+	conn.Write(data)
+}
+
+// wsRecv reads a frame of the server
+func wsRecv(t *testing.T, conn net.Conn, rd *bufio.Reader) (byte, string) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var head [2]byte
+	if _, err := io.ReadFull(rd, head[:]); err != nil {
+		t.Fatalf("read frame error:%v", err)
+	}
+	n := int(head[1] & 0x7f)
+	if n == 126 {
+		var ext [2]byte
+		io.ReadFull(rd, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, n)
+	io.ReadFull(rd, payload)
+	return head[0] & 0x0f, string(payload)
+}
+
+func TestWebSocket(t *testing.T) {
+
+	handler := func(conn *Conn, msgs []*Message, w io.Writer) error {
+		for _, msg := range msgs {
+			if msg.OutputType == JSON {
+				io.WriteString(w, `{"status":true,"value":"`+msg.Command+`"}`)
+				continue
+			}
+			io.WriteString(w, "+"+msg.Command+"\r\n")
+		}
+		return nil
+	}
+	var refused int32
+	opened := func(conn *Conn) error {
+		if atomic.LoadInt32(&refused) != 0 {
+			return errors.New("max number of clients reached")
+		}
+		return nil
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWebSocket(w, r, handler, opened, func(conn *Conn) {})
+	}))
+	defer s.Close()
+
+	conn, rd, res := wsDial(t, s, "/ws")
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Want status 101, got %d", res.StatusCode)
+	}
+	// the example of RFC 6455
+	if accept := res.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Want Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=, got: %s", accept)
+	}
+
+	testCases := []struct {
+		frames []string
+		opcode byte
+		res    string
+	}{
+		{[]string{`["GET","k"]`}, wsText, `{"status":true,"value":"get"}`},
+		{[]string{`[]`}, wsText, `{"status":false,"code":"ERR","error":"invalid JSON command: the command is empty"}`},
+		// the fragments are joined, the pings answered in between
+		{[]string{`["SE`, "", `T","k","v"]`}, wsPong, ""},
+	}
+	for _, testCase := range testCases {
+		for i, frame := range testCase.frames {
+			last := i == len(testCase.frames)-1
+			switch {
+			case len(testCase.frames) == 1:
+				wsSend(conn, wsText, true, frame)
+			case i == 0:
+				wsSend(conn, wsText, false, frame)
+			case last:
+				wsSend(conn, wsContinuation, true, frame)
+			default:
+				wsSend(conn, wsPing, true, frame)
+			}
+		}
+		if opcode, res := wsRecv(t, conn, rd); opcode != testCase.opcode || res != testCase.res {
+			t.Errorf("Want: %d %s, got: %d %s, frames:%q", testCase.opcode, testCase.res, opcode, res, testCase.frames)
+		}
+	}
+	if opcode, res := wsRecv(t, conn, rd); opcode != wsText || res != `{"status":true,"value":"set"}` {
+		t.Errorf("Want the reply of the fragmented message, got: %d %s", opcode, res)
+	}
+
+	// the close frame is echoed
+	wsSend(conn, wsClose, true, "\x03\xe8")
+	if opcode, res := wsRecv(t, conn, rd); opcode != wsClose || res != "\x03\xe8" {
+		t.Errorf("Want the close frame echoed, got: %d %q", opcode, res)
+	}
+	conn.Close()
+
+	// the RESP stream goes through binary messages
+	conn, rd, _ = wsDial(t, s, "/ws?format=resp")
+	wsSend(conn, wsBinary, true, "PING\r\n*1\r\n$4\r\nINFO\r\n")
+	for _, want := range []string{"+ping\r\n", "+info\r\n"} {
+		if opcode, res := wsRecv(t, conn, rd); opcode != wsBinary || res != want {
+			t.Errorf("Want: %q, got: %d %q", want, opcode, res)
+		}
+	}
+	// the client frames must be masked
+	conn.Write([]byte{0x82, 0x01, 'x'})
+	if opcode, res := wsRecv(t, conn, rd); opcode != wsClose || !strings.HasPrefix(res, "\x03\xea") {
+		t.Errorf("Want a protocol error close frame, got: %d %q", opcode, res)
+	}
+	conn.Close()
+
+	// a refused connection is closed with the reason
+	atomic.StoreInt32(&refused, 1)
+	conn, rd, _ = wsDial(t, s, "/ws")
+	if opcode, res := wsRecv(t, conn, rd); opcode != wsClose || res != "\x03\xf5max number of clients reached" {
+		t.Errorf("Want the connection refused, got: %d %q", opcode, res)
+	}
+	conn.Close()
+
+	// the requests that aren't handshakes are replied with an error
+	r, err := http.Get(s.URL + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusBadRequest {
+		t.Errorf("Want status 400, got %d", r.StatusCode)
+	}
+}
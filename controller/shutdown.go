@@ -0,0 +1,174 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/junostorage/controller/server"
+)
+
+var (
+	errShuttingDown    = errors.New("the server is shutting down")
+	errShutdownFailed  = errors.New("Errors trying to SHUTDOWN. Check logs.")
+	errShutdownAborted = errors.New("SHUTDOWN aborted")
+	errNoShutdown      = errors.New("No shutdown in progress.")
+)
+
+// shutdownRequest is a SHUTDOWN handled by the goroutine serving the
+// listeners, done receives the outcome once the shutdown can't be aborted
+// anymore
+type shutdownRequest struct {
+	save   bool
+	nosave bool
+	now    bool
+	force  bool
+	done   chan error
+}
+
+// SHUTDOWN [NOSAVE|SAVE] [NOW] [FORCE] [ABORT]
+func (c *Controller) cmdShutdown(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	req := &shutdownRequest{done: make(chan error, 1)}
+	abort := false
+	for _, v := range msg.Values[1:] {
+		switch strings.ToLower(v.String()) {
+		default:
+			return "", errSyntax
+		case "nosave":
+			req.nosave = true
+		case "save":
+			req.save = true
+		case "now":
+			req.now = true
+		case "force":
+			req.force = true
+		case "abort":
+			abort = true
+		}
+	}
+	if req.save && req.nosave {
+		return "", errSyntax
+	}
+
+	if abort {
+		if len(msg.Values) != 2 {
+			return "", errSyntax
+		}
+		if atomic.LoadInt32(&c.shutdownBusy) == 0 {
+			return "", errNoShutdown
+		}
+		select {
+		case c.abortc <- struct{}{}:
+		default:
+		}
+		return okOutput(msg)
+	}
+
+	select {
+	case c.shutdownc <- req:
+	case <-c.done:
+		return "", errShuttingDown
+	}
+	if err := <-req.done; err != nil {
+		return "", err
+	}
+	// the clients are closed by the shutdown without a reply
+	if conn != nil {
+		conn.CloseAfterReply()
+		return "", nil
+	}
+	return okOutput(msg)
+}
+
+// prepareShutdown drains the running commands and performs the final
+// save. The shutdown is aborted when the save fails without FORCE, or with
+// SHUTDOWN ABORT while the commands are drained. Otherwise the commands
+// are refused from now on.
+func (c *Controller) prepareShutdown(req *shutdownRequest) error {
+	atomic.StoreInt32(&c.shutdownBusy, 1)
+	defer atomic.StoreInt32(&c.shutdownBusy, 0)
+	select {
+	case <-c.abortc:
+	default:
+	}
+	logs.Warnf("User requested shutdown...")
+
+	// there are no replicas to wait for, NOW is accepted for compatibility
+
+	// the write lock is taken once the running commands are done, the
+	// new ones wait for it
+	locked := make(chan struct{})
+	go func() {
+		c.mu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-c.abortc:
+		go func() {
+			<-locked
+			c.mu.Unlock()
+		}()
+		logs.Warnf("Shutdown aborted")
+		return errShutdownAborted
+	}
+	defer c.mu.Unlock()
+
+	if req.save || (!req.nosave && len(c.saveRules) > 0) {
+		logs.Warnf("Saving the final snapshot before exiting.")
+		if err := c.store.Save(); err != nil {
+			logs.Errorf("Error trying to save the DB: %v", err)
+			if !req.force {
+				logs.Errorf("Error trying to save the DB, can't exit.")
+				return errShutdownFailed
+			}
+		} else {
+			logs.Warnf("DB saved on disk")
+		}
+	}
+	c.setShuttingDown()
+	return nil
+}
+
+// setShuttingDown refuses the commands and the connections from now on,
+// the caller holds the write lock
+func (c *Controller) setShuttingDown() {
+	c.connsMu.Lock()
+	c.shuttingDown = true
+	c.connsMu.Unlock()
+}
+
+// stop closes the listeners, shuts the http servers down within
+// shutdown-timeout and closes the clients. The background tasks are
+// stopped.
+func (c *Controller) stop(listeners []net.Listener, httpServers []*http.Server) {
+	c.mu.Lock()
+	c.setShuttingDown()
+	c.mu.Unlock()
+
+	for _, ln := range listeners {
+		ln.Close()
+	}
+
+	timeout := time.Duration(c.config.Int("shutdown-timeout")) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, s := range httpServers {
+		if err := s.Shutdown(ctx); err != nil {
+			logs.Warnf("http server shutdown: %v", err)
+			s.Close()
+		}
+	}
+
+	for _, conn := range c.sortedConns() {
+		conn.Close()
+	}
+
+	close(c.done)
+	logs.Warnf("junostorage is now ready to exit, bye bye...")
+}
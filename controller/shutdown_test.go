@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/junostorage/config"
+)
+
+func TestShutdown(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "junoshutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	cfg := config.New()
+	cfg.SetStartup("bind", "127.0.0.1")
+	cfg.SetStartup("port", strconv.Itoa(port))
+	cfg.SetStartup("http-port", "0")
+	cfg.SetStartup("dir", filepath.Join(dir, "missing"))
+	errc := make(chan error, 1)
+	go func() { errc <- ListenAndServeEx(cfg, nil) }()
+
+	var conn net.Conn
+	for i := 0; i < 50 && conn == nil; i++ {
+		conn, _ = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conn == nil {
+		t.Fatalf("Dial error")
+	}
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	send := func(data string) string {
+		io.WriteString(conn, data)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, _ := rd.ReadString('\n')
+		return line
+	}
+
+	testCases := []struct {
+		data string
+		res  string
+	}{
+		{"SET k v\r\n", "+OK\r\n"},
+		{"SHUTDOWN ABORT\r\n", "-ERR No shutdown in progress.\r\n"},
+		{"SHUTDOWN SAVE NOSAVE\r\n", "-ERR syntax error\r\n"},
+		// the save fails as dir is missing, the server keeps running
+		{"SHUTDOWN SAVE\r\n", "-ERR Errors trying to SHUTDOWN. Check logs.\r\n"},
+		{"GET k\r\n", "$1\r\n"},
+	}
+	for _, testCase := range testCases {
+		if res := send(testCase.data); res != testCase.res {
+			t.Errorf("Want: %q, got: %q, data:%q", testCase.res, res, testCase.data)
+		}
+	}
+	rd.ReadString('\n')
+
+	// the clients are closed without a reply once the snapshot is saved
+	if err := os.Mkdir(filepath.Join(dir, "missing"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if res := send("SHUTDOWN SAVE\r\n"); res != "" {
+		t.Errorf("Want the connection closed, got: %q", res)
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("ListenAndServeEx error:%v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Want ListenAndServeEx to return")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing", "dump.juno")); err != nil {
+		t.Errorf("Want the snapshot saved, got: %v", err)
+	}
+	if _, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+		t.Errorf("Want the listener closed")
+	}
+}
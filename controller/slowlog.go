@@ -0,0 +1,219 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/junostorage/controller/server"
+
+	"github.com/junostorage/resp"
+)
+
+const (
+	slowlogMaxArgc   = 32
+	slowlogMaxArgLen = 128
+)
+
+// slowlogEntry is a command that took longer than slowlog-log-slower-than
+type slowlogEntry struct {
+	id       int64
+	time     time.Time
+	duration time.Duration
+	args     []string
+	addr     string
+	name     string
+}
+
+// slowlog is a bounded log of the slow commands, newest first
+type slowlog struct {
+	mu      sync.Mutex
+	nextID  int64
+	entries []slowlogEntry
+}
+
+// record adds the command to the log when it's slower than the threshold
+// given in microseconds, a negative threshold disables the log.
+func (s *slowlog) record(msg *server.Message, d time.Duration, addr, name string, threshold, maxLen int64) {
+	if threshold < 0 || int64(d/time.Microsecond) < threshold {
+		return
+	}
+
+	argc := len(msg.Values)
+	if argc > slowlogMaxArgc {
+		argc = slowlogMaxArgc
+	}
+	// the passwords are not logged
+	redacted := redactedArgs(msg)
+	args := make([]string, 0, argc)
+	for i := 0; i < argc; i++ {
+		if i == slowlogMaxArgc-1 && len(msg.Values) > slowlogMaxArgc {
+			args = append(args, fmt.Sprintf("... (%d more arguments)", len(msg.Values)-slowlogMaxArgc+1))
+			break
+		}
+		arg := msg.Values[i].String()
+		if i >= redacted {
+			arg = "(redacted)"
+		}
+		if len(arg) > slowlogMaxArgLen {
+			arg = fmt.Sprintf("%s... (%d more bytes)", arg[:slowlogMaxArgLen], len(arg)-slowlogMaxArgLen)
+		}
+		args = append(args, arg)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := slowlogEntry{id: s.nextID, time: time.Now(), duration: d, args: args, addr: addr, name: name}
+	s.nextID++
+	s.entries = append([]slowlogEntry{e}, s.entries...)
+	if int64(len(s.entries)) > maxLen {
+		s.entries = s.entries[:maxLen]
+	}
+}
+
+func (s *slowlog) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+func (s *slowlog) reset() {
+	s.mu.Lock()
+	s.entries = nil
+	s.mu.Unlock()
+}
+
+// get returns up to n newest entries, all of them when n is negative
+func (s *slowlog) get(n int) []slowlogEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n < 0 || n > len(s.entries) {
+		n = len(s.entries)
+	}
+	entries := make([]slowlogEntry, n)
+	copy(entries, s.entries)
+	return entries
+}
+
+// clientAddr returns the address of the client that sent the message
+func clientAddr(conn *server.Conn, msg *server.Message) string {
+	if conn != nil {
+		return conn.Addr()
+	}
+	return msg.RemoteAddr
+}
+
+// clientName returns the name of the client, HTTP clients have no name
+func clientName(conn *server.Conn) string {
+	if conn != nil {
+		return conn.Name()
+	}
+	return ""
+}
+
+func (c *Controller) cmdSlowlog(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) < 2 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	switch strings.ToLower(msg.Values[1].String()) {
+	default:
+		err = fmt.Errorf("unknown subcommand '%s'. Try SLOWLOG HELP.", msg.Values[1].String())
+	case "get":
+		res, err = c.cmdSlowlogGet(msg)
+	case "len":
+		if len(msg.Values) != 2 {
+			return "", errInvalidNumberOfArguments
+		}
+		res, err = integerOutput(msg, c.slowlog.len())
+	case "reset":
+		if len(msg.Values) != 2 {
+			return "", errInvalidNumberOfArguments
+		}
+		c.slowlog.reset()
+		res, err = okOutput(msg)
+	}
+	return
+}
+
+// SLOWLOG GET [count]
+func (c *Controller) cmdSlowlogGet(msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) > 3 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	n := 10
+	if len(msg.Values) == 3 {
+		if n, err = strconv.Atoi(msg.Values[2].String()); err != nil || n < -1 {
+			return "", errors.New("count should be greater than or equal to -1")
+		}
+	}
+
+	entries := c.slowlog.get(n)
+
+	switch msg.OutputType {
+	case server.JSON:
+		items := make([]jsonObject, 0, len(entries))
+		for _, e := range entries {
+			items = append(items, jsonObject{
+				resp.StringValue("id"), resp.IntegerValue(int(e.id)),
+				resp.StringValue("time"), resp.IntegerValue(int(e.time.Unix())),
+				resp.StringValue("duration"), resp.IntegerValue(int(e.duration / time.Microsecond)),
+				resp.StringValue("args"), stringsValue(e.args),
+				resp.StringValue("addr"), resp.StringValue(e.addr),
+				resp.StringValue("name"), resp.StringValue(e.name),
+			})
+		}
+		return jsonOutput(items)
+	case server.RESP:
+		vals := make([]resp.Value, 0, len(entries))
+		for _, e := range entries {
+			args := make([]resp.Value, 0, len(e.args))
+			for _, a := range e.args {
+				args = append(args, resp.StringValue(a))
+			}
+			vals = append(vals, resp.ArrayValue([]resp.Value{
+				resp.IntegerValue(int(e.id)),
+				resp.IntegerValue(int(e.time.Unix())),
+				resp.IntegerValue(int(e.duration / time.Microsecond)),
+				resp.ArrayValue(args),
+				resp.StringValue(e.addr),
+				resp.StringValue(e.name),
+			}))
+		}
+		data, err := resp.ArrayValue(vals).MarshalRESP()
+		if err != nil {
+			return "", err
+		}
+
+		res = string(data)
+	}
+
+	return
+}
+
+// integerOutput returns the reply of the commands which reply with an integer
+func integerOutput(msg *server.Message, n int) (res string, err error) {
+	switch msg.OutputType {
+	case server.JSON:
+		return jsonOutput(n)
+	case server.RESP:
+		data, err := resp.IntegerValue(n).MarshalRESP()
+		if err != nil {
+			return "", err
+		}
+
+		res = string(data)
+	}
+
+	return
+}
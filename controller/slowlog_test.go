@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowlog(t *testing.T) {
+
+	s := &slowlog{}
+
+	message, _ := readMessage("SET mkey " + strings.Repeat("x", 200) + "\r\n")
+	s.record(message, time.Millisecond, "127.0.0.1:5000", "", 2000, 2)
+	if n := s.len(); n != 0 {
+		t.Errorf("Expected fast command not to be logged, got %d entries", n)
+	}
+
+	s.record(message, 3*time.Millisecond, "127.0.0.1:5000", "", 2000, 2)
+	s.record(message, 3*time.Millisecond, "127.0.0.1:5000", "", 2000, 2)
+	s.record(message, 3*time.Millisecond, "127.0.0.1:5000", "", 2000, 2)
+	if n := s.len(); n != 2 {
+		t.Errorf("Expected the log to be bounded to 2 entries, got %d", n)
+	}
+
+	entries := s.get(1)
+	if len(entries) != 1 || entries[0].id != 2 {
+		t.Fatalf("Expected the newest entry, got %v", entries)
+	}
+	if want := strings.Repeat("x", 128) + "... (72 more bytes)"; entries[0].args[2] != want {
+		t.Errorf("Expected truncated argument, got %q", entries[0].args[2])
+	}
+
+	message, _ = readMessage("LPUSH list" + strings.Repeat(" 1", 40) + "\r\n")
+	s.record(message, time.Millisecond, "127.0.0.1:5000", "", 0, 10)
+	entries = s.get(1)
+	if len(entries[0].args) != 32 || entries[0].args[31] != "... (11 more arguments)" {
+		t.Errorf("Expected truncated arguments, got %v", entries[0].args)
+	}
+
+	s.record(message, time.Second, "127.0.0.1:5000", "", -1, 10)
+	if n := s.len(); n != 3 {
+		t.Errorf("Expected disabled log not to record, got %d entries", n)
+	}
+
+	message, _ = readMessage("SLOWLOG RESET\r\n")
+	if _, err := c.cmdSlowlog(message); err != nil {
+		t.Fatalf("cmdSlowlog error:%v", err)
+	}
+	message, _ = readMessage("SLOWLOG LEN\r\n")
+	res, err := c.cmdSlowlog(message)
+	if err != nil {
+		t.Fatalf("cmdSlowlog error:%v", err)
+	}
+	if res != ":0\r\n" {
+		t.Errorf("Expected empty slowlog, got %q", res)
+	}
+
+}
@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"crypto/tls"
+
+	"github.com/junostorage/controller/server"
+)
+
+// tlsConfig returns the TLS configuration of the listeners
+func (c *Controller) tlsConfig() (*tls.Config, error) {
+	minVersion, err := server.ParseTLSProtocols(c.config.String("tls-protocols"))
+	if err != nil {
+		return nil, err
+	}
+	ciphers, err := server.ParseCipherSuites(c.config.String("tls-ciphers"))
+	if err != nil {
+		return nil, err
+	}
+
+	opts := server.TLSOptions{
+		CertFile:     c.config.String("tls-cert-file"),
+		KeyFile:      c.config.String("tls-key-file"),
+		CAFile:       c.config.String("tls-ca-cert-file"),
+		MinVersion:   minVersion,
+		CipherSuites: ciphers,
+	}
+	switch c.config.String("tls-auth-clients") {
+	case "yes":
+		opts.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		opts.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return server.NewTLSConfig(opts)
+}
+
+// certUser returns the ACL user named after the common name of the client
+// certificate when tls-auth-clients-user is CN, the user must exist and be
+// enabled.
+func (c *Controller) certUser(cn string) string {
+	if cn == "" || c.config.String("tls-auth-clients-user") != "cn" {
+		return ""
+	}
+	if u, ok := c.acl.GetUser(cn); ok && u.Enabled {
+		return cn
+	}
+	return ""
+}
@@ -0,0 +1,522 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/junostorage/controller/server"
+	"github.com/junostorage/storage"
+
+	"github.com/junostorage/resp"
+)
+
+// invalidateChannel is the channel the RESP2 redirect clients receive the
+// invalidation messages on
+const invalidateChannel = "__redis__:invalidate"
+
+var (
+	errTrackingOptions = errors.New("You can't use both OPTIN and OPTOUT")
+	errTrackingBCAST   = errors.New("OPTIN and OPTOUT are not compatible with BCAST")
+	errTrackingPrefix  = errors.New("PREFIX option requires BCAST mode to be enabled")
+	errTrackingRedir   = errors.New("The client ID you want redirect to does not exist")
+	errCachingMode     = errors.New("CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+	errCachingYes      = errors.New("CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+	errCachingNo       = errors.New("CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+)
+
+// trackingClient is the tracking state of a connection
+type trackingClient struct {
+	conn *server.Conn
+	// redirect is the ID of the client receiving the invalidations, 0
+	// when the connection receives its own
+	redirect int64
+	// redirectBroken is set once the redirect client is gone
+	redirectBroken bool
+	bcast          bool
+	prefixes       []string
+	optin          bool
+	optout         bool
+	noloop         bool
+	// caching is the CLIENT CACHING answer for the next command, 0 when
+	// it wasn't called
+	caching int
+}
+
+// tracking holds the keys read by the tracking clients and the prefixes of
+// the BCAST clients. The table only records the client IDs, the entries of
+// the closed clients are dropped when the key is invalidated.
+type tracking struct {
+	mu       sync.Mutex
+	clients  map[int64]*trackingClient
+	keys     map[string]map[int64]bool
+	prefixes map[string]map[int64]bool
+	// items is the number of client IDs in the keys table
+	items int
+}
+
+func newTracking() *tracking {
+	return &tracking{
+		clients:  make(map[int64]*trackingClient),
+		keys:     make(map[string]map[int64]bool),
+		prefixes: make(map[string]map[int64]bool),
+	}
+}
+
+// client returns the tracking state of the connection, nil when tracking
+// is off
+func (t *tracking) client(conn *server.Conn) *trackingClient {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.clients[conn.ID]
+}
+
+// enable turns tracking on for the connection replacing its previous
+// options
+func (t *tracking) enable(tc *trackingClient) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.disableLocked(tc.conn.ID)
+	t.clients[tc.conn.ID] = tc
+	for _, prefix := range tc.prefixes {
+		if t.prefixes[prefix] == nil {
+			t.prefixes[prefix] = make(map[int64]bool)
+		}
+		t.prefixes[prefix][tc.conn.ID] = true
+	}
+}
+
+// disable turns tracking off for the client
+func (t *tracking) disable(id int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.disableLocked(id)
+}
+
+func (t *tracking) disableLocked(id int64) {
+	tc, ok := t.clients[id]
+	if !ok {
+		return
+	}
+	delete(t.clients, id)
+	for _, prefix := range tc.prefixes {
+		delete(t.prefixes[prefix], id)
+		if len(t.prefixes[prefix]) == 0 {
+			delete(t.prefixes, prefix)
+		}
+	}
+}
+
+// remember records the keys read by the client. Once the table has more
+// keys than max, keys are invalidated to make room; max 0 means no limit.
+// It returns the keys that were evicted from the table with their clients.
+func (t *tracking) remember(id int64, keys []string, max int) map[string][]int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, key := range keys {
+		ids, ok := t.keys[key]
+		if !ok {
+			ids = make(map[int64]bool)
+			t.keys[key] = ids
+		}
+		if !ids[id] {
+			ids[id] = true
+			t.items++
+		}
+	}
+
+	if max <= 0 || len(t.keys) <= max {
+		return nil
+	}
+	evicted := make(map[string][]int64)
+	for key := range t.keys {
+		if len(t.keys) <= max {
+			break
+		}
+		evicted[key] = t.forgetLocked(key)
+	}
+	return evicted
+}
+
+// forget removes the key from the table returning the clients that read it
+func (t *tracking) forget(key string) []int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.forgetLocked(key)
+}
+
+func (t *tracking) forgetLocked(key string) []int64 {
+	ids, ok := t.keys[key]
+	if !ok {
+		return nil
+	}
+	delete(t.keys, key)
+	t.items -= len(ids)
+	list := make([]int64, 0, len(ids))
+	for id := range ids {
+		list = append(list, id)
+	}
+	return list
+}
+
+// forgetAll empties the table, it's used when the whole dataset changes
+func (t *tracking) forgetAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.keys = make(map[string]map[int64]bool)
+	t.items = 0
+}
+
+// broadcast returns the BCAST clients with a prefix of the key
+func (t *tracking) broadcast(key string) []int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var list []int64
+	for prefix, ids := range t.prefixes {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for id := range ids {
+			list = append(list, id)
+		}
+	}
+	return list
+}
+
+// stats returns the number of tracked keys, tracked items and prefixes
+func (t *tracking) stats() (keys, items, prefixes int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.keys), t.items, len(t.prefixes)
+}
+
+// numClients returns the number of clients with tracking on
+func (t *tracking) numClients() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.clients)
+}
+
+// trackCommand records the keys read by a tracking client and invalidates
+// the keys written by the command. It's called once the command succeeded.
+func (c *Controller) trackCommand(conn *server.Conn, msg *server.Message, cmd *command) {
+	keys, write := cmd.keys(stringArgs(msg.Values)), cmd.flags&flagWrite != 0
+	if write {
+		for _, key := range keys {
+			c.invalidateKey(conn, key)
+		}
+	}
+
+	if conn == nil {
+		return
+	}
+	tc := c.tracking.client(conn)
+	if tc == nil {
+		return
+	}
+	// the CLIENT CACHING answer is only valid for the next command
+	c.tracking.mu.Lock()
+	caching := tc.caching
+	if !(msg.Command == storage.CmdClient && len(msg.Values) > 1 && strings.ToLower(msg.Values[1].String()) == "caching") {
+		tc.caching = 0
+	}
+	c.tracking.mu.Unlock()
+	if write || len(keys) == 0 || tc.bcast {
+		return
+	}
+	if (tc.optin && caching != 1) || (tc.optout && caching == -1) {
+		return
+	}
+
+	evicted := c.tracking.remember(conn.ID, keys, int(c.config.Int("tracking-table-max-keys")))
+	for key, ids := range evicted {
+		c.sendInvalidation(ids, nil, resp.ArrayValue([]resp.Value{resp.StringValue(key)}))
+	}
+}
+
+// invalidateKey sends the invalidation of the key to the clients that read
+// it and to the BCAST clients of its prefixes. conn is the client that
+// modified the key, nil when it's expired.
+func (c *Controller) invalidateKey(conn *server.Conn, key string) {
+	ids := append(c.tracking.forget(key), c.tracking.broadcast(key)...)
+	if len(ids) == 0 {
+		return
+	}
+	c.sendInvalidation(ids, conn, resp.ArrayValue([]resp.Value{resp.StringValue(key)}))
+}
+
+// invalidateAll tells the tracking clients that all their keys changed
+func (c *Controller) invalidateAll() {
+	c.tracking.forgetAll()
+
+	c.tracking.mu.Lock()
+	ids := make([]int64, 0, len(c.tracking.clients))
+	for id := range c.tracking.clients {
+		ids = append(ids, id)
+	}
+	c.tracking.mu.Unlock()
+
+	c.sendInvalidation(ids, nil, resp.NilValue())
+}
+
+// sendInvalidation sends the invalidation message to the clients, a client
+// is sent a single message even if it's listed more than once. The NOLOOP
+// clients don't receive the invalidations of their own writes.
+func (c *Controller) sendInvalidation(ids []int64, from *server.Conn, keys resp.Value) {
+	sent := make(map[int64]bool)
+	for _, id := range ids {
+		if sent[id] {
+			continue
+		}
+		sent[id] = true
+
+		c.tracking.mu.Lock()
+		tc, ok := c.tracking.clients[id]
+		c.tracking.mu.Unlock()
+		if !ok || (tc.noloop && tc.conn == from) {
+			continue
+		}
+
+		target := tc.conn
+		if tc.redirect != 0 {
+			target = c.connByID(tc.redirect)
+			if target == nil {
+				c.redirectBroken(tc)
+				continue
+			}
+		}
+
+		switch {
+		case target.Proto() >= 3:
+			c.pubsub.push(target, resp.StringValue("invalidate"), keys)
+		case tc.redirect != 0 && c.pubsub.subscribed(target):
+			c.pubsub.push(target, resp.StringValue("message"), resp.StringValue(invalidateChannel), keys)
+		}
+	}
+}
+
+// redirectBroken tells a RESP3 client that its redirect client is gone,
+// only once.
+func (c *Controller) redirectBroken(tc *trackingClient) {
+	c.tracking.mu.Lock()
+	broken := tc.redirectBroken
+	tc.redirectBroken = true
+	c.tracking.mu.Unlock()
+
+	if !broken && tc.conn.Proto() >= 3 {
+		c.pubsub.push(tc.conn, resp.StringValue("tracking-redir-broken"), resp.IntegerValue(int(tc.redirect)))
+	}
+}
+
+// connByID returns the open connection with the ID
+func (c *Controller) connByID(id int64) *server.Conn {
+	c.connsMu.Lock()
+	defer c.connsMu.Unlock()
+
+	for conn := range c.conns {
+		if conn.ID == id {
+			return conn
+		}
+	}
+	return nil
+}
+
+// CLIENT TRACKING ON|OFF [REDIRECT client-id] [PREFIX prefix ...] [BCAST]
+// [OPTIN] [OPTOUT] [NOLOOP]
+func (c *Controller) cmdClientTracking(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) < 3 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	var on bool
+	switch strings.ToLower(msg.Values[2].String()) {
+	default:
+		return "", errSyntax
+	case "on":
+		on = true
+	case "off":
+	}
+
+	tc := &trackingClient{conn: conn}
+	args := msg.Values[3:]
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(args[i].String()) {
+		default:
+			return "", errSyntax
+		case "redirect":
+			if i+1 >= len(args) {
+				return "", errSyntax
+			}
+			i++
+			id, err := strconv.ParseInt(args[i].String(), 10, 64)
+			if err != nil {
+				return "", errNotInteger
+			}
+			tc.redirect = id
+		case "prefix":
+			if i+1 >= len(args) {
+				return "", errSyntax
+			}
+			i++
+			tc.prefixes = append(tc.prefixes, args[i].String())
+		case "bcast":
+			tc.bcast = true
+		case "optin":
+			tc.optin = true
+		case "optout":
+			tc.optout = true
+		case "noloop":
+			tc.noloop = true
+		}
+	}
+
+	if !on {
+		c.tracking.disable(conn.ID)
+		return okOutput(msg)
+	}
+
+	switch {
+	case tc.optin && tc.optout:
+		return "", errTrackingOptions
+	case tc.bcast && (tc.optin || tc.optout):
+		return "", errTrackingBCAST
+	case len(tc.prefixes) > 0 && !tc.bcast:
+		return "", errTrackingPrefix
+	}
+	if err := checkPrefixes(tc.prefixes); err != nil {
+		return "", err
+	}
+	if tc.bcast && len(tc.prefixes) == 0 {
+		// BCAST without prefixes tracks every key
+		tc.prefixes = []string{""}
+	}
+	if tc.redirect != 0 && (tc.redirect == conn.ID || c.connByID(tc.redirect) == nil) {
+		if tc.redirect == conn.ID {
+			return "", errors.New("The client ID you want redirect to is the current client")
+		}
+		return "", errTrackingRedir
+	}
+
+	c.tracking.enable(tc)
+
+	return okOutput(msg)
+}
+
+// checkPrefixes returns an error when a prefix is a prefix of another
+func checkPrefixes(prefixes []string) error {
+	for i, a := range prefixes {
+		for j, b := range prefixes {
+			if i != j && a != b && strings.HasPrefix(b, a) {
+				return fmt.Errorf("Prefix '%s' overlaps with another provided prefix '%s'. Prefixes for a single client must not overlap.", a, b)
+			}
+		}
+	}
+	return nil
+}
+
+// CLIENT CACHING YES|NO
+func (c *Controller) cmdClientCaching(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 3 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	tc := c.tracking.client(conn)
+	if tc == nil || (!tc.optin && !tc.optout) {
+		return "", errCachingMode
+	}
+
+	c.tracking.mu.Lock()
+	defer c.tracking.mu.Unlock()
+	switch strings.ToLower(msg.Values[2].String()) {
+	default:
+		return "", errSyntax
+	case "yes":
+		if !tc.optin {
+			return "", errCachingYes
+		}
+		tc.caching = 1
+	case "no":
+		if !tc.optout {
+			return "", errCachingNo
+		}
+		tc.caching = -1
+	}
+
+	return okOutput(msg)
+}
+
+// CLIENT GETREDIR
+func (c *Controller) cmdClientGetRedir(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 2 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	return integerOutput(msg, int(c.trackingRedirect(conn)))
+}
+
+// trackingRedirect returns the redirect client ID, 0 without redirection
+// and -1 when tracking is off
+func (c *Controller) trackingRedirect(conn *server.Conn) int64 {
+	tc := c.tracking.client(conn)
+	if tc == nil {
+		return -1
+	}
+	return tc.redirect
+}
+
+// CLIENT TRACKINGINFO
+func (c *Controller) cmdClientTrackingInfo(conn *server.Conn, msg *server.Message) (res string, err error) {
+
+	if len(msg.Values) != 2 {
+		err = errInvalidNumberOfArguments
+		return
+	}
+
+	flags := []string{"off"}
+	redirect := int64(-1)
+	var prefixes []string
+	c.tracking.mu.Lock()
+	if tc := c.tracking.clients[conn.ID]; tc != nil {
+		flags = []string{"on"}
+		for _, f := range []struct {
+			set  bool
+			name string
+		}{
+			{tc.bcast, "bcast"},
+			{tc.optin, "optin"},
+			{tc.optout, "optout"},
+			{tc.caching == 1, "caching-yes"},
+			{tc.caching == -1, "caching-no"},
+			{tc.noloop, "noloop"},
+			{tc.redirectBroken, "broken_redirect"},
+		} {
+			if f.set {
+				flags = append(flags, f.name)
+			}
+		}
+		redirect = tc.redirect
+		if tc.bcast {
+			prefixes = append(prefixes, tc.prefixes...)
+			sort.Strings(prefixes)
+		}
+	}
+	c.tracking.mu.Unlock()
+
+	return valueOutput(msg, resp.MapValue([]resp.Value{
+		resp.StringValue("flags"), resp.SetValue(stringsValue(flags).Array()),
+		resp.StringValue("redirect"), resp.IntegerValue(int(redirect)),
+		resp.StringValue("prefixes"), stringsValue(prefixes),
+	}))
+}
@@ -0,0 +1,188 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/junostorage/controller/server"
+)
+
+// frameReader reads the frames the server pushes to a connection
+type frameReader struct {
+	t  *testing.T
+	p  net.Conn
+	rd *bufio.Reader
+}
+
+func newFrameReader(t *testing.T, p net.Conn) *frameReader {
+	return &frameReader{t: t, p: p, rd: bufio.NewReader(p)}
+}
+
+// read returns the next n lines
+func (fr *frameReader) read(n int) string {
+	fr.t.Helper()
+	fr.p.SetReadDeadline(time.Now().Add(time.Second))
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		line, err := fr.rd.ReadString('\n')
+		if err != nil {
+			fr.t.Fatalf("read error:%v", err)
+		}
+		buf.WriteString(line)
+	}
+	return buf.String()
+}
+
+// none checks that nothing was pushed
+func (fr *frameReader) none() {
+	fr.p.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if line, err := fr.rd.ReadString('\n'); err == nil {
+		fr.t.Errorf("Expected no frame, got %q", line)
+	}
+}
+
+// trackingConn returns a RESP3 connection registered like the server does
+func trackingConn(t *testing.T) (*server.Conn, *frameReader, func()) {
+	p1, p2 := net.Pipe()
+	conn := server.NewConn(p1)
+	conn.SetProto(3)
+	c.connsMu.Lock()
+	c.conns[conn] = true
+	c.connsMu.Unlock()
+	return conn, newFrameReader(t, p2), func() {
+		c.connsMu.Lock()
+		delete(c.conns, conn)
+		c.connsMu.Unlock()
+		c.pubsub.remove(conn)
+		c.tracking.disable(conn.ID)
+		p1.Close()
+		p2.Close()
+	}
+}
+
+func TestTracking(t *testing.T) {
+
+	conn, frames, done := trackingConn(t)
+	defer done()
+	writer, _, done2 := trackingConn(t)
+	defer done2()
+
+	if res := sendCommand(t, conn, "CLIENT TRACKING on\r\n"); res != "+OK\r\n" {
+		t.Fatalf("Unexpected reply %q", res)
+	}
+	sendCommand(t, conn, "GET track:1\r\n")
+	sendCommand(t, writer, "SET track:1 v\r\n")
+	if frame := frames.read(6); frame != ">2\r\n$10\r\ninvalidate\r\n*1\r\n$7\r\ntrack:1\r\n" {
+		t.Errorf("Unexpected invalidation %q", frame)
+	}
+	// the key is only invalidated once until it's read again
+	sendCommand(t, writer, "SET track:1 w\r\n")
+	frames.none()
+
+	// NOLOOP skips the invalidations of the own writes
+	sendCommand(t, conn, "CLIENT TRACKING on NOLOOP\r\n")
+	sendCommand(t, conn, "GET track:1\r\n")
+	sendCommand(t, conn, "SET track:1 x\r\n")
+	frames.none()
+
+	// OPTIN only tracks the keys read after CLIENT CACHING yes
+	sendCommand(t, conn, "CLIENT TRACKING on OPTIN\r\n")
+	sendCommand(t, conn, "GET track:2\r\n")
+	sendCommand(t, conn, "CLIENT CACHING yes\r\n")
+	sendCommand(t, conn, "GET track:3\r\n")
+	sendCommand(t, writer, "SET track:2 v\r\n")
+	sendCommand(t, writer, "SET track:3 v\r\n")
+	if frame := frames.read(6); frame != ">2\r\n$10\r\ninvalidate\r\n*1\r\n$7\r\ntrack:3\r\n" {
+		t.Errorf("Unexpected invalidation %q", frame)
+	}
+	frames.none()
+
+	// BCAST sends the invalidations of the keys with the prefixes
+	sendCommand(t, conn, "CLIENT TRACKING on BCAST PREFIX user:\r\n")
+	sendCommand(t, writer, "SET user:1 v\r\n")
+	sendCommand(t, writer, "SET other:1 v\r\n")
+	if frame := frames.read(6); frame != ">2\r\n$10\r\ninvalidate\r\n*1\r\n$6\r\nuser:1\r\n" {
+		t.Errorf("Unexpected invalidation %q", frame)
+	}
+	frames.none()
+	if info := c.clientInfo(conn); !strings.Contains(info, " flags=tB ") || !strings.Contains(info, " redir=0 ") {
+		t.Errorf("Unexpected client info %q", info)
+	}
+
+	testCases := []struct {
+		data string
+		err  string
+	}{
+		{"CLIENT TRACKING on PREFIX a\r\n", "-ERR PREFIX option requires BCAST mode to be enabled\r\n"},
+		{"CLIENT TRACKING on OPTIN OPTOUT\r\n", "-ERR You can't use both OPTIN and OPTOUT\r\n"},
+		{"CLIENT TRACKING on BCAST OPTIN\r\n", "-ERR OPTIN and OPTOUT are not compatible with BCAST\r\n"},
+		{"CLIENT TRACKING on BCAST PREFIX a PREFIX ab\r\n", "-ERR Prefix 'a' overlaps with another provided prefix 'ab'. Prefixes for a single client must not overlap.\r\n"},
+		{"CLIENT TRACKING on REDIRECT 999999\r\n", "-ERR The client ID you want redirect to does not exist\r\n"},
+	}
+	for _, testCase := range testCases {
+		if res := sendCommand(t, conn, testCase.data); res != testCase.err {
+			t.Errorf("Expected %q, got %q", testCase.err, res)
+		}
+	}
+
+	if res := sendCommand(t, conn, "CLIENT TRACKING off\r\n"); res != "+OK\r\n" {
+		t.Errorf("Unexpected reply %q", res)
+	}
+	if res := sendCommand(t, conn, "CLIENT GETREDIR\r\n"); res != ":-1\r\n" {
+		t.Errorf("Expected -1, got %q", res)
+	}
+}
+
+func TestTrackingRedirect(t *testing.T) {
+
+	conn, _, done := trackingConn(t)
+	defer done()
+	conn.SetProto(2)
+	target, frames, done2 := trackingConn(t)
+	defer done2()
+	target.SetProto(2)
+
+	if res := sendCommand(t, target, "SUBSCRIBE __redis__:invalidate\r\n"); res != "" {
+		t.Fatalf("Unexpected reply %q", res)
+	}
+	frames.read(6)
+
+	if res := sendCommand(t, conn, fmt.Sprintf("CLIENT TRACKING on REDIRECT %d\r\n", target.ID)); res != "+OK\r\n" {
+		t.Fatalf("Unexpected reply %q", res)
+	}
+	if res := sendCommand(t, conn, "CLIENT GETREDIR\r\n"); res != fmt.Sprintf(":%d\r\n", target.ID) {
+		t.Errorf("Unexpected redirect %q", res)
+	}
+	sendCommand(t, conn, "GET redir:1\r\n")
+	sendCommand(t, conn, "SET redir:1 v\r\n")
+	if frame := frames.read(8); frame != "*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n*1\r\n$7\r\nredir:1\r\n" {
+		t.Errorf("Unexpected invalidation %q", frame)
+	}
+}
+
+func TestTrackingTableLimit(t *testing.T) {
+
+	conn, frames, done := trackingConn(t)
+	defer done()
+
+	c.config.Set("tracking-table-max-keys", "2")
+	defer c.config.Set("tracking-table-max-keys", "1000000")
+
+	sendCommand(t, conn, "CLIENT TRACKING on\r\n")
+	sendCommand(t, conn, "GET limit:1\r\n")
+	sendCommand(t, conn, "GET limit:2\r\n")
+	sendCommand(t, conn, "GET limit:3\r\n")
+
+	// one of the keys is invalidated to keep the table bounded
+	if frame := frames.read(6); !strings.HasPrefix(frame, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$7\r\nlimit:") {
+		t.Errorf("Unexpected invalidation %q", frame)
+	}
+	if keys, _, _ := c.tracking.stats(); keys != 2 {
+		t.Errorf("Expected 2 tracked keys, got %d", keys)
+	}
+}
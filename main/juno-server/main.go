@@ -3,14 +3,17 @@ package main
 import (
 	"flag"
 	"log"
+	"strconv"
 
+	"github.com/junostorage/config"
 	"github.com/junostorage/controller"
 )
 
 var (
-	port     int
-	httpPort int
-	host     string
+	port       int
+	httpPort   int
+	host       string
+	configFile string
 )
 
 func main() {
@@ -18,9 +21,38 @@ func main() {
 	flag.IntVar(&port, "p", 6380, "The listening port.")
 	flag.IntVar(&httpPort, "http", 6382, "The http listening port.")
 	flag.StringVar(&host, "h", "", "The listening host.")
+	flag.StringVar(&configFile, "c", "", "The configuration file.")
 	flag.Parse()
 
-	if err := controller.ListenAndServe(host, port, httpPort); err != nil {
+	cfg := config.New()
+	if configFile != "" {
+		var err error
+		if cfg, err = config.Load(configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// flags given on the command line override the configuration file,
+	// the first invalid one is reported
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		switch f.Name {
+		case "p":
+			err = cfg.SetStartup("port", strconv.Itoa(port))
+		case "http":
+			err = cfg.SetStartup("http-port", strconv.Itoa(httpPort))
+		case "h":
+			err = cfg.SetStartup("bind", host)
+		}
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := controller.ListenAndServe(cfg); err != nil {
 		log.Fatal(err)
 	}
 }
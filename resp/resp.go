@@ -20,6 +20,18 @@ const (
 	Integer      Type = ':'
 	BulkString   Type = '$'
 	Array        Type = '*'
+
+	// RESP3 types
+	Map            Type = '%'
+	Set            Type = '~'
+	Double         Type = ','
+	BigNumber      Type = '('
+	Boolean        Type = '#'
+	Null           Type = '_'
+	VerbatimString Type = '='
+	BlobError      Type = '!'
+	Attribute      Type = '|'
+	Push           Type = '>'
 )
 
 // TypeName returns name of the underlying RESP type.
@@ -37,6 +49,26 @@ func (t Type) String() string {
 		return "BulkString"
 	case '*':
 		return "Array"
+	case '%':
+		return "Map"
+	case '~':
+		return "Set"
+	case ',':
+		return "Double"
+	case '(':
+		return "BigNumber"
+	case '#':
+		return "Boolean"
+	case '_':
+		return "Null"
+	case '=':
+		return "VerbatimString"
+	case '!':
+		return "BlobError"
+	case '|':
+		return "Attribute"
+	case '>':
+		return "Push"
 	}
 }
 
@@ -44,9 +76,13 @@ func (t Type) String() string {
 type Value struct {
 	typ     Type
 	integer int
+	double  float64
 	str     []byte
 	array   []Value
 	null    bool
+	// attrs are the key value pairs of the RESP3 attribute sent before
+	// the value
+	attrs []Value
 }
 
 // Integer converts Value to an int. If Value cannot be converted, Zero is returned.
@@ -55,8 +91,10 @@ func (v Value) Integer() int {
 	default:
 		n, _ := strconv.ParseInt(v.String(), 10, 64)
 		return int(n)
-	case ':':
+	case ':', '#':
 		return v.integer
+	case ',':
+		return int(v.double)
 	}
 }
 
@@ -66,12 +104,22 @@ func (v Value) String() string {
 		return string(v.str)
 	}
 	switch v.typ {
-	case '+', '-':
+	case '+', '-', '(', '!':
 		return string(v.str)
 	case ':':
 		return strconv.FormatInt(int64(v.integer), 10)
-	case '*':
+	case '*', '%', '~', '>':
 		return fmt.Sprintf("%v", v.array)
+	case ',':
+		return formatDouble(v.double)
+	case '#':
+		return strconv.FormatBool(v.integer != 0)
+	case '=':
+		// the payload follows the three characters format and the colon
+		if len(v.str) >= 4 {
+			return string(v.str[4:])
+		}
+		return string(v.str)
 	}
 	return ""
 }
@@ -81,7 +129,7 @@ func (v Value) Bytes() []byte {
 	switch v.typ {
 	default:
 		return []byte(v.String())
-	case '$', '+', '-':
+	case '$', '+', '-', '(', '!':
 		return v.str
 	}
 }
@@ -94,6 +142,8 @@ func (v Value) Float() float64 {
 		return f
 	case ':':
 		return float64(v.integer)
+	case ',':
+		return v.double
 	}
 }
 
@@ -110,16 +160,20 @@ func (v Value) Bool() bool {
 // Error converts the Value to an error. If Value is not an error, nil is returned.
 func (v Value) Error() error {
 	switch v.typ {
-	case '-':
+	case '-', '!':
 		return errors.New(string(v.str))
 	}
 	return nil
 }
 
 // Array converts the Value to a an array. If Value is not an array or when it's is a RESP Null value, nil is returned.
+// The sets and the pushes are returned as arrays, the maps as their keys and values in a flat array.
 func (v Value) Array() []Value {
-	if v.typ == '*' && !v.null {
-		return v.array
+	switch v.typ {
+	case '*', '%', '~', '>':
+		if !v.null {
+			return v.array
+		}
 	}
 	return nil
 }
@@ -130,6 +184,9 @@ func (v Value) Array() []Value {
 //   ':'  Integer
 //   '$'  BulkString
 //   '*'  Array
+// RESP3 adds the types Map, Set, Double, BigNumber, Boolean, Null,
+// VerbatimString, BlobError and Push. The attributes are not a type of their
+// own, they are returned by Attributes.
 func (v Value) Type() Type {
 	return v.typ
 }
@@ -182,6 +239,9 @@ func marshalArrayRESP(v Value) ([]byte, error) {
 }
 
 func marshalAnyRESP(v Value) ([]byte, error) {
+	if v.attrs != nil {
+		return marshalAttributeRESP(v)
+	}
 	switch v.typ {
 	default:
 		if v.typ == 0 && v.null {
@@ -196,6 +256,21 @@ func marshalAnyRESP(v Value) ([]byte, error) {
 		return marshalBulkRESP(v)
 	case '*':
 		return marshalArrayRESP(v)
+	case '%', '~', '>':
+		return marshalAggregateRESP(v)
+	case ',':
+		return marshalSimpleRESP(v.typ, []byte(formatDouble(v.double)))
+	case '(':
+		return marshalSimpleRESP(v.typ, v.str)
+	case '#':
+		if v.integer != 0 {
+			return []byte("#t\r\n"), nil
+		}
+		return []byte("#f\r\n"), nil
+	case '_':
+		return []byte("_\r\n"), nil
+	case '=', '!':
+		return marshalBlobRESP(v)
 	}
 }
 
@@ -260,6 +335,8 @@ func (rd *Reader) readValue(multibulk, child bool) (val Value, telnet bool, n in
 	n++
 	if c == '*' {
 		val, rn, err = rd.readArrayValue(multibulk)
+	} else if c == '|' && !multibulk {
+		val, rn, err = rd.readAttributeValue()
 	} else if multibulk && !child {
 		telnet = true
 	} else {
@@ -278,6 +355,12 @@ func (rd *Reader) readValue(multibulk, child bool) (val Value, telnet bool, n in
 			val, rn, err = rd.readIntegerValue()
 		case '$':
 			val, rn, err = rd.readBulkValue()
+		case '%', '~', '>', ',', '(', '#', '_', '=', '!':
+			// the commands are arrays of bulk strings
+			if multibulk {
+				return nullValue, telnet, n, &errProtocol{"expected '$', got '" + string(c) + "'"}
+			}
+			val, rn, err = rd.readRESP3Value(c)
 		}
 	}
 	if telnet {
@@ -576,7 +659,7 @@ func (wr *Writer) WriteValue(v Value) error {
 		return err
 	}
 	_, err = wr.wr.Write(b)
-	return nil
+	return err
 }
 
 // WriteSimpleString writes a RESP simple string. A simple string has no new lines. The carriage return and new line characters are replaced with spaces.
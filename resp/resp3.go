@@ -0,0 +1,311 @@
+package resp
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// MapValue returns a RESP3 map, the pairs are the keys followed by their
+// values.
+func MapValue(pairs []Value) Value { return Value{typ: '%', array: pairs} }
+
+// SetValue returns a RESP3 set.
+func SetValue(vals []Value) Value { return Value{typ: '~', array: vals} }
+
+// PushValue returns a RESP3 push, the out of band data sent to the
+// clients, e.g. the pub/sub messages.
+func PushValue(vals []Value) Value { return Value{typ: '>', array: vals} }
+
+// DoubleValue returns a RESP3 double.
+func DoubleValue(f float64) Value { return Value{typ: ',', double: f} }
+
+// BigNumberValue returns a RESP3 big number.
+func BigNumberValue(n *big.Int) Value { return Value{typ: '(', str: []byte(n.String())} }
+
+// BooleanValue returns a RESP3 boolean.
+func BooleanValue(t bool) Value {
+	if t {
+		return Value{typ: '#', integer: 1}
+	}
+	return Value{typ: '#'}
+}
+
+// NilValue returns the RESP3 null.
+func NilValue() Value { return Value{typ: '_', null: true} }
+
+// VerbatimValue returns a RESP3 verbatim string, the format is three
+// characters, e.g. txt or mkd.
+func VerbatimValue(format, s string) Value {
+	return Value{typ: '=', str: []byte(format + ":" + s)}
+}
+
+// AttributeValue returns the value with the RESP3 attribute, the pairs are
+// the keys followed by their values.
+func AttributeValue(pairs []Value, v Value) Value {
+	if pairs == nil {
+		pairs = []Value{}
+	}
+	v.attrs = pairs
+	return v
+}
+
+// Attributes returns the key value pairs of the attribute of the value, nil
+// when it has none.
+func (v Value) Attributes() []Value {
+	return v.attrs
+}
+
+// Map converts the Value to a map. The keys are the string form of the map
+// keys. If Value is not a map, nil is returned.
+func (v Value) Map() map[string]Value {
+	if v.typ != '%' {
+		return nil
+	}
+	m := make(map[string]Value, len(v.array)/2)
+	for i := 0; i+1 < len(v.array); i += 2 {
+		m[v.array[i].String()] = v.array[i+1]
+	}
+	return m
+}
+
+// BigInt converts the Value to a big.Int. If Value cannot be converted, nil
+// is returned.
+func (v Value) BigInt() *big.Int {
+	n, ok := new(big.Int).SetString(v.String(), 10)
+	if !ok {
+		return nil
+	}
+	return n
+}
+
+// RESP2 returns the value in the RESP2 types for the clients that didn't
+// switch to RESP3. The maps become flat arrays, the sets and pushes
+// arrays, the booleans integers and the other RESP3 scalars bulk strings.
+func (v Value) RESP2() Value {
+	v.attrs = nil
+	switch v.typ {
+	case '%', '~', '>', '*':
+		if v.null {
+			return Value{typ: '*', null: true}
+		}
+		vals := make([]Value, len(v.array))
+		for i := range v.array {
+			vals[i] = v.array[i].RESP2()
+		}
+		return Value{typ: '*', array: vals}
+	case ',', '(', '=':
+		return StringValue(v.String())
+	case '#':
+		return Value{typ: ':', integer: v.integer}
+	case '_':
+		return NullValue()
+	case '!':
+		return Value{typ: '-', str: v.str}
+	}
+	return v
+}
+
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func parseDouble(s string) (float64, error) {
+	switch s {
+	case "inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func marshalAggregateRESP(v Value) ([]byte, error) {
+	n := len(v.array)
+	if v.typ == '%' {
+		n /= 2
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(byte(v.typ))
+	buf.WriteString(strconv.Itoa(n))
+	buf.WriteString("\r\n")
+	for i := 0; i < len(v.array); i++ {
+		data, err := v.array[i].MarshalRESP()
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+func marshalBlobRESP(v Value) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(v.typ))
+	buf.WriteString(strconv.Itoa(len(v.str)))
+	buf.WriteString("\r\n")
+	buf.Write(v.str)
+	buf.WriteString("\r\n")
+	return buf.Bytes(), nil
+}
+
+func marshalAttributeRESP(v Value) ([]byte, error) {
+	attrs := MapValue(v.attrs)
+	data, err := marshalAggregateRESP(attrs)
+	if err != nil {
+		return nil, err
+	}
+	data[0] = '|'
+
+	v.attrs = nil
+	value, err := v.MarshalRESP()
+	if err != nil {
+		return nil, err
+	}
+	return append(data, value...), nil
+}
+
+func (rd *Reader) readRESP3Value(typ byte) (val Value, n int, err error) {
+	switch typ {
+	case '%', '~', '>':
+		return rd.readAggregateValue(typ)
+	case '=', '!':
+		return rd.readBlobValue(typ)
+	}
+
+	line, n, err := rd.readLine()
+	if err != nil {
+		return nullValue, n, err
+	}
+	switch typ {
+	case ',':
+		f, err := parseDouble(string(line))
+		if err != nil {
+			return nullValue, n, &errProtocol{"invalid double"}
+		}
+		return Value{typ: ',', double: f}, n, nil
+	case '(':
+		if _, ok := new(big.Int).SetString(string(line), 10); !ok {
+			return nullValue, n, &errProtocol{"invalid big number"}
+		}
+		return Value{typ: '(', str: line}, n, nil
+	case '#':
+		switch string(line) {
+		case "t":
+			return Value{typ: '#', integer: 1}, n, nil
+		case "f":
+			return Value{typ: '#'}, n, nil
+		}
+		return nullValue, n, &errProtocol{"invalid boolean"}
+	default:
+		if len(line) != 0 {
+			return nullValue, n, &errProtocol{"invalid null"}
+		}
+		return Value{typ: '_', null: true}, n, nil
+	}
+}
+
+// readAggregateValue reads a map, a set or a push
+func (rd *Reader) readAggregateValue(typ byte) (val Value, n int, err error) {
+	l, n, err := rd.readInt()
+	if err != nil || l < 0 || l > 1024*1024 {
+		if err == nil || isProtocolError(err) {
+			return nullValue, n, &errProtocol{"invalid aggregate length"}
+		}
+		return nullValue, n, err
+	}
+	if typ == '%' {
+		l *= 2
+	}
+
+	vals := make([]Value, l)
+	for i := 0; i < l; i++ {
+		v, _, rn, err := rd.readValue(false, true)
+		n += rn
+		if err != nil {
+			return nullValue, n, err
+		}
+		vals[i] = v
+	}
+	return Value{typ: Type(typ), array: vals}, n, nil
+}
+
+// readBlobValue reads a verbatim string or a blob error
+func (rd *Reader) readBlobValue(typ byte) (val Value, n int, err error) {
+	l, n, err := rd.readInt()
+	if err != nil || l < 0 || l > 512*1024*1024 {
+		if err == nil || isProtocolError(err) {
+			return nullValue, n, &errProtocol{"invalid bulk length"}
+		}
+		return nullValue, n, err
+	}
+	b := make([]byte, l+2)
+	rn, err := io.ReadFull(rd.rd, b)
+	n += rn
+	if err != nil {
+		return nullValue, n, err
+	}
+	if b[l] != '\r' || b[l+1] != '\n' {
+		return nullValue, n, &errProtocol{"invalid bulk line ending"}
+	}
+	if typ == '=' && (l < 4 || b[3] != ':') {
+		return nullValue, n, &errProtocol{"invalid verbatim string"}
+	}
+	return Value{typ: Type(typ), str: b[:l]}, n, nil
+}
+
+// readAttributeValue reads the attribute and the value it's sent with
+func (rd *Reader) readAttributeValue() (val Value, n int, err error) {
+	attrs, n, err := rd.readAggregateValue('%')
+	if err != nil {
+		return nullValue, n, err
+	}
+	val, _, rn, err := rd.readValue(false, true)
+	n += rn
+	if err != nil {
+		return nullValue, n, err
+	}
+	val.attrs = attrs.array
+	return val, n, nil
+}
+
+func isProtocolError(err error) bool {
+	_, ok := err.(*strconv.NumError)
+	return ok
+}
+
+// WriteMap writes a RESP3 map, the pairs are the keys followed by their values.
+func (wr *Writer) WriteMap(pairs []Value) error { return wr.WriteValue(MapValue(pairs)) }
+
+// WriteSet writes a RESP3 set.
+func (wr *Writer) WriteSet(vals []Value) error { return wr.WriteValue(SetValue(vals)) }
+
+// WritePush writes a RESP3 push.
+func (wr *Writer) WritePush(vals []Value) error { return wr.WriteValue(PushValue(vals)) }
+
+// WriteDouble writes a RESP3 double.
+func (wr *Writer) WriteDouble(f float64) error { return wr.WriteValue(DoubleValue(f)) }
+
+// WriteBoolean writes a RESP3 boolean.
+func (wr *Writer) WriteBoolean(t bool) error { return wr.WriteValue(BooleanValue(t)) }
+
+// WriteNil writes the RESP3 null.
+func (wr *Writer) WriteNil() error { return wr.WriteValue(NilValue()) }
+
+// WriteVerbatim writes a RESP3 verbatim string.
+func (wr *Writer) WriteVerbatim(format, s string) error {
+	return wr.WriteValue(VerbatimValue(format, s))
+}
@@ -155,13 +155,14 @@ func TestBigFragmented(t *testing.T) {
 		defer pw.Close()
 		for len(cmd) >= frag {
 			if _, err := pw.Write(cmd[:frag]); err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 			cmd = cmd[frag:]
 		}
 		if len(cmd) > 0 {
 			if _, err := pw.Write(cmd); err != nil {
-				t.Fatal(err)
+				t.Error(err)
 			}
 		}
 	}()
@@ -386,3 +387,57 @@ func BenchmarkRead(b *testing.B) {
 	}
 	//fmt.Printf("\n%f\n", float64(k)/(float64(time.Now().Sub(start))/float64(time.Second)))
 }
+
+func TestRESP3(t *testing.T) {
+	testCases := []struct {
+		data  string
+		typ   Type
+		str   string
+		resp2 string
+	}{
+		{"%2\r\n+a\r\n:1\r\n$1\r\nb\r\n#t\r\n", Map, "[a 1 b true]", "*4\r\n+a\r\n:1\r\n$1\r\nb\r\n:1\r\n"},
+		{"~2\r\n$1\r\na\r\n$1\r\nb\r\n", Set, "[a b]", "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", Push, "[message ch hi]", "*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n"},
+		{",3.14\r\n", Double, "3.14", "$4\r\n3.14\r\n"},
+		{",inf\r\n", Double, "inf", "$3\r\ninf\r\n"},
+		{"(3492890328409238509324850943850943825024385\r\n", BigNumber, "3492890328409238509324850943850943825024385", "$43\r\n3492890328409238509324850943850943825024385\r\n"},
+		{"#f\r\n", Boolean, "false", ":0\r\n"},
+		{"_\r\n", Null, "", "$-1\r\n"},
+		{"=15\r\ntxt:Some string\r\n", VerbatimString, "Some string", "$11\r\nSome string\r\n"},
+		{"!21\r\nSYNTAX invalid syntax\r\n", BlobError, "SYNTAX invalid syntax", "-SYNTAX invalid syntax\r\n"},
+		{"|1\r\n+ttl\r\n:3600\r\n$5\r\nvalue\r\n", BulkString, "value", "$5\r\nvalue\r\n"},
+	}
+
+	for _, testCase := range testCases {
+		v, n, err := NewReader(strings.NewReader(testCase.data)).ReadValue()
+		if err != nil {
+			t.Fatalf("ReadValue error:%v, data:%q", err, testCase.data)
+		}
+		if n != len(testCase.data) {
+			t.Errorf("Expected %d bytes read, got %d", len(testCase.data), n)
+		}
+		if v.Type() != testCase.typ || v.String() != testCase.str {
+			t.Errorf("Expected %v %q, got %v %q", testCase.typ, testCase.str, v.Type(), v.String())
+		}
+		if data, _ := v.MarshalRESP(); string(data) != testCase.data {
+			t.Errorf("Expected %q to remarshal, got %q", testCase.data, data)
+		}
+		if data, _ := v.RESP2().MarshalRESP(); string(data) != testCase.resp2 {
+			t.Errorf("Expected %q in RESP2, got %q", testCase.resp2, data)
+		}
+	}
+
+	v, _, _ := NewReader(strings.NewReader("%1\r\n$3\r\nkey\r\n,1.5\r\n")).ReadValue()
+	if m := v.Map(); m["key"].Float() != 1.5 {
+		t.Errorf("Unexpected map %v", m)
+	}
+	v, _, _ = NewReader(strings.NewReader("|1\r\n+ttl\r\n:3600\r\n$5\r\nvalue\r\n")).ReadValue()
+	if attrs := v.Attributes(); len(attrs) != 2 || attrs[1].Integer() != 3600 {
+		t.Errorf("Unexpected attributes %v", attrs)
+	}
+
+	// the commands are arrays of bulk strings
+	if _, _, _, err := NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n#t\r\n")).ReadMultiBulk(); err == nil {
+		t.Errorf("Expected a protocol error")
+	}
+}
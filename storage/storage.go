@@ -2,7 +2,7 @@ package storage
 
 import (
 	"errors"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/junostorage/utils/glob"
@@ -27,50 +27,151 @@ const (
 	CmdLindex  = "lindex"
 	CmdLpop    = "lpop"
 	CmdExpire  = "expire"
+	CmdMemory  = "memory"
+	CmdConfig  = "config"
+	CmdInfo    = "info"
+	CmdSlowlog = "slowlog"
+	CmdLatency = "latency"
+	CmdMonitor = "monitor"
+	CmdClient  = "client"
+	CmdAuth    = "auth"
+	CmdACL     = "acl"
+	CmdHello   = "hello"
+	CmdOutput  = "output"
+	CmdCommand = "command"
+
+	CmdSelect   = "select"
+	CmdMove     = "move"
+	CmdSwapdb   = "swapdb"
+	CmdFlushdb  = "flushdb"
+	CmdFlushall = "flushall"
+	CmdSave     = "save"
+	CmdShutdown = "shutdown"
+
+	CmdSubscribe    = "subscribe"
+	CmdUnsubscribe  = "unsubscribe"
+	CmdPsubscribe   = "psubscribe"
+	CmdPunsubscribe = "punsubscribe"
+	CmdPublish      = "publish"
+	CmdPubsub       = "pubsub"
+)
+
+// Estimated per-entry overheads, in bytes, used for memory accounting.
+const (
+	itemOverhead  = 48 // map entry, Item header and interface
+	elemOverhead  = 16 // string header of a list element
+	fieldOverhead = 32 // hash bucket share of a hash field
 )
 
 var (
-	errKeyHold   = errors.New("Operation against a key holding the wrong kind of value")
+	// ErrWrongType is returned by the commands run on a key holding another
+	// kind of value
+	ErrWrongType = errors.New("Operation against a key holding the wrong kind of value")
 	ErrNullValue = errors.New("Key not found")
 )
 
 type Item struct {
-	Object     interface{}
+	Object interface{}
+	// Expiration is the Unix time in nanoseconds the key expires at,
+	// DefaultExpiration when it doesn't
 	Expiration int64
+	// Estimated number of bytes held by the key and its value
+	Size int64
 }
 
 type MemoryCache struct {
+	// keyspace hits and misses, updated atomically as reads run concurrently
+	hits    int64
+	misses  int64
 	items   map[string]Item
 	expires map[string]bool
-	//mu    sync.RWMutex
+	// used is the estimated number of bytes held by the keys of the
+	// database in the shard, the store accounts for all its databases
+	used  int64
+	store *Store
+	shard *shard
+	// index is the database index, it changes with Store.Swap
+	index int
 }
 
-var (
-	memCache *MemoryCache
-	once     sync.Once
-)
-
-//Create new MemoryCache instance
+// New creates a MemoryCache of its own store. It's not safe for concurrent
+// use, Open returns a goroutine-safe Store.
 func New() *MemoryCache {
-	once.Do(func() {
-		memCache = &MemoryCache{items: make(map[string]Item), expires: make(map[string]bool)}
-	})
-	return memCache
+	return NewStore(Options{Shards: 1}).shards[0].dbs[0]
+}
+
+func newMemoryCache(s *Store, sh *shard, index int) *MemoryCache {
+	return &MemoryCache{items: make(map[string]Item), expires: make(map[string]bool), store: s, shard: sh, index: index}
 }
 
 // Sets the value at the specified key
 func (m *MemoryCache) Set(key string, value interface{}) (err error) {
+	if err = m.reserve(); err != nil {
+		return err
+	}
+	size := sizeOf(key, value)
+	m.account(size - m.items[key].Size)
 	m.items[key] = Item{
 		Object:     value,
 		Expiration: int64(DefaultExpiration),
+		Size:       size,
 	}
+	delete(m.expires, key)
 
 	return
 }
 
+// update replaces the value of a key keeping its expiration, delta is
+// the change of the estimated size.
+func (m *MemoryCache) update(key string, value interface{}, delta int64) {
+	item, ok := m.items[key]
+	if !ok {
+		item.Expiration = int64(DefaultExpiration)
+		delta += itemOverhead + int64(len(key))
+	}
+	item.Object = value
+	item.Size += delta
+	m.items[key] = item
+	m.account(delta)
+}
+
+// account records the change of the estimated size of the database, every
+// write is accounted. The store counters are shared by the shards.
+func (m *MemoryCache) account(delta int64) {
+	m.used += delta
+	s := m.store
+	used := atomic.AddInt64(&s.used, delta)
+	for {
+		peak := atomic.LoadInt64(&s.peak)
+		if used <= peak || atomic.CompareAndSwapInt64(&s.peak, peak, used) {
+			break
+		}
+	}
+	atomic.AddInt64(&s.dirty, 1)
+}
+
+// sizeOf estimates the number of bytes held by the key and its value.
+func sizeOf(key string, value interface{}) int64 {
+	size := int64(itemOverhead + len(key))
+	switch v := value.(type) {
+	case string:
+		size += int64(len(v))
+	case []string:
+		for _, e := range v {
+			size += int64(elemOverhead + len(e))
+		}
+	case map[string]string:
+		for f, e := range v {
+			size += int64(fieldOverhead + len(f) + len(e))
+		}
+	}
+	return size
+}
+
 // Get the value of a key
 func (m *MemoryCache) Get(key string) (value string, err error) {
-	switch v := m.items[key].Object.(type) {
+	item, _ := m.lookup(key)
+	switch v := item.Object.(type) {
 	case string:
 		value = v
 
@@ -78,7 +179,7 @@ func (m *MemoryCache) Get(key string) (value string, err error) {
 		err = ErrNullValue
 
 	default:
-		err = errKeyHold
+		err = ErrWrongType
 	}
 
 	return
@@ -86,42 +187,79 @@ func (m *MemoryCache) Get(key string) (value string, err error) {
 
 // Remove the specified keys.
 func (m *MemoryCache) Del(key string) bool {
-	_, ok := m.items[key]
+	m.expireIfNeeded(key)
+	return m.remove(key)
+}
+
+// remove deletes the key and its expiration
+func (m *MemoryCache) remove(key string) bool {
+	item, ok := m.items[key]
+	if !ok {
+		return false
+	}
+	m.account(-item.Size)
 	delete(m.items, key)
 	delete(m.expires, key)
-	return ok
+	return true
 }
 
-// Set expiration time for specified key
+// expireIfNeeded removes the key once it expired, it's called before the
+// key is written
+func (m *MemoryCache) expireIfNeeded(key string) {
+	if !m.IsExpire(key) {
+		return
+	}
+	m.remove(key)
+	atomic.AddInt64(&m.store.expired, 1)
+	if m.store.opts.OnExpire != nil {
+		m.store.opts.OnExpire(m.index, key)
+	}
+}
+
+// Set expiration time for specified key, the key is persisted when d
+// isn't positive
 func (m *MemoryCache) SetTTL(key string, d time.Duration) error {
 
+	m.expireIfNeeded(key)
 	if _, ok := m.items[key]; !ok {
 		return ErrNullValue
 	}
-	e := int64(DefaultExpiration)
+	value := m.items[key]
 	if d > 0 {
-		e = time.Now().Add(d).Unix()
+		value.Expiration = time.Now().Add(d).UnixNano()
+		m.expires[key] = true
+	} else {
+		value.Expiration = int64(DefaultExpiration)
+		delete(m.expires, key)
 	}
-	value := m.items[key]
-	value.Expiration = int64(e)
 	m.items[key] = value
-	m.expires[key] = true
+	atomic.AddInt64(&m.store.dirty, 1)
 	return nil
 }
 
 // Set the string value of the field
 func (m *MemoryCache) HSet(key string, field string, value string) (err error) {
+	if err = m.reserve(); err != nil {
+		return err
+	}
+	m.expireIfNeeded(key)
 	switch v := m.items[key].Object.(type) {
 	case map[string]string:
+		delta := int64(len(value))
+		if old, ok := v[field]; ok {
+			delta -= int64(len(old))
+		} else {
+			delta += int64(fieldOverhead + len(field))
+		}
 		v[field] = value
-		m.Set(key, v)
+		m.update(key, v, delta)
 
 	case nil:
-		m.Set(key, map[string]string{
-			field: value})
+		m.update(key, map[string]string{
+			field: value}, int64(fieldOverhead+len(field)+len(value)))
 
 	default:
-		err = errKeyHold
+		err = ErrWrongType
 	}
 
 	return
@@ -129,7 +267,8 @@ func (m *MemoryCache) HSet(key string, field string, value string) (err error) {
 
 // Get the value of a hash field stored at specified key
 func (m *MemoryCache) HGet(key string, field string) (value string, err error) {
-	switch v := m.items[key].Object.(type) {
+	item, _ := m.lookup(key)
+	switch v := item.Object.(type) {
 	case map[string]string:
 		v2, ok := v[field]
 		if !ok {
@@ -142,14 +281,15 @@ func (m *MemoryCache) HGet(key string, field string) (value string, err error) {
 		err = ErrNullValue
 
 	default:
-		err = errKeyHold
+		err = ErrWrongType
 	}
 	return
 }
 
 // Get all the fields and values stored in a hash at specified key
 func (m *MemoryCache) HGetAll(key string) (values []string, err error) {
-	switch v := m.items[key].Object.(type) {
+	item, _ := m.lookup(key)
+	switch v := item.Object.(type) {
 	case map[string]string:
 		for k := range v {
 			values = append(values, k, v[k])
@@ -159,34 +299,41 @@ func (m *MemoryCache) HGetAll(key string) (values []string, err error) {
 		err = ErrNullValue
 
 	default:
-		err = errKeyHold
+		err = ErrWrongType
 	}
 	return
 }
 
 func (m *MemoryCache) HDel(key string, fields ...string) (n int, err error) {
+	m.expireIfNeeded(key)
 	switch v := m.items[key].Object.(type) {
 	case map[string]string:
+		var delta int64
 		for _, f := range fields {
-			_, ok := v[f]
+			old, ok := v[f]
 			if ok {
 				n++
 				delete(v, f)
+				delta -= int64(fieldOverhead + len(f) + len(old))
 			}
 		}
-		m.Set(key, v)
+		m.update(key, v, delta)
 
 	case nil:
 		err = ErrNullValue
 
 	default:
-		err = errKeyHold
+		err = ErrWrongType
 	}
 	return
 }
 
 // LPush prepend one or multiple values to a list
 func (m *MemoryCache) LPush(key string, values ...string) (err error) {
+	if err = m.reserve(); err != nil {
+		return err
+	}
+	m.expireIfNeeded(key)
 	var list []string
 	switch v := m.items[key].Object.(type) {
 	case []string:
@@ -196,22 +343,25 @@ func (m *MemoryCache) LPush(key string, values ...string) (err error) {
 		list = make([]string, 0)
 
 	default:
-		err = errKeyHold
+		err = ErrWrongType
 		return
 	}
 
+	var delta int64
 	for _, v := range values {
 		list = append([]string{v}, list...)
+		delta += int64(elemOverhead + len(v))
 	}
 
-	m.Set(key, list)
+	m.update(key, list, delta)
 	return
 
 }
 
 // Get element from a list by its index
 func (m *MemoryCache) Lindex(key string, i int) (value string, err error) {
-	switch v := m.items[key].Object.(type) {
+	item, _ := m.lookup(key)
+	switch v := item.Object.(type) {
 	case []string:
 		n := len(v)
 		if i >= 0 && i < n {
@@ -228,7 +378,7 @@ func (m *MemoryCache) Lindex(key string, i int) (value string, err error) {
 		err = ErrNullValue
 
 	default:
-		err = errKeyHold
+		err = ErrWrongType
 
 	}
 	return
@@ -236,7 +386,8 @@ func (m *MemoryCache) Lindex(key string, i int) (value string, err error) {
 
 // Get the length of the list stored at key
 func (m *MemoryCache) Llen(key string) (n int, err error) {
-	switch v := m.items[key].Object.(type) {
+	item, _ := m.lookup(key)
+	switch v := item.Object.(type) {
 	case []string:
 		return len(v), nil
 
@@ -244,7 +395,7 @@ func (m *MemoryCache) Llen(key string) (n int, err error) {
 		err = ErrNullValue
 
 	default:
-		err = errKeyHold
+		err = ErrWrongType
 	}
 
 	return
@@ -252,6 +403,7 @@ func (m *MemoryCache) Llen(key string) (n int, err error) {
 
 // Remove and get the first element in a list
 func (m *MemoryCache) LPop(key string) (value string, err error) {
+	m.expireIfNeeded(key)
 	switch v := m.items[key].Object.(type) {
 	case []string:
 		if len(v) < 1 {
@@ -259,13 +411,13 @@ func (m *MemoryCache) LPop(key string) (value string, err error) {
 			break
 		}
 		value = v[0]
-		m.Set(key, v[1:])
+		m.update(key, v[1:], -int64(elemOverhead+len(value)))
 
 	case nil:
 		err = ErrNullValue
 
 	default:
-		err = errKeyHold
+		err = ErrWrongType
 
 	}
 	return
@@ -274,6 +426,9 @@ func (m *MemoryCache) LPop(key string) (value string, err error) {
 // Returns all keys matching pattern.
 func (m *MemoryCache) Keys(pattern string) (values []string, err error) {
 	for key := range m.items {
+		if m.IsExpire(key) {
+			continue
+		}
 		matched, err := glob.Match(pattern, key)
 		if err != nil {
 			return nil, err
@@ -287,9 +442,9 @@ func (m *MemoryCache) Keys(pattern string) (values []string, err error) {
 
 // Check for key expire
 func (m *MemoryCache) IsExpire(key string) bool {
-	now := time.Now().Unix()
+	now := time.Now().UnixNano()
 	_, ok := m.expires[key]
-	return ok && (now > m.items[key].Expiration)
+	return ok && now >= m.items[key].Expiration
 }
 
 // Get expire key list
@@ -299,3 +454,104 @@ func (m *MemoryCache) ExpireList() (list []string) {
 	}
 	return
 }
+
+// lookup returns the item stored at key recording a keyspace hit or miss,
+// the expired keys are missing although they're only removed once written
+// or by DeleteExpired.
+func (m *MemoryCache) lookup(key string) (Item, bool) {
+	item, ok := m.items[key]
+	if ok && m.IsExpire(key) {
+		item, ok = Item{}, false
+	}
+	if ok {
+		atomic.AddInt64(&m.hits, 1)
+	} else {
+		atomic.AddInt64(&m.misses, 1)
+	}
+	return item, ok
+}
+
+// KeyspaceStats returns the number of successful and failed key lookups
+func (m *MemoryCache) KeyspaceStats() (hits, misses int64) {
+	return atomic.LoadInt64(&m.hits), atomic.LoadInt64(&m.misses)
+}
+
+// ResetStats resets the keyspace and peak memory stats
+func (m *MemoryCache) ResetStats() {
+	atomic.StoreInt64(&m.hits, 0)
+	atomic.StoreInt64(&m.misses, 0)
+	atomic.StoreInt64(&m.store.peak, atomic.LoadInt64(&m.store.used))
+}
+
+// ExpiresLen returns the number of keys with an expiration set
+func (m *MemoryCache) ExpiresLen() int {
+	return len(m.expires)
+}
+
+// MemoryUsage returns the estimated number of bytes held by the key and its value
+func (m *MemoryCache) MemoryUsage(key string) (int64, error) {
+	item, ok := m.lookup(key)
+	if !ok {
+		return 0, ErrNullValue
+	}
+	return item.Size, nil
+}
+
+// UsedMemory returns the estimated number of bytes held by all keys of the
+// databases sharing the memory accounting
+func (m *MemoryCache) UsedMemory() int64 {
+	return atomic.LoadInt64(&m.store.used)
+}
+
+// PeakMemory returns the highest value UsedMemory reached
+func (m *MemoryCache) PeakMemory() int64 {
+	return atomic.LoadInt64(&m.store.peak)
+}
+
+// Len returns the number of keys
+func (m *MemoryCache) Len() int {
+	return len(m.items)
+}
+
+// Flush removes all keys
+func (m *MemoryCache) Flush() {
+	m.account(-m.used)
+	m.items = make(map[string]Item)
+	m.expires = make(map[string]bool)
+}
+
+// DeleteExpired removes the expired keys, it returns their number
+func (m *MemoryCache) DeleteExpired() int {
+	n := 0
+	for key := range m.expires {
+		if m.IsExpire(key) {
+			m.expireIfNeeded(key)
+			n++
+		}
+	}
+	return n
+}
+
+// Move moves the key with its expiration to the database dst of the same
+// shard. It returns false when the key doesn't exist or dst already holds it.
+func (m *MemoryCache) Move(key string, dst *MemoryCache) bool {
+	m.expireIfNeeded(key)
+	dst.expireIfNeeded(key)
+	item, ok := m.items[key]
+	if !ok {
+		return false
+	}
+	if _, ok := dst.items[key]; ok {
+		return false
+	}
+
+	dst.items[key] = item
+	if m.expires[key] {
+		dst.expires[key] = true
+	}
+	dst.account(item.Size)
+	delete(m.items, key)
+	delete(m.expires, key)
+	m.account(-item.Size)
+	return true
+}
@@ -105,4 +105,112 @@ func TestExpireKey(t *testing.T) {
 		t.Fatalf("TTL error:%v", err)
 	}
 
+	// a ttl that isn't positive persists the key
+	if err := memcache.SetTTL(key, 0); err != nil {
+		t.Fatalf("TTL error:%v", err)
+	}
+	if v, err := memcache.Get(key); err != nil || v != value || len(memcache.ExpireList()) != 0 {
+		t.Errorf("Want the key persisted, got: %v, %v, %v", v, err, memcache.ExpireList())
+	}
+
+	// the expiration isn't rounded to seconds
+	if err := memcache.SetTTL(key, 50*time.Millisecond); err != nil {
+		t.Fatalf("TTL error:%v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := memcache.Get(key); err != ErrNullValue {
+		t.Errorf("Want the key expired, got: %v", err)
+	}
+
+}
+
+func TestMemoryUsage(t *testing.T) {
+	key := "memkey"
+	memcache := New()
+	memcache.Del(key)
+	used := memcache.UsedMemory()
+
+	if err := memcache.HSet(key, "name", "nemo"); err != nil {
+		t.Fatalf("HSet error:%v", err)
+	}
+	size, err := memcache.MemoryUsage(key)
+	if err != nil {
+		t.Fatalf("MemoryUsage error:%v", err)
+	}
+	if want := sizeOf(key, map[string]string{"name": "nemo"}); size != want {
+		t.Errorf("Want: %d, got: %d", want, size)
+	}
+	if got := memcache.UsedMemory() - used; got != size {
+		t.Errorf("Want used memory grow by %d, got: %d", size, got)
+	}
+
+	if _, err := memcache.HDel(key, "name"); err != nil {
+		t.Fatalf("HDel error:%v", err)
+	}
+	size, _ = memcache.MemoryUsage(key)
+	if want := sizeOf(key, map[string]string{}); size != want {
+		t.Errorf("Want: %d, got: %d", want, size)
+	}
+
+	memcache.Del(key)
+	if got := memcache.UsedMemory(); got != used {
+		t.Errorf("Want used memory: %d, got: %d", used, got)
+	}
+	if _, err := memcache.MemoryUsage(key); err != ErrNullValue {
+		t.Errorf("Want: %v, got: %v", ErrNullValue, err)
+	}
+
+}
+
+func TestDatabases(t *testing.T) {
+	if New() == New() {
+		t.Fatalf("Want independent stores")
+	}
+
+	s, err := Open(Options{Databases: 2})
+	if err != nil {
+		t.Fatalf("Open error:%v", err)
+	}
+	defer s.Close()
+	db0, db1 := s.DB(0), s.DB(1)
+	if err := db0.Set("k", "v"); err != nil {
+		t.Fatalf("Set error:%v", err)
+	}
+	if err := db0.SetTTL("k", time.Minute); err != nil {
+		t.Fatalf("TTL error:%v", err)
+	}
+	used := s.UsedMemory()
+	if used == 0 {
+		t.Errorf("Want used memory")
+	}
+
+	if !db0.Move("k", 1) {
+		t.Fatalf("Move failed")
+	}
+	if db0.Move("k", 1) {
+		t.Errorf("Want no move of a missing key")
+	}
+	if got, err := db1.Get("k"); err != nil || got != "v" {
+		t.Errorf("Want: v, got: %s %v", got, err)
+	}
+	if keys, expires := db1.Len(); keys != 1 || expires != 1 {
+		t.Errorf("Want the key and its expiration moved, got %d %d", keys, expires)
+	}
+	if got := s.UsedMemory(); got != used {
+		t.Errorf("Want used memory: %d, got: %d", used, got)
+	}
+
+	db0.Set("other", "v")
+	db1.Flush()
+	if keys, _ := s.Len(); keys != 1 {
+		t.Errorf("Want only the flushed database emptied, got %d keys", keys)
+	}
+	if got, want := s.UsedMemory(), sizeOf("other", "v"); got != want {
+		t.Errorf("Want used memory: %d, got: %d", want, got)
+	}
+
+	s.Swap(0, 1)
+	if _, err := db1.Get("other"); err != nil {
+		t.Errorf("Want the databases swapped, got %v", err)
+	}
 }
@@ -0,0 +1,887 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EvictionPolicy chooses the keys removed once the memory limit is reached
+type EvictionPolicy string
+
+const (
+	// NoEviction rejects the writes that grow the dataset with ErrOutOfMemory
+	NoEviction EvictionPolicy = "noeviction"
+	// AllKeysRandom evicts random keys
+	AllKeysRandom EvictionPolicy = "allkeys-random"
+	// VolatileRandom evicts random keys with an expiration
+	VolatileRandom EvictionPolicy = "volatile-random"
+	// VolatileTTL evicts the keys with an expiration closest to expire
+	VolatileTTL EvictionPolicy = "volatile-ttl"
+)
+
+// evictionSamples is the number of keys sampled by VolatileTTL
+const evictionSamples = 5
+
+// snapshotMagic starts the snapshots, followed by snapshotVersion on four
+// digits, e.g. JUNO0001, so the files of other servers aren't loaded
+const (
+	snapshotMagic   = "JUNO"
+	snapshotVersion = 1
+)
+
+var (
+	// ErrOutOfMemory is returned by the writes growing the dataset over
+	// MaxMemory when no key can be evicted
+	ErrOutOfMemory = errors.New("used memory is over the memory limit")
+	// ErrNoPath is returned by Save and Load when the store has no Path
+	ErrNoPath = errors.New("the store has no snapshot path")
+	// ErrSnapshotFormat is returned by Load when the file isn't a snapshot
+	// of a store
+	ErrSnapshotFormat = errors.New("not a snapshot of the store")
+)
+
+// DefaultShards is the number of shards of the stores opened with no
+// Options.Shards
+const DefaultShards = 64
+
+// Options configures a Store
+type Options struct {
+	// Databases is the number of databases, 1 when it's 0
+	Databases int
+	// Shards is the number of lock-striped shards the keys are spread
+	// over, DefaultShards when it's 0. The commands on keys of distinct
+	// shards run in parallel.
+	Shards int
+	// MaxMemory limits the estimated number of bytes held by the keys, 0
+	// means no limit
+	MaxMemory int64
+	// Eviction is the policy applied once MaxMemory is reached,
+	// NoEviction when it's empty
+	Eviction EvictionPolicy
+	// Path is the snapshot file read by Open and written by Save and
+	// Close, the store is in memory only when it's empty
+	Path string
+	// SaveInterval writes the snapshot periodically when the store changed,
+	// 0 disables it
+	SaveInterval time.Duration
+	// ExpireInterval removes the expired keys periodically, 0 disables it.
+	// The expired keys are missing to the reads anyway.
+	ExpireInterval time.Duration
+	// OnExpire and OnEvict are called with the shard of the key locked for
+	// each key removed on expiration or evicted
+	OnExpire func(db int, key string)
+	OnEvict  func(db int, key string)
+}
+
+// shard holds the keys of all the databases hashing to it
+type shard struct {
+	mu  sync.RWMutex
+	dbs []*MemoryCache
+}
+
+// Store is a set of databases safe for concurrent use. The keys are spread
+// over lock-striped shards, the commands of a DB are atomic and Update,
+// UpdateKeys and View run several commands at once.
+type Store struct {
+	shards []*shard
+
+	// optsMu guards the options changed once the store is open
+	optsMu sync.RWMutex
+	opts   Options
+	// saveMu serializes the saves
+	saveMu sync.Mutex
+
+	// memory accounting of all the databases, see MemoryCache.account.
+	// The counters are updated atomically by the shards.
+	used int64
+	peak int64
+	// dirty counts the writes since the last save
+	dirty    int64
+	lastSave int64
+	expired  int64
+	evicted  int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open creates a store, the snapshot at opts.Path is loaded when it exists.
+// Close stops the background expiration and saves.
+func Open(opts Options) (*Store, error) {
+	s := NewStore(opts)
+	if s.opts.Path != "" {
+		if err := s.Load(); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if s.opts.ExpireInterval > 0 {
+		s.every(s.opts.ExpireInterval, func() { s.DeleteExpired() })
+	}
+	if s.opts.Path != "" && s.opts.SaveInterval > 0 {
+		s.every(s.opts.SaveInterval, func() {
+			if s.Changes() > 0 {
+				s.Save()
+			}
+		})
+	}
+	return s, nil
+}
+
+// NewStore creates an empty store without loading the snapshot nor
+// starting the background expiration and saves, they're left to the caller.
+func NewStore(opts Options) *Store {
+	if opts.Databases <= 0 {
+		opts.Databases = 1
+	}
+	if opts.Shards <= 0 {
+		opts.Shards = DefaultShards
+	}
+	if opts.Eviction == "" {
+		opts.Eviction = NoEviction
+	}
+	s := &Store{opts: opts, lastSave: time.Now().UnixNano(), done: make(chan struct{})}
+	s.shards = make([]*shard, opts.Shards)
+	for i := range s.shards {
+		sh := &shard{dbs: make([]*MemoryCache, opts.Databases)}
+		for j := range sh.dbs {
+			sh.dbs[j] = newMemoryCache(s, sh, j)
+		}
+		s.shards[i] = sh
+	}
+	return s
+}
+
+// every runs f periodically until the store is closed
+func (s *Store) every(d time.Duration, f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t := time.NewTicker(d)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-t.C:
+				f()
+			}
+		}
+	}()
+}
+
+// Close stops the background tasks and saves the snapshot when the store
+// has a Path.
+func (s *Store) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+		close(s.done)
+	}
+	s.wg.Wait()
+	if err := s.Save(); err != ErrNoPath {
+		return err
+	}
+	return nil
+}
+
+// Databases returns the number of databases
+func (s *Store) Databases() int {
+	return s.opts.Databases
+}
+
+// DB returns the database i, it must be lower than Databases
+func (s *Store) DB(i int) *DB {
+	return &DB{s: s, index: i}
+}
+
+// shardIndex returns the index of the shard holding the key, the FNV-1a
+// hash of the key
+func (s *Store) shardIndex(key string) int {
+	if len(s.shards) == 1 {
+		return 0
+	}
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(s.shards)))
+}
+
+// lockAll locks all the shards, always in the same order so that it never
+// waits on UpdateKeys in a cycle
+func (s *Store) lockAll() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+	}
+}
+
+func (s *Store) unlockAll() {
+	for _, sh := range s.shards {
+		sh.mu.Unlock()
+	}
+}
+
+func (s *Store) rlockAll() {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+	}
+}
+
+func (s *Store) runlockAll() {
+	for _, sh := range s.shards {
+		sh.mu.RUnlock()
+	}
+}
+
+// Tx gives access to the databases while the shards are locked. It must not
+// be used once the transaction function returned.
+type Tx struct {
+	s *Store
+	// held are the shards locked by UpdateKeys, all of them when it's nil
+	held []bool
+}
+
+// DB returns the database i, it must be lower than Databases
+func (tx *Tx) DB(i int) *DB {
+	return &DB{s: tx.s, index: i, tx: tx}
+}
+
+// check panics when the transaction doesn't hold the shard i
+func (tx *Tx) check(i int) {
+	if tx.held != nil && !tx.held[i] {
+		panic("storage: the key is not locked by the transaction")
+	}
+}
+
+// Update runs fn with all the shards locked for writing. The changes made
+// before fn returned an error are kept. The keys to evict are only taken
+// from the shard of the written key.
+func (s *Store) Update(fn func(tx *Tx) error) error {
+	s.lockAll()
+	defer s.unlockAll()
+	return fn(&Tx{s: s})
+}
+
+// UpdateKeys runs fn with the shards of the keys locked for writing, fn
+// must only use these keys. The shards are locked in their order so that
+// the transactions on overlapping keys never wait on each other in a cycle.
+func (s *Store) UpdateKeys(keys []string, fn func(tx *Tx) error) error {
+	held := make([]bool, len(s.shards))
+	for _, key := range keys {
+		held[s.shardIndex(key)] = true
+	}
+	for i, sh := range s.shards {
+		if held[i] {
+			sh.mu.Lock()
+		}
+	}
+	defer func() {
+		for i, sh := range s.shards {
+			if held[i] {
+				sh.mu.Unlock()
+			}
+		}
+	}()
+	return fn(&Tx{s: s, held: held})
+}
+
+// View runs fn with all the shards locked for reading, fn must not write.
+func (s *Store) View(fn func(tx *Tx) error) error {
+	s.rlockAll()
+	defer s.runlockAll()
+	return fn(&Tx{s: s})
+}
+
+// Swap swaps the databases i and j
+func (s *Store) Swap(i, j int) {
+	s.lockAll()
+	defer s.unlockAll()
+	for _, sh := range s.shards {
+		sh.dbs[i], sh.dbs[j] = sh.dbs[j], sh.dbs[i]
+		sh.dbs[i].index, sh.dbs[j].index = i, j
+	}
+}
+
+// FlushAll removes the keys of all the databases
+func (s *Store) FlushAll() {
+	s.lockAll()
+	defer s.unlockAll()
+	for _, sh := range s.shards {
+		for _, db := range sh.dbs {
+			db.Flush()
+		}
+	}
+}
+
+// DeleteExpired removes the expired keys of all the databases, it returns
+// their number. The shards are locked one at a time.
+func (s *Store) DeleteExpired() int {
+	n := 0
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		for _, db := range sh.dbs {
+			n += db.DeleteExpired()
+		}
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// SetPath changes the path of the snapshot, the store is in memory only
+// when it's empty
+func (s *Store) SetPath(path string) {
+	s.optsMu.Lock()
+	s.opts.Path = path
+	s.optsMu.Unlock()
+}
+
+// path returns the path of the snapshot
+func (s *Store) path() string {
+	s.optsMu.RLock()
+	defer s.optsMu.RUnlock()
+	return s.opts.Path
+}
+
+// SetMaxMemory changes the memory limit and the eviction policy
+func (s *Store) SetMaxMemory(max int64, policy EvictionPolicy) {
+	s.optsMu.Lock()
+	s.opts.MaxMemory = max
+	s.opts.Eviction = policy
+	s.optsMu.Unlock()
+}
+
+// overLimit reports whether the used memory is over the memory limit, and
+// the eviction policy
+func (s *Store) overLimit() (bool, EvictionPolicy) {
+	s.optsMu.RLock()
+	defer s.optsMu.RUnlock()
+	return s.opts.MaxMemory > 0 && atomic.LoadInt64(&s.used) > s.opts.MaxMemory, s.opts.Eviction
+}
+
+// Reserve evicts keys until the used memory is within the memory limit,
+// it returns ErrOutOfMemory when it's still over. The shards are locked
+// one at a time.
+func (s *Store) Reserve() error {
+	for _, sh := range s.shards {
+		over, policy := s.overLimit()
+		if !over {
+			return nil
+		}
+		sh.mu.Lock()
+		for over && sh.evict(policy) {
+			over, policy = s.overLimit()
+		}
+		sh.mu.Unlock()
+	}
+	if over, _ := s.overLimit(); over {
+		return ErrOutOfMemory
+	}
+	return nil
+}
+
+// reserve evicts keys until the used memory is within the memory limit,
+// the shard of the database is locked. The keys of the other shards are
+// only evicted when they aren't locked, waiting for them could deadlock.
+func (m *MemoryCache) reserve() error {
+	for {
+		over, policy := m.store.overLimit()
+		if !over {
+			return nil
+		}
+		if !m.shard.evict(policy) && !m.store.evictOthers(m.shard, policy) {
+			return ErrOutOfMemory
+		}
+	}
+}
+
+// evictOthers evicts a key of a shard other than locked, it returns false
+// when there's none to remove or their shards are busy
+func (s *Store) evictOthers(locked *shard, policy EvictionPolicy) bool {
+	for _, sh := range s.shards {
+		if sh == locked || !sh.mu.TryLock() {
+			continue
+		}
+		ok := sh.evict(policy)
+		sh.mu.Unlock()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// evict removes a key of the shard chosen by the eviction policy, it
+// returns false when there's none to remove. The shard is locked.
+func (sh *shard) evict(policy EvictionPolicy) bool {
+	for _, db := range sh.dbs {
+		var key string
+		var ok bool
+		switch policy {
+		case AllKeysRandom:
+			for k := range db.items {
+				key, ok = k, true
+				break
+			}
+		case VolatileRandom:
+			for k := range db.expires {
+				key, ok = k, true
+				break
+			}
+		case VolatileTTL:
+			n := 0
+			for k := range db.expires {
+				if !ok || db.items[k].Expiration < db.items[key].Expiration {
+					key, ok = k, true
+				}
+				n++
+				if n == evictionSamples {
+					break
+				}
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		db.remove(key)
+		atomic.AddInt64(&db.store.evicted, 1)
+		if db.store.opts.OnEvict != nil {
+			db.store.opts.OnEvict(db.index, key)
+		}
+		return true
+	}
+	return false
+}
+
+// UsedMemory returns the estimated number of bytes held by the keys
+func (s *Store) UsedMemory() int64 {
+	return atomic.LoadInt64(&s.used)
+}
+
+// PeakMemory returns the highest value UsedMemory reached
+func (s *Store) PeakMemory() int64 {
+	return atomic.LoadInt64(&s.peak)
+}
+
+// Len returns the number of keys and of keys with an expiration of all
+// the databases
+func (s *Store) Len() (keys, expires int) {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for _, db := range sh.dbs {
+			keys += db.Len()
+			expires += db.ExpiresLen()
+		}
+		sh.mu.RUnlock()
+	}
+	return
+}
+
+// KeyspaceStats returns the number of successful and failed key lookups
+func (s *Store) KeyspaceStats() (hits, misses int64) {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for _, db := range sh.dbs {
+			h, m := db.KeyspaceStats()
+			hits += h
+			misses += m
+		}
+		sh.mu.RUnlock()
+	}
+	return
+}
+
+// ExpiredKeys returns the number of keys removed on expiration
+func (s *Store) ExpiredKeys() int64 {
+	return atomic.LoadInt64(&s.expired)
+}
+
+// EvictedKeys returns the number of keys evicted to free memory
+func (s *Store) EvictedKeys() int64 {
+	return atomic.LoadInt64(&s.evicted)
+}
+
+// ResetStats resets the keyspace, expired, evicted and peak memory stats
+func (s *Store) ResetStats() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		for _, db := range sh.dbs {
+			db.ResetStats()
+		}
+		sh.mu.Unlock()
+	}
+	atomic.StoreInt64(&s.expired, 0)
+	atomic.StoreInt64(&s.evicted, 0)
+}
+
+// Changes returns the number of writes since the last save
+func (s *Store) Changes() int64 {
+	return atomic.LoadInt64(&s.dirty)
+}
+
+// LastSave returns the time of the last save, or of the opening
+func (s *Store) LastSave() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastSave))
+}
+
+// record is a key of the snapshot
+type record struct {
+	DB         int
+	Key        string
+	Expiration int64 // Unix nanoseconds or DefaultExpiration
+	Kind       byte  // 's'tring, 'l'ist or 'h'ash
+	String     string
+	List       []string
+	Hash       map[string]string
+}
+
+// Save writes the snapshot of the databases to Path, the file is replaced
+// once it's completely written. The writes wait for the save.
+func (s *Store) Save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	path := s.path()
+	if path == "" {
+		return ErrNoPath
+	}
+
+	s.rlockAll()
+	defer s.runlockAll()
+
+	tmp := filepath.Join(filepath.Dir(path), "temp-"+filepath.Base(path))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	if err := s.encode(bw); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&s.dirty, 0)
+	atomic.StoreInt64(&s.lastSave, time.Now().UnixNano())
+	return nil
+}
+
+func (s *Store) encode(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%s%04d", snapshotMagic, snapshotVersion); err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(w)
+	for _, sh := range s.shards {
+		for i, db := range sh.dbs {
+			for key, item := range db.items {
+				if db.IsExpire(key) {
+					continue
+				}
+				rec := record{DB: i, Key: key, Expiration: int64(DefaultExpiration)}
+				if db.expires[key] {
+					rec.Expiration = item.Expiration
+				}
+				switch v := item.Object.(type) {
+				case string:
+					rec.Kind, rec.String = 's', v
+				case []string:
+					rec.Kind, rec.List = 'l', v
+				case map[string]string:
+					rec.Kind, rec.Hash = 'h', v
+				}
+				if err := enc.Encode(&rec); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Load replaces the databases with the snapshot at Path, the keys of the
+// databases beyond Databases are dropped. The databases are kept when the
+// file isn't a snapshot of a store.
+func (s *Store) Load() error {
+	path := s.path()
+	if path == "" {
+		return ErrNoPath
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+	if err := readHeader(rd); err != nil {
+		return fmt.Errorf("can't load %s: %v", path, err)
+	}
+
+	s.lockAll()
+	defer s.unlockAll()
+	for _, sh := range s.shards {
+		for _, db := range sh.dbs {
+			db.Flush()
+		}
+	}
+
+	dec := gob.NewDecoder(rd)
+	for {
+		var rec record
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if rec.DB < 0 || rec.DB >= s.opts.Databases {
+			continue
+		}
+		db := s.shards[s.shardIndex(rec.Key)].dbs[rec.DB]
+		var value interface{}
+		switch rec.Kind {
+		case 's':
+			value = rec.String
+		case 'l':
+			value = rec.List
+			if rec.List == nil {
+				value = []string{}
+			}
+		case 'h':
+			value = rec.Hash
+			if rec.Hash == nil {
+				value = map[string]string{}
+			}
+		default:
+			continue
+		}
+		db.update(rec.Key, value, sizeOf(rec.Key, value)-itemOverhead-int64(len(rec.Key)))
+		if rec.Expiration != int64(DefaultExpiration) {
+			item := db.items[rec.Key]
+			item.Expiration = rec.Expiration
+			db.items[rec.Key] = item
+			db.expires[rec.Key] = true
+		}
+	}
+	atomic.StoreInt64(&s.dirty, 0)
+	atomic.StoreInt64(&s.lastSave, time.Now().UnixNano())
+	return nil
+}
+
+// readHeader checks the magic and the version of a snapshot
+func readHeader(r io.Reader) error {
+	buf := make([]byte, len(snapshotMagic)+4)
+	n, _ := io.ReadFull(r, buf)
+	header := string(buf[:n])
+	switch {
+	case strings.HasPrefix(header, "REDIS"):
+		return fmt.Errorf("%v, it's a Redis RDB file", ErrSnapshotFormat)
+	case n < len(buf) || !strings.HasPrefix(header, snapshotMagic):
+		return ErrSnapshotFormat
+	}
+	version, err := strconv.Atoi(header[len(snapshotMagic):])
+	if err != nil {
+		return ErrSnapshotFormat
+	}
+	if version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d, want %d", version, snapshotVersion)
+	}
+	return nil
+}
+
+// DB is a database of a store, its commands are atomic
+type DB struct {
+	s     *Store
+	index int
+	// tx is the transaction holding the locks, nil out of transactions
+	tx *Tx
+}
+
+// read runs f on the database in the shard of the key locked for reading
+func (db *DB) read(key string, f func(m *MemoryCache)) {
+	i := db.s.shardIndex(key)
+	sh := db.s.shards[i]
+	if db.tx != nil {
+		db.tx.check(i)
+		f(sh.dbs[db.index])
+		return
+	}
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	f(sh.dbs[db.index])
+}
+
+// write runs f on the database in the shard of the key locked for writing
+func (db *DB) write(key string, f func(m *MemoryCache)) {
+	i := db.s.shardIndex(key)
+	sh := db.s.shards[i]
+	if db.tx != nil {
+		db.tx.check(i)
+		f(sh.dbs[db.index])
+		return
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	f(sh.dbs[db.index])
+}
+
+// each runs f on the database in every shard, locking them one at a time
+func (db *DB) each(write bool, f func(m *MemoryCache)) {
+	for i, sh := range db.s.shards {
+		switch {
+		case db.tx != nil:
+			db.tx.check(i)
+		case write:
+			sh.mu.Lock()
+		default:
+			sh.mu.RLock()
+		}
+		f(sh.dbs[db.index])
+		switch {
+		case db.tx != nil:
+		case write:
+			sh.mu.Unlock()
+		default:
+			sh.mu.RUnlock()
+		}
+	}
+}
+
+// Set sets the string value of the key, removing its expiration
+func (db *DB) Set(key, value string) (err error) {
+	db.write(key, func(m *MemoryCache) { err = m.Set(key, value) })
+	return
+}
+
+// Get returns the string value of the key
+func (db *DB) Get(key string) (value string, err error) {
+	db.read(key, func(m *MemoryCache) { value, err = m.Get(key) })
+	return
+}
+
+// Del removes the key, it returns false when it doesn't exist
+func (db *DB) Del(key string) (ok bool) {
+	db.write(key, func(m *MemoryCache) { ok = m.Del(key) })
+	return
+}
+
+// SetTTL expires the key after d, it's persisted when d isn't positive
+func (db *DB) SetTTL(key string, d time.Duration) (err error) {
+	db.write(key, func(m *MemoryCache) { err = m.SetTTL(key, d) })
+	return
+}
+
+// HSet sets the field of the hash stored at key
+func (db *DB) HSet(key, field, value string) (err error) {
+	db.write(key, func(m *MemoryCache) { err = m.HSet(key, field, value) })
+	return
+}
+
+// HGet returns the field of the hash stored at key
+func (db *DB) HGet(key, field string) (value string, err error) {
+	db.read(key, func(m *MemoryCache) { value, err = m.HGet(key, field) })
+	return
+}
+
+// HGetAll returns the fields and values of the hash stored at key
+func (db *DB) HGetAll(key string) (values []string, err error) {
+	db.read(key, func(m *MemoryCache) { values, err = m.HGetAll(key) })
+	return
+}
+
+// HDel removes the fields of the hash stored at key, it returns the number
+// of fields removed
+func (db *DB) HDel(key string, fields ...string) (n int, err error) {
+	db.write(key, func(m *MemoryCache) { n, err = m.HDel(key, fields...) })
+	return
+}
+
+// LPush prepends the values to the list stored at key
+func (db *DB) LPush(key string, values ...string) (err error) {
+	db.write(key, func(m *MemoryCache) { err = m.LPush(key, values...) })
+	return
+}
+
+// Lindex returns the element at index i of the list stored at key
+func (db *DB) Lindex(key string, i int) (value string, err error) {
+	db.read(key, func(m *MemoryCache) { value, err = m.Lindex(key, i) })
+	return
+}
+
+// Llen returns the length of the list stored at key
+func (db *DB) Llen(key string) (n int, err error) {
+	db.read(key, func(m *MemoryCache) { n, err = m.Llen(key) })
+	return
+}
+
+// LPop removes and returns the first element of the list stored at key
+func (db *DB) LPop(key string) (value string, err error) {
+	db.write(key, func(m *MemoryCache) { value, err = m.LPop(key) })
+	return
+}
+
+// Keys returns the keys matching the glob pattern, the shards are read one
+// at a time
+func (db *DB) Keys(pattern string) (keys []string, err error) {
+	db.each(false, func(m *MemoryCache) {
+		if err != nil {
+			return
+		}
+		var found []string
+		found, err = m.Keys(pattern)
+		keys = append(keys, found...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Move moves the key to the database dst, it returns false when the key
+// doesn't exist or dst already holds it
+func (db *DB) Move(key string, dst int) (ok bool) {
+	db.write(key, func(m *MemoryCache) { ok = m.Move(key, m.shard.dbs[dst]) })
+	return
+}
+
+// Flush removes all the keys of the database
+func (db *DB) Flush() {
+	db.each(true, func(m *MemoryCache) { m.Flush() })
+}
+
+// MemoryUsage returns the estimated number of bytes held by the key
+func (db *DB) MemoryUsage(key string) (n int64, err error) {
+	db.read(key, func(m *MemoryCache) { n, err = m.MemoryUsage(key) })
+	return
+}
+
+// Len returns the number of keys and of keys with an expiration
+func (db *DB) Len() (keys, expires int) {
+	db.each(false, func(m *MemoryCache) {
+		keys += m.Len()
+		expires += m.ExpiresLen()
+	})
+	return
+}
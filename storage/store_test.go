@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStoreConcurrency(t *testing.T) {
+	s, err := Open(Options{})
+	if err != nil {
+		t.Fatalf("Open error:%v", err)
+	}
+	defer s.Close()
+	db := s.DB(0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("key:%d:%d", i, j)
+				db.Set(key, "v")
+				db.Get(key)
+				db.LPush("list", key)
+				db.HSet("hash", key, "v")
+				db.Llen("list")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n, _ := db.Llen("list"); n != 800 {
+		t.Errorf("Want: 800, got: %d", n)
+	}
+	if keys, _ := s.Len(); keys != 802 {
+		t.Errorf("Want: 802 keys, got: %d", keys)
+	}
+}
+
+func TestStoreTransactions(t *testing.T) {
+	s, err := Open(Options{Databases: 2})
+	if err != nil {
+		t.Fatalf("Open error:%v", err)
+	}
+	defer s.Close()
+	s.DB(0).Set("balance", "10")
+
+	err = s.Update(func(tx *Tx) error {
+		v, err := tx.DB(0).Get("balance")
+		if err != nil {
+			return err
+		}
+		if err := tx.DB(1).Set("balance", v); err != nil {
+			return err
+		}
+		tx.DB(0).Del("balance")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update error:%v", err)
+	}
+
+	s.View(func(tx *Tx) error {
+		if _, err := tx.DB(0).Get("balance"); err != ErrNullValue {
+			t.Errorf("Want: %v, got: %v", ErrNullValue, err)
+		}
+		if v, _ := tx.DB(1).Get("balance"); v != "10" {
+			t.Errorf("Want: 10, got: %s", v)
+		}
+		return nil
+	})
+}
+
+func TestStoreUpdateKeys(t *testing.T) {
+	s, err := Open(Options{Shards: 8})
+	if err != nil {
+		t.Fatalf("Open error:%v", err)
+	}
+	defer s.Close()
+
+	// the keys are spread over the shards
+	keys := make([]string, 32)
+	used := make(map[int]bool)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%d", i)
+		used[s.shardIndex(keys[i])] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("Want the keys spread over the shards, got %d", len(used))
+	}
+
+	// transfers between overlapping keys in opposite orders don't deadlock
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				from, to := keys[(i+j)%len(keys)], keys[(i+j+1)%len(keys)]
+				if i%2 == 1 {
+					from, to = to, from
+				}
+				s.UpdateKeys([]string{from, to}, func(tx *Tx) error {
+					db := tx.DB(0)
+					n, _ := db.Llen(from)
+					db.LPush(to, fmt.Sprint(n))
+					return nil
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	total := 0
+	for _, key := range keys {
+		n, _ := s.DB(0).Llen(key)
+		total += n
+	}
+	if total != 800 {
+		t.Errorf("Want: 800, got: %d", total)
+	}
+
+	// the keys of the other shards aren't locked
+	var other string
+	for _, key := range keys {
+		if s.shardIndex(key) != s.shardIndex(keys[0]) {
+			other = key
+			break
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Want a panic for a key out of the transaction")
+		}
+	}()
+	s.UpdateKeys(keys[:1], func(tx *Tx) error {
+		tx.DB(0).Get(other)
+		return nil
+	})
+}
+
+func TestStoreExpiration(t *testing.T) {
+	var expired []string
+	s, err := Open(Options{OnExpire: func(db int, key string) { expired = append(expired, key) }})
+	if err != nil {
+		t.Fatalf("Open error:%v", err)
+	}
+	defer s.Close()
+	db := s.DB(0)
+
+	db.Set("gone", "v")
+	m := s.shards[s.shardIndex("gone")].dbs[0]
+	item := m.items["gone"]
+	item.Expiration = time.Now().Add(-time.Minute).UnixNano()
+	m.items["gone"] = item
+	m.expires["gone"] = true
+
+	// the expired keys are missing before they're removed
+	if _, err := db.Get("gone"); err != ErrNullValue {
+		t.Errorf("Want: %v, got: %v", ErrNullValue, err)
+	}
+	if keys, _ := db.Keys("*"); len(keys) != 0 {
+		t.Errorf("Want no keys, got: %v", keys)
+	}
+	if n := s.DeleteExpired(); n != 1 {
+		t.Errorf("Want 1 expired key, got: %d", n)
+	}
+	if len(expired) != 1 || expired[0] != "gone" || s.ExpiredKeys() != 1 {
+		t.Errorf("Want gone expired, got: %v", expired)
+	}
+}
+
+func TestStoreEviction(t *testing.T) {
+	max := 4 * sizeOf("key:0", "value")
+	s, err := Open(Options{MaxMemory: max})
+	if err != nil {
+		t.Fatalf("Open error:%v", err)
+	}
+	defer s.Close()
+	db := s.DB(0)
+
+	for i := 0; i < 5; i++ {
+		if err := db.Set(fmt.Sprintf("key:%d", i), "value"); err != nil {
+			t.Fatalf("Set error:%v", err)
+		}
+	}
+	if err := db.Set("key:5", "value"); err != ErrOutOfMemory {
+		t.Errorf("Want: %v, got: %v", ErrOutOfMemory, err)
+	}
+
+	var evicted []string
+	s.opts.OnEvict = func(db int, key string) { evicted = append(evicted, key) }
+	s.SetMaxMemory(max, AllKeysRandom)
+	if err := db.Set("key:5", "value"); err != nil {
+		t.Fatalf("Set error:%v", err)
+	}
+	if len(evicted) != 1 || s.EvictedKeys() != 1 {
+		t.Errorf("Want 1 evicted key, got: %v", evicted)
+	}
+
+	// volatile-ttl only evicts the keys with an expiration
+	s.SetMaxMemory(max/2, VolatileTTL)
+	db.SetTTL("key:5", time.Hour)
+	if err := s.Reserve(); err != ErrOutOfMemory {
+		t.Errorf("Want: %v, got: %v", ErrOutOfMemory, err)
+	}
+	if _, err := db.Get("key:5"); err != ErrNullValue {
+		t.Errorf("Want key:5 evicted, got: %v", err)
+	}
+}
+
+func TestStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.gob")
+	s, err := Open(Options{Databases: 2, Path: path})
+	if err != nil {
+		t.Fatalf("Open error:%v", err)
+	}
+	s.DB(0).Set("string", "v")
+	s.DB(0).SetTTL("string", time.Hour)
+	s.DB(1).LPush("list", "a", "b")
+	s.DB(1).HSet("hash", "f", "v")
+	s.DB(1).HDel("hash", "f")
+	if s.Changes() == 0 {
+		t.Errorf("Want changes")
+	}
+	used := s.UsedMemory()
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error:%v", err)
+	}
+
+	s, err = Open(Options{Databases: 2, Path: path})
+	if err != nil {
+		t.Fatalf("Open error:%v", err)
+	}
+	defer s.Close()
+	if v, _ := s.DB(0).Get("string"); v != "v" {
+		t.Errorf("Want: v, got: %s", v)
+	}
+	if _, expires := s.DB(0).Len(); expires != 1 {
+		t.Errorf("Want the expiration loaded")
+	}
+	if v, _ := s.DB(1).Lindex("list", 0); v != "b" {
+		t.Errorf("Want: b, got: %s", v)
+	}
+	if _, err := s.DB(1).HGetAll("hash"); err != nil {
+		t.Errorf("Want the empty hash loaded, got: %v", err)
+	}
+	if got := s.UsedMemory(); got != used {
+		t.Errorf("Want used memory: %d, got: %d", used, got)
+	}
+	if s.Changes() != 0 {
+		t.Errorf("Want no changes, got: %d", s.Changes())
+	}
+
+	// the files that aren't snapshots aren't loaded, the keys are kept
+	for _, data := range []string{"REDIS0011\xfa\tredis-ver", "JUNO", "JUNO9999"} {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Load(); err == nil {
+			t.Errorf("Want an error loading %q", data)
+		} else if strings.HasPrefix(data, "REDIS") && !strings.Contains(err.Error(), "Redis RDB file") {
+			t.Errorf("Want the Redis file reported, got: %v", err)
+		}
+		if v, _ := s.DB(0).Get("string"); v != "v" {
+			t.Errorf("Want the keys kept, got: %s", v)
+		}
+	}
+}
+
+// BenchmarkStore compares a single shard with the default shards, run it
+// with -cpu 1,2,4,8 to see the throughput scale with GOMAXPROCS
+func BenchmarkStore(b *testing.B) {
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			db := NewStore(Options{Shards: shards}).DB(0)
+			keys := make([]string, 1024)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("key:%d", i)
+			}
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					key := keys[i%len(keys)]
+					if i%4 == 0 {
+						db.Get(key)
+					} else {
+						db.Set(key, "value")
+					}
+					i++
+				}
+			})
+		})
+	}
+}
@@ -1,10 +1,113 @@
 package glob
 
 import (
-	glob "path/filepath"
+	"errors"
 )
 
+var ErrBadPattern = errors.New("syntax error in pattern")
+
+// Match reports whether name matches the Redis style glob pattern: '*'
+// matches any sequence of characters ('/' included), '?' any single
+// character, [abc] one of the characters, [^abc] none of them, [a-z] a
+// range and \x matches x literally.
 func Match(pattern, name string) (matched bool, err error) {
-	matched, err = glob.Match(pattern, name)
-	return
+	return match(pattern, name)
+}
+
+func match(pattern, name string) (bool, error) {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true, nil
+			}
+			for i := 0; i <= len(name); i++ {
+				ok, err := match(pattern[1:], name[i:])
+				if err != nil || ok {
+					return ok, err
+				}
+			}
+			return false, nil
+
+		case '?':
+			if len(name) == 0 {
+				return false, nil
+			}
+			pattern, name = pattern[1:], name[1:]
+
+		case '[':
+			if len(name) == 0 {
+				return false, nil
+			}
+			end := 1
+			if end < len(pattern) && pattern[end] == '^' {
+				end++
+			}
+			// a ']' right after the opening bracket is a literal
+			if end < len(pattern) && pattern[end] == ']' {
+				end++
+			}
+			for end < len(pattern) && pattern[end] != ']' {
+				if pattern[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(pattern) {
+				return false, ErrBadPattern
+			}
+			if !matchClass(pattern[1:end], name[0]) {
+				return false, nil
+			}
+			pattern, name = pattern[end+1:], name[1:]
+
+		case '\\':
+			if len(pattern) < 2 {
+				return false, ErrBadPattern
+			}
+			if len(name) == 0 || name[0] != pattern[1] {
+				return false, nil
+			}
+			pattern, name = pattern[2:], name[1:]
+
+		default:
+			if len(name) == 0 || name[0] != pattern[0] {
+				return false, nil
+			}
+			pattern, name = pattern[1:], name[1:]
+		}
+	}
+	return len(name) == 0, nil
+}
+
+// matchClass reports whether c is in the class, the content of [...]
+func matchClass(class string, c byte) bool {
+	negate := false
+	if len(class) > 0 && class[0] == '^' {
+		negate = true
+		class = class[1:]
+	}
+	found := false
+	for i := 0; i < len(class); i++ {
+		lo := class[i]
+		if lo == '\\' && i+1 < len(class) {
+			i++
+			lo = class[i]
+		}
+		hi := lo
+		if i+2 < len(class) && class[i+1] == '-' {
+			hi = class[i+2]
+			i += 2
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if c >= lo && c <= hi {
+			found = true
+		}
+	}
+	return found != negate
 }
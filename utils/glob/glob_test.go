@@ -19,3 +19,41 @@ func TestMatch(t *testing.T) {
 	}
 
 }
+
+func TestMatchPatterns(t *testing.T) {
+
+	testCases := []struct {
+		pattern string
+		name    string
+		matched bool
+	}{
+		{"*", "user/1", true},
+		{"cache:*", "cache:user/1", true},
+		{"cache:*", "session:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"*llo*", "hello world", true},
+		{"", "", true},
+	}
+
+	for _, testCase := range testCases {
+		matched, err := Match(testCase.pattern, testCase.name)
+		if err != nil {
+			t.Fatalf("match error:%v", err)
+		}
+		if matched != testCase.matched {
+			t.Errorf("Want: %v, got: %v, pattern:%q, name:%q", testCase.matched, matched, testCase.pattern, testCase.name)
+		}
+	}
+
+	if _, err := Match("h[ello", "hello"); err != ErrBadPattern {
+		t.Errorf("Want: %v, got: %v", ErrBadPattern, err)
+	}
+
+}